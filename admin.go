@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type userPermissionsResponse struct {
+	Username    string                `json:"username"`
+	Namespaces  []string              `json:"namespaces"`
+	Permissions []namespacePermission `json:"permissions"`
+	// AllNamespaces is set for LDAP_ADMIN_GROUP members, who have read,
+	// write and delete on every namespace.
+	AllNamespaces bool `json:"all_namespaces,omitempty"`
+}
+
+// requireAdmin authenticates the request with Basic Auth and checks that the
+// caller is a member of the LDAP admin group.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	user, _, ok := authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !user.Admin {
+		writeAPIError(w, http.StatusForbidden, "admin access required")
+		return nil, false
+	}
+	return user, true
+}
+
+func handleAdminUserPermissions(w http.ResponseWriter, r *http.Request) {
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	target := strings.TrimSpace(chi.URLParam(r, "username"))
+	if target == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing username")
+		return
+	}
+
+	// The lookup binds as LDAP_BIND_USER when it is set, so admins who signed
+	// in with a bearer token or client certificate can use it too. Without a
+	// service account it rebinds with the Basic login name; admin.Name may be
+	// the LDAP_USERNAME_ATTR value.
+	login, password, _ := r.BasicAuth()
+	access, err := ldapLookup(login, password, target)
+	switch {
+	case errors.Is(err, errLDAPNoServiceAccount):
+		writeAPIError(w, http.StatusNotImplemented, err.Error())
+		return
+	case errors.Is(err, errLDAPUserNotFound):
+		writeAPIError(w, http.StatusNotFound, "user not found")
+		return
+	case errors.Is(err, errLDAPBusy):
+		w.Header().Set("Retry-After", "1")
+		writeAPIError(w, http.StatusServiceUnavailable, "authentication backend busy")
+		return
+	case err != nil:
+		log.Printf("admin permission lookup for %s by %s failed: %v", target, admin.Name, err)
+		writeAPIError(w, http.StatusBadGateway, "directory lookup failed")
+		return
+	}
+
+	namespaces := namespacesFromAccess(access)
+	if namespaces == nil {
+		namespaces = []string{}
+	}
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(userPermissionsResponse{
+		Username:      target,
+		Namespaces:    namespaces,
+		Permissions:   buildNamespacePermissions(namespaces, access),
+		AllNamespaces: allNamespacesAllowed(access),
+	})
+}
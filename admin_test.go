@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminUserPermissions(t *testing.T) {
+	withAdminAuth(t)
+	var gotBind, gotTarget string
+	prevLookup := ldapLookup
+	ldapLookup = func(bindUsername, bindPassword, target string) ([]Access, error) {
+		gotBind, gotTarget = bindUsername, target
+		return []Access{
+			{Group: "team1_r", Namespace: "team1", PullOnly: true},
+			{Group: "team1_rw", Namespace: "team1"},
+			{Group: "team2_rd", Namespace: "team2", PullOnly: true, DeleteAllowed: true},
+		}, nil
+	}
+	t.Cleanup(func() {
+		ldapLookup = prevLookup
+	})
+
+	rec := serveAdminRequest(t, "root", "/admin/users/bob/permissions")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if gotBind != "root" || gotTarget != "bob" {
+		t.Fatalf("unexpected lookup: bind=%q target=%q", gotBind, gotTarget)
+	}
+
+	var payload userPermissionsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if payload.Username != "bob" || len(payload.Permissions) != 2 {
+		t.Fatalf("unexpected payload: %#v", payload)
+	}
+	if p := payload.Permissions[0]; p.Namespace != "team1" || p.PullOnly || p.DeleteAllowed {
+		t.Fatalf("unexpected team1 permissions: %#v", p)
+	}
+	if p := payload.Permissions[1]; p.Namespace != "team2" || !p.PullOnly || !p.DeleteAllowed {
+		t.Fatalf("unexpected team2 permissions: %#v", p)
+	}
+}
+
+func TestAdminUserPermissionsForbiddenForNonAdmin(t *testing.T) {
+	withAdminAuth(t)
+	rec := serveAdminRequest(t, "alice", "/admin/users/bob/permissions")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	var body apiErrorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode error body: %v", err)
+	}
+	if body.Detail != "admin access required" || body.RequestID == "" || body.RequestID != rec.Header().Get(requestIDHeader) {
+		t.Fatalf("expected problem+json with the request id, got %+v (header %q)", body, rec.Header().Get(requestIDHeader))
+	}
+}
+
+func TestAdminUserPermissionsRequiresAuth(t *testing.T) {
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/users/bob/permissions", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestAdminUserPermissionsUserNotFound(t *testing.T) {
+	withAdminAuth(t)
+	prevLookup := ldapLookup
+	ldapLookup = func(bindUsername, bindPassword, target string) ([]Access, error) {
+		return nil, errLDAPUserNotFound
+	}
+	t.Cleanup(func() {
+		ldapLookup = prevLookup
+	})
+
+	rec := serveAdminRequest(t, "root", "/admin/users/ghost/permissions")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestIsAdminMember(t *testing.T) {
+	groups := []string{"cn=team1_rw,ou=groups,dc=glauth,dc=com", "cn=CVAdmins,ou=groups,dc=glauth,dc=com"}
+	if !isAdminMember(groups, "cvadmins") {
+		t.Fatalf("expected admin membership")
+	}
+	if isAdminMember(groups, "") {
+		t.Fatalf("expected no admin without configured group")
+	}
+}
+
+// withAdminAuth treats "root" as an admin and everyone else as a regular user.
+func withAdminAuth(t *testing.T) {
+	t.Helper()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username, Admin: username == "root"}, []Access{{Namespace: "team1"}}, nil
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+}
+
+func serveAdminRequest(t *testing.T, username, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.SetBasicAuth(username, "secret")
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminUserPermissionsForTokenAdmin(t *testing.T) {
+	signer := newRSASigner(t, "rsa-1")
+	withOIDCAuth(t, signer)
+	prevCfg := ldapCfg
+	ldapCfg.AdminGroup = "registry_admins"
+	ldapCfg.BindUser = ""
+	t.Cleanup(func() { ldapCfg = prevCfg })
+	token := signer.sign(t, "RS256", validClaims("registry_admins"))
+
+	// A token admin has no password, so the lookup needs the service account.
+	rec := serveBearerRequest(t, "/admin/users/bob/permissions", token)
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without LDAP_BIND_USER, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
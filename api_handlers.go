@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"strings"
 
@@ -24,6 +25,26 @@ func registerAPI(api huma.API) {
 	huma.Delete(group, "/tag", handleTagDelete)
 }
 
+// apiErrorResponse is huma's problem+json body with the request id added, the
+// way registryErrorResponse carries it for /v2 errors.
+type apiErrorResponse struct {
+	huma.ErrorModel
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeAPIError writes the problem+json error huma sends for the /api
+// routes, for handlers that live outside huma such as exports, imports and
+// the /admin endpoints.
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiErrorResponse{
+		ErrorModel: huma.ErrorModel{Title: http.StatusText(status), Status: status, Detail: message},
+		RequestID:  w.Header().Get(requestIDHeader),
+	})
+}
+
 func mustSession(ctx context.Context) sessionData {
 	return ctx.Value(sessionContextKey{}).(sessionData)
 }
@@ -69,7 +90,7 @@ func handleDashboard(ctx context.Context, _ *struct{}) (*dashboardOutput, error)
 
 func requireNamespace(sess sessionData, namespace string) (string, error) {
 	ns := strings.TrimSpace(namespace)
-	if ns == "" || !namespaceAllowed(sess.Namespaces, ns) {
+	if ns == "" || !sessionNamespaceAllowed(sess, ns) {
 		return "", huma.Error403Forbidden("namespace not allowed")
 	}
 	return ns, nil
@@ -198,7 +219,7 @@ func handleTags(ctx context.Context, input *tagsInput) (*tagsOutput, error) {
 	if err != nil {
 		return nil, err
 	}
-	if !namespaceAllowed(sess.Namespaces, namespace) {
+	if !sessionNamespaceAllowed(sess, namespace) {
 		return nil, huma.Error403Forbidden("namespace not allowed")
 	}
 
@@ -231,7 +252,7 @@ func handleTagInfo(ctx context.Context, input *tagInfoInput) (*tagInfoOutput, er
 	if err != nil {
 		return nil, err
 	}
-	if !namespaceAllowed(sess.Namespaces, namespace) {
+	if !sessionNamespaceAllowed(sess, namespace) {
 		return nil, huma.Error403Forbidden("namespace not allowed")
 	}
 
@@ -259,7 +280,7 @@ func handleTagLayers(ctx context.Context, input *tagLayersInput) (*tagLayersOutp
 	if err != nil {
 		return nil, err
 	}
-	if !namespaceAllowed(sess.Namespaces, namespace) {
+	if !sessionNamespaceAllowed(sess, namespace) {
 		return nil, huma.Error403Forbidden("namespace not allowed")
 	}
 
@@ -296,12 +317,18 @@ func handleTagDelete(ctx context.Context, input *tagDeleteInput) (*tagDeleteOutp
 	if err != nil {
 		return nil, err
 	}
-	if !namespaceAllowed(sess.Namespaces, namespace) {
+	if !sessionNamespaceAllowed(sess, namespace) {
 		return nil, huma.Error403Forbidden("namespace not allowed")
 	}
 	if !namespaceDeleteAllowed(sess.Access, namespace) {
 		return nil, huma.Error403Forbidden("delete not allowed")
 	}
+	if deleteWindowCfg.enabled() && !deleteWindowCfg.allows(sess.User) {
+		return nil, huma.Error403Forbidden(deleteWindowMessage)
+	}
+	if replica.cfg.Enabled {
+		return nil, huma.Error409Conflict("read-only replica; delete the tag on the primary")
+	}
 
 	digest, status, message, err := fetchTagDigest(ctx, repo, tag)
 	if err != nil {
@@ -321,6 +348,9 @@ func handleTagDelete(ctx context.Context, input *tagDeleteInput) (*tagDeleteOutp
 	if status != 0 {
 		return nil, ToHuma(status, message)
 	}
+	manifestConversions.invalidate(digest)
+	imageSizes.invalidate(digest)
+	auditEvent("delete", sess.User.Name, repo+":"+tag)
 
 	return &tagDeleteOutput{
 		Body: tagDeletePayload{
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type auditUserContextKey struct{}
+
+// auditEvent writes one audit record. user is the canonical username, taken
+// from LDAP_USERNAME_ATTR when it is set rather than the name typed at login.
+func auditEvent(action, user, target string) {
+	if target == "" {
+		log.Printf("audit action=%s user=%q", action, user)
+		return
+	}
+	log.Printf("audit action=%s user=%q target=%q", action, user, target)
+}
+
+// withAuditUser records the authenticated user on r for auditRegistryChange.
+func withAuditUser(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), auditUserContextKey{}, user.Name))
+}
+
+// auditRegistryChange audits manifest pushes and deletes the registry
+// accepted.
+func auditRegistryChange(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	user, ok := resp.Request.Context().Value(auditUserContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return nil
+	}
+	separator := ":"
+	if isDigestReference(route.Reference) {
+		separator = "@"
+	}
+	target := route.Repo + separator + route.Reference
+	switch {
+	case resp.Request.Method == http.MethodPut && resp.StatusCode == http.StatusCreated:
+		auditEvent("push", user, target)
+	case resp.Request.Method == http.MethodDelete && resp.StatusCode == http.StatusAccepted:
+		auditEvent("delete", user, target)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// mailBindConn accepts a bind by mail and serves the user's entry from
+// filtered subtree searches.
+type mailBindConn struct {
+	mail  string
+	entry *ldap.Entry
+	bound bool
+}
+
+func (c *mailBindConn) Bind(username, password string) error {
+	if username != c.mail || password != "secret" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = true
+	return nil
+}
+
+func (c *mailBindConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if !c.bound || req.Filter != "(mail="+ldap.EscapeFilter(c.mail)+")" {
+		return &ldap.SearchResult{}, nil
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{c.entry}}, nil
+}
+
+func withUsernameAttribute(t *testing.T, attr string) *mailBindConn {
+	t.Helper()
+	prevCfg, prevAuth := ldapCfg, ldapDirectoryAuth
+	ldapCfg.UserDNTemplate = ""
+	ldapCfg.UserFilter = "(mail=%s)"
+	ldapCfg.GroupFilter = ""
+	ldapCfg.GroupAttribute = "memberOf"
+	ldapCfg.GroupNamePrefix = "team"
+	ldapCfg.UsernameAttribute = attr
+	conn := &mailBindConn{
+		mail: "alice.smith@example.com",
+		entry: ldap.NewEntry("cn=alice,ou=people,dc=example,dc=com", map[string][]string{
+			"memberOf":       {"cn=team1_rw,ou=groups,dc=example,dc=com"},
+			"sAMAccountName": {"asmith"},
+		}),
+	}
+	ldapDirectoryAuth = func(username, password string) (*User, []Access, error) {
+		conn.bound = false
+		return authenticateConn(conn, username, password)
+	}
+	t.Cleanup(func() {
+		ldapCfg, ldapDirectoryAuth = prevCfg, prevAuth
+	})
+	return conn
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &logs
+}
+
+func postLogin(t *testing.T, username string) *httptest.ResponseRecorder {
+	t.Helper()
+	form := url.Values{}
+	form.Set("username", username)
+	form.Set("password", "secret")
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLoginAuditRecordsMappedUsername(t *testing.T) {
+	withUsernameAttribute(t, "sAMAccountName")
+	logs := captureLogs(t)
+
+	rec := postLogin(t, "alice.smith@example.com")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected login redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), `audit action=login user="asmith"`) {
+		t.Fatalf("expected audit entry for asmith, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), `user="alice.smith@example.com"`) {
+		t.Fatalf("expected the login email not to be recorded as the user")
+	}
+}
+
+func TestLoginAuditKeepsLoginNameWithoutAttribute(t *testing.T) {
+	withUsernameAttribute(t, "")
+	logs := captureLogs(t)
+
+	if rec := postLogin(t, "alice.smith@example.com"); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected login redirect, got %d", rec.Code)
+	}
+	if !strings.Contains(logs.String(), `audit action=login user="alice.smith@example.com"`) {
+		t.Fatalf("expected audit entry under the login name, got %q", logs.String())
+	}
+}
+
+func TestRegistryPushAuditRecordsUser(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+	logs := captureLogs(t)
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if !strings.Contains(logs.String(), `audit action=push user="alice" target="team1/app:v1"`) {
+		t.Fatalf("expected push audit entry, got %q", logs.String())
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"log"
 	"net/http"
 	"strings"
 )
@@ -8,16 +10,48 @@ import (
 var ldapAuth = ldapAuthenticateAccess
 
 func authenticate(w http.ResponseWriter, r *http.Request) (*User, []Access, bool) {
+	if cert, ok := verifiedClientCert(r); ok {
+		return authenticateClientCert(w, cert)
+	}
+
+	if token, ok := bearerToken(r); ok && oidcAuth.enabled() {
+		u, access, err := oidcAuth.authenticate(r.Context(), token)
+		if err != nil {
+			log.Printf("bearer token rejected: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid token")
+			return nil, nil, false
+		}
+		return u, access, true
+	}
+
 	username, password, ok := r.BasicAuth()
 	if !ok || password == "" {
+		if u, access, ok := publicNamespaces.anonymousAccess(r); ok {
+			return u, access, requirePublicNamespace(w, r, access[0].Namespace)
+		}
 		w.Header().Set("WWW-Authenticate", `Basic realm="Registry"`)
-		http.Error(w, "auth required", http.StatusUnauthorized)
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "auth required")
 		return nil, nil, false
 	}
 
 	u, access, err := ldapAuth(username, password)
+	if errors.Is(err, errLDAPBusy) {
+		w.Header().Set("Retry-After", "1")
+		writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "authentication backend busy")
+		return nil, nil, false
+	}
+	if errors.Is(err, errLDAPUnavailable) || errors.Is(err, errLDAPUnreachable) {
+		setRetryAfter(w, ldapCircuit.remaining())
+		writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "authentication backend unavailable")
+		return nil, nil, false
+	}
+	if errors.Is(err, errLDAPSearchFailed) {
+		writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "authentication backend error")
+		return nil, nil, false
+	}
 	if err != nil {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credentials")
 		return nil, nil, false
 	}
 
@@ -34,21 +68,21 @@ func authorize(access []Access, r *http.Request) bool {
 		return true
 	}
 
-	// Path must be /v2/<namespace>/...
-	if !strings.HasPrefix(r.URL.Path, "/v2/") {
-		return false
-	}
-	rest := strings.TrimPrefix(r.URL.Path, "/v2/")
-	parts := strings.SplitN(rest, "/", 2)
-	if len(parts) < 2 || parts[0] == "" {
+	namespace, ok := requestNamespace(r)
+	if !ok {
 		return false
 	}
-	namespace := parts[0]
 	pullOnly, deleteAllowed, ok := namespacePermissions(access, namespace)
 	if !ok {
 		return false
 	}
 
+	// Upload sessions belong to a push whatever the method, so querying an
+	// upload's offset or cancelling it needs write access.
+	if route, ok := parseRegistryPath(r.URL.Path); ok && route.isUpload() {
+		return !pullOnly
+	}
+
 	// Pull-only enforcement
 	if pullOnly {
 		switch r.Method {
@@ -68,9 +102,46 @@ func authorize(access []Access, r *http.Request) bool {
 	return true
 }
 
+// requestNamespace extracts <namespace> from a /v2/<namespace>/... path.
+func requestNamespace(r *http.Request) (string, bool) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		return "", false
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) < 2 || parts[0] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+// authDecision renders the permission decision for the request's namespace,
+// e.g. "namespace=team1;pull=allow;push=deny;delete=deny".
+func authDecision(access []Access, r *http.Request) string {
+	namespace, ok := requestNamespace(r)
+	if !ok {
+		return "namespace=;pull=deny;push=deny;delete=deny"
+	}
+	pullOnly, deleteAllowed, ok := namespacePermissions(access, namespace)
+	verdict := func(allowed bool) string {
+		if allowed {
+			return "allow"
+		}
+		return "deny"
+	}
+	return "namespace=" + namespace +
+		";pull=" + verdict(ok) +
+		";push=" + verdict(ok && !pullOnly) +
+		";delete=" + verdict(ok && deleteAllowed)
+}
+
 func namespacePermissions(access []Access, namespace string) (pullOnly bool, deleteAllowed bool, ok bool) {
 	pullOnly = true
 	for _, entry := range access {
+		if entry.AllNamespaces {
+			// The admin grant wins over any narrower namespace group.
+			return entry.PullOnly, entry.DeleteAllowed, true
+		}
 		if entry.Namespace == "" || entry.Namespace != namespace {
 			continue
 		}
@@ -61,6 +61,20 @@ func TestAuthorizeDelete(t *testing.T) {
 	}
 }
 
+func TestAuthorizeUploadSessionsRequirePush(t *testing.T) {
+	path := "/v2/team1/repo/blobs/uploads/session-1"
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		req := httptest.NewRequest(method, path, nil)
+		if authorize([]Access{{Namespace: "team1", PullOnly: true, DeleteAllowed: true}}, req) {
+			t.Fatalf("expected %s on an upload to be denied without push", method)
+		}
+		req = httptest.NewRequest(method, path, nil)
+		if !authorize([]Access{{Namespace: "team1"}}, req) {
+			t.Fatalf("expected %s on an upload to be allowed with push", method)
+		}
+	}
+}
+
 func TestAuthorizeRejectsDotSegments(t *testing.T) {
 	access := []Access{{Namespace: "team1"}}
 	req := httptest.NewRequest(http.MethodGet, "/v2/team1/../team2/repo", nil)
@@ -94,3 +108,48 @@ func TestAuthorizeAllowsMultipleNamespaces(t *testing.T) {
 		t.Fatalf("expected DELETE to be denied for team2")
 	}
 }
+
+func TestAuthDecision(t *testing.T) {
+	access := []Access{{Namespace: "team1", PullOnly: true}}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+	if got := authDecision(access, req); got != "namespace=team1;pull=allow;push=deny;delete=deny" {
+		t.Fatalf("unexpected decision: %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/team2/app/manifests/latest", nil)
+	if got := authDecision(access, req); got != "namespace=team2;pull=deny;push=deny;delete=deny" {
+		t.Fatalf("unexpected decision: %q", got)
+	}
+}
+
+func TestAuthDecisionHeaderDebugFlag(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	prev := debugAuthHeader
+	t.Cleanup(func() {
+		debugAuthHeader = prev
+	})
+
+	debugAuthHeader = false
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if got := rec.Header().Get("X-Auth-Decision"); got != "" {
+		t.Fatalf("expected no decision header without debug flag, got %q", got)
+	}
+
+	debugAuthHeader = true
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if got := rec.Header().Get("X-Auth-Decision"); got != "namespace=team1;pull=allow;push=allow;delete=deny" {
+		t.Fatalf("unexpected decision header: %q", got)
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team2/app/manifests/latest")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Auth-Decision"); got != "namespace=team2;pull=deny;push=deny;delete=deny" {
+		t.Fatalf("unexpected decision header on forbidden response: %q", got)
+	}
+}
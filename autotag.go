@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// timestampTagLayout formats auto tags as ts-20240101T120000Z (UTC).
+const timestampTagLayout = "20060102T150405Z"
+
+// timestampTagger tags manifests pushed by digest with the time of the push,
+// so untagged pushes stay traceable.
+type timestampTagger struct {
+	enabled bool
+	now     func() time.Time
+}
+
+type timestampTagContextKey struct{}
+
+type timestampTagPush struct {
+	ContentType string
+	Body        []byte
+}
+
+func newTimestampTagger(enabled bool) *timestampTagger {
+	return &timestampTagger{enabled: enabled, now: time.Now}
+}
+
+func (t *timestampTagger) tag() string {
+	return "ts-" + t.now().UTC().Format(timestampTagLayout)
+}
+
+// prepareTimestampTag keeps the body of by-digest manifest pushes so
+// applyTimestampTag can tag it once the registry has stored it.
+func prepareTimestampTag(r *http.Request) *http.Request {
+	if !timestampTags.enabled || r.Method != http.MethodPut {
+		return r
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests || !isDigestReference(route.Reference) {
+		return r
+	}
+	body, ok := peekManifestBody(r)
+	if !ok {
+		return r
+	}
+	push := timestampTagPush{ContentType: r.Header.Get("Content-Type"), Body: body}
+	return r.WithContext(context.WithValue(r.Context(), timestampTagContextKey{}, push))
+}
+
+// applyTimestampTag pushes the accepted manifest again under a timestamp tag.
+// Tags are never moved: if the tag already points at another digest, the
+// short digest is appended to keep it unique.
+func applyTimestampTag(resp *http.Response) error {
+	if resp.Request == nil || resp.StatusCode != http.StatusCreated {
+		return nil
+	}
+	push, ok := resp.Request.Context().Value(timestampTagContextKey{}).(timestampTagPush)
+	if !ok {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok {
+		return nil
+	}
+	ctx := resp.Request.Context()
+	tag := timestampTags.tag()
+	existing, status, _, err := fetchTagDigest(ctx, route.Repo, tag)
+	if err != nil {
+		log.Printf("timestamp tag %s:%s lookup failed: %v", route.Repo, tag, err)
+		return nil
+	}
+	if status == 0 && existing == route.Reference {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		_, encoded, _ := strings.Cut(route.Reference, ":")
+		if len(encoded) > 12 {
+			encoded = encoded[:12]
+		}
+		tag += "-" + encoded
+	}
+	if err := putManifest(ctx, route.Repo, tag, push.ContentType, push.Body); err != nil {
+		log.Printf("timestamp tag %s:%s failed: %v", route.Repo, tag, err)
+		return nil
+	}
+	resp.Header.Set("X-Timestamp-Tag", tag)
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimestampTagCreatedOnDigestPush(t *testing.T) {
+	pushedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.FixedZone("CET", 3600))
+	withTimestampTagger(t, true, pushedAt)
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	image := newTestRegistryImage(t, "layer-one")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+image.ManifestDigest, bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	tag := rec.Header().Get("X-Timestamp-Tag")
+	if tag != "ts-20240101T110000Z" {
+		t.Fatalf("expected UTC timestamp tag, got %q", tag)
+	}
+	stamp, err := time.Parse(timestampTagLayout, strings.TrimPrefix(tag, "ts-"))
+	if err != nil || !stamp.Equal(pushedAt) {
+		t.Fatalf("expected tag to parse back to the push time, got %v, %v", stamp, err)
+	}
+	if got := registry.tags("team1/app"); len(got) != 1 || got[0] != tag {
+		t.Fatalf("expected only the timestamp tag, got %v", got)
+	}
+	if !bytes.Equal(registry.manifests["team1/app:"+tag], image.Manifest) {
+		t.Fatalf("expected timestamp tag to point at the pushed manifest")
+	}
+
+	other := newTestRegistryImage(t, "layer-two")
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+other.ManifestDigest, bytes.NewReader(other.Manifest))
+	if got := rec.Header().Get("X-Timestamp-Tag"); got != tag+"-"+strings.TrimPrefix(other.ManifestDigest, "sha256:")[:12] {
+		t.Fatalf("expected a colliding push to get a digest suffix, got %q", got)
+	}
+	if !bytes.Equal(registry.manifests["team1/app:"+tag], image.Manifest) {
+		t.Fatalf("expected the existing timestamp tag not to move")
+	}
+}
+
+func TestTimestampTagSkipsTagPushes(t *testing.T) {
+	withTimestampTagger(t, true, time.Now())
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	image := newTestRegistryImage(t, "layer-one")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Timestamp-Tag") != "" {
+		t.Fatalf("expected tag push without auto tag, got %d %q", rec.Code, rec.Header().Get("X-Timestamp-Tag"))
+	}
+	if got := registry.tags("team1/app"); len(got) != 1 || got[0] != "v1" {
+		t.Fatalf("unexpected tags %v", got)
+	}
+}
+
+func withTimestampTagger(t *testing.T, enabled bool, now time.Time) {
+	t.Helper()
+	prev := timestampTags
+	timestampTags = newTimestampTagger(enabled)
+	timestampTags.now = func() time.Time { return now }
+	t.Cleanup(func() { timestampTags = prev })
+}
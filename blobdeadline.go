@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// idleDeadline pushes the connection's read or write deadline out by timeout
+// every time data moves, so a transfer is only cut off once it stalls.
+type idleDeadline struct {
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d idleDeadline) extendRead() {
+	_ = d.rc.SetReadDeadline(time.Now().Add(d.timeout))
+}
+
+// clearRead drops the read deadline once there is nothing left to read. The
+// server watches an idle connection for the client going away, and a read
+// deadline passing there would cancel the request.
+func (d idleDeadline) clearRead() {
+	_ = d.rc.SetReadDeadline(time.Time{})
+}
+
+func (d idleDeadline) extendWrite() {
+	_ = d.rc.SetWriteDeadline(time.Now().Add(d.timeout))
+}
+
+type idleDeadlineBody struct {
+	io.ReadCloser
+	deadline idleDeadline
+}
+
+func (b *idleDeadlineBody) Read(p []byte) (int, error) {
+	b.deadline.extendRead()
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.deadline.clearRead()
+	}
+	return n, err
+}
+
+type idleDeadlineWriter struct {
+	http.ResponseWriter
+	deadline idleDeadline
+}
+
+func (w *idleDeadlineWriter) WriteHeader(status int) {
+	w.deadline.extendWrite()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idleDeadlineWriter) Write(p []byte) (int, error) {
+	w.deadline.extendWrite()
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController, which the reverse proxy flushes
+// through, reach the underlying connection.
+func (w *idleDeadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// archiveIdleTimeout is how long an image export or import may stall when
+// BLOB_IDLE_TIMEOUT is unset, matching the server's WriteTimeout.
+const archiveIdleTimeout = 30 * time.Second
+
+// applyBlobIdleDeadline replaces the server's absolute read and write
+// timeouts with BLOB_IDLE_TIMEOUT, reset on every read and write, for blob
+// downloads and uploads. Other requests keep the server timeouts.
+func applyBlobIdleDeadline(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	if blobIdleTimeout <= 0 {
+		return w, r
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindBlobs {
+		return w, r
+	}
+	return withIdleDeadline(w, r, blobIdleTimeout)
+}
+
+// applyArchiveIdleDeadline does the same for image exports and imports,
+// which stream a whole image and would otherwise be cut off by the server
+// timeouts however fast they move.
+func applyArchiveIdleDeadline(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	timeout := blobIdleTimeout
+	if timeout <= 0 {
+		timeout = archiveIdleTimeout
+	}
+	return withIdleDeadline(w, r, timeout)
+}
+
+func withIdleDeadline(w http.ResponseWriter, r *http.Request, timeout time.Duration) (http.ResponseWriter, *http.Request) {
+	deadline := idleDeadline{rc: http.NewResponseController(w), timeout: timeout}
+	deadline.extendWrite()
+	if r.Body != nil && r.Body != http.NoBody {
+		deadline.extendRead()
+		r.Body = &idleDeadlineBody{ReadCloser: r.Body, deadline: deadline}
+	} else {
+		deadline.clearRead()
+	}
+	return &idleDeadlineWriter{ResponseWriter: w, deadline: deadline}, r
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startIdleDeadlineServer serves uploads with short absolute server timeouts
+// and reports the outcome of reading each request body.
+func startIdleDeadlineServer(t *testing.T, idle time.Duration) (string, <-chan error) {
+	t.Helper()
+	prev := blobIdleTimeout
+	blobIdleTimeout = idle
+	t.Cleanup(func() { blobIdleTimeout = prev })
+
+	results := make(chan error, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r = applyBlobIdleDeadline(w, r)
+		_, err := io.Copy(io.Discard, r.Body)
+		results <- err
+		if err != nil {
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	server.Config.ReadTimeout = 100 * time.Millisecond
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	t.Cleanup(server.Close)
+	return server.URL + "/v2/team1/app/blobs/uploads/session-1", results
+}
+
+// sendChunks streams chunks separated by gap, then pauses for stall before
+// ending the body.
+func sendChunks(t *testing.T, url string, chunks int, gap, stall time.Duration) {
+	t.Helper()
+	body, pipe := io.Pipe()
+	go func() {
+		for i := 0; i < chunks; i++ {
+			if _, err := pipe.Write([]byte("chunk")); err != nil {
+				return
+			}
+			time.Sleep(gap)
+		}
+		time.Sleep(stall)
+		_ = pipe.Close()
+	}()
+	req, err := http.NewRequest(http.MethodPatch, url, body)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+func TestBlobIdleDeadlineKeepsActiveTransfer(t *testing.T) {
+	url, results := startIdleDeadlineServer(t, 250*time.Millisecond)
+
+	// 10 chunks 40ms apart outlast the 100ms server timeout but never idle.
+	sendChunks(t, url, 10, 40*time.Millisecond, 0)
+	if err := <-results; err != nil {
+		t.Fatalf("expected active upload to complete, got %v", err)
+	}
+}
+
+func TestBlobIdleDeadlineCutsOffStalledTransfer(t *testing.T) {
+	url, results := startIdleDeadlineServer(t, 250*time.Millisecond)
+
+	sendChunks(t, url, 1, 0, time.Second)
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Fatalf("expected stalled upload to be cut off")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stalled upload was never cut off")
+	}
+}
+
+func TestBlobIdleDeadlineOnlyAppliesToBlobs(t *testing.T) {
+	prev := blobIdleTimeout
+	blobIdleTimeout = time.Minute
+	t.Cleanup(func() { blobIdleTimeout = prev })
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+	if w, _ := applyBlobIdleDeadline(rec, req); w != http.ResponseWriter(rec) {
+		t.Fatalf("expected manifest requests to keep the server timeouts")
+	}
+}
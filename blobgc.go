@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// blobGCConfig configures the in-process blob collector. Unlike `registry
+// garbage-collect`, it deletes blobs and _layers links while the registry is
+// live. References are marked a second time and every blob and layer link is
+// re-checked against the grace cutoff just before it is unlinked, but a push
+// that links an old, unreferenced blob between that check and the unlink can
+// still lose it. Put the registry in read-only mode while GC_BLOBS runs, or
+// keep GC_BLOB_GRACE well above the time a push takes, if that matters.
+type blobGCConfig struct {
+	// StorageRoot is the registry filesystem root, shared with STORAGE_ROOT.
+	StorageRoot string
+	Interval    time.Duration
+	// Grace skips blobs written more recently than this, so a blob whose
+	// manifest has not been pushed yet is not collected mid-push.
+	Grace time.Duration
+	// PruneEmptyNamespaces removes namespaces left without repositories.
+	PruneEmptyNamespaces bool
+}
+
+func loadBlobGCConfig() blobGCConfig {
+	cfg := blobGCConfig{
+		StorageRoot: loadStorageRoot(),
+		Interval:    getEnvDuration("GC_BLOB_INTERVAL", 24*time.Hour),
+		Grace:       getEnvDuration("GC_BLOB_GRACE", time.Hour),
+
+		PruneEmptyNamespaces: getEnvBool("PRUNE_EMPTY_NAMESPACES", false),
+	}
+	if !getEnvBool("GC_BLOBS", false) {
+		cfg.Interval = 0
+	}
+	return cfg
+}
+
+// blobGC deletes blobs that no manifest revision in any repository refers
+// to, the way `registry garbage-collect` does, but leaves recently written
+// blobs alone.
+type blobGC struct {
+	cfg blobGCConfig
+	now func() time.Time
+}
+
+type blobGCResult struct {
+	Deleted []string
+	// Skipped counts unreferenced blobs still inside the grace period.
+	Skipped int
+	// Pruned lists the empty namespaces removed before collecting.
+	Pruned []string
+}
+
+func newBlobGC(cfg blobGCConfig) *blobGC {
+	return &blobGC{cfg: cfg, now: time.Now}
+}
+
+func (g *blobGC) enabled() bool {
+	return g.cfg.StorageRoot != "" && g.cfg.Interval > 0
+}
+
+// run collects once per interval until ctx is cancelled.
+func (g *blobGC) run(ctx context.Context) {
+	ticker := time.NewTicker(g.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := g.collect(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("blob gc failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect marks every blob referenced from a manifest revision and sweeps the
+// rest of the blob store, removing the blob and the repository layer links
+// pointing at it.
+func (g *blobGC) collect(ctx context.Context) (blobGCResult, error) {
+	var result blobGCResult
+	v2 := filepath.Join(g.cfg.StorageRoot, "docker", "registry", "v2")
+	blobsDir := filepath.Join(v2, "blobs")
+	reposDir := filepath.Join(v2, "repositories")
+
+	cutoff := g.now().Add(-g.cfg.Grace)
+	if g.cfg.PruneEmptyNamespaces {
+		pruned, err := pruneEmptyNamespaces(ctx, reposDir, cutoff)
+		if err != nil {
+			return result, err
+		}
+		result.Pruned = pruned
+	}
+
+	marked, err := markReferencedBlobs(ctx, blobsDir, reposDir)
+	if err != nil {
+		return result, err
+	}
+
+	sweep := map[string]struct{}{}
+	err = filepath.WalkDir(blobsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		digest, ok := blobDigestFromPath(blobsDir, path)
+		if !ok {
+			return nil
+		}
+		if _, ok := marked[digest]; ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			result.Skipped++
+			return nil
+		}
+		sweep[digest] = struct{}{}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return result, err
+	}
+
+	if len(sweep) > 0 {
+		if err := sweepBlobs(ctx, blobsDir, reposDir, cutoff, sweep, &result); err != nil {
+			return result, err
+		}
+	}
+	sort.Strings(result.Deleted)
+	log.Printf("blob gc complete: deleted=%d within_grace=%d pruned_namespaces=%d", len(result.Deleted), result.Skipped, len(result.Pruned))
+	return result, nil
+}
+
+// sweepBlobs re-checks the candidates and deletes their layer links and data.
+func sweepBlobs(ctx context.Context, blobsDir, reposDir string, cutoff time.Time, sweep map[string]struct{}, result *blobGCResult) error {
+	// The registry keeps serving while we walk, so a manifest pushed since
+	// the first mark may now reference a candidate. Mark again right before
+	// unlinking and keep anything that picked up a reference.
+	remarked, err := markReferencedBlobs(ctx, blobsDir, reposDir)
+	if err != nil {
+		return err
+	}
+	for digest := range remarked {
+		delete(sweep, digest)
+	}
+	if err := removeLayerLinks(reposDir, sweep, cutoff); err != nil {
+		return err
+	}
+	for digest := range sweep {
+		data := blobDataPath(blobsDir, digest)
+		if info, err := os.Stat(data); err == nil && info.ModTime().After(cutoff) {
+			result.Skipped++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Dir(data)); err != nil {
+			log.Printf("blob gc: delete %s failed: %v", digest, err)
+			continue
+		}
+		result.Deleted = append(result.Deleted, digest)
+	}
+	return nil
+}
+
+// pruneEmptyNamespaces removes every namespace under reposDir that holds no
+// tag, manifest revision or upload, so it drops out of the registry catalog
+// and stops counting toward MAX_NAMESPACES. Namespaces with files written
+// after cutoff are kept, since a push may have uploaded layers and not yet
+// its manifest.
+func pruneEmptyNamespaces(ctx context.Context, reposDir string, cutoff time.Time) ([]string, error) {
+	entries, err := os.ReadDir(reposDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var pruned []string
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(reposDir, entry.Name())
+		inUse, err := namespaceInUse(dir, cutoff)
+		if err != nil {
+			return pruned, err
+		}
+		if inUse {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("blob gc: prune namespace %s failed: %v", entry.Name(), err)
+			continue
+		}
+		namespaceLimit.forget(entry.Name())
+		log.Printf("blob gc: pruned empty namespace %s", entry.Name())
+		pruned = append(pruned, entry.Name())
+	}
+	return pruned, nil
+}
+
+// namespaceInUse reports whether dir has a tag or revision link, an upload,
+// or any file modified after cutoff.
+func namespaceInUse(dir string, cutoff time.Time) (bool, error) {
+	inUse := false
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "_uploads" {
+				entries, err := os.ReadDir(path)
+				if err != nil {
+					return err
+				}
+				if len(entries) > 0 {
+					inUse = true
+					return fs.SkipAll
+				}
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) || (d.Name() == "link" && strings.Contains(filepath.ToSlash(path), "/_manifests/")) {
+			inUse = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return inUse, err
+}
+
+// markReferencedBlobs returns every manifest revision together with the
+// config, layers and child manifests it names.
+func markReferencedBlobs(ctx context.Context, blobsDir, reposDir string) (map[string]struct{}, error) {
+	marked := map[string]struct{}{}
+	err := filepath.WalkDir(reposDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "_uploads" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "link" {
+			return nil
+		}
+		rel, err := filepath.Rel(reposDir, path)
+		if err != nil {
+			return nil
+		}
+		_, digest, isManifest, ok := parseRepositoryLink(filepath.ToSlash(rel))
+		if !ok || !isManifest {
+			return nil
+		}
+		marked[digest] = struct{}{}
+		data, err := os.ReadFile(blobDataPath(blobsDir, digest)) // #nosec G304 -- path is built from a validated digest
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		var refs manifestReferences
+		if json.Unmarshal(data, &refs) != nil {
+			return nil
+		}
+		if refs.Config != nil && refs.Config.Digest != "" {
+			marked[refs.Config.Digest] = struct{}{}
+		}
+		for _, desc := range append(refs.Layers, refs.Manifests...) {
+			if desc.Digest != "" {
+				marked[desc.Digest] = struct{}{}
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return marked, nil
+}
+
+// blobDataPath maps <alg>:<hex> to blobs/<alg>/<xx>/<hex>/data.
+func blobDataPath(blobsDir, digest string) string {
+	alg, hexDigest, _ := strings.Cut(digest, ":")
+	if len(hexDigest) < 2 {
+		return filepath.Join(blobsDir, alg, hexDigest, "data")
+	}
+	return filepath.Join(blobsDir, alg, hexDigest[:2], hexDigest, "data")
+}
+
+// removeLayerLinks deletes <repo>/_layers/<alg>/<hex> for every swept digest
+// in a single pass over the repositories. A link written after cutoff means a
+// push or mount has just claimed the blob again; it is left in place and the
+// digest is dropped from digests so the blob itself survives too.
+func removeLayerLinks(reposDir string, digests map[string]struct{}, cutoff time.Time) error {
+	err := filepath.WalkDir(reposDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		switch d.Name() {
+		case "_uploads", "_manifests":
+			return filepath.SkipDir
+		case "_layers":
+			for digest := range digests {
+				alg, hexDigest, _ := strings.Cut(digest, ":")
+				dir := filepath.Join(path, alg, hexDigest)
+				if info, err := os.Stat(filepath.Join(dir, "link")); err == nil && info.ModTime().After(cutoff) {
+					delete(digests, digest)
+					continue
+				}
+				if err := os.RemoveAll(dir); err != nil {
+					return err
+				}
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
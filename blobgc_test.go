@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlobGCKeepsUnreferencedBlobWithinGrace(t *testing.T) {
+	root := t.TempDir()
+	layer := writeTestBlob(t, root, []byte("layer contents"), nil)
+	config := writeTestBlob(t, root, []byte(`{"os":"linux"}`), nil)
+	manifest := writeTestBlob(t, root, []byte(`{"schemaVersion":2,"config":{"digest":"`+config+`"},"layers":[{"digest":"`+layer+`"}]}`), nil)
+	orphan := writeTestBlob(t, root, []byte("uploaded before its manifest"), nil)
+	writeRepoLink(t, root, "team1/app", "_manifests/revisions", manifest)
+	writeRepoLink(t, root, "team1/app", "_layers", layer)
+	writeRepoLink(t, root, "team1/app", "_layers", orphan)
+
+	written := time.Now()
+	gc := newBlobGC(blobGCConfig{StorageRoot: root, Interval: time.Hour, Grace: time.Hour})
+	gc.now = func() time.Time { return written.Add(30 * time.Minute) }
+
+	result, err := gc.collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(result.Deleted) != 0 || result.Skipped != 1 {
+		t.Fatalf("expected the orphan to be kept within the grace, got %+v", result)
+	}
+	if _, err := os.Stat(blobDataPath(blobsDirOf(root), orphan)); err != nil {
+		t.Fatalf("expected orphan blob to survive: %v", err)
+	}
+
+	gc.now = func() time.Time { return written.Add(2 * time.Hour) }
+	result, err = gc.collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(result.Deleted) != 1 || result.Deleted[0] != orphan {
+		t.Fatalf("expected only %s to be collected after the grace, got %+v", orphan, result)
+	}
+	if _, err := os.Stat(blobDataPath(blobsDirOf(root), orphan)); !os.IsNotExist(err) {
+		t.Fatalf("expected orphan blob to be deleted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docker", "registry", "v2", "repositories", "team1", "app", "_layers", "sha256", orphan[len("sha256:"):])); !os.IsNotExist(err) {
+		t.Fatalf("expected orphan layer link to be deleted, got %v", err)
+	}
+	for _, digest := range []string{layer, config, manifest} {
+		if _, err := os.Stat(blobDataPath(blobsDirOf(root), digest)); err != nil {
+			t.Fatalf("expected referenced blob %s to survive: %v", digest, err)
+		}
+	}
+}
+
+func TestBlobGCKeepsBlobRelinkedAfterMarking(t *testing.T) {
+	root := t.TempDir()
+	orphan := writeTestBlob(t, root, []byte("unreferenced until a new push mounts it"), nil)
+	writeRepoLink(t, root, "team1/old", "_layers", orphan)
+	writeRepoLink(t, root, "team2/new", "_layers", orphan)
+
+	written := time.Now()
+	fresh := filepath.Join(root, "docker", "registry", "v2", "repositories", "team2", "new", "_layers", "sha256", orphan[len("sha256:"):], "link")
+	if err := os.Chtimes(fresh, written.Add(90*time.Minute), written.Add(90*time.Minute)); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	gc := newBlobGC(blobGCConfig{StorageRoot: root, Interval: time.Hour, Grace: time.Hour})
+	gc.now = func() time.Time { return written.Add(2 * time.Hour) }
+
+	result, err := gc.collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(result.Deleted) != 0 {
+		t.Fatalf("expected the re-linked blob to be kept, got %+v", result)
+	}
+	if _, err := os.Stat(blobDataPath(blobsDirOf(root), orphan)); err != nil {
+		t.Fatalf("expected re-linked blob to survive: %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("expected the fresh layer link to survive: %v", err)
+	}
+}
+
+func TestBlobGCPrunesEmptyNamespaces(t *testing.T) {
+	root := t.TempDir()
+	layer := writeTestBlob(t, root, []byte("layer contents"), nil)
+	manifest := writeTestBlob(t, root, []byte(`{"schemaVersion":2,"layers":[{"digest":"`+layer+`"}]}`), nil)
+	writeRepoLink(t, root, "team1/app", "_manifests/revisions", manifest)
+	writeRepoLink(t, root, "team1/app", "_layers", layer)
+	// team2's only repository had its tags and manifests deleted.
+	writeRepoLink(t, root, "team2/old", "_layers", layer)
+	if err := os.MkdirAll(filepath.Join(root, "docker", "registry", "v2", "repositories", "team2", "old", "_manifests", "tags"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// team3 has a push in progress.
+	uploads := filepath.Join(root, "docker", "registry", "v2", "repositories", "team3", "new", "_uploads", "abc")
+	if err := os.MkdirAll(uploads, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(uploads, "startedat"), []byte("now"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	prevLimit := namespaceLimit
+	namespaceLimit = newNamespaceLimiter(3)
+	namespaceLimit.known = map[string]struct{}{"team1": {}, "team2": {}, "team3": {}}
+	t.Cleanup(func() { namespaceLimit = prevLimit })
+
+	written := time.Now()
+	gc := newBlobGC(blobGCConfig{StorageRoot: root, Interval: time.Hour, Grace: time.Hour, PruneEmptyNamespaces: true})
+	gc.now = func() time.Time { return written.Add(30 * time.Minute) }
+	result, err := gc.collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(result.Pruned) != 0 {
+		t.Fatalf("expected recently written namespaces to be kept, got %v", result.Pruned)
+	}
+
+	gc.now = func() time.Time { return written.Add(2 * time.Hour) }
+	result, err = gc.collect(context.Background())
+	if err != nil {
+		t.Fatalf("collect: %v", err)
+	}
+	if len(result.Pruned) != 1 || result.Pruned[0] != "team2" {
+		t.Fatalf("expected only team2 to be pruned, got %v", result.Pruned)
+	}
+	reposDir := filepath.Join(root, "docker", "registry", "v2", "repositories")
+	if _, err := os.Stat(filepath.Join(reposDir, "team2")); !os.IsNotExist(err) {
+		t.Fatalf("expected team2 to be removed, got %v", err)
+	}
+	for _, namespace := range []string{"team1", "team3"} {
+		if _, err := os.Stat(filepath.Join(reposDir, namespace)); err != nil {
+			t.Fatalf("expected %s to survive: %v", namespace, err)
+		}
+	}
+	if _, ok := namespaceLimit.known["team2"]; ok || len(namespaceLimit.known) != 2 {
+		t.Fatalf("expected team2 to free its namespace slot, got %v", namespaceLimit.known)
+	}
+	if _, err := os.Stat(blobDataPath(blobsDirOf(root), layer)); err != nil {
+		t.Fatalf("expected the layer still used by team1 to survive: %v", err)
+	}
+}
+
+func TestBlobGCKeepsEmptyNamespacesByDefault(t *testing.T) {
+	root := t.TempDir()
+	layer := writeTestBlob(t, root, []byte("layer contents"), nil)
+	writeRepoLink(t, root, "team2/old", "_layers", layer)
+
+	gc := newBlobGC(blobGCConfig{StorageRoot: root, Interval: time.Hour, Grace: time.Hour})
+	gc.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	result, err := gc.collect(context.Background())
+	if err != nil || len(result.Pruned) != 0 {
+		t.Fatalf("expected no pruning, got %+v, %v", result, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "docker", "registry", "v2", "repositories", "team2")); err != nil {
+		t.Fatalf("expected team2 to survive: %v", err)
+	}
+}
+
+func TestBlobGCMissingStorageRoot(t *testing.T) {
+	gc := newBlobGC(blobGCConfig{StorageRoot: filepath.Join(t.TempDir(), "missing"), Interval: time.Hour})
+	result, err := gc.collect(context.Background())
+	if err != nil || len(result.Deleted) != 0 {
+		t.Fatalf("expected missing root to be ignored, got %+v, %v", result, err)
+	}
+}
+
+func blobsDirOf(root string) string {
+	return filepath.Join(root, "docker", "registry", "v2", "blobs")
+}
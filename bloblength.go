@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// enforceBlobLength spools blob upload chunks that declare a Content-Length
+// and rejects them with 400 SIZE_INVALID when the bytes received differ, so a
+// short or padded body never reaches the registry. Chunked uploads without a
+// declared length are passed through.
+func enforceBlobLength(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !verifyBlobLength || (r.Method != http.MethodPut && r.Method != http.MethodPatch) || r.ContentLength < 0 {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || !route.isUpload() {
+		return r, true
+	}
+
+	f, err := os.CreateTemp("", "cv-blob-")
+	if err != nil {
+		log.Printf("blob spool failed: %v", err)
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "unable to buffer upload")
+		return nil, false
+	}
+	// Unlink right away so the spool disappears with the last file handle.
+	_ = os.Remove(f.Name())
+
+	n, err := io.Copy(f, io.LimitReader(r.Body, r.ContentLength+1))
+	if err != nil || n != r.ContentLength {
+		_ = f.Close()
+		message := "received more bytes than Content-Length declares"
+		if err != nil || n < r.ContentLength {
+			message = "received fewer bytes than Content-Length declares"
+		}
+		writeRegistryError(w, http.StatusBadRequest, "SIZE_INVALID", message)
+		return nil, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "unable to buffer upload")
+		return nil, false
+	}
+	// The transport closes the body once it has been sent, releasing the spool.
+	r.Body = f
+	return r, true
+}
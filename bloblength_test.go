@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlobLengthMismatchRejected(t *testing.T) {
+	withVerifyBlobLength(t, true)
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	location := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+
+	for _, tc := range []struct {
+		name     string
+		declared int64
+		want     string
+	}{
+		{name: "short body", declared: 15, want: "fewer"},
+		{name: "long body", declared: 5, want: "more"},
+	} {
+		rec := serveDeclaredLengthRequest(t, http.MethodPatch, location, "0123456789", tc.declared)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "SIZE_INVALID") || !strings.Contains(rec.Body.String(), tc.want) {
+			t.Fatalf("%s: expected 400 SIZE_INVALID, got %d: %s", tc.name, rec.Code, rec.Body.String())
+		}
+	}
+	if got := serveProxyRequest(t, http.MethodGet, location).Header().Get("Range"); got != "0-0" {
+		t.Fatalf("expected rejected chunks not to reach the registry, got Range %q", got)
+	}
+
+	rec := serveDeclaredLengthRequest(t, http.MethodPatch, location, "0123456789", 10)
+	if rec.Code != http.StatusAccepted || rec.Header().Get("Range") != "0-9" {
+		t.Fatalf("expected matching chunk to be accepted, got %d %q", rec.Code, rec.Header().Get("Range"))
+	}
+
+	digest := testDigest([]byte("0123456789abc"))
+	rec = serveDeclaredLengthRequest(t, http.MethodPut, location+"?digest="+digest, "abc", 2)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected padded final chunk to be rejected, got %d", rec.Code)
+	}
+	if _, ok := registry.blobs[digest]; ok {
+		t.Fatalf("expected rejected upload not to be stored")
+	}
+	rec = serveDeclaredLengthRequest(t, http.MethodPut, location+"?digest="+digest, "abc", 3)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected upload to complete, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBlobLengthUncheckedWhenDisabled(t *testing.T) {
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	location := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+	rec := serveDeclaredLengthRequest(t, http.MethodPatch, location, "0123456789", 5)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected chunk to be proxied unchecked, got %d", rec.Code)
+	}
+}
+
+func serveDeclaredLengthRequest(t *testing.T, method, path, body string, declared int64) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.ContentLength = declared
+	req.SetBasicAuth("alice", "secret")
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func withVerifyBlobLength(t *testing.T, enabled bool) {
+	t.Helper()
+	prev := verifyBlobLength
+	verifyBlobLength = enabled
+	t.Cleanup(func() { verifyBlobLength = prev })
+}
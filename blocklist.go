@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const blockedDigestMessage = "digest blocked by policy"
+
+// digestBlocklist holds image digests that must never be served to clients.
+type digestBlocklist struct {
+	mu      sync.RWMutex
+	inline  string
+	path    string
+	digests map[string]struct{}
+}
+
+func loadDigestBlocklist() *digestBlocklist {
+	list := &digestBlocklist{
+		inline: os.Getenv("BLOCKED_DIGESTS"),
+		path:   strings.TrimSpace(os.Getenv("BLOCKED_DIGESTS_FILE")),
+	}
+	if err := list.reload(); err != nil {
+		log.Printf("blocked digests load failed: %v", err)
+	}
+	return list
+}
+
+// reload re-reads the configured digest sources. On error the previous list is kept.
+func (b *digestBlocklist) reload() error {
+	digests := make(map[string]struct{})
+	for _, d := range splitCommaList(b.inline) {
+		digests[strings.ToLower(d)] = struct{}{}
+	}
+	if b.path != "" {
+		data, err := os.ReadFile(b.path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", b.path, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			digests[strings.ToLower(line)] = struct{}{}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("parse %s: %w", b.path, err)
+		}
+	}
+
+	b.mu.Lock()
+	b.digests = digests
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *digestBlocklist) blocked(digest string) bool {
+	if b == nil || digest == "" {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.digests[strings.ToLower(strings.TrimSpace(digest))]
+	return ok
+}
+
+// watch reloads the blocklist every time a signal arrives on sigs.
+func (b *digestBlocklist) watch(sigs <-chan os.Signal) {
+	for range sigs {
+		if err := b.reload(); err != nil {
+			log.Printf("blocked digests reload failed: %v", err)
+			continue
+		}
+		log.Printf("blocked digests reloaded")
+	}
+}
+
+// blockedRequest reports whether a pull request addresses a blocked digest directly.
+func blockedRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.isUpload() {
+		return false
+	}
+	if route.Kind != registryKindManifests && route.Kind != registryKindBlobs {
+		return false
+	}
+	return blockedDigests.blocked(route.Reference)
+}
+
+// blockBlockedDigestResponse rewrites upstream responses whose content digest is
+// blocked, covering manifests that were requested by tag.
+func blockBlockedDigestResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	if resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead {
+		return nil
+	}
+	if !blockedDigests.blocked(resp.Header.Get("Docker-Content-Digest")) {
+		return nil
+	}
+	return replaceWithRegistryError(resp, http.StatusUnavailableForLegalReasons, "DENIED", blockedDigestMessage)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	testBlockedDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testAllowedDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestBlockedDigestRefusedOnPull(t *testing.T) {
+	withBlocklist(t, testBlockedDigest, "")
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "blob")
+	})
+
+	for _, path := range []string{
+		"/v2/team1/app/blobs/" + testBlockedDigest,
+		"/v2/team1/app/manifests/" + testBlockedDigest,
+	} {
+		rec := serveProxyRequest(t, http.MethodGet, path)
+		if rec.Code != http.StatusUnavailableForLegalReasons {
+			t.Fatalf("expected 451 for %s, got %d", path, rec.Code)
+		}
+	}
+	if *calls != 0 {
+		t.Fatalf("expected blocked pulls not to reach upstream, got %d calls", *calls)
+	}
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/"+testAllowedDigest)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for allowed digest, got %d", rec.Code)
+	}
+	if rec.Body.String() != "blob" {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+}
+
+func TestBlockedDigestRefusedForTagReference(t *testing.T) {
+	withBlocklist(t, testBlockedDigest, "")
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		header := http.Header{}
+		if strings.HasSuffix(r.URL.Path, "/bad") {
+			header.Set("Docker-Content-Digest", testBlockedDigest)
+		} else {
+			header.Set("Docker-Content-Digest", testAllowedDigest)
+		}
+		return proxyTestResponse(r, http.StatusOK, header, "{}")
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/bad")
+	if rec.Code != http.StatusUnavailableForLegalReasons {
+		t.Fatalf("expected 451, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "{}") {
+		t.Fatalf("expected manifest body to be withheld")
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/good")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestBlockedDigestRefusedOnExport(t *testing.T) {
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	cleanup := withUpstream(t, image.handler("team1/app", "v1"))
+	defer cleanup()
+	token := seedSession(t, "alice", []string{"team1"})
+
+	for _, digest := range []string{image.ManifestDigest, image.ConfigDigest, image.LayerDigests[1]} {
+		withBlocklist(t, digest, "")
+		rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/v1/export")
+		if rec.Code != http.StatusUnavailableForLegalReasons || rec.Header().Get("Content-Type") == "application/x-tar" {
+			t.Fatalf("expected 451 without an archive when %s is blocked, got %d", digest, rec.Code)
+		}
+	}
+
+	withBlocklist(t, testBlockedDigest, "")
+	if rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/v1/export"); rec.Code != http.StatusOK {
+		t.Fatalf("expected images without blocked content to export, got %d", rec.Code)
+	}
+}
+
+func TestDigestBlocklistReloadOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte("# known bad\n"+testBlockedDigest+"\n"), 0o600); err != nil {
+		t.Fatalf("write blocklist: %v", err)
+	}
+	list := withBlocklist(t, "", path)
+	if !list.blocked(testBlockedDigest) || list.blocked(testAllowedDigest) {
+		t.Fatalf("unexpected initial blocklist state")
+	}
+
+	if err := os.WriteFile(path, []byte(testAllowedDigest+"\n"), 0o600); err != nil {
+		t.Fatalf("rewrite blocklist: %v", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	go list.watch(sigs)
+	t.Cleanup(func() { close(sigs) })
+	sigs <- syscall.SIGHUP
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !list.blocked(testAllowedDigest) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected blocklist to reload after SIGHUP")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if list.blocked(testBlockedDigest) {
+		t.Fatalf("expected previous digest to be unblocked after reload")
+	}
+}
+
+func TestDigestBlocklistReloadKeepsListOnError(t *testing.T) {
+	list := withBlocklist(t, testBlockedDigest, filepath.Join(t.TempDir(), "missing.txt"))
+	if err := list.reload(); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+	if !list.blocked(strings.ToUpper(testBlockedDigest)) {
+		t.Fatalf("expected previous list to be retained after failed reload")
+	}
+}
+
+func withBlocklist(t *testing.T, inline, path string) *digestBlocklist {
+	t.Helper()
+	list := &digestBlocklist{inline: inline, path: path, digests: map[string]struct{}{}}
+	for _, d := range splitCommaList(inline) {
+		list.digests[strings.ToLower(d)] = struct{}{}
+	}
+	if path != "" {
+		_ = list.reload()
+	}
+	prev := blockedDigests
+	blockedDigests = list
+	t.Cleanup(func() {
+		blockedDigests = prev
+	})
+	return list
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// canonicalHostConfig sends requests addressed to any host other than Host,
+// such as the registry's IP or an internal name, to Host, so image
+// references always carry the canonical name. Reject refuses them instead
+// of redirecting.
+type canonicalHostConfig struct {
+	Host   string
+	Reject bool
+}
+
+func loadCanonicalHostConfig() canonicalHostConfig {
+	cfg := canonicalHostConfig{Host: strings.ToLower(strings.TrimSuffix(strings.TrimSpace(os.Getenv("CANONICAL_HOST")), "."))}
+	switch mode := strings.ToLower(strings.TrimSpace(os.Getenv("CANONICAL_HOST_MODE"))); mode {
+	case "", "redirect":
+	case "reject":
+		cfg.Reject = true
+	default:
+		log.Printf("invalid CANONICAL_HOST_MODE %q (want redirect or reject), redirecting", mode)
+	}
+	return cfg
+}
+
+func (c canonicalHostConfig) enabled() bool {
+	return c.Host != ""
+}
+
+// matches reports whether host is the canonical host. A canonical host
+// without a port matches on any port, and with HOST_NAMESPACE_ROUTING the
+// namespace subdomains are canonical too.
+func (c canonicalHostConfig) matches(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == c.Host {
+		return true
+	}
+	if _, _, err := net.SplitHostPort(c.Host); err != nil {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = strings.TrimSuffix(h, ".")
+		}
+		if host == c.Host {
+			return true
+		}
+	}
+	_, ok := hostRouting.hostNamespace(host)
+	return ok
+}
+
+// canonicalHostMiddleware applies CANONICAL_HOST to every request except the
+// health endpoints, which probes reach by address.
+func canonicalHostMiddleware(cfg canonicalHostConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/healthz", "/readyz", "/metrics":
+				next.ServeHTTP(w, r)
+				return
+			}
+			if cfg.matches(r.Host) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			message := "use " + cfg.Host + " to reach this registry"
+			if cfg.Reject {
+				if strings.HasPrefix(r.URL.Path, "/v2/") {
+					writeRegistryError(w, http.StatusMisdirectedRequest, "DENIED", message)
+				} else {
+					http.Error(w, message, http.StatusMisdirectedRequest)
+				}
+				return
+			}
+			// 308 keeps the method and body, so pushes follow it too.
+			http.Redirect(w, r, "https://"+cfg.Host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func withCanonicalHost(t *testing.T, cfg canonicalHostConfig) {
+	t.Helper()
+	prev := canonicalHost
+	canonicalHost = cfg
+	t.Cleanup(func() { canonicalHost = prev })
+}
+
+func serveToHost(t *testing.T, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, target, nil)
+	req.SetBasicAuth("alice", "secret")
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAlternateHostRedirectedToCanonicalHost(t *testing.T) {
+	withCanonicalHost(t, canonicalHostConfig{Host: "registry.example.com"})
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "{}")
+	})
+
+	for _, host := range []string{"10.0.0.5", "registry.internal:8443"} {
+		rec := serveToHost(t, http.MethodPut, "https://"+host+"/v2/team1/app/manifests/latest?x=1")
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://registry.example.com/v2/team1/app/manifests/latest?x=1" {
+			t.Fatalf("%s: expected 308 to the canonical host, got %d %q", host, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+	if *calls != 0 {
+		t.Fatalf("expected redirected requests not to reach the registry")
+	}
+
+	for _, host := range []string{"registry.example.com", "Registry.Example.com:443"} {
+		if rec := serveToHost(t, http.MethodGet, "https://"+host+"/v2/team1/app/manifests/latest"); rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected the canonical host to be served, got %d", host, rec.Code)
+		}
+	}
+}
+
+func TestAlternateHostRejected(t *testing.T) {
+	withCanonicalHost(t, canonicalHostConfig{Host: "registry.example.com", Reject: true})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "{}")
+	})
+
+	rec := serveToHost(t, http.MethodGet, "https://10.0.0.5/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusMisdirectedRequest || !strings.Contains(rec.Body.String(), "use registry.example.com") {
+		t.Fatalf("expected 421 naming the canonical host, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCanonicalHostExemptions(t *testing.T) {
+	withCanonicalHost(t, canonicalHostConfig{Host: "registry.example.com:5443"})
+	withHealthConfig(t, healthConfig{Enabled: true})
+	prevRouting := hostRouting
+	hostRouting = hostRoutingConfig{Enabled: true, Domain: "registry.example.com"}
+	t.Cleanup(func() { hostRouting = prevRouting })
+
+	if rec := serveToHost(t, http.MethodGet, "https://10.0.0.5/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("expected probes by address to be served, got %d", rec.Code)
+	}
+	if rec := serveToHost(t, http.MethodGet, "https://team1.registry.example.com/login"); rec.Code == http.StatusPermanentRedirect {
+		t.Fatalf("expected namespace subdomains to count as canonical")
+	}
+	// A canonical host with a port requires that port.
+	if rec := serveToHost(t, http.MethodGet, "https://registry.example.com/login"); rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://registry.example.com:5443/login" {
+		t.Fatalf("expected a redirect to the canonical port, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// capabilitiesPath serves the capabilities document. It sits next to
+// /v2/_catalog, where no repository name can collide with it.
+const capabilitiesPath = "/v2/_capabilities"
+
+// registryCapabilities lists the registry features available to the caller,
+// so client tooling can check before it tries them.
+type registryCapabilities struct {
+	// Push and Delete are true when the caller may push to or delete from at
+	// least one namespace and this instance accepts writes.
+	Push   bool `json:"push"`
+	Delete bool `json:"delete"`
+
+	CrossRepoMount bool `json:"crossRepoMount"`
+	ChunkedUpload  bool `json:"chunkedUpload"`
+	Pagination     bool `json:"pagination"`
+	Referrers      bool `json:"referrers"`
+}
+
+func currentCapabilities(access []Access) registryCapabilities {
+	writable := !replica.cfg.Enabled || replica.proxy != nil
+	caps := registryCapabilities{
+		CrossRepoMount: writable,
+		ChunkedUpload:  writable,
+		Pagination:     true,
+		Referrers:      referrersEnabled,
+	}
+	for _, entry := range access {
+		if entry.Namespace == "" && !entry.AllNamespaces {
+			continue
+		}
+		caps.Push = caps.Push || (writable && !entry.PullOnly)
+		caps.Delete = caps.Delete || (writable && entry.DeleteAllowed)
+	}
+	return caps
+}
+
+// serveCapabilities answers GET /v2/_capabilities for authenticated callers.
+// It reports whether the request was handled.
+func serveCapabilities(w http.ResponseWriter, r *http.Request, access []Access) bool {
+	if r.URL.Path != capabilitiesPath {
+		return false
+	}
+	body, err := json.Marshal(currentCapabilities(access))
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "unable to encode capabilities")
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+	return true
+}
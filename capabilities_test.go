@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func fetchCapabilities(t *testing.T) registryCapabilities {
+	t.Helper()
+	rec := serveProxyRequest(t, http.MethodGet, capabilitiesPath)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var caps registryCapabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+		t.Fatalf("decode capabilities: %v", err)
+	}
+	return caps
+}
+
+func TestCapabilitiesReflectConfig(t *testing.T) {
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("capabilities reached the registry: %s", r.URL.Path)
+		return nil
+	})
+	originalReferrers := referrersEnabled
+	t.Cleanup(func() { referrersEnabled = originalReferrers })
+
+	referrersEnabled = false
+	caps := fetchCapabilities(t)
+	if caps.Delete || caps.Referrers || !caps.Push || !caps.CrossRepoMount || !caps.ChunkedUpload || !caps.Pagination {
+		t.Fatalf("unexpected capabilities without delete or referrers: %#v", caps)
+	}
+
+	referrersEnabled = true
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1", DeleteAllowed: true}}, nil
+	}
+	caps = fetchCapabilities(t)
+	if !caps.Delete || !caps.Referrers {
+		t.Fatalf("expected delete and referrers, got %#v", caps)
+	}
+	if *calls != 0 {
+		t.Fatalf("expected no registry calls, got %d", *calls)
+	}
+}
+
+func TestCapabilitiesOnReplicaWithoutPrimary(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("capabilities reached the registry: %s", r.URL.Path)
+		return nil
+	})
+	withReplica(t, replicaConfig{Enabled: true}, nil)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1", DeleteAllowed: true}}, nil
+	}
+
+	caps := fetchCapabilities(t)
+	if caps.Push || caps.Delete || caps.CrossRepoMount || caps.ChunkedUpload {
+		t.Fatalf("expected a read-only document, got %#v", caps)
+	}
+}
+
+func TestCapabilitiesRequireAuthentication(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "")
+	})
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, capabilitiesPath, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", rec.Code)
+	}
+}
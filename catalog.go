@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -75,6 +77,23 @@ func fetchCatalog(ctx context.Context, namespace string) ([]repoInfo, error) {
 }
 
 func fetchRepos(ctx context.Context, namespace string) ([]string, error) {
+	all, err := fetchAllRepos(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []string
+	prefix := namespace + "/"
+	for _, repo := range all {
+		if strings.HasPrefix(repo, prefix) {
+			repos = append(repos, repo)
+		}
+	}
+	return repos, nil
+}
+
+// fetchAllRepos returns every repository in the registry catalog.
+func fetchAllRepos(ctx context.Context) ([]string, error) {
 	client := &http.Client{Timeout: 10 * time.Second}
 
 	catalogURL := upstream.ResolveReference(&url.URL{Path: "/v2/_catalog"})
@@ -98,15 +117,7 @@ func fetchRepos(ctx context.Context, namespace string) ([]string, error) {
 	if err := json.Unmarshal(body, &cat); err != nil {
 		return nil, err
 	}
-
-	var repos []string
-	prefix := namespace + "/"
-	for _, repo := range cat.Repositories {
-		if strings.HasPrefix(repo, prefix) {
-			repos = append(repos, repo)
-		}
-	}
-	return repos, nil
+	return cat.Repositories, nil
 }
 
 func fetchTags(ctx context.Context, repo string) ([]string, error) {
@@ -191,16 +202,25 @@ func fetchTagInfo(ctx context.Context, repo, tag string) (tagInfo, error) {
 	}
 
 	digest := resp.Header.Get("Docker-Content-Digest")
-	compressed, err := manifestCompressedSize(ctx, client, repo, body, resp.Header.Get("Content-Type"))
+	compressed, err := imageSizes.compressedSize(ctx, client, repo, digest, body, resp.Header.Get("Content-Type"))
 	if err != nil {
 		return tagInfo{}, err
 	}
 
-	return tagInfo{
+	info := tagInfo{
 		Tag:            tag,
 		Digest:         digest,
 		CompressedSize: compressed,
-	}, nil
+	}
+	if tagSignatures.enabled && digest != "" {
+		signed, err := tagSignatures.signed(ctx, client, repo, digest)
+		if err != nil {
+			log.Printf("signature lookup for %s@%s failed: %v", repo, digest, err)
+		} else {
+			info.Signed = &signed
+		}
+	}
+	return info, nil
 }
 
 type manifestSchema2 struct {
@@ -293,6 +313,27 @@ func deleteManifest(ctx context.Context, repo, digest string) (int, string, erro
 	return resp.StatusCode, message, nil
 }
 
+// putManifest uploads body as repo:ref, returning an error unless the registry
+// answers 201.
+func putManifest(ctx context.Context, repo, ref, contentType string, body []byte) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	manifestURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/manifests/" + ref})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, manifestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("manifest put status: %s", resp.Status)
+	}
+	return nil
+}
+
 func fetchManifestCompressedSizeByDigest(ctx context.Context, client *http.Client, repo, digest string) (int64, error) {
 	manifestURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/manifests/" + digest})
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL.String(), nil)
@@ -524,7 +565,7 @@ func fetchConfigInfo(ctx context.Context, client *http.Client, repo string, mani
 	info.Entrypoint = cfg.Config.Entrypoint
 	info.Cmd = cfg.Config.Cmd
 	info.Env = cfg.Config.Env
-	info.Labels = cfg.Config.Labels
+	info.Labels = stripLabels(cfg.Config.Labels)
 	info.HistoryCount = len(cfg.History)
 	if len(cfg.History) > 0 {
 		info.History = make([]historyInfo, 0, len(cfg.History))
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// tlsCertExpiry holds the NotAfter of every certificate the TLS listener
+// serves, by domain, for containervault_tls_cert_expiry_seconds.
+var tlsCertExpiry = &certExpiryGauge{}
+
+type certExpiryGauge struct {
+	mu     sync.Mutex
+	expiry map[string]time.Time
+
+	// lookup finds the certificate certmagic serves for a name; nil until
+	// the listener's tls.Config exists.
+	lookup func(string) (*x509.Certificate, error)
+}
+
+// certDomains returns the names a certificate is served for: its DNS and IP
+// SANs, or its common name when it has none.
+func certDomains(cert *x509.Certificate) []string {
+	domains := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		domains = append(domains, ip.String())
+	}
+	if len(domains) == 0 && cert.Subject.CommonName != "" {
+		domains = append(domains, cert.Subject.CommonName)
+	}
+	return domains
+}
+
+// set records cert's expiry for each of its domains.
+func (g *certExpiryGauge) set(cert *x509.Certificate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.expiry == nil {
+		g.expiry = map[string]time.Time{}
+	}
+	for _, domain := range certDomains(cert) {
+		g.expiry[strings.ToLower(domain)] = cert.NotAfter
+	}
+}
+
+// replace drops every recorded domain and records cert, for a listener that
+// serves a single certificate.
+func (g *certExpiryGauge) replace(cert *x509.Certificate) {
+	g.mu.Lock()
+	g.expiry = nil
+	g.mu.Unlock()
+	g.set(cert)
+}
+
+// trackCertmagic records the certificates lookup returns for domains and
+// keeps the gauge current from certmagic's events afterwards.
+func (g *certExpiryGauge) trackCertmagic(lookup func(string) (*x509.Certificate, error), domains []string) {
+	g.mu.Lock()
+	g.lookup = lookup
+	g.mu.Unlock()
+	for _, domain := range domains {
+		g.refresh(domain)
+	}
+}
+
+func (g *certExpiryGauge) refresh(domain string) {
+	g.mu.Lock()
+	lookup := g.lookup
+	g.mu.Unlock()
+	if lookup == nil {
+		return
+	}
+	if cert, err := lookup(domain); err == nil {
+		g.set(cert)
+	}
+}
+
+// certmagicEvent updates the gauge when certmagic caches a certificate, at
+// startup or after an on-demand issuance, and when it obtains or renews one,
+// reading the new certificate from storage before it is swapped in.
+func (g *certExpiryGauge) certmagicEvent(storage certmagic.Storage) func(context.Context, string, map[string]any) error {
+	return func(ctx context.Context, event string, data map[string]any) error {
+		switch event {
+		case "cached_managed_cert":
+			sans, _ := data["sans"].([]string)
+			for _, san := range sans {
+				g.refresh(san)
+			}
+		case "cert_obtained":
+			path, _ := data["certificate_path"].(string)
+			if path == "" || storage == nil {
+				return nil
+			}
+			cert, err := loadStoredCertificate(ctx, storage, path)
+			if err != nil {
+				log.Printf("certificate expiry metric not updated for %v: %v", data["identifier"], err)
+				return nil
+			}
+			g.set(cert)
+		}
+		return nil
+	}
+}
+
+func loadStoredCertificate(ctx context.Context, storage certmagic.Storage, key string) (*x509.Certificate, error) {
+	pemBytes, err := storage.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s holds no PEM certificate", key)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// write renders the gauge in the Prometheus text format.
+func (g *certExpiryGauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintln(w, "# HELP containervault_tls_cert_expiry_seconds Unix time at which the certificate served for domain expires.")
+	fmt.Fprintln(w, "# TYPE containervault_tls_cert_expiry_seconds gauge")
+	domains := make([]string, 0, len(g.expiry))
+	for domain := range g.expiry {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		fmt.Fprintf(w, "containervault_tls_cert_expiry_seconds{domain=%q} %d\n", domain, g.expiry[domain].Unix())
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func withCertExpiryGauge(t *testing.T) *certExpiryGauge {
+	t.Helper()
+	prev := tlsCertExpiry
+	tlsCertExpiry = &certExpiryGauge{}
+	t.Cleanup(func() { tlsCertExpiry = prev })
+	return tlsCertExpiry
+}
+
+func newExpiryTestCert(t *testing.T, name string, notAfter time.Time) (*x509.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse cert: %v", err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func expiryMetricLine(domain string, notAfter time.Time) string {
+	return fmt.Sprintf("containervault_tls_cert_expiry_seconds{domain=%q} %d\n", domain, notAfter.Unix())
+}
+
+func TestMetricsReportFileCertificateExpiry(t *testing.T) {
+	withCertExpiryGauge(t)
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadReloadableCertificate: %v", err)
+	}
+	leaf := listenerCert.current.Load().Leaf
+
+	rec := serveUnauthenticated(t, "/metrics", "")
+	for _, domain := range []string{"registry", "localhost"} {
+		if !strings.Contains(rec.Body.String(), expiryMetricLine(domain, leaf.NotAfter)) {
+			t.Fatalf("expected expiry for %s in metrics, got:\n%s", domain, rec.Body.String())
+		}
+	}
+}
+
+func TestCertExpiryGaugeReplaceDropsOldDomains(t *testing.T) {
+	gauge := &certExpiryGauge{}
+	old, _ := newExpiryTestCert(t, "old.example.com", time.Now().Add(time.Hour))
+	current, _ := newExpiryTestCert(t, "new.example.com", time.Now().Add(48*time.Hour))
+	gauge.replace(old)
+	gauge.replace(current)
+
+	var out strings.Builder
+	gauge.write(&out)
+	if strings.Contains(out.String(), "old.example.com") || !strings.Contains(out.String(), expiryMetricLine("new.example.com", current.NotAfter)) {
+		t.Fatalf("expected only the current certificate, got:\n%s", out.String())
+	}
+}
+
+func TestCertExpiryFollowsCertmagicEvents(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	gauge := withCertExpiryGauge(t)
+	storageDir := t.TempDir()
+	t.Setenv("CERTMAGIC_DOMAINS", "registry.example.com")
+	t.Setenv("CERTMAGIC_STORAGE", storageDir)
+
+	served, _ := newExpiryTestCert(t, "registry.example.com", time.Now().Add(24*time.Hour))
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName != "registry.example.com" {
+					return nil, fmt.Errorf("no certificate for %s", hello.ServerName)
+				}
+				return &tls.Certificate{Certificate: [][]byte{served.Raw}, Leaf: served}, nil
+			},
+		}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var out strings.Builder
+	gauge.write(&out)
+	if !strings.Contains(out.String(), expiryMetricLine("registry.example.com", served.NotAfter)) {
+		t.Fatalf("expected the managed certificate's expiry at startup, got:\n%s", out.String())
+	}
+
+	renewed, renewedPEM := newExpiryTestCert(t, "registry.example.com", time.Now().Add(90*24*time.Hour))
+	storage := &certmagic.FileStorage{Path: storageDir}
+	certKey := "certificates/acme/registry.example.com/registry.example.com.crt"
+	if err := storage.Store(context.Background(), certKey, renewedPEM); err != nil {
+		t.Fatalf("store renewed cert: %v", err)
+	}
+	if err := certmagic.Default.OnEvent(context.Background(), "cert_obtained", map[string]any{"renewal": true, "identifier": "registry.example.com", "certificate_path": certKey}); err != nil {
+		t.Fatalf("event: %v", err)
+	}
+	out.Reset()
+	gauge.write(&out)
+	if !strings.Contains(out.String(), expiryMetricLine("registry.example.com", renewed.NotAfter)) {
+		t.Fatalf("expected the renewed certificate's expiry, got:\n%s", out.String())
+	}
+
+	// A cache event looks the certificate up from the listener again.
+	if err := certmagic.Default.OnEvent(context.Background(), "cached_managed_cert", map[string]any{"sans": []string{"registry.example.com"}}); err != nil {
+		t.Fatalf("event: %v", err)
+	}
+	out.Reset()
+	gauge.write(&out)
+	if !strings.Contains(out.String(), expiryMetricLine("registry.example.com", served.NotAfter)) {
+		t.Fatalf("expected the cached certificate's expiry, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"time"
+)
+
+// servedCertificate returns the leaf certificate the TLS listener presents
+// for serverName. main sets it once it knows where certificates come from;
+// it is nil until then.
+var servedCertificate func(serverName string) (*x509.Certificate, error)
+
+// certSource names where servedCertificate reads from: "certmagic" or "file".
+var certSource string
+
+type certInfoResponse struct {
+	Source          string    `json:"source"`
+	Subject         string    `json:"subject"`
+	SANs            []string  `json:"sans"`
+	Issuer          string    `json:"issuer"`
+	NotBefore       time.Time `json:"notBefore"`
+	NotAfter        time.Time `json:"notAfter"`
+	DaysUntilExpiry int       `json:"daysUntilExpiry"`
+}
+
+// tlsConfigCertificate asks cfg.GetCertificate, as a handshake for
+// serverName would, which covers certificates managed by Certmagic.
+func tlsConfigCertificate(cfg *tls.Config) func(string) (*x509.Certificate, error) {
+	return func(serverName string) (*x509.Certificate, error) {
+		if cfg.GetCertificate == nil {
+			return nil, fmt.Errorf("tls config has no certificate source")
+		}
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName, Conn: lookupConn{}})
+		if err != nil {
+			return nil, err
+		}
+		if cert == nil || len(cert.Certificate) == 0 {
+			return nil, fmt.Errorf("no certificate for %q", serverName)
+		}
+		if cert.Leaf != nil {
+			return cert.Leaf, nil
+		}
+		return x509.ParseCertificate(cert.Certificate[0])
+	}
+}
+
+// lookupConn stands in for the connection of a ClientHelloInfo built outside
+// a handshake; certmagic logs its addresses when no certificate matches.
+type lookupConn struct{ net.Conn }
+
+func (lookupConn) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (lookupConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func newCertInfoResponse(cert *x509.Certificate, now time.Time) certInfoResponse {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return certInfoResponse{
+		Source:          certSource,
+		Subject:         cert.Subject.String(),
+		SANs:            sans,
+		Issuer:          cert.Issuer.String(),
+		NotBefore:       cert.NotBefore.UTC(),
+		NotAfter:        cert.NotAfter.UTC(),
+		DaysUntilExpiry: int(math.Floor(cert.NotAfter.Sub(now).Hours() / 24)),
+	}
+}
+
+// handleAdminCert reports the certificate served for ?name=, defaulting to
+// the host the request was sent to.
+func handleAdminCert(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	if servedCertificate == nil {
+		writeAPIError(w, http.StatusServiceUnavailable, "certificate not available")
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = r.Host
+		if host, _, err := net.SplitHostPort(name); err == nil {
+			name = host
+		}
+	}
+	cert, err := servedCertificate(name)
+	if err != nil {
+		log.Printf("certificate lookup for %q failed: %v", name, err)
+		writeAPIError(w, http.StatusServiceUnavailable, "certificate not available")
+		return
+	}
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(newCertInfoResponse(cert, time.Now()))
+}
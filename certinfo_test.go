@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withServedCertificate(t *testing.T, fn func(string) (*x509.Certificate, error), source string) {
+	t.Helper()
+	prevCert, prevSource := servedCertificate, certSource
+	servedCertificate, certSource = fn, source
+	t.Cleanup(func() {
+		servedCertificate, certSource = prevCert, prevSource
+	})
+}
+
+func TestAdminCertReportsLoadedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	t.Setenv("TLS_CERT_TTL", "720h")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadReloadableCertificate: %v", err)
+	}
+	withServedCertificate(t, tlsConfigCertificate(&tls.Config{GetCertificate: listenerCert.GetCertificate}), "file")
+	withAdminAuth(t)
+
+	rec := serveAdminRequest(t, "root", "/admin/cert")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var info certInfoResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !info.NotAfter.Equal(pair.Leaf.NotAfter) || !info.NotBefore.Equal(pair.Leaf.NotBefore) {
+		t.Fatalf("expected validity %s-%s, got %s-%s", pair.Leaf.NotBefore, pair.Leaf.NotAfter, info.NotBefore, info.NotAfter)
+	}
+	if info.Source != "file" || info.Issuer != pair.Leaf.Issuer.String() || len(info.SANs) == 0 {
+		t.Fatalf("unexpected certificate info %+v", info)
+	}
+	if info.DaysUntilExpiry < 28 || info.DaysUntilExpiry > 30 {
+		t.Fatalf("expected about 30 days until expiry, got %d", info.DaysUntilExpiry)
+	}
+
+	if rec := serveAdminRequest(t, "alice", "/admin/cert"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be refused, got %d", rec.Code)
+	}
+}
+
+func TestTLSConfigCertificateUsesServerName(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("load key pair: %v", err)
+	}
+	var asked string
+	cfg := &tls.Config{GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		asked = hello.ServerName
+		return &pair, nil
+	}}
+
+	cert, err := tlsConfigCertificate(cfg)("registry.example.com")
+	if err != nil {
+		t.Fatalf("tlsConfigCertificate: %v", err)
+	}
+	if asked != "registry.example.com" || !cert.NotAfter.Equal(pair.Leaf.NotAfter) {
+		t.Fatalf("unexpected certificate for %q: %s", asked, cert.NotAfter)
+	}
+	if info := newCertInfoResponse(cert, cert.NotAfter.Add(-36*time.Hour)); info.DaysUntilExpiry != 1 {
+		t.Fatalf("expected 1 day until expiry, got %d", info.DaysUntilExpiry)
+	}
+}
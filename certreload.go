@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// reloadableCertificate serves the listener's certificate/key files through
+// tls.Config.GetCertificate and re-reads them on SIGHUP, so rotated
+// certificates are picked up without dropping open connections. Handshakes
+// that started before a reload keep the certificate they were given.
+type reloadableCertificate struct {
+	certPath string
+	keyPath  string
+	current  atomic.Pointer[tls.Certificate]
+}
+
+func loadReloadableCertificate(certPath, keyPath string) (*reloadableCertificate, error) {
+	c := &reloadableCertificate{certPath: certPath, keyPath: keyPath}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload swaps in the pair on disk. On error the previous certificate stays.
+// It reads under lockCertDir so it never pairs the key of a self-signed
+// renewal in progress with the certificate it replaces. A directory that
+// cannot be locked, such as a read-only /certs mount, is read without it.
+func (c *reloadableCertificate) reload() error {
+	if unlock, err := lockCertDir(filepath.Dir(c.certPath)); err == nil {
+		defer unlock()
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", c.certPath, err)
+	}
+	c.current.Store(&cert)
+	if cert.Leaf != nil {
+		tlsCertExpiry.replace(cert.Leaf)
+	}
+	return nil
+}
+
+func (c *reloadableCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+func (c *reloadableCertificate) watch(sigs <-chan os.Signal) {
+	for range sigs {
+		if err := c.reload(); err != nil {
+			log.Printf("tls certificate reload failed, keeping the current certificate: %v", err)
+			continue
+		}
+		log.Printf("tls certificate reloaded from %s", c.certPath)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadableCertificateSwapsOnSIGHUP(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadReloadableCertificate: %v", err)
+	}
+	first, _ := listenerCert.GetCertificate(nil)
+
+	if err := os.Remove(certPath); err != nil {
+		t.Fatalf("remove cert: %v", err)
+	}
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert again: %v", err)
+	}
+	sigs := make(chan os.Signal, 1)
+	go listenerCert.watch(sigs)
+	t.Cleanup(func() { close(sigs) })
+	sigs <- syscall.SIGHUP
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		current, _ := listenerCert.GetCertificate(nil)
+		if current.Leaf.SerialNumber.Cmp(first.Leaf.SerialNumber) != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the certificate to be replaced after SIGHUP")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadableCertificateKeepsCurrentOnError(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadReloadableCertificate: %v", err)
+	}
+	before, _ := listenerCert.GetCertificate(nil)
+
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("corrupt cert: %v", err)
+	}
+	if err := listenerCert.reload(); err == nil {
+		t.Fatalf("expected reload of a corrupt certificate to fail")
+	}
+	if after, _ := listenerCert.GetCertificate(nil); after != before {
+		t.Fatalf("expected the previous certificate to keep serving")
+	}
+}
+
+func TestReloadableCertificateWaitsForCertDirLock(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "registry.crt"), filepath.Join(dir, "registry.key")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("loadReloadableCertificate: %v", err)
+	}
+
+	unlock, err := lockCertDir(dir)
+	if err != nil {
+		t.Fatalf("lockCertDir: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- listenerCert.reload() }()
+	select {
+	case err := <-done:
+		unlock()
+		t.Fatalf("reload did not wait for the renewal lock: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("reload still blocked after the lock was released")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	// lockLeaseTTL is how long a lock outlives a replica that stopped
+	// renewing it, e.g. because it crashed mid-issuance.
+	lockLeaseTTL       = time.Minute
+	lockRenewInterval  = lockLeaseTTL / 3
+	lockPollInterval   = time.Second
+	certStorageTimeout = 30 * time.Second
+)
+
+// loadCertmagicStorage builds the storage selected by
+// CERTMAGIC_STORAGE_BACKEND. The file backend returns nil, leaving
+// CERTMAGIC_STORAGE or certmagic's default location in charge.
+func loadCertmagicStorage() (certmagic.Storage, error) {
+	backend := strings.ToLower(strings.TrimSpace(getEnv("CERTMAGIC_STORAGE_BACKEND", "file")))
+	switch backend {
+	case "", "file":
+		return nil, nil
+	case "redis":
+		addr := strings.TrimSpace(os.Getenv("CERTMAGIC_REDIS_ADDR"))
+		if addr == "" {
+			return nil, fmt.Errorf("CERTMAGIC_REDIS_ADDR must be set for the redis storage backend")
+		}
+		db := 0
+		if raw := strings.TrimSpace(os.Getenv("CERTMAGIC_REDIS_DB")); raw != "" {
+			var err error
+			if db, err = strconv.Atoi(raw); err != nil || db < 0 {
+				return nil, fmt.Errorf("invalid CERTMAGIC_REDIS_DB %q", raw)
+			}
+		}
+		return &redisStorage{
+			addr:     addr,
+			username: strings.TrimSpace(os.Getenv("CERTMAGIC_REDIS_USERNAME")),
+			password: os.Getenv("CERTMAGIC_REDIS_PASSWORD"),
+			db:       db,
+			useTLS:   getEnvBool("CERTMAGIC_REDIS_TLS", false),
+			prefix:   storagePrefix("CERTMAGIC_REDIS_PREFIX"),
+		}, nil
+	case "s3":
+		bucket := strings.TrimSpace(os.Getenv("CERTMAGIC_S3_BUCKET"))
+		if bucket == "" {
+			return nil, fmt.Errorf("CERTMAGIC_S3_BUCKET must be set for the s3 storage backend")
+		}
+		creds, err := awsCredentialsFromEnv("s3 storage backend")
+		if err != nil {
+			return nil, err
+		}
+		region := strings.TrimSpace(os.Getenv("CERTMAGIC_S3_REGION"))
+		if region == "" {
+			region = "us-east-1"
+		}
+		rawEndpoint := strings.TrimSpace(os.Getenv("CERTMAGIC_S3_ENDPOINT"))
+		if rawEndpoint == "" {
+			rawEndpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		endpoint, err := url.Parse(rawEndpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid CERTMAGIC_S3_ENDPOINT %q", rawEndpoint)
+		}
+		return newS3Storage(endpoint, bucket, region, storagePrefix("CERTMAGIC_S3_PREFIX"), creds), nil
+	}
+	return nil, fmt.Errorf("unsupported CERTMAGIC_STORAGE_BACKEND %q (want file, redis or s3)", backend)
+}
+
+// storagePrefix reads the key prefix from name, defaulting to "certmagic".
+func storagePrefix(name string) string {
+	if prefix := strings.Trim(strings.TrimSpace(os.Getenv(name)), "/"); prefix != "" {
+		return prefix
+	}
+	return "certmagic"
+}
+
+// lockLeases keeps the storage locks this process holds alive until they
+// are unlocked, so a lock only expires when its holder stops renewing it.
+type lockLeases struct {
+	mu   sync.Mutex
+	held map[string]heldLock
+}
+
+type heldLock struct {
+	token string
+	stop  context.CancelFunc
+}
+
+func newLockToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hold records name as held under token and calls renew every
+// lockRenewInterval until release.
+func (l *lockLeases) hold(name, token string, renew func(context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.mu.Lock()
+	if l.held == nil {
+		l.held = map[string]heldLock{}
+	}
+	l.held[name] = heldLock{token: token, stop: cancel}
+	l.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(lockRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := renew(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("certmagic storage: renewing lock %s failed: %v", name, err)
+				}
+			}
+		}
+	}()
+}
+
+// release stops renewing name and returns the token it was held under.
+func (l *lockLeases) release(name string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.held[name]
+	if !ok {
+		return "", false
+	}
+	lock.stop()
+	delete(l.held, name)
+	return lock.token, true
+}
+
+// waitForLock sleeps for lockPollInterval or until ctx is done.
+func waitForLock(ctx context.Context) error {
+	timer := time.NewTimer(lockPollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// storageDirs returns the directory keys between base and key, followed by
+// key, for recursive listings over flat key spaces.
+func storageDirs(base, key string) []string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, base), "/")
+	parts := strings.Split(rel, "/")
+	keys := make([]string, 0, len(parts))
+	for i := range parts {
+		keys = append(keys, joinStorageKey(base, strings.Join(parts[:i+1], "/")))
+	}
+	return keys
+}
+
+func joinStorageKey(base, key string) string {
+	base, key = strings.Trim(base, "/"), strings.Trim(key, "/")
+	switch {
+	case base == "":
+		return key
+	case key == "":
+		return base
+	}
+	return base + "/" + key
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// exerciseCertStorage runs the certmagic.Storage contract the backends
+// share against storage.
+func exerciseCertStorage(t *testing.T, storage certmagic.Storage) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := storage.Load(ctx, "certificates/missing.crt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for a missing key, got %v", err)
+	}
+	for key, value := range map[string]string{
+		"certificates/acme/example.com/example.com.crt": "cert",
+		"certificates/acme/example.com/example.com.key": "key",
+		"acme/account.json":                             "account",
+	} {
+		if err := storage.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatalf("store %s: %v", key, err)
+		}
+	}
+	if value, err := storage.Load(ctx, "certificates/acme/example.com/example.com.crt"); err != nil || string(value) != "cert" {
+		t.Fatalf("load: %q, %v", value, err)
+	}
+	if !storage.Exists(ctx, "certificates/acme") || storage.Exists(ctx, "certificates/other") {
+		t.Fatalf("unexpected Exists results")
+	}
+	if info, err := storage.Stat(ctx, "certificates/acme/example.com/example.com.key"); err != nil || !info.IsTerminal || info.Size != 3 || info.Modified.IsZero() {
+		t.Fatalf("unexpected stat of a key: %#v, %v", info, err)
+	}
+	if info, err := storage.Stat(ctx, "certificates/acme"); err != nil || info.IsTerminal {
+		t.Fatalf("unexpected stat of a directory: %#v, %v", info, err)
+	}
+
+	if list, err := storage.List(ctx, "certificates", false); err != nil || strings.Join(list, ",") != "certificates/acme" {
+		t.Fatalf("unexpected listing: %v, %v", list, err)
+	}
+	want := "certificates/acme,certificates/acme/example.com,certificates/acme/example.com/example.com.crt,certificates/acme/example.com/example.com.key"
+	if list, err := storage.List(ctx, "certificates", true); err != nil || strings.Join(list, ",") != want {
+		t.Fatalf("unexpected recursive listing: %v, %v", list, err)
+	}
+
+	if err := storage.Delete(ctx, "certificates"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if storage.Exists(ctx, "certificates/acme/example.com/example.com.crt") || !storage.Exists(ctx, "acme/account.json") {
+		t.Fatalf("expected only the deleted directory to be gone")
+	}
+	if _, err := storage.List(ctx, "certificates", true); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist listing an empty directory, got %v", err)
+	}
+
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := storage.Lock(waitCtx, "issue_cert_example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a second lock to wait, got %v", err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err == nil {
+		t.Fatalf("expected unlocking twice to fail")
+	}
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("relock: %v", err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+}
+
+// fakeRedis answers the commands redisStorage sends from memory.
+type fakeRedis struct {
+	mu       sync.Mutex
+	password string
+	hashes   map[string]map[string]string
+	strings  map[string]string
+	commands []string
+}
+
+func startFakeRedis(t *testing.T, password string) (*fakeRedis, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	server := &fakeRedis{password: password, hashes: map[string]map[string]string{}, strings: map[string]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		var out string
+		switch {
+		case cmd == "AUTH":
+			if args[len(args)-1] != f.password {
+				out = "-WRONGPASS invalid password\r\n"
+				break
+			}
+			authed = true
+			out = "+OK\r\n"
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		default:
+			out = f.exec(cmd, args[1:])
+		}
+		if _, err := io.WriteString(conn, out); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, cmd)
+	bulk := func(value string, ok bool) string {
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	}
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "HSET":
+		hash := f.hashes[args[0]]
+		if hash == nil {
+			hash = map[string]string{}
+			f.hashes[args[0]] = hash
+		}
+		for i := 1; i+1 < len(args); i += 2 {
+			hash[args[i]] = args[i+1]
+		}
+		return ":1\r\n"
+	case "HGET":
+		value, ok := f.hashes[args[0]][args[1]]
+		return bulk(value, ok)
+	case "HSTRLEN":
+		return fmt.Sprintf(":%d\r\n", len(f.hashes[args[0]][args[1]]))
+	case "EXISTS":
+		_, hash := f.hashes[args[0]]
+		_, str := f.strings[args[0]]
+		if hash || str {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if _, ok := f.hashes[key]; ok {
+				delete(f.hashes, key)
+				n++
+			}
+			if _, ok := f.strings[key]; ok {
+				delete(f.strings, key)
+				n++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		var keys []string
+		for key := range f.hashes {
+			if ok, _ := path.Match(args[2], key); ok || strings.HasPrefix(key, strings.TrimSuffix(args[2], "*")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		out := fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, key := range keys {
+			out += bulk(key, true)
+		}
+		return out
+	case "SET":
+		if _, ok := f.strings[args[0]]; ok {
+			return "$-1\r\n"
+		}
+		f.strings[args[0]] = args[1]
+		return "+OK\r\n"
+	case "EVAL":
+		key, token := args[2], args[3]
+		if f.strings[key] != token {
+			return ":0\r\n"
+		}
+		if strings.Contains(args[0], `"del"`) {
+			delete(f.strings, key)
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + cmd + "'\r\n"
+}
+
+func TestRedisStorage(t *testing.T) {
+	server, addr := startFakeRedis(t, "secret")
+	storage := &redisStorage{addr: addr, password: "secret", db: 2, prefix: "certmagic"}
+	exerciseCertStorage(t, storage)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.commands[0] != "SELECT" {
+		t.Fatalf("expected SELECT after AUTH, got %v", server.commands[:1])
+	}
+	if _, ok := server.hashes["certmagic/acme/account.json"]; !ok {
+		t.Fatalf("expected keys under the prefix, got %v", server.hashes)
+	}
+}
+
+func TestRedisStorageReportsAuthFailure(t *testing.T) {
+	_, addr := startFakeRedis(t, "secret")
+	storage := &redisStorage{addr: addr, password: "wrong", prefix: "certmagic"}
+	if err := storage.Store(context.Background(), "key", []byte("value")); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected the AUTH error, got %v", err)
+	}
+}
+
+type fakeS3Object struct {
+	body     []byte
+	modified time.Time
+}
+
+// newFakeS3 serves path-style object and ListObjectsV2 requests for bucket.
+func newFakeS3(t *testing.T, bucket string) (*httptest.Server, map[string]fakeS3Object) {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string]fakeS3Object{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`))
+			return
+		}
+		key, ok := strings.CutPrefix(r.URL.Path, "/"+bucket)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`<Error><Code>NoSuchBucket</Code></Error>`))
+			return
+		}
+		key = strings.TrimPrefix(key, "/")
+		mu.Lock()
+		defer mu.Unlock()
+		object, exists := objects[key]
+		switch {
+		case key == "" && r.Method == http.MethodGet:
+			prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+			type content struct {
+				Key string `xml:"Key"`
+			}
+			type common struct {
+				Prefix string `xml:"Prefix"`
+			}
+			var contents []content
+			var commons []common
+			seen := map[string]bool{}
+			var keys []string
+			for key := range objects {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				rest, ok := strings.CutPrefix(key, prefix)
+				if !ok {
+					continue
+				}
+				if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+					if p := prefix + rest[:i+1]; !seen[p] {
+						seen[p] = true
+						commons = append(commons, common{p})
+					}
+					continue
+				}
+				contents = append(contents, content{key})
+			}
+			_ = xml.NewEncoder(w).Encode(struct {
+				XMLName        xml.Name  `xml:"ListBucketResult"`
+				Contents       []content `xml:"Contents"`
+				CommonPrefixes []common  `xml:"CommonPrefixes"`
+			}{Contents: contents, CommonPrefixes: commons})
+		case r.Method == http.MethodPut:
+			if r.Header.Get("If-None-Match") == "*" && exists {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				_, _ = w.Write([]byte(`<Error><Code>PreconditionFailed</Code></Error>`))
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[key] = fakeS3Object{body: body, modified: time.Now()}
+		case r.Method == http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case !exists:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(object.body)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(object.body)
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, objects
+}
+
+func TestS3Storage(t *testing.T) {
+	server, objects := newFakeS3(t, "certs")
+	endpoint, _ := url.Parse(server.URL)
+	storage := newS3Storage(endpoint, "certs", "eu-west-1", "certmagic", awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	exerciseCertStorage(t, storage)
+
+	if _, ok := objects["certmagic/acme/account.json"]; !ok {
+		t.Fatalf("expected objects under the prefix, got %v", objects)
+	}
+
+	storage.creds.AccessKeyID = "other"
+	if err := storage.Store(context.Background(), "key", []byte("value")); err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Fatalf("expected the S3 error to be reported, got %v", err)
+	}
+}
+
+func TestS3StorageBreaksStaleLocks(t *testing.T) {
+	server, _ := newFakeS3(t, "certs")
+	endpoint, _ := url.Parse(server.URL)
+	creds := awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	crashed := newS3Storage(endpoint, "certs", "us-east-1", "certmagic", creds)
+	if err := crashed.Lock(context.Background(), "issue_cert_example.com"); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	defer crashed.leases.release("issue_cert_example.com")
+
+	storage := newS3Storage(endpoint, "certs", "us-east-1", "certmagic", creds)
+	storage.now = func() time.Time { return time.Now().Add(2 * lockLeaseTTL) }
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := storage.Lock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("expected the stale lock to be taken over, got %v", err)
+	}
+	if err := storage.Unlock(ctx, "issue_cert_example.com"); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+}
+
+func TestLoadCertmagicStorage(t *testing.T) {
+	for _, name := range []string{"CERTMAGIC_REDIS_ADDR", "CERTMAGIC_REDIS_DB", "CERTMAGIC_S3_BUCKET", "CERTMAGIC_S3_ENDPOINT", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("CERTMAGIC_STORAGE_BACKEND", "file")
+	if storage, err := loadCertmagicStorage(); err != nil || storage != nil {
+		t.Fatalf("expected no storage for the file backend, got %v, %v", storage, err)
+	}
+	for _, backend := range []string{"redis", "s3", "consul"} {
+		t.Setenv("CERTMAGIC_STORAGE_BACKEND", backend)
+		if _, err := loadCertmagicStorage(); err == nil {
+			t.Fatalf("expected error for %s without its settings", backend)
+		}
+	}
+
+	t.Setenv("CERTMAGIC_STORAGE_BACKEND", "Redis")
+	t.Setenv("CERTMAGIC_REDIS_ADDR", "redis:6379")
+	t.Setenv("CERTMAGIC_REDIS_DB", "3")
+	storage, err := loadCertmagicStorage()
+	if redis, ok := storage.(*redisStorage); err != nil || !ok || redis.db != 3 || redis.prefix != "certmagic" {
+		t.Fatalf("unexpected redis storage %#v, %v", storage, err)
+	}
+	t.Setenv("CERTMAGIC_REDIS_DB", "-1")
+	if _, err := loadCertmagicStorage(); err == nil {
+		t.Fatalf("expected error for a negative CERTMAGIC_REDIS_DB")
+	}
+
+	t.Setenv("CERTMAGIC_STORAGE_BACKEND", "s3")
+	t.Setenv("CERTMAGIC_S3_BUCKET", "certs")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("CERTMAGIC_S3_REGION", "eu-west-1")
+	storage, err = loadCertmagicStorage()
+	if s3, ok := storage.(*s3Storage); err != nil || !ok || s3.endpoint.String() != "https://s3.eu-west-1.amazonaws.com" {
+		t.Fatalf("unexpected s3 storage %#v, %v", storage, err)
+	}
+	t.Setenv("CERTMAGIC_S3_ENDPOINT", "minio:9000")
+	if _, err := loadCertmagicStorage(); err == nil {
+		t.Fatalf("expected error for an endpoint without a scheme")
+	}
+}
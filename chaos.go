@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// chaosConfig injects artificial latency for client timeout testing.
+// It is a no-op unless both Delay and Probability are positive.
+type chaosConfig struct {
+	Delay       time.Duration
+	Probability float64
+}
+
+func loadChaosConfig() chaosConfig {
+	cfg := chaosConfig{
+		Delay:       getEnvDuration("CHAOS_DELAY", 0),
+		Probability: getEnvFloat("CHAOS_DELAY_PROBABILITY", 0),
+	}
+	if cfg.enabled() {
+		log.Printf("chaos delay enabled: %s with probability %.2f", cfg.Delay, cfg.Probability)
+	}
+	return cfg
+}
+
+func (c chaosConfig) enabled() bool {
+	return c.Delay > 0 && c.Probability > 0
+}
+
+var chaosRandom = rand.Float64
+
+func chaosDelayMiddleware(cfg chaosConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if !cfg.enabled() {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if chaosRandom() < cfg.Probability {
+				timer := time.NewTimer(cfg.Delay)
+				select {
+				case <-timer.C:
+				case <-r.Context().Done():
+					timer.Stop()
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
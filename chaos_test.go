@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosDelayAppliedWithProbabilityOne(t *testing.T) {
+	handler := chaosDelayMiddleware(chaosConfig{Delay: 50 * time.Millisecond, Probability: 1.0})(okHandler())
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected delay of at least 50ms, got %s", elapsed)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestChaosDelaySkippedWithProbabilityZero(t *testing.T) {
+	handler := chaosDelayMiddleware(chaosConfig{Delay: time.Second, Probability: 0.0})(okHandler())
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected no delay, got %s", elapsed)
+	}
+}
+
+func TestChaosDelayUsesProbability(t *testing.T) {
+	prev := chaosRandom
+	t.Cleanup(func() {
+		chaosRandom = prev
+	})
+	handler := chaosDelayMiddleware(chaosConfig{Delay: time.Second, Probability: 0.25})(okHandler())
+
+	chaosRandom = func() float64 { return 0.5 }
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("expected request outside the probability to skip the delay, got %s", elapsed)
+	}
+}
+
+func TestLoadChaosConfigDisabledByDefault(t *testing.T) {
+	t.Setenv("CHAOS_DELAY", "")
+	t.Setenv("CHAOS_DELAY_PROBABILITY", "")
+	if loadChaosConfig().enabled() {
+		t.Fatalf("expected chaos delay disabled by default")
+	}
+
+	t.Setenv("CHAOS_DELAY", "2s")
+	t.Setenv("CHAOS_DELAY_PROBABILITY", "0.1")
+	cfg := loadChaosConfig()
+	if !cfg.enabled() || cfg.Delay != 2*time.Second || cfg.Probability != 0.1 {
+		t.Fatalf("unexpected chaos config: %#v", cfg)
+	}
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -1,14 +1,144 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	upstream = mustParse("http://registry:5000")
 	ldapCfg  = loadLDAPConfig()
+
+	// groupSuffixes map group name endings to namespace permissions.
+	groupSuffixes = loadGroupSuffixes()
+
+	// deleteWindowCfg limits deletes to DELETE_WINDOW.
+	deleteWindowCfg = loadDeleteWindowConfig()
+
+	blockedDigests = loadDigestBlocklist()
+
+	debugAuthHeader = getEnvBool("DEBUG_AUTH_HEADER", false)
+
+	// debugTLS logs the details of every TLS handshake.
+	debugTLS = getEnvBool("DEBUG_TLS", false)
+
+	// referrersEnabled serves the OCI 1.1 referrers API and advertises it on /v2/.
+	referrersEnabled = getEnvBool("OCI_REFERRERS", false)
+
+	hostRouting = loadHostRoutingConfig()
+
+	// canonicalHost redirects or refuses requests for other hosts.
+	canonicalHost = loadCanonicalHostConfig()
+
+	chaosCfg = loadChaosConfig()
+
+	digestCfg = loadDigestPolicy()
+
+	// verifyBlobLength rejects blob upload chunks whose body does not match their Content-Length.
+	verifyBlobLength = getEnvBool("VERIFY_BLOB_LENGTH", false)
+
+	// allowedDigestAlgs are the ALLOWED_DIGEST_ALGS blob uploads may be
+	// finalized with; empty leaves the choice to the registry.
+	allowedDigestAlgs = loadAllowedDigestAlgs()
+	uploadDigests     = newUploadDigestTracker()
+
+	manifestCfg = loadManifestPolicy()
+
+	// strictTagNames refuses manifest pushes to invalid or digest-like tags.
+	strictTagNames = getEnvBool("STRICT_TAG_NAMES", false)
+
+	// dedupeManifestPulls shares one upstream fetch between concurrent
+	// identical manifest pulls.
+	dedupeManifestPulls = getEnvBool("DEDUPE_MANIFEST_PULLS", false)
+
+	// manifestSizeLimit caps manifest PUT bodies while they are read.
+	manifestSizeLimit = loadManifestSizeLimit()
+
+	overwriteCollector = newOverwriteGC(loadGCConfig())
+
+	// blobScrub verifies stored blob digests in the background; its counters are served on /metrics.
+	blobScrub = newBlobScrubber(loadScrubConfig())
+
+	storageReport = newStorageReporter(loadStorageConfig())
+
+	oidcAuth = newOIDCAuthenticator(loadOIDCConfig())
+
+	publicNamespaces = loadPublicNamespaces()
+
+	mtlsCfg = loadMTLSConfig()
+
+	repoLimiter = newRepoRateLimiter(loadRepoRateConfig())
+
+	uploadLimiter = newUploadSessionLimiter(loadUploadLimitConfig())
+
+	timestampTags = newTimestampTagger(getEnvBool("AUTO_TIMESTAMP_TAG", false))
+
+	// strippedConfigLabels are removed from image configs served on pull.
+	strippedConfigLabels = splitCommaList(os.Getenv("STRIP_CONFIG_LABELS"))
+	sanitizedContent     = loadSanitizedContentStore()
+
+	// signedPullNamespaces only serve manifests with a cosign signature.
+	signedPullNamespaces = splitCommaList(os.Getenv("SIGNED_PULL_NAMESPACES"))
+
+	// immutableNamespaces refuse pushes that move an existing tag, except
+	// for the mutableTags listed.
+	immutableNamespaces = splitCommaList(os.Getenv("IMMUTABLE_NAMESPACES"))
+	mutableTags         = splitCommaList(os.Getenv("IMMUTABLE_NAMESPACES_MUTABLE_TAGS"))
+
+	tagSignatures = newSignatureCache(getEnvBool("TAG_SIGNATURES", false), getEnvDuration("TAG_SIGNATURE_CACHE_TTL", 5*time.Minute))
+
+	conversionCfg       = loadConversionConfig()
+	manifestConversions = newConversionCache(conversionCfg.CacheSize)
+
+	// imageSizes caches per-manifest compressed sizes for tag info; zero disables caching.
+	imageSizes = newImageSizeCache(getEnvInt("IMAGE_SIZE_CACHE_SIZE", 10000))
+
+	// blobIdleTimeout cuts off blob transfers that move no data for this long; zero keeps the server timeouts.
+	blobIdleTimeout = getEnvDuration("BLOB_IDLE_TIMEOUT", 0)
+
+	// maxHeaderBytes caps the size of request headers, including the request line.
+	maxHeaderBytes = getEnvInt("MAX_HEADER_BYTES", 64<<10)
+
+	// namespaceLimit refuses pushes that would create more than MAX_NAMESPACES namespaces; zero disables it.
+	namespaceLimit = newNamespaceLimiter(getEnvInt("MAX_NAMESPACES", 0))
+
+	// importMaxBytes caps both the uploaded and the extracted size of archives
+	// accepted by the image import API; zero disables the limit.
+	importMaxBytes = int64(getEnvInt("IMPORT_MAX_BYTES", 10<<30))
+
+	ldapBinds = newBindLimiter(ldapCfg.MaxConcurrentBinds, ldapCfg.BindQueueTimeout)
+
+	// ldapBindDurations records the latency of every LDAP bind for /metrics.
+	ldapBindDurations = newDurationHistogram(loadLDAPBindBuckets())
+
+	// ldapGroups caches resolved permissions per user; zero disables it.
+	ldapGroups = newLDAPGroupCache(getEnvDuration("LDAP_CACHE_TTL", time.Minute))
+
+	// ldapCircuit fails logins fast while the directory is unreachable; a zero threshold disables it.
+	ldapCircuit = newLDAPBreaker(getEnvInt("LDAP_BREAKER_THRESHOLD", 0), getEnvDuration("LDAP_BREAKER_COOLDOWN", 30*time.Second))
+
+	remotePull = newRemotePuller(loadRemoteConfig())
+
+	replica = newReplicaForwarder(loadReplicaConfig())
+
+	healthCfg = loadHealthConfig()
+
+	quarantine = loadQuarantineStore()
+
+	// requestIDHeader carries the request id quoted in error responses.
+	requestIDHeader = http.CanonicalHeaderKey(getEnv("REQUEST_ID_HEADER", "X-Request-ID"))
+
+	// extraResponseHeaders are EXTRA_RESPONSE_HEADERS added to every response.
+	extraResponseHeaders = loadExtraResponseHeaders()
 )
 
 func mustParse(s string) *url.URL {
@@ -20,16 +150,163 @@ func mustParse(s string) *url.URL {
 }
 
 func loadLDAPConfig() LDAPConfig {
-	return LDAPConfig{
+	ldapCAPath := strings.TrimSpace(os.Getenv("LDAP_TLS_CA"))
+	cfg := LDAPConfig{
 		URL:             getEnv("LDAP_URL", "ldaps://ldap:389"),
 		BaseDN:          getEnv("LDAP_BASE_DN", "dc=glauth,dc=com"),
 		UserFilter:      getEnv("LDAP_USER_FILTER", "(mail=%s)"),
+		UserBaseDN:      strings.TrimSpace(getEnv("LDAP_USER_BASE_DN", "")),
 		GroupAttribute:  getEnv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
 		GroupNamePrefix: getEnv("LDAP_GROUP_PREFIX", "team"),
 		UserMailDomain:  getEnv("LDAP_USER_DOMAIN", "@example.com"),
 		StartTLS:        getEnvBool("LDAP_STARTTLS", false),
-		SkipTLSVerify:   getEnvBool("LDAP_SKIP_TLS_VERIFY", true),
+		SkipTLSVerify:   getEnvBool("LDAP_TLS_INSECURE", getEnvBool("LDAP_SKIP_TLS_VERIFY", ldapCAPath == "")),
+		UserDNTemplate:  ldapBindDNTemplate(),
+		AdminGroup:      strings.TrimSpace(getEnv("LDAP_ADMIN_GROUP", "")),
+		BindUser:        strings.TrimSpace(getEnv("LDAP_BIND_USER", "")),
+		BindPassword:    getEnvSecret("LDAP_BIND_PASSWORD"),
+		GroupFilter:     strings.TrimSpace(getEnv("LDAP_GROUP_FILTER", "")),
+		GroupBaseDN:     strings.TrimSpace(getEnv("LDAP_GROUP_BASE_DN", "")),
+		PageSize:        ldapPageSize(getEnvInt("LDAP_PAGE_SIZE", 500)),
+
+		MaxConcurrentBinds: getEnvInt("LDAP_MAX_CONCURRENT_BINDS", 0),
+		BindQueueTimeout:   getEnvDuration("LDAP_BIND_QUEUE_TIMEOUT", 0),
+		DialTimeout:        getEnvDuration("LDAP_DIAL_TIMEOUT", 5*time.Second),
+
+		SlowThreshold: getEnvDuration("LDAP_SLOW_THRESHOLD", 0),
+
+		UsernameAttribute: strings.TrimSpace(getEnv("LDAP_USERNAME_ATTR", "")),
+
+		NestedGroupDepth:       getEnvInt("LDAP_NESTED_GROUP_DEPTH", 0),
+		GroupSearchConcurrency: getEnvInt("LDAP_GROUP_SEARCH_CONCURRENCY", 4),
+		NestedGroups:           getEnvBool("LDAP_NESTED_GROUPS", false),
+		NestedGroupsMethod:     nestedGroupsMethod(getEnv("LDAP_NESTED_GROUPS_METHOD", nestedGroupsMemberOf)),
+
+		RequireOCSPStaple: getEnvBool("LDAP_TLS_REQUIRE_STAPLE", false),
+
+		TLSMinVersion:    getEnvTLSVersion("LDAP_TLS_MIN_VERSION", tls.VersionTLS12),
+		TLSMaxVersion:    getEnvTLSVersion("LDAP_TLS_MAX_VERSION", 0),
+		TLSRenegotiation: ldapRenegotiation(getEnv("LDAP_TLS_RENEGOTIATION", "never")),
+
+		TLSRootCAs: loadLDAPRootCAs(ldapCAPath),
+	}
+	if cfg.NestedGroups && cfg.NestedGroupDepth <= 0 {
+		cfg.NestedGroupDepth = defaultNestedGroupDepth
+	}
+	if cfg.TLSMaxVersion != 0 && cfg.TLSMaxVersion < cfg.TLSMinVersion {
+		log.Printf("LDAP_TLS_MAX_VERSION is below LDAP_TLS_MIN_VERSION, ignoring the maximum")
+		cfg.TLSMaxVersion = 0
+	}
+	return cfg
+}
+
+// ldapBindDNTemplate reads LDAP_BIND_DN_TEMPLATE, or its older name
+// LDAP_USER_DN_TEMPLATE when unset.
+func ldapBindDNTemplate() string {
+	if template := strings.TrimSpace(os.Getenv("LDAP_BIND_DN_TEMPLATE")); template != "" {
+		return template
 	}
+	return strings.TrimSpace(os.Getenv("LDAP_USER_DN_TEMPLATE"))
+}
+
+// validateLDAPConfig checks the user lookup templates, each of which must
+// take the username exactly once, and that a service account has a password.
+func validateLDAPConfig(cfg LDAPConfig) error {
+	if n := strings.Count(cfg.UserFilter, "%s"); n != 1 {
+		return fmt.Errorf("LDAP_USER_FILTER %q must contain exactly one %%s placeholder, found %d", cfg.UserFilter, n)
+	}
+	if cfg.UserDNTemplate != "" && (strings.Count(cfg.UserDNTemplate, "%s") != 1 || strings.Count(cfg.UserDNTemplate, "%") != 1) {
+		return fmt.Errorf("LDAP_BIND_DN_TEMPLATE %q must contain exactly one %%s placeholder and no other %% verbs", cfg.UserDNTemplate)
+	}
+	if cfg.BindUser != "" && cfg.BindPassword == "" {
+		return fmt.Errorf("LDAP_BIND_PASSWORD must be set with LDAP_BIND_USER")
+	}
+	return nil
+}
+
+const (
+	nestedGroupsMemberOf = "memberof"
+	nestedGroupsInChain  = "in-chain"
+
+	// defaultNestedGroupDepth bounds the memberOf walk when
+	// LDAP_NESTED_GROUPS is set without LDAP_NESTED_GROUP_DEPTH.
+	defaultNestedGroupDepth = 5
+)
+
+func nestedGroupsMethod(v string) string {
+	switch method := strings.ToLower(strings.TrimSpace(v)); method {
+	case nestedGroupsMemberOf, nestedGroupsInChain:
+		return method
+	default:
+		log.Printf("invalid LDAP_NESTED_GROUPS_METHOD %q (want memberof or in-chain), using memberof", v)
+		return nestedGroupsMemberOf
+	}
+}
+
+// loadLDAPRootCAs reads the LDAP_TLS_CA bundle. A bundle that cannot be
+// loaded yields an empty pool, so verification fails rather than falling
+// back to the system roots.
+func loadLDAPRootCAs(path string) *x509.CertPool {
+	if path == "" {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("LDAP_TLS_CA: %v; LDAP TLS connections will fail verification", err)
+		return pool
+	}
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		log.Printf("LDAP_TLS_CA: no certificates found in %s; LDAP TLS connections will fail verification", path)
+	}
+	return pool
+}
+
+// tlsVersions maps the TLS version names accepted in configuration.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// getEnvTLSVersion parses a TLS version such as "1.2" from key.
+func getEnvTLSVersion(key string, def uint16) uint16 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(v), "tls")]
+	if !ok {
+		log.Printf("invalid %s %q (want 1.0, 1.1, 1.2 or 1.3), using default", key, v)
+		return def
+	}
+	return version
+}
+
+// ldapRenegotiation parses LDAP_TLS_RENEGOTIATION: never, once or freely.
+// Renegotiation only exists before TLS 1.3.
+func ldapRenegotiation(v string) tls.RenegotiationSupport {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "never":
+		return tls.RenegotiateNever
+	case "once":
+		return tls.RenegotiateOnceAsClient
+	case "freely":
+		return tls.RenegotiateFreelyAsClient
+	}
+	log.Printf("invalid LDAP_TLS_RENEGOTIATION %q (want never, once or freely), using never", v)
+	return tls.RenegotiateNever
+}
+
+func ldapPageSize(n int) uint32 {
+	if n <= 0 {
+		return 0
+	}
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n) // #nosec G115 -- bounded above
 }
 
 func getEnv(key, def string) string {
@@ -39,6 +316,24 @@ func getEnv(key, def string) string {
 	return def
 }
 
+// getEnvSecret reads key, or when it is unset the file named by key_FILE,
+// trimming surrounding whitespace so mounted secrets can end in a newline.
+func getEnvSecret(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return strings.TrimSpace(v)
+	}
+	path := strings.TrimSpace(os.Getenv(key + "_FILE"))
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path) // #nosec G304 -- path comes from operator configuration
+	if err != nil {
+		log.Printf("unable to read %s_FILE: %v", key, err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
 func getEnvBool(key string, def bool) bool {
 	if v, ok := os.LookupEnv(key); ok {
 		v = strings.ToLower(strings.TrimSpace(v))
@@ -46,3 +341,55 @@ func getEnvBool(key string, def bool) bool {
 	}
 	return def
 }
+
+func getEnvInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		log.Printf("invalid %s %q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return def
+	}
+	d, err := parseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s %q, using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil {
+		log.Printf("invalid %s %q, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+// parseDuration accepts Go duration strings and plain integers as seconds.
+func parseDuration(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if secs, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", raw)
+	}
+	return d, nil
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetEnv(t *testing.T) {
@@ -49,6 +53,153 @@ func TestLoadLDAPConfigDefaultSkipVerify(t *testing.T) {
 	}
 }
 
+func TestGetEnvInt(t *testing.T) {
+	t.Setenv("CV_TEST_INT", "7")
+	if got := getEnvInt("CV_TEST_INT", 1); got != 7 {
+		t.Fatalf("expected 7, got %d", got)
+	}
+	t.Setenv("CV_TEST_INT", "seven")
+	if got := getEnvInt("CV_TEST_INT", 1); got != 1 {
+		t.Fatalf("expected default on invalid value, got %d", got)
+	}
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	tests := []struct {
+		value  string
+		expect time.Duration
+	}{
+		{"250ms", 250 * time.Millisecond},
+		{"2m", 2 * time.Minute},
+		{"3", 3 * time.Second},
+		{"bogus", time.Second},
+		{"", time.Second},
+	}
+	for _, tt := range tests {
+		t.Setenv("CV_TEST_DURATION", tt.value)
+		if got := getEnvDuration("CV_TEST_DURATION", time.Second); got != tt.expect {
+			t.Fatalf("value %q expected %s got %s", tt.value, tt.expect, got)
+		}
+	}
+}
+
+func TestLoadLDAPConfigBindLimits(t *testing.T) {
+	t.Setenv("LDAP_MAX_CONCURRENT_BINDS", "8")
+	t.Setenv("LDAP_BIND_QUEUE_TIMEOUT", "2s")
+	cfg := loadLDAPConfig()
+	if cfg.MaxConcurrentBinds != 8 || cfg.BindQueueTimeout != 2*time.Second {
+		t.Fatalf("unexpected bind limits: %d %s", cfg.MaxConcurrentBinds, cfg.BindQueueTimeout)
+	}
+}
+
+func TestLoadLDAPConfigUserLookup(t *testing.T) {
+	t.Setenv("LDAP_USER_FILTER", "(sAMAccountName=%s)")
+	t.Setenv("LDAP_USER_BASE_DN", "ou=people,dc=example,dc=com")
+	t.Setenv("LDAP_USER_DN_TEMPLATE", "uid=%s,ou=old,dc=example,dc=com")
+	t.Setenv("LDAP_BIND_DN_TEMPLATE", "")
+	cfg := loadLDAPConfig()
+	if cfg.UserFilter != "(sAMAccountName=%s)" || cfg.UserBaseDN != "ou=people,dc=example,dc=com" || cfg.UserDNTemplate != "uid=%s,ou=old,dc=example,dc=com" {
+		t.Fatalf("unexpected user lookup settings: %+v", cfg)
+	}
+	t.Setenv("LDAP_BIND_DN_TEMPLATE", "CN=%s,OU=Users,DC=example,DC=com")
+	if cfg := loadLDAPConfig(); cfg.UserDNTemplate != "CN=%s,OU=Users,DC=example,DC=com" {
+		t.Fatalf("expected LDAP_BIND_DN_TEMPLATE to win, got %q", cfg.UserDNTemplate)
+	}
+	if err := validateLDAPConfig(loadLDAPConfig()); err != nil {
+		t.Fatalf("expected a valid configuration, got %v", err)
+	}
+}
+
+func TestValidateLDAPConfigPlaceholders(t *testing.T) {
+	for _, cfg := range []LDAPConfig{
+		{UserFilter: "(mail=alice)"},
+		{UserFilter: "(|(mail=%s)(uid=%s))"},
+		{UserFilter: "(mail=%s)", UserDNTemplate: "uid=alice,dc=example,dc=com"},
+		{UserFilter: "(mail=%s)", UserDNTemplate: "uid=%s,ou=%d,dc=example,dc=com"},
+	} {
+		if err := validateLDAPConfig(cfg); err == nil || !strings.Contains(err.Error(), "exactly one %s") {
+			t.Fatalf("expected %+v to be refused, got %v", cfg, err)
+		}
+	}
+	if err := validateLDAPConfig(LDAPConfig{UserFilter: "(mail=%s)", UserDNTemplate: "uid=%s,dc=example,dc=com"}); err != nil {
+		t.Fatalf("expected one placeholder each to be accepted, got %v", err)
+	}
+}
+
+func TestValidateLDAPConfigServiceAccount(t *testing.T) {
+	t.Setenv("LDAP_BIND_USER", "cn=registry,ou=services,dc=example,dc=com")
+	unsetEnv(t, "LDAP_BIND_PASSWORD")
+	unsetEnv(t, "LDAP_BIND_PASSWORD_FILE")
+	if err := validateLDAPConfig(loadLDAPConfig()); err == nil || !strings.Contains(err.Error(), "LDAP_BIND_PASSWORD") {
+		t.Fatalf("expected a service account without a password to be refused, got %v", err)
+	}
+	t.Setenv("LDAP_BIND_PASSWORD", "s3rvice\n")
+	cfg := loadLDAPConfig()
+	if cfg.BindUser != "cn=registry,ou=services,dc=example,dc=com" || cfg.BindPassword != "s3rvice" {
+		t.Fatalf("unexpected service account: %q %q", cfg.BindUser, cfg.BindPassword)
+	}
+	if err := validateLDAPConfig(cfg); err != nil {
+		t.Fatalf("expected a valid configuration, got %v", err)
+	}
+}
+
+func TestLoadLDAPConfigTLSVersions(t *testing.T) {
+	unsetEnv(t, "LDAP_TLS_MIN_VERSION")
+	unsetEnv(t, "LDAP_TLS_MAX_VERSION")
+	unsetEnv(t, "LDAP_TLS_RENEGOTIATION")
+	cfg := loadLDAPConfig()
+	if cfg.TLSMinVersion != tls.VersionTLS12 || cfg.TLSMaxVersion != 0 || cfg.TLSRenegotiation != tls.RenegotiateNever {
+		t.Fatalf("unexpected defaults: min %x max %x renegotiation %d", cfg.TLSMinVersion, cfg.TLSMaxVersion, cfg.TLSRenegotiation)
+	}
+
+	t.Setenv("LDAP_TLS_MIN_VERSION", "1.0")
+	t.Setenv("LDAP_TLS_MAX_VERSION", "TLS1.1")
+	t.Setenv("LDAP_TLS_RENEGOTIATION", "freely")
+	cfg = loadLDAPConfig()
+	if cfg.TLSMinVersion != tls.VersionTLS10 || cfg.TLSMaxVersion != tls.VersionTLS11 || cfg.TLSRenegotiation != tls.RenegotiateFreelyAsClient {
+		t.Fatalf("unexpected versions: min %x max %x renegotiation %d", cfg.TLSMinVersion, cfg.TLSMaxVersion, cfg.TLSRenegotiation)
+	}
+
+	t.Setenv("LDAP_TLS_MIN_VERSION", "1.3")
+	t.Setenv("LDAP_TLS_RENEGOTIATION", "sometimes")
+	cfg = loadLDAPConfig()
+	if cfg.TLSMinVersion != tls.VersionTLS13 || cfg.TLSMaxVersion != 0 || cfg.TLSRenegotiation != tls.RenegotiateNever {
+		t.Fatalf("expected a maximum below the minimum and a bad renegotiation value to be ignored: max %x renegotiation %d", cfg.TLSMaxVersion, cfg.TLSRenegotiation)
+	}
+
+	t.Setenv("LDAP_TLS_MIN_VERSION", "1.4")
+	if cfg := loadLDAPConfig(); cfg.TLSMinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected an unknown version to fall back to TLS 1.2, got %x", cfg.TLSMinVersion)
+	}
+}
+
+func TestLoadLDAPConfigTLSCA(t *testing.T) {
+	unsetEnv(t, "LDAP_TLS_CA")
+	unsetEnv(t, "LDAP_SKIP_TLS_VERIFY")
+	unsetEnv(t, "LDAP_TLS_INSECURE")
+	if cfg := loadLDAPConfig(); cfg.TLSRootCAs != nil || !cfg.SkipTLSVerify {
+		t.Fatalf("expected no CA and skipped verification by default")
+	}
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	writeTestCA(t, caPath, filepath.Join(dir, "ca.key"))
+	t.Setenv("LDAP_TLS_CA", caPath)
+	if cfg := loadLDAPConfig(); cfg.TLSRootCAs == nil || cfg.SkipTLSVerify {
+		t.Fatalf("expected LDAP_TLS_CA to be loaded and verification enabled")
+	}
+
+	t.Setenv("LDAP_SKIP_TLS_VERIFY", "true")
+	if cfg := loadLDAPConfig(); !cfg.SkipTLSVerify {
+		t.Fatalf("expected an explicit LDAP_SKIP_TLS_VERIFY to win")
+	}
+
+	t.Setenv("LDAP_TLS_INSECURE", "false")
+	if cfg := loadLDAPConfig(); cfg.SkipTLSVerify {
+		t.Fatalf("expected LDAP_TLS_INSECURE to take precedence over LDAP_SKIP_TLS_VERIFY")
+	}
+}
+
 func unsetEnv(t *testing.T, key string) {
 	t.Helper()
 	val, ok := os.LookupEnv(key)
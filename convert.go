@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerConfigType       = "application/vnd.docker.container.image.v1+json"
+	dockerLayerGzipType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	dockerLayerType        = "application/vnd.docker.image.rootfs.diff.tar"
+	dockerForeignLayerType = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// ociToDockerLayerTypes maps OCI layer media types that have a Docker schema 2
+// equivalent. Layers outside this map (e.g. zstd) make a manifest unconvertible.
+var ociToDockerLayerTypes = map[string]string{
+	ociLayerGzipType: dockerLayerGzipType,
+	ociLayerType:     dockerLayerType,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": dockerForeignLayerType,
+}
+
+var errConversionUnsupported = errors.New("manifest cannot be converted")
+
+type conversionConfig struct {
+	Enabled   bool
+	CacheSize int
+}
+
+func loadConversionConfig() conversionConfig {
+	return conversionConfig{
+		Enabled:   getEnvBool("MANIFEST_CONVERSION", false),
+		CacheSize: getEnvInt("MANIFEST_CONVERSION_CACHE_SIZE", 1000),
+	}
+}
+
+type conversionKey struct {
+	SourceDigest string
+	TargetType   string
+}
+
+type conversionEntry struct {
+	key  conversionKey
+	body []byte
+}
+
+// conversionCache is an LRU of converted manifests keyed by source digest and
+// target media type. Manifests are content addressed, so entries only need
+// dropping when their source manifest is deleted.
+type conversionCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[conversionKey]*list.Element
+
+	conversions atomic.Int64
+}
+
+func newConversionCache(size int) *conversionCache {
+	return &conversionCache{size: size, order: list.New(), entries: map[conversionKey]*list.Element{}}
+}
+
+func (c *conversionCache) get(key conversionKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*conversionEntry).body, true
+}
+
+func (c *conversionCache) put(key conversionKey, body []byte) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*conversionEntry).body = body
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&conversionEntry{key: key, body: body})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*conversionEntry).key)
+	}
+}
+
+// invalidate drops every conversion of sourceDigest.
+func (c *conversionCache) invalidate(sourceDigest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, elem := range c.entries {
+		if key.SourceDigest == sourceDigest {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// convert returns the target representation of body, converting at most once
+// per (source digest, target type).
+func (c *conversionCache) convert(sourceDigest, targetType string, body []byte) ([]byte, error) {
+	key := conversionKey{SourceDigest: sourceDigest, TargetType: targetType}
+	if converted, ok := c.get(key); ok {
+		return converted, nil
+	}
+	if targetType != dockerManifestType {
+		return nil, errConversionUnsupported
+	}
+	converted, err := convertOCIToDockerManifest(body)
+	if err != nil {
+		return nil, err
+	}
+	c.conversions.Add(1)
+	c.put(key, converted)
+	return converted, nil
+}
+
+// convertOCIToDockerManifest rewrites an OCI image manifest as Docker schema 2.
+// Only media types change; digests and sizes of the config and layers are kept.
+func convertOCIToDockerManifest(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var manifest map[string]any
+	if err := dec.Decode(&manifest); err != nil {
+		return nil, err
+	}
+	config, ok := manifest["config"].(map[string]any)
+	if !ok || config["mediaType"] != ociConfigType {
+		return nil, errConversionUnsupported
+	}
+	layers, _ := manifest["layers"].([]any)
+	for _, raw := range layers {
+		layer, ok := raw.(map[string]any)
+		if !ok {
+			return nil, errConversionUnsupported
+		}
+		mediaType, _ := layer["mediaType"].(string)
+		dockerType, ok := ociToDockerLayerTypes[mediaType]
+		if !ok {
+			return nil, errConversionUnsupported
+		}
+		layer["mediaType"] = dockerType
+		delete(layer, "annotations")
+	}
+	config["mediaType"] = dockerConfigType
+	delete(config, "annotations")
+	manifest["mediaType"] = dockerManifestType
+	for _, field := range []string{"annotations", "subject", "artifactType"} {
+		delete(manifest, field)
+	}
+	return json.Marshal(manifest)
+}
+
+type conversionTargetContextKey struct{}
+
+// acceptsOnlyDockerManifest reports whether the Accept header asks for Docker
+// schema 2 but not OCI image manifests.
+func acceptsOnlyDockerManifest(header http.Header) bool {
+	docker, oci := false, false
+	for _, value := range header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			switch mediaType {
+			case dockerManifestType:
+				docker = true
+			case ociManifestType, "*/*":
+				oci = true
+			}
+		}
+	}
+	return docker && !oci
+}
+
+// prepareManifestConversion lets the registry answer Docker-only clients with
+// an OCI manifest, which convertManifestResponse then rewrites. Only tag
+// references are converted, since a digest reference names exact bytes.
+func prepareManifestConversion(r *http.Request) *http.Request {
+	if !conversionCfg.Enabled || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return r
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests || isDigestReference(route.Reference) {
+		return r
+	}
+	if !acceptsOnlyDockerManifest(r.Header) {
+		return r
+	}
+	out := r.Clone(context.WithValue(r.Context(), conversionTargetContextKey{}, dockerManifestType))
+	out.Header.Add("Accept", ociManifestType)
+	return out
+}
+
+// convertManifestResponse rewrites OCI manifest responses for requests marked
+// by prepareManifestConversion and drops cached conversions of deleted
+// manifests.
+func convertManifestResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	if resp.Request.Method == http.MethodDelete {
+		if route, ok := parseRegistryPath(resp.Request.URL.Path); ok && route.Kind == registryKindManifests && resp.StatusCode == http.StatusAccepted {
+			manifestConversions.invalidate(route.Reference)
+		}
+		return nil
+	}
+	target, ok := resp.Request.Context().Value(conversionTargetContextKey{}).(string)
+	if !ok || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != ociManifestType {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok {
+		return nil
+	}
+
+	sourceDigest := resp.Header.Get("Docker-Content-Digest")
+	var body []byte
+	if resp.Request.Method == http.MethodGet {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(body) > maxManifestBytes {
+			return fmt.Errorf("manifest %s exceeds %d bytes", sourceDigest, maxManifestBytes)
+		}
+		if sourceDigest == "" {
+			sum := sha256.Sum256(body)
+			sourceDigest = "sha256:" + hex.EncodeToString(sum[:])
+		}
+	}
+
+	converted, ok := manifestConversions.get(conversionKey{SourceDigest: sourceDigest, TargetType: target})
+	if !ok {
+		if body == nil {
+			// HEAD carries no body; fetch the source manifest to convert it once.
+			if sanitized, ok := sanitizedContent.get(route.Repo, sourceDigest); ok {
+				body = sanitized.Body
+			} else {
+				client := &http.Client{Timeout: 10 * time.Second}
+				fetched, err := fetchManifestByDigest(resp.Request.Context(), client, route.Repo, sourceDigest)
+				if err != nil {
+					log.Printf("manifest conversion fetch for %s@%s failed: %v", route.Repo, sourceDigest, err)
+					return nil
+				}
+				body = fetched
+			}
+		}
+		var err error
+		converted, err = manifestConversions.convert(sourceDigest, target, body)
+		if err != nil {
+			if !errors.Is(err, errConversionUnsupported) {
+				log.Printf("manifest conversion for %s@%s failed: %v", route.Repo, sourceDigest, err)
+			}
+			if resp.Request.Method == http.MethodGet {
+				resp.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			return nil
+		}
+	}
+
+	sum := sha256.Sum256(converted)
+	resp.Header.Set("Content-Type", target)
+	resp.Header.Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(converted)))
+	resp.Header.Del("Etag")
+	resp.ContentLength = int64(len(converted))
+	if resp.Request.Method == http.MethodGet {
+		resp.Body = io.NopCloser(bytes.NewReader(converted))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withConvertingUpstream serves image as an OCI manifest and, like the
+// registry, refuses clients that do not accept OCI.
+func withConvertingUpstream(t *testing.T, image testRegistryImage) *int {
+	t.Helper()
+	return withProxyUpstream(t, func(r *http.Request) *http.Response {
+		if r.Method == http.MethodDelete {
+			return proxyTestResponse(r, http.StatusAccepted, nil, "")
+		}
+		if !strings.Contains(strings.Join(r.Header.Values("Accept"), ","), ociManifestType) {
+			return proxyTestResponse(r, http.StatusNotFound, nil, `{"errors":[{"code":"MANIFEST_UNKNOWN"}]}`)
+		}
+		header := http.Header{}
+		header.Set("Content-Type", ociManifestType)
+		header.Set("Docker-Content-Digest", image.ManifestDigest)
+		body := string(image.Manifest)
+		if r.Method == http.MethodHead {
+			body = ""
+		}
+		return proxyTestResponse(r, http.StatusOK, header, body)
+	})
+}
+
+func serveManifestPull(t *testing.T, method, path, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Accept", accept)
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestManifestConversionServedFromCache(t *testing.T) {
+	cache := withManifestConversion(t, conversionConfig{Enabled: true, CacheSize: 10})
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	withConvertingUpstream(t, image)
+
+	first := serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/v1", dockerManifestType)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	if ct := first.Header().Get("Content-Type"); ct != dockerManifestType {
+		t.Fatalf("expected docker content type, got %q", ct)
+	}
+	if got := first.Header().Get("Docker-Content-Digest"); got != testDigest(first.Body.Bytes()) {
+		t.Fatalf("digest header %q does not match converted body", got)
+	}
+	var manifest manifestSchema2
+	if err := json.Unmarshal(first.Body.Bytes(), &manifest); err != nil {
+		t.Fatalf("decode converted manifest: %v", err)
+	}
+	if manifest.MediaType != dockerManifestType || manifest.Config.MediaType != dockerConfigType || manifest.Config.Digest != image.ConfigDigest {
+		t.Fatalf("unexpected converted manifest: %+v", manifest)
+	}
+	if len(manifest.Layers) != 2 || manifest.Layers[0].MediaType != dockerLayerGzipType || manifest.Layers[1].Digest != image.LayerDigests[1] {
+		t.Fatalf("unexpected converted layers: %+v", manifest.Layers)
+	}
+
+	second := serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/v1", dockerManifestType)
+	if second.Body.String() != first.Body.String() {
+		t.Fatalf("expected identical cached conversion")
+	}
+	head := serveManifestPull(t, http.MethodHead, "/v2/team1/app/manifests/v1", dockerManifestType)
+	if head.Code != http.StatusOK || head.Header().Get("Docker-Content-Digest") != first.Header().Get("Docker-Content-Digest") {
+		t.Fatalf("expected HEAD to report the converted digest, got %d %q", head.Code, head.Header().Get("Docker-Content-Digest"))
+	}
+	if n := cache.conversions.Load(); n != 1 {
+		t.Fatalf("expected a single conversion, got %d", n)
+	}
+}
+
+func TestManifestConversionInvalidatedOnDelete(t *testing.T) {
+	cache := withManifestConversion(t, conversionConfig{Enabled: true, CacheSize: 10})
+	image := newTestRegistryImage(t, "layer-one")
+	withConvertingUpstream(t, image)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1", DeleteAllowed: true}}, nil
+	}
+
+	serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/v1", dockerManifestType)
+	rec := serveProxyRequest(t, http.MethodDelete, "/v2/team1/app/manifests/"+image.ManifestDigest)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	if _, ok := cache.get(conversionKey{SourceDigest: image.ManifestDigest, TargetType: dockerManifestType}); ok {
+		t.Fatalf("expected cached conversion to be dropped")
+	}
+	serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/v1", dockerManifestType)
+	if n := cache.conversions.Load(); n != 2 {
+		t.Fatalf("expected re-conversion after delete, got %d conversions", n)
+	}
+}
+
+func TestManifestConversionSkipsOCIClientsAndDigests(t *testing.T) {
+	cache := withManifestConversion(t, conversionConfig{Enabled: true, CacheSize: 10})
+	image := newTestRegistryImage(t, "layer-one")
+	withConvertingUpstream(t, image)
+
+	rec := serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/v1", dockerManifestType+", "+ociManifestType)
+	if rec.Header().Get("Content-Type") != ociManifestType || rec.Body.String() != string(image.Manifest) {
+		t.Fatalf("expected OCI-capable client to get the original manifest")
+	}
+	rec = serveManifestPull(t, http.MethodGet, "/v2/team1/app/manifests/"+image.ManifestDigest, dockerManifestType)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected digest pulls to pass through unconverted, got %d", rec.Code)
+	}
+	if n := cache.conversions.Load(); n != 0 {
+		t.Fatalf("expected no conversions, got %d", n)
+	}
+}
+
+func TestConvertOCIToDockerManifestRejectsUnmappedLayers(t *testing.T) {
+	body := `{"schemaVersion":2,"mediaType":"` + ociManifestType + `","config":{"mediaType":"` + ociConfigType + `","digest":"sha256:aa","size":1},` +
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+zstd","digest":"sha256:bb","size":1}]}`
+	if _, err := convertOCIToDockerManifest([]byte(body)); err != errConversionUnsupported {
+		t.Fatalf("expected errConversionUnsupported, got %v", err)
+	}
+}
+
+func TestConversionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newConversionCache(2)
+	cache.put(conversionKey{SourceDigest: "a"}, []byte("a"))
+	cache.put(conversionKey{SourceDigest: "b"}, []byte("b"))
+	cache.get(conversionKey{SourceDigest: "a"})
+	cache.put(conversionKey{SourceDigest: "c"}, []byte("c"))
+	if _, ok := cache.get(conversionKey{SourceDigest: "b"}); ok {
+		t.Fatalf("expected least recently used entry to be evicted")
+	}
+	if _, ok := cache.get(conversionKey{SourceDigest: "a"}); !ok {
+		t.Fatalf("expected recently used entry to be kept")
+	}
+}
+
+func withManifestConversion(t *testing.T, cfg conversionConfig) *conversionCache {
+	t.Helper()
+	prevCfg, prevCache := conversionCfg, manifestConversions
+	conversionCfg = cfg
+	manifestConversions = newConversionCache(cfg.CacheSize)
+	t.Cleanup(func() {
+		conversionCfg, manifestConversions = prevCfg, prevCache
+	})
+	return manifestConversions
+}
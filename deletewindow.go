@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// deleteWindowNow is the clock delete windows are checked against.
+var deleteWindowNow = time.Now
+
+// deleteWindow is a daily time range, [Start, End) in minutes after
+// midnight, on Days. A range whose end is before its start runs past
+// midnight into the next day.
+type deleteWindow struct {
+	Days       [7]bool
+	Start, End int
+}
+
+// deleteWindowConfig limits deletes to Windows in Location; outside them a
+// delete is refused whatever the user's permissions. ExemptAdmins lets
+// LDAP_ADMIN_GROUP members delete at any time.
+type deleteWindowConfig struct {
+	Windows      []deleteWindow
+	Location     *time.Location
+	ExemptAdmins bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func loadDeleteWindowConfig() deleteWindowConfig {
+	cfg := deleteWindowConfig{Location: time.UTC, ExemptAdmins: getEnvBool("DELETE_WINDOW_EXEMPT_ADMINS", false)}
+	if tz := strings.TrimSpace(os.Getenv("DELETE_WINDOW_TZ")); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Printf("invalid DELETE_WINDOW_TZ %q: %v, using UTC", tz, err)
+		} else {
+			cfg.Location = loc
+		}
+	}
+	raw := splitCommaList(os.Getenv("DELETE_WINDOW"))
+	for _, entry := range raw {
+		window, err := parseDeleteWindow(entry)
+		if err != nil {
+			log.Printf("ignoring DELETE_WINDOW entry %q: %v", entry, err)
+			continue
+		}
+		cfg.Windows = append(cfg.Windows, window)
+	}
+	if len(raw) > 0 && len(cfg.Windows) == 0 {
+		// A window was asked for; never fall back to allowing deletes at
+		// any time because it was mistyped.
+		log.Printf("DELETE_WINDOW has no valid entry, refusing all deletes")
+		cfg.Windows = []deleteWindow{{}}
+	}
+	return cfg
+}
+
+// parseDeleteWindow reads "[Day[-Day]] HH:MM-HH:MM", e.g. "Sat-Sun
+// 22:00-06:00" or "02:00-04:00" for every day.
+func parseDeleteWindow(entry string) (deleteWindow, error) {
+	var w deleteWindow
+	fields := strings.Fields(entry)
+	var times string
+	switch len(fields) {
+	case 1:
+		times = fields[0]
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	case 2:
+		times = fields[1]
+		first, last, isRange := strings.Cut(strings.ToLower(fields[0]), "-")
+		from, ok := weekdays[first]
+		if !ok {
+			return w, fmt.Errorf("unknown day %q", first)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdays[last]; !ok {
+				return w, fmt.Errorf("unknown day %q", last)
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	default:
+		return w, fmt.Errorf("expected [day[-day]] HH:MM-HH:MM")
+	}
+	start, end, ok := strings.Cut(times, "-")
+	if !ok {
+		return w, fmt.Errorf("expected a HH:MM-HH:MM time range")
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, err
+	}
+	if w.Start == w.End || w.Start == 24*60 {
+		return w, fmt.Errorf("empty time range %s", times)
+	}
+	return w, nil
+}
+
+// parseClock reads HH:MM as minutes after midnight; 24:00 ends a day.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hours, herr := strconv.Atoi(h)
+	minutes, merr := strconv.Atoi(m)
+	if !ok || herr != nil || merr != nil || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return hours*60 + minutes, nil
+}
+
+func (c deleteWindowConfig) enabled() bool {
+	return len(c.Windows) > 0
+}
+
+// open reports whether now falls inside one of the windows.
+func (c deleteWindowConfig) open(now time.Time) bool {
+	if !c.enabled() {
+		return true
+	}
+	now = now.In(c.Location)
+	minute := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range c.Windows {
+		if w.Start < w.End {
+			if w.Days[today] && minute >= w.Start && minute < w.End {
+				return true
+			}
+			continue
+		}
+		if (w.Days[today] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether user may delete now.
+func (c deleteWindowConfig) allows(user *User) bool {
+	if c.ExemptAdmins && user != nil && user.Admin {
+		return true
+	}
+	return c.open(deleteWindowNow())
+}
+
+const deleteWindowMessage = "deletes are only allowed during the DELETE_WINDOW maintenance window"
+
+// enforceDeleteWindow refuses registry manifest and blob deletes outside
+// DELETE_WINDOW with 403. Cancelling an upload is part of a push and is not
+// held to the window.
+func enforceDeleteWindow(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if r.Method != http.MethodDelete || !deleteWindowCfg.enabled() {
+		return true
+	}
+	if route, ok := parseRegistryPath(r.URL.Path); !ok || route.isUpload() {
+		return true
+	}
+	if deleteWindowCfg.allows(user) {
+		return true
+	}
+	writeRegistryError(w, http.StatusForbidden, "DENIED", deleteWindowMessage)
+	return false
+}
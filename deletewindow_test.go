@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func withDeleteWindow(t *testing.T, raw string, exemptAdmins bool, now time.Time) {
+	t.Helper()
+	t.Setenv("DELETE_WINDOW", raw)
+	t.Setenv("DELETE_WINDOW_TZ", "")
+	prevCfg, prevNow := deleteWindowCfg, deleteWindowNow
+	deleteWindowCfg = loadDeleteWindowConfig()
+	deleteWindowCfg.ExemptAdmins = exemptAdmins
+	deleteWindowNow = func() time.Time { return now }
+	t.Cleanup(func() {
+		deleteWindowCfg = prevCfg
+		deleteWindowNow = prevNow
+	})
+}
+
+// withDeleteAccess lets alice delete in team1, as an admin when admin is set.
+func withDeleteAccess(t *testing.T, admin bool) *int {
+	t.Helper()
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusAccepted, nil, "")
+	})
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username, Admin: admin}, []Access{{Namespace: "team1", DeleteAllowed: true}}, nil
+	}
+	return calls
+}
+
+const deleteManifestPath = "/v2/team1/app/manifests/sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// 2026-10-17 is a Saturday.
+var saturdayNight = time.Date(2026, 10, 17, 23, 30, 0, 0, time.UTC)
+
+func TestDeleteInsideWindowAllowed(t *testing.T) {
+	calls := withDeleteAccess(t, false)
+	withDeleteWindow(t, "Sat 22:00-06:00", false, saturdayNight.Add(5*time.Hour))
+
+	if rec := serveProxyRequest(t, http.MethodDelete, deleteManifestPath); rec.Code != http.StatusAccepted || *calls != 1 {
+		t.Fatalf("expected the delete to reach the registry early on Sunday, got %d after %d calls", rec.Code, *calls)
+	}
+}
+
+func TestDeleteOutsideWindowRefused(t *testing.T) {
+	calls := withDeleteAccess(t, false)
+	withDeleteWindow(t, "Sat 22:00-06:00", true, saturdayNight.Add(7*time.Hour))
+
+	rec := serveProxyRequest(t, http.MethodDelete, deleteManifestPath)
+	if rec.Code != http.StatusForbidden || *calls != 0 {
+		t.Fatalf("expected 403 outside the window, got %d after %d calls", rec.Code, *calls)
+	}
+	// Cancelling an upload is not a delete of stored content.
+	if rec := serveProxyRequest(t, http.MethodDelete, "/v2/team1/app/blobs/uploads/session-1"); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected upload cancels outside the window, got %d", rec.Code)
+	}
+}
+
+func TestDeleteWindowExemptsAdmins(t *testing.T) {
+	calls := withDeleteAccess(t, true)
+	withDeleteWindow(t, "Sat 22:00-06:00", true, saturdayNight.Add(-time.Hour))
+
+	if rec := serveProxyRequest(t, http.MethodDelete, deleteManifestPath); rec.Code != http.StatusAccepted || *calls != 1 {
+		t.Fatalf("expected an exempt admin to delete outside the window, got %d", rec.Code)
+	}
+}
+
+func TestParseDeleteWindow(t *testing.T) {
+	cfg := deleteWindowConfig{Location: time.UTC}
+	for _, entry := range []string{"Fri-Mon 00:00-24:00", "02:00-03:00"} {
+		w, err := parseDeleteWindow(entry)
+		if err != nil {
+			t.Fatalf("%s: %v", entry, err)
+		}
+		cfg.Windows = append(cfg.Windows, w)
+	}
+	for _, tc := range []struct {
+		at   time.Time
+		open bool
+	}{
+		{saturdayNight, true},
+		{time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC), true},  // Monday
+		{time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC), false}, // Tuesday
+		{time.Date(2026, 10, 20, 2, 30, 0, 0, time.UTC), true},
+	} {
+		if got := cfg.open(tc.at); got != tc.open {
+			t.Fatalf("%s: expected open=%v", tc.at, tc.open)
+		}
+	}
+	for _, entry := range []string{"Sat", "Foo 01:00-02:00", "01:00-01:00", "25:00-02:00"} {
+		if _, err := parseDeleteWindow(entry); err == nil {
+			t.Fatalf("expected %q to be rejected", entry)
+		}
+	}
+}
+
+func TestInvalidDeleteWindowRefusesDeletes(t *testing.T) {
+	withDeleteWindow(t, "whenever", false, saturdayNight)
+	if deleteWindowCfg.allows(&User{Name: "alice"}) {
+		t.Fatalf("expected a mistyped DELETE_WINDOW to refuse deletes")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// digestPolicy controls strict validation of digests in registry requests.
+type digestPolicy struct {
+	Strict bool
+	// RejectUppercase refuses uppercase hex instead of lowercasing it.
+	RejectUppercase bool
+}
+
+var digestHexLengths = map[string]int{
+	"sha256": 64,
+	"sha512": 128,
+}
+
+var errDigestInvalid = errors.New("invalid digest")
+
+func loadDigestPolicy() digestPolicy {
+	return digestPolicy{
+		Strict:          getEnvBool("STRICT_DIGESTS", false),
+		RejectUppercase: strings.EqualFold(strings.TrimSpace(os.Getenv("DIGEST_CASE_POLICY")), "reject"),
+	}
+}
+
+// normalizeDigest validates <algorithm>:<hex> and returns it in canonical lowercase form.
+func (p digestPolicy) normalizeDigest(raw string) (string, error) {
+	alg, encoded, ok := strings.Cut(raw, ":")
+	if !ok || alg == "" || encoded == "" {
+		return "", fmt.Errorf("%w: %q is not of the form algorithm:hex", errDigestInvalid, raw)
+	}
+	want, ok := digestHexLengths[alg]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported algorithm %q", errDigestInvalid, alg)
+	}
+	if len(encoded) != want {
+		return "", fmt.Errorf("%w: %s digest must have %d hex characters, got %d", errDigestInvalid, alg, want, len(encoded))
+	}
+	lower := strings.ToLower(encoded)
+	if lower != encoded && p.RejectUppercase {
+		return "", fmt.Errorf("%w: digest hex must be lowercase", errDigestInvalid)
+	}
+	for _, c := range lower {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return "", fmt.Errorf("%w: non-hex character %q", errDigestInvalid, c)
+		}
+	}
+	return alg + ":" + lower, nil
+}
+
+// enforceDigestPolicy validates digests in blob and manifest paths and in the
+// digest/mount upload parameters, rewriting them to canonical form.
+func enforceDigestPolicy(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !digestCfg.Strict {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || (route.Kind != registryKindBlobs && route.Kind != registryKindManifests) {
+		return r, true
+	}
+
+	out := r
+	if !route.isUpload() && (route.Kind == registryKindBlobs || isDigestReference(route.Reference)) {
+		digest, err := digestCfg.normalizeDigest(route.Reference)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return nil, false
+		}
+		if digest != route.Reference {
+			out = r.Clone(r.Context())
+			out.URL.Path = "/v2/" + route.Repo + "/" + route.Kind + "/" + digest
+			out.URL.RawPath = ""
+		}
+	}
+
+	query := out.URL.Query()
+	changed := false
+	for _, key := range []string{"digest", "mount"} {
+		raw := query.Get(key)
+		if raw == "" {
+			continue
+		}
+		digest, err := digestCfg.normalizeDigest(raw)
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return nil, false
+		}
+		if digest != raw {
+			query.Set(key, digest)
+			changed = true
+		}
+	}
+	if changed {
+		if out == r {
+			out = r.Clone(r.Context())
+		}
+		out.URL.RawQuery = query.Encode()
+	}
+	return out, true
+}
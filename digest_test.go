@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDigest(t *testing.T) {
+	hex64 := strings.Repeat("ab", 32)
+	tests := []struct {
+		name   string
+		policy digestPolicy
+		raw    string
+		want   string
+		ok     bool
+	}{
+		{name: "valid sha256", raw: "sha256:" + hex64, want: "sha256:" + hex64, ok: true},
+		{name: "valid sha512", raw: "sha512:" + strings.Repeat("0", 128), want: "sha512:" + strings.Repeat("0", 128), ok: true},
+		{name: "uppercase normalized", raw: "sha256:" + strings.ToUpper(hex64), want: "sha256:" + hex64, ok: true},
+		{name: "uppercase rejected", policy: digestPolicy{RejectUppercase: true}, raw: "sha256:" + strings.ToUpper(hex64), ok: false},
+		{name: "wrong length", raw: "sha256:abcd", ok: false},
+		{name: "bad algorithm", raw: "md5:" + strings.Repeat("a", 32), ok: false},
+		{name: "non hex", raw: "sha256:" + strings.Repeat("z", 64), ok: false},
+		{name: "missing separator", raw: hex64, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.normalizeDigest(tt.raw)
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok=%v, got err=%v", tt.ok, err)
+			}
+			if tt.ok && got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStrictDigestsRejectMalformed(t *testing.T) {
+	withDigestPolicy(t, digestPolicy{Strict: true})
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	for _, path := range []string{
+		"/v2/team1/app/blobs/sha256:abcd",
+		"/v2/team1/app/manifests/sha256:abcd",
+		"/v2/team1/app/blobs/md5:" + strings.Repeat("a", 32),
+		"/v2/team1/app/blobs/uploads/uuid?digest=sha256:zz",
+	} {
+		method := http.MethodGet
+		if strings.Contains(path, "uploads") {
+			method = http.MethodPut
+		}
+		rec := serveProxyRequest(t, method, path)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %s, got %d", path, rec.Code)
+		}
+		var payload registryErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&payload); err != nil {
+			t.Fatalf("decode error body: %v", err)
+		}
+		if len(payload.Errors) != 1 || payload.Errors[0].Code != "DIGEST_INVALID" {
+			t.Fatalf("expected DIGEST_INVALID, got %#v", payload)
+		}
+	}
+	if *calls != 0 {
+		t.Fatalf("expected malformed digests not to reach upstream, got %d calls", *calls)
+	}
+}
+
+func TestStrictDigestsNormalizeUppercase(t *testing.T) {
+	withDigestPolicy(t, digestPolicy{Strict: true})
+	var gotPath, gotQuery string
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		gotPath = r.URL.Path
+		gotQuery = r.URL.Query().Get("digest")
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	hex64 := strings.Repeat("ab", 32)
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/sha256:"+strings.ToUpper(hex64))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if gotPath != "/v2/team1/app/blobs/sha256:"+hex64 {
+		t.Fatalf("expected normalized digest path, got %q", gotPath)
+	}
+
+	rec = serveProxyRequest(t, http.MethodPut, "/v2/team1/app/blobs/uploads/uuid?digest=sha256:"+strings.ToUpper(hex64))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if gotQuery != "sha256:"+hex64 {
+		t.Fatalf("expected normalized digest query, got %q", gotQuery)
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected tag reference to pass, got %d", rec.Code)
+	}
+}
+
+func TestStrictDigestsUppercaseRejectedByPolicy(t *testing.T) {
+	withDigestPolicy(t, digestPolicy{Strict: true, RejectUppercase: true})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/sha256:"+strings.Repeat("AB", 32))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestDigestPolicyDisabledPassesThrough(t *testing.T) {
+	withDigestPolicy(t, digestPolicy{})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/sha256:abcd")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected passthrough without STRICT_DIGESTS, got %d", rec.Code)
+	}
+}
+
+func withDigestPolicy(t *testing.T, policy digestPolicy) {
+	t.Helper()
+	prev := digestCfg
+	digestCfg = policy
+	t.Cleanup(func() {
+		digestCfg = prev
+	})
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+)
+
+const (
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+	route53API    = "https://route53.amazonaws.com"
+	route53Region = "us-east-1"
+	challengeTTL  = 2 * time.Minute
+	dnsAPITimeout = 30 * time.Second
+	route53XMLNS  = "https://route53.amazonaws.com/doc/2013-04-01/"
+)
+
+// newDNSProvider builds the DNS-01 provider selected by
+// CERTMAGIC_DNS_PROVIDER from that provider's credential variables.
+func newDNSProvider(name string) (certmagic.DNSProvider, error) {
+	client := &http.Client{Timeout: dnsAPITimeout}
+	switch name {
+	case "cloudflare":
+		token := strings.TrimSpace(os.Getenv("CLOUDFLARE_API_TOKEN"))
+		if token == "" {
+			return nil, fmt.Errorf("CLOUDFLARE_API_TOKEN must be set for the cloudflare DNS provider")
+		}
+		return &cloudflareDNS{token: token, baseURL: cloudflareAPI, client: client}, nil
+	case "route53":
+		creds, err := awsCredentialsFromEnv("route53 DNS provider")
+		if err != nil {
+			return nil, err
+		}
+		return &route53DNS{
+			creds:    creds,
+			zoneID:   strings.TrimSpace(os.Getenv("ROUTE53_HOSTED_ZONE_ID")),
+			endpoint: route53API,
+			client:   client,
+			now:      time.Now,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported CERTMAGIC_DNS_PROVIDER %q (want cloudflare or route53)", name)
+}
+
+// challengeRecord returns the fully qualified name of a TXT record certmagic
+// asks to add or remove in zone.
+func challengeRecord(zone string, rec libdns.Record) (string, libdns.TXT, error) {
+	parsed, err := rec.RR().Parse()
+	if err != nil {
+		return "", libdns.TXT{}, err
+	}
+	txt, ok := parsed.(libdns.TXT)
+	if !ok {
+		return "", libdns.TXT{}, fmt.Errorf("unsupported %s record for DNS-01", rec.RR().Type)
+	}
+	return libdns.AbsoluteName(txt.Name, zone), txt, nil
+}
+
+func challengeTTLSeconds(ttl time.Duration) int {
+	if ttl <= 0 {
+		ttl = challengeTTL
+	}
+	return int(ttl.Seconds())
+}
+
+// cloudflareDNS manages challenge records through the Cloudflare API with a
+// token that has Zone:Read and DNS:Edit on the zone.
+type cloudflareDNS struct {
+	token   string
+	baseURL string
+	client  *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl,omitempty"`
+}
+
+func (c *cloudflareDNS) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var added []libdns.Record
+	for _, rec := range recs {
+		name, txt, err := challengeRecord(zone, rec)
+		if err != nil {
+			return added, err
+		}
+		// Cloudflare's shortest TTL is 60s; 1 means automatic.
+		ttl := challengeTTLSeconds(txt.TTL)
+		if ttl < 60 {
+			ttl = 1
+		}
+		body := cloudflareRecord{Type: "TXT", Name: strings.TrimSuffix(name, "."), Content: txt.Text, TTL: ttl}
+		if err := c.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", body, nil); err != nil {
+			return added, err
+		}
+		added = append(added, txt)
+	}
+	return added, nil
+}
+
+func (c *cloudflareDNS) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	zoneID, err := c.zoneID(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var deleted []libdns.Record
+	for _, rec := range recs {
+		name, txt, err := challengeRecord(zone, rec)
+		if err != nil {
+			return deleted, err
+		}
+		query := url.Values{"type": {"TXT"}, "name": {strings.TrimSuffix(name, ".")}}
+		var existing []cloudflareRecord
+		if err := c.do(ctx, http.MethodGet, "/zones/"+zoneID+"/dns_records?"+query.Encode(), nil, &existing); err != nil {
+			return deleted, err
+		}
+		for _, record := range existing {
+			if strings.Trim(record.Content, `"`) != txt.Text {
+				continue
+			}
+			if err := c.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+record.ID, nil, nil); err != nil {
+				return deleted, err
+			}
+			deleted = append(deleted, txt)
+		}
+	}
+	return deleted, nil
+}
+
+func (c *cloudflareDNS) zoneID(ctx context.Context, zone string) (string, error) {
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	query := url.Values{"name": {strings.TrimSuffix(zone, ".")}}
+	if err := c.do(ctx, http.MethodGet, "/zones?"+query.Encode(), nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("cloudflare zone %s not found", zone)
+	}
+	return zones[0].ID, nil
+}
+
+func (c *cloudflareDNS) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare %s %s: %s: %w", method, path, resp.Status, err)
+	}
+	if !envelope.Success {
+		messages := make([]string, 0, len(envelope.Errors))
+		for _, e := range envelope.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare %s %s: %s: %s", method, path, resp.Status, strings.Join(messages, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+// route53DNS manages challenge records through the Route 53 API. The zone is
+// looked up by name unless ROUTE53_HOSTED_ZONE_ID is set. Route 53 keeps all
+// TXT values for a name in one record set, so values are merged into it and
+// removed from it rather than created and deleted on their own.
+type route53DNS struct {
+	creds    awsCredentials
+	zoneID   string
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+
+	// mu serialises read-modify-write of record sets, e.g. for a wildcard
+	// and its apex, which share _acme-challenge.<zone>.
+	mu sync.Mutex
+}
+
+type route53RecordSet struct {
+	Name            string   `xml:"Name"`
+	Type            string   `xml:"Type"`
+	TTL             int      `xml:"TTL"`
+	ResourceRecords []string `xml:"ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Change struct {
+	Action            string           `xml:"Action"`
+	ResourceRecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	XMLNS   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+func (r *route53DNS) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return r.update(ctx, zone, recs, func(values []string, value string) []string {
+		if slices.Contains(values, value) {
+			return values
+		}
+		return append(values, value)
+	})
+}
+
+func (r *route53DNS) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	return r.update(ctx, zone, recs, func(values []string, value string) []string {
+		return slices.DeleteFunc(slices.Clone(values), func(v string) bool { return v == value })
+	})
+}
+
+// update applies change to the TXT values of each record's name and writes
+// the record set back, deleting it once no values are left.
+func (r *route53DNS) update(ctx context.Context, zone string, recs []libdns.Record, change func([]string, string) []string) ([]libdns.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zoneID, err := r.hostedZone(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	var done []libdns.Record
+	for _, rec := range recs {
+		name, txt, err := challengeRecord(zone, rec)
+		if err != nil {
+			return done, err
+		}
+		current, err := r.recordSet(ctx, zoneID, name)
+		if err != nil {
+			return done, err
+		}
+		next := route53RecordSet{Name: name, Type: "TXT", TTL: challengeTTLSeconds(txt.TTL)}
+		if current != nil {
+			next.TTL = current.TTL
+			next.ResourceRecords = current.ResourceRecords
+		}
+		next.ResourceRecords = change(next.ResourceRecords, strconv.Quote(txt.Text))
+		action := "UPSERT"
+		switch {
+		case current != nil && slices.Equal(next.ResourceRecords, current.ResourceRecords):
+			done = append(done, txt)
+			continue
+		case len(next.ResourceRecords) == 0 && current == nil:
+			continue
+		case len(next.ResourceRecords) == 0:
+			action, next = "DELETE", *current
+		}
+		if err := r.change(ctx, zoneID, action, next); err != nil {
+			return done, err
+		}
+		done = append(done, txt)
+	}
+	return done, nil
+}
+
+func (r *route53DNS) hostedZone(ctx context.Context, zone string) (string, error) {
+	if r.zoneID != "" {
+		return r.zoneID, nil
+	}
+	var list struct {
+		HostedZones []struct {
+			ID   string `xml:"Id"`
+			Name string `xml:"Name"`
+		} `xml:"HostedZones>HostedZone"`
+	}
+	query := url.Values{"dnsname": {zone}, "maxitems": {"1"}}
+	if err := r.do(ctx, http.MethodGet, "/2013-04-01/hostedzonesbyname", query, nil, &list); err != nil {
+		return "", err
+	}
+	if len(list.HostedZones) == 0 || !strings.EqualFold(list.HostedZones[0].Name, zone) {
+		return "", fmt.Errorf("route53 hosted zone %s not found", zone)
+	}
+	return strings.TrimPrefix(list.HostedZones[0].ID, "/hostedzone/"), nil
+}
+
+// recordSet returns the TXT record set at name, or nil when there is none.
+func (r *route53DNS) recordSet(ctx context.Context, zoneID, name string) (*route53RecordSet, error) {
+	var list struct {
+		RecordSets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	query := url.Values{"name": {name}, "type": {"TXT"}, "maxitems": {"1"}}
+	if err := r.do(ctx, http.MethodGet, "/2013-04-01/hostedzone/"+zoneID+"/rrset", query, nil, &list); err != nil {
+		return nil, err
+	}
+	// The listing starts at name, so the first set may belong to a later name.
+	if len(list.RecordSets) == 0 || !strings.EqualFold(list.RecordSets[0].Name, name) || list.RecordSets[0].Type != "TXT" {
+		return nil, nil
+	}
+	return &list.RecordSets[0], nil
+}
+
+func (r *route53DNS) change(ctx context.Context, zoneID, action string, set route53RecordSet) error {
+	req := route53ChangeRequest{XMLNS: route53XMLNS, Changes: []route53Change{{Action: action, ResourceRecordSet: set}}}
+	return r.do(ctx, http.MethodPost, "/2013-04-01/hostedzone/"+zoneID+"/rrset", nil, req, nil)
+}
+
+func (r *route53DNS) do(ctx context.Context, method, path string, query url.Values, body, out any) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = xml.Marshal(body); err != nil {
+			return err
+		}
+	}
+	target := r.endpoint + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	signAWSv4(req, data, r.creds, route53Region, "route53", r.now())
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		_ = xml.NewDecoder(resp.Body).Decode(&failure)
+		return fmt.Errorf("route53 %s %s: %s: %s %s", method, path, resp.Status, failure.Code, failure.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromEnv reads the standard AWS_* credential variables for
+// user, which names the feature in the error when they are missing.
+func awsCredentialsFromEnv(user string) (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKeyID:     strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID")),
+		SecretAccessKey: strings.TrimSpace(os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		SessionToken:    strings.TrimSpace(os.Getenv("AWS_SESSION_TOKEN")),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for the %s", user)
+	}
+	return creds, nil
+}
+
+// signAWSv4 adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and x-amz-* headers and the body.
+func signAWSv4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payload := sha256.Sum256(body)
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
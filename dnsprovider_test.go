@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+func challengeRR(value string) libdns.Record {
+	return libdns.RR{Type: "TXT", Name: "_acme-challenge", Data: value}
+}
+
+// From the AWS Signature Version 4 test suite (get-vanilla).
+func TestSignAWSv4MatchesReferenceVector(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSv4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("unexpected Authorization:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestCloudflareDNSAddsAndRemovesChallenge(t *testing.T) {
+	records := map[string]cloudflareRecord{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"success":false,"errors":[{"code":10000,"message":"Authentication error"}]}`))
+			return
+		}
+		var result any
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			if r.URL.Query().Get("name") != "example.com" {
+				t.Errorf("unexpected zone lookup %q", r.URL.RawQuery)
+			}
+			result = []map[string]string{{"id": "zone1"}}
+		case r.Method == http.MethodPost && r.URL.Path == "/zones/zone1/dns_records":
+			var rec cloudflareRecord
+			_ = json.NewDecoder(r.Body).Decode(&rec)
+			rec.ID = fmt.Sprintf("rec%d", len(records)+1)
+			records[rec.ID] = rec
+			result = rec
+		case r.Method == http.MethodGet && r.URL.Path == "/zones/zone1/dns_records":
+			var list []cloudflareRecord
+			for _, rec := range records {
+				if rec.Name == r.URL.Query().Get("name") {
+					list = append(list, rec)
+				}
+			}
+			result = list
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/zones/zone1/dns_records/"):
+			delete(records, strings.TrimPrefix(r.URL.Path, "/zones/zone1/dns_records/"))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"success": true, "result": result})
+	}))
+	defer server.Close()
+	provider := &cloudflareDNS{token: "token", baseURL: server.URL, client: server.Client()}
+	ctx := context.Background()
+
+	if _, err := provider.AppendRecords(ctx, "example.com.", []libdns.Record{challengeRR("one"), challengeRR("two")}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if len(records) != 2 || records["rec1"].Name != "_acme-challenge.example.com" || records["rec1"].Content != "one" {
+		t.Fatalf("unexpected records after append: %#v", records)
+	}
+	deleted, err := provider.DeleteRecords(ctx, "example.com.", []libdns.Record{challengeRR("one")})
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("delete: %v (%d deleted)", err, len(deleted))
+	}
+	if len(records) != 1 || records["rec2"].Content != "two" {
+		t.Fatalf("expected only the other value to remain, got %#v", records)
+	}
+
+	provider.token = "wrong"
+	if _, err := provider.AppendRecords(ctx, "example.com.", []libdns.Record{challengeRR("three")}); err == nil || !strings.Contains(err.Error(), "Authentication error") {
+		t.Fatalf("expected the API error to be reported, got %v", err)
+	}
+}
+
+func TestRoute53DNSMergesChallengeValues(t *testing.T) {
+	var sets []route53RecordSet
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("request not signed: %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzonesbyname":
+			_, _ = w.Write([]byte(`<ListHostedZonesByNameResponse><HostedZones><HostedZone><Id>/hostedzone/Z1</Id><Name>example.com.</Name></HostedZone></HostedZones></ListHostedZonesByNameResponse>`))
+		case r.Method == http.MethodGet && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset":
+			_ = xml.NewEncoder(w).Encode(struct {
+				XMLName xml.Name           `xml:"ListResourceRecordSetsResponse"`
+				Sets    []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+			}{Sets: sets})
+		case r.Method == http.MethodPost && r.URL.Path == "/2013-04-01/hostedzone/Z1/rrset":
+			var change route53ChangeRequest
+			_ = xml.NewDecoder(r.Body).Decode(&change)
+			c := change.Changes[0]
+			actions = append(actions, c.Action)
+			sets = nil
+			if c.Action == "UPSERT" {
+				sets = []route53RecordSet{c.ResourceRecordSet}
+			}
+			_, _ = w.Write([]byte(`<ChangeResourceRecordSetsResponse/>`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+	provider := &route53DNS{creds: awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, endpoint: server.URL, client: server.Client(), now: time.Now}
+	ctx := context.Background()
+
+	for _, value := range []string{"one", "two"} {
+		if _, err := provider.AppendRecords(ctx, "example.com.", []libdns.Record{challengeRR(value)}); err != nil {
+			t.Fatalf("append %s: %v", value, err)
+		}
+	}
+	if len(sets) != 1 || sets[0].Name != "_acme-challenge.example.com." || strings.Join(sets[0].ResourceRecords, ",") != `"one","two"` {
+		t.Fatalf("expected both values in one record set, got %#v", sets)
+	}
+	for _, value := range []string{"one", "two"} {
+		if _, err := provider.DeleteRecords(ctx, "example.com.", []libdns.Record{challengeRR(value)}); err != nil {
+			t.Fatalf("delete %s: %v", value, err)
+		}
+	}
+	if len(sets) != 0 {
+		t.Fatalf("expected the record set to be removed, got %#v", sets)
+	}
+	if strings.Join(actions, ",") != "UPSERT,UPSERT,UPSERT,DELETE" {
+		t.Fatalf("unexpected change actions: %v", actions)
+	}
+}
+
+func TestNewDNSProviderRequiresCredentials(t *testing.T) {
+	t.Setenv("CLOUDFLARE_API_TOKEN", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	for _, name := range []string{"cloudflare", "route53", "gandi"} {
+		if _, err := newDNSProvider(name); err == nil {
+			t.Fatalf("expected error for %s without credentials", name)
+		}
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("ROUTE53_HOSTED_ZONE_ID", "Z1")
+	provider, err := newDNSProvider("route53")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r53, ok := provider.(*route53DNS); !ok || r53.zoneID != "Z1" {
+		t.Fatalf("unexpected provider %#v", provider)
+	}
+}
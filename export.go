@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ociLayoutFile   = "oci-layout"
+	ociIndexFile    = "index.json"
+	dockerManifest  = "manifest.json"
+	ociLayoutBody   = `{"imageLayoutVersion":"1.0.0"}`
+	ociIndexMedia   = "application/vnd.oci.image.index.v1+json"
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+// blobClient has no overall timeout so large layers can stream; requests are
+// bounded by the caller's context instead.
+var blobClient = &http.Client{}
+
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type dockerSaveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// handleRepoAction dispatches /api/repos/<name>/... routes, where <name> may
+// contain slashes, which huma's path parameters cannot match. Errors use the
+// same problem+json envelope as the huma routes. Imports push through serve.
+func handleRepoAction(w http.ResponseWriter, r *http.Request, serve registryHandler) {
+	sess, ok := getSession(r)
+	if !ok || sess.User == nil {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/api/repos/")
+	w, r = applyArchiveIdleDeadline(w, r)
+
+	if r.Method == http.MethodGet && strings.HasSuffix(rest, "/export") {
+		idx := strings.LastIndex(rest, "/tags/")
+		if idx <= 0 {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		repo := rest[:idx]
+		tag := strings.TrimSuffix(rest[idx+len("/tags/"):], "/export")
+		handleImageExport(w, r, sess, repo, tag)
+		return
+	}
+	if r.Method == http.MethodPost && strings.HasSuffix(rest, "/import") {
+		handleImageImport(w, r, sess, serve, strings.TrimSuffix(rest, "/import"))
+		return
+	}
+
+	writeAPIError(w, http.StatusNotFound, "not found")
+}
+
+func handleImageExport(w http.ResponseWriter, r *http.Request, sess sessionData, repo, tag string) {
+	repo, tag, namespace, err := repoTagNamespace(repo, tag)
+	if err != nil || strings.Contains(tag, "/") {
+		writeAPIError(w, http.StatusBadRequest, "invalid repo or tag")
+		return
+	}
+	if !sessionNamespaceAllowed(sess, namespace) {
+		writeAPIError(w, http.StatusForbidden, "namespace not allowed")
+		return
+	}
+
+	image, err := resolveExportImage(r.Context(), repo, tag)
+	if err != nil {
+		log.Printf("export %s:%s failed: %v", repo, tag, err)
+		writeAPIError(w, http.StatusBadGateway, "registry unavailable")
+		return
+	}
+	if status, message := exportRefusal(r.Context(), repo, tag, image); status != 0 {
+		writeAPIError(w, status, message)
+		return
+	}
+	if image, err = sanitizeExportImage(r.Context(), repo, image); err != nil {
+		log.Printf("export %s:%s failed: %v", repo, tag, err)
+		writeAPIError(w, http.StatusBadGateway, "registry unavailable")
+		return
+	}
+
+	filename := strings.ReplaceAll(repo, "/", "_") + "_" + tag + ".tar"
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	setNoCacheHeaders(w)
+
+	if err := writeImageTar(r.Context(), w, repo, tag, image); err != nil {
+		// Headers are already sent; abort the stream so the client sees a truncated archive.
+		log.Printf("export %s:%s aborted: %v", repo, tag, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type exportImage struct {
+	// TagDigest, TagBody and TagContentType describe the manifest the tag
+	// points at: the exported manifest, or the index it was selected from.
+	TagDigest      string
+	TagBody        []byte
+	TagContentType string
+	ManifestBody   []byte
+	ManifestDigest string
+	MediaType      string
+	Manifest       manifestSchema2
+}
+
+func resolveExportImage(ctx context.Context, repo, tag string) (exportImage, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	body, contentType, tagDigest, err := fetchManifestPayload(ctx, client, repo, tag)
+	if err != nil {
+		return exportImage{}, err
+	}
+	if tagDigest == "" {
+		sum := sha256.Sum256(body)
+		tagDigest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	manifestBody, _, err := resolveManifestBody(ctx, client, repo, body, contentType)
+	if err != nil {
+		return exportImage{}, err
+	}
+	var manifest manifestSchema2
+	if err := json.Unmarshal(manifestBody, &manifest); err != nil {
+		return exportImage{}, err
+	}
+	if manifest.Config.Digest == "" {
+		return exportImage{}, fmt.Errorf("manifest has no config")
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" && !isManifestListContentType(contentType) {
+		mediaType = contentType
+	}
+	if mediaType == "" {
+		mediaType = ociManifestType
+	}
+	sum := sha256.Sum256(manifestBody)
+	return exportImage{
+		TagDigest:      tagDigest,
+		TagBody:        body,
+		TagContentType: contentType,
+		ManifestBody:   manifestBody,
+		ManifestDigest: "sha256:" + hex.EncodeToString(sum[:]),
+		MediaType:      mediaType,
+		Manifest:       manifest,
+	}, nil
+}
+
+// exportRefusal applies the pull policies of the /v2 path to an image about
+// to be exported. It returns the status and message to refuse the export
+// with, or zero when the image may be exported.
+func exportRefusal(ctx context.Context, repo, tag string, image exportImage) (int, string) {
+	digests := []string{image.TagDigest, image.ManifestDigest, image.Manifest.Config.Digest}
+	for _, layer := range image.Manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	for _, digest := range digests {
+		if blockedDigests.blocked(digest) {
+			return http.StatusUnavailableForLegalReasons, blockedDigestMessage
+		}
+	}
+	if quarantine.enabled {
+		for _, digest := range []string{image.TagDigest, image.ManifestDigest} {
+			if quarantine.quarantined(digest) {
+				return http.StatusForbidden, fmt.Sprintf("%s is quarantined pending a security scan", digest)
+			}
+		}
+	}
+	if signedPullRequired(repo) && !signatureArtifactTag.MatchString(tag) {
+		// The tag's own manifest carries the signature, as in a pull by tag.
+		return manifestSignatureRefusal(ctx, repo, image.TagDigest, image.TagContentType, image.TagBody)
+	}
+	return 0, ""
+}
+
+// writeImageTar writes an OCI image layout that also carries a docker-save
+// manifest.json, so both `docker load` and OCI tooling can import it.
+func writeImageTar(ctx context.Context, w io.Writer, repo, tag string, image exportImage) error {
+	tw := tar.NewWriter(w)
+
+	if err := writeTarFile(tw, ociLayoutFile, []byte(ociLayoutBody)); err != nil {
+		return err
+	}
+
+	blobs := append([]ociDescriptor{{
+		MediaType: image.Manifest.Config.MediaType,
+		Digest:    image.Manifest.Config.Digest,
+		Size:      image.Manifest.Config.Size,
+	}}, layerDescriptors(image.Manifest)...)
+
+	written := map[string]bool{}
+	for _, blob := range blobs {
+		if written[blob.Digest] {
+			continue
+		}
+		if err := copyBlobToTar(ctx, tw, repo, blob); err != nil {
+			return err
+		}
+		written[blob.Digest] = true
+	}
+
+	manifestPath, err := blobTarPath(image.ManifestDigest)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, manifestPath, image.ManifestBody); err != nil {
+		return err
+	}
+
+	index, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		MediaType:     ociIndexMedia,
+		Manifests: []ociDescriptor{{
+			MediaType: image.MediaType,
+			Digest:    image.ManifestDigest,
+			Size:      int64(len(image.ManifestBody)),
+			Annotations: map[string]string{
+				"io.containerd.image.name":          repo + ":" + tag,
+				"org.opencontainers.image.ref.name": tag,
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, ociIndexFile, index); err != nil {
+		return err
+	}
+
+	configPath, err := blobTarPath(image.Manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	save := dockerSaveManifest{Config: configPath, RepoTags: []string{repo + ":" + tag}}
+	for _, layer := range image.Manifest.Layers {
+		layerPath, err := blobTarPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+		save.Layers = append(save.Layers, layerPath)
+	}
+	saveJSON, err := json.Marshal([]dockerSaveManifest{save})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, dockerManifest, saveJSON); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func layerDescriptors(manifest manifestSchema2) []ociDescriptor {
+	layers := make([]ociDescriptor, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		layers = append(layers, ociDescriptor{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+	}
+	return layers
+}
+
+// blobTarPath maps sha256:<hex> to blobs/sha256/<hex>.
+func blobTarPath(digest string) (string, error) {
+	normalized, err := (digestPolicy{RejectUppercase: true}).normalizeDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	alg, encoded, _ := strings.Cut(normalized, ":")
+	return "blobs/" + alg + "/" + encoded, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// copyBlobToTar streams a blob from the registry into the archive, verifying
+// its size and sha256 digest on the way. Sanitized configs are written from
+// sanitizedContent.
+func copyBlobToTar(ctx context.Context, tw *tar.Writer, repo string, blob ociDescriptor) error {
+	name, err := blobTarPath(blob.Digest)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(blob.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest algorithm for %s", blob.Digest)
+	}
+	if sanitized, ok := sanitizedContent.get(repo, blob.Digest); ok {
+		return writeTarFile(tw, name, sanitized.Body)
+	}
+
+	blobURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/blobs/" + blob.Digest})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := blobClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("blob %s status: %s", blob.Digest, resp.Status)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    blob.Size,
+		ModTime: time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), io.LimitReader(resp.Body, blob.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != blob.Size {
+		return fmt.Errorf("blob %s size mismatch: expected %d, got %d", blob.Digest, blob.Size, n)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != blob.Digest {
+		return fmt.Errorf("blob %s digest mismatch: got %s", blob.Digest, got)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// testRegistryImage is a single-platform image served by fakeRegistry.
+type testRegistryImage struct {
+	Manifest       []byte
+	ManifestDigest string
+	ConfigDigest   string
+	LayerDigests   []string
+	Blobs          map[string][]byte
+}
+
+func newTestRegistryImage(t *testing.T, layers ...string) testRegistryImage {
+	t.Helper()
+	image := testRegistryImage{Blobs: map[string][]byte{}}
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/sh"]}}`)
+	image.ConfigDigest = testDigest(config)
+	image.Blobs[image.ConfigDigest] = config
+
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int    `json:"size"`
+	}
+	manifest := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: image.ConfigDigest, Size: len(config)},
+	}
+	for _, layer := range layers {
+		digest := testDigest([]byte(layer))
+		image.Blobs[digest] = []byte(layer)
+		image.LayerDigests = append(image.LayerDigests, digest)
+		manifest.Layers = append(manifest.Layers, descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: digest, Size: len(layer)})
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	image.Manifest = body
+	image.ManifestDigest = testDigest(body)
+	return image
+}
+
+// handler serves the image under repo, with the manifest reachable by tag and digest.
+func (img testRegistryImage) handler(repo, tag string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/v2/" + repo + "/"
+		switch {
+		case r.URL.Path == prefix+"manifests/"+tag || r.URL.Path == prefix+"manifests/"+img.ManifestDigest:
+			w.Header().Set("Content-Type", ociManifestType)
+			w.Header().Set("Docker-Content-Digest", img.ManifestDigest)
+			_, _ = w.Write(img.Manifest)
+		case strings.HasPrefix(r.URL.Path, prefix+"blobs/"):
+			blob, ok := img.Blobs[strings.TrimPrefix(r.URL.Path, prefix+"blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func testDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func readTarEntries(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	entries := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read tar entry %s: %v", hdr.Name, err)
+		}
+		entries[hdr.Name] = body
+	}
+}
+
+func TestImageExportContainsManifestAndLayers(t *testing.T) {
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	cleanup := withUpstream(t, image.handler("team1/app", "v1"))
+	defer cleanup()
+
+	router := cvRouter()
+	token := seedSession(t, "alice", []string{"team1"})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/repos/team1/app/tags/v1/export", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-tar" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	entries := readTarEntries(t, rec.Body.Bytes())
+	for _, name := range []string{ociLayoutFile, ociIndexFile, dockerManifest} {
+		if _, ok := entries[name]; !ok {
+			t.Fatalf("expected %s in archive, got %v", name, tarNames(entries))
+		}
+	}
+	for digest, content := range image.Blobs {
+		path, _ := blobTarPath(digest)
+		if !bytes.Equal(entries[path], content) {
+			t.Fatalf("expected blob %s in archive", digest)
+		}
+	}
+	manifestPath, _ := blobTarPath(image.ManifestDigest)
+	if !bytes.Equal(entries[manifestPath], image.Manifest) {
+		t.Fatalf("expected manifest blob in archive")
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(entries[ociIndexFile], &index); err != nil {
+		t.Fatalf("decode index: %v", err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Digest != image.ManifestDigest {
+		t.Fatalf("unexpected index: %#v", index)
+	}
+
+	var save []dockerSaveManifest
+	if err := json.Unmarshal(entries[dockerManifest], &save); err != nil {
+		t.Fatalf("decode manifest.json: %v", err)
+	}
+	if len(save) != 1 || len(save[0].Layers) != 2 || save[0].RepoTags[0] != "team1/app:v1" {
+		t.Fatalf("unexpected manifest.json: %#v", save)
+	}
+	for _, layer := range save[0].Layers {
+		if _, ok := entries[layer]; !ok {
+			t.Fatalf("manifest.json references missing layer %s", layer)
+		}
+	}
+}
+
+func TestImageExportNamespaceNotAllowed(t *testing.T) {
+	router := cvRouter()
+	token := seedSession(t, "alice", []string{"team1"})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/repos/team2/app/tags/v1/export", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	var problem huma.ErrorModel
+	if rec.Header().Get("Content-Type") != "application/problem+json" || json.Unmarshal(rec.Body.Bytes(), &problem) != nil || problem.Detail != "namespace not allowed" {
+		t.Fatalf("expected the huma error envelope, got %q: %s", rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+}
+
+func TestImageExportOutlastsServerWriteTimeout(t *testing.T) {
+	prev := blobIdleTimeout
+	blobIdleTimeout = 250 * time.Millisecond
+	t.Cleanup(func() { blobIdleTimeout = prev })
+
+	layer := strings.Repeat("x", 10)
+	image := newTestRegistryImage(t, layer)
+	serveImage := image.handler("team1/app", "v1")
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/blobs/"+image.LayerDigests[0]) {
+			serveImage(w, r)
+			return
+		}
+		// 10 bytes 40ms apart outlast the 100ms write timeout but never idle.
+		for i := range len(layer) {
+			_, _ = w.Write([]byte{layer[i]})
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	})
+	defer cleanup()
+
+	server := httptest.NewUnstartedServer(cvRouter())
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/repos/team1/app/tags/v1/export", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: seedSession(t, "alice", []string{"team1"})})
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("expected the export to finish, got %v", err)
+	}
+	name, err := blobTarPath(image.LayerDigests[0])
+	if err != nil {
+		t.Fatalf("blob path: %v", err)
+	}
+	if got := string(readTarEntries(t, body)[name]); got != layer {
+		t.Fatalf("expected the whole layer, got %q", got)
+	}
+}
+
+func TestImageExportRequiresSession(t *testing.T) {
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/repos/team1/app/tags/v1/export", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestImageExportRejectsCorruptBlob(t *testing.T) {
+	image := newTestRegistryImage(t, "layer-one")
+	image.Blobs[image.LayerDigests[0]] = []byte("layer-two")
+	cleanup := withUpstream(t, image.handler("team1/app", "v1"))
+	defer cleanup()
+
+	exported, err := resolveExportImage(context.Background(), "team1/app", "v1")
+	if err != nil {
+		t.Fatalf("resolveExportImage: %v", err)
+	}
+	if err := writeImageTar(context.Background(), io.Discard, "team1/app", "v1", exported); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("expected digest mismatch, got %v", err)
+	}
+}
+
+func serveExportRequest(t *testing.T, token, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func tarNames(entries map[string][]byte) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type gcConfig struct {
+	OnOverwrite bool
+	// Delay is the grace period before an orphaned manifest is deleted, so
+	// pulls that already resolved the old digest can finish.
+	Delay time.Duration
+}
+
+func loadGCConfig() gcConfig {
+	return gcConfig{
+		OnOverwrite: getEnvBool("GC_ON_OVERWRITE", false),
+		Delay:       getEnvDuration("GC_OVERWRITE_DELAY", 5*time.Minute),
+	}
+}
+
+type gcCandidate struct {
+	Repo   string
+	Digest string
+}
+
+// overwriteGC deletes manifests left untagged when a tag is moved to a new
+// digest. Deleting the manifest makes its blobs eligible for the registry's
+// own garbage collection.
+type overwriteGC struct {
+	cfg gcConfig
+	now func() time.Time
+
+	mu      sync.Mutex
+	pending map[gcCandidate]time.Time
+}
+
+type overwrittenTagContextKey struct{}
+
+// overwrittenTag records the digest a tag pointed at before a manifest push.
+type overwrittenTag struct {
+	Repo   string
+	Tag    string
+	Digest string
+}
+
+func newOverwriteGC(cfg gcConfig) *overwriteGC {
+	return &overwriteGC{cfg: cfg, now: time.Now, pending: map[gcCandidate]time.Time{}}
+}
+
+func (g *overwriteGC) enabled() bool {
+	return g.cfg.OnOverwrite
+}
+
+// run processes due candidates once per minute until ctx is cancelled.
+func (g *overwriteGC) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.process(ctx)
+		}
+	}
+}
+
+func (g *overwriteGC) schedule(candidate gcCandidate) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.pending[candidate]; !ok {
+		g.pending[candidate] = g.now().Add(g.cfg.Delay)
+	}
+}
+
+func (g *overwriteGC) pendingCandidates() []gcCandidate {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	candidates := make([]gcCandidate, 0, len(g.pending))
+	for candidate := range g.pending {
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Repo != candidates[j].Repo {
+			return candidates[i].Repo < candidates[j].Repo
+		}
+		return candidates[i].Digest < candidates[j].Digest
+	})
+	return candidates
+}
+
+// process deletes every due candidate that no tag still reaches. Candidates that
+// were re-tagged in the meantime are dropped; lookup failures are retried on
+// the next run.
+func (g *overwriteGC) process(ctx context.Context) {
+	now := g.now()
+	for _, candidate := range g.pendingCandidates() {
+		g.mu.Lock()
+		due := !g.pending[candidate].After(now)
+		g.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		referenced, err := digestTagged(ctx, candidate.Repo, candidate.Digest)
+		if err != nil {
+			log.Printf("gc: unable to check references for %s@%s: %v", candidate.Repo, candidate.Digest, err)
+			continue
+		}
+		if !referenced {
+			status, message, err := deleteManifest(ctx, candidate.Repo, candidate.Digest)
+			if err != nil {
+				log.Printf("gc: delete %s@%s failed: %v", candidate.Repo, candidate.Digest, err)
+				continue
+			}
+			switch status {
+			case 0:
+				manifestConversions.invalidate(candidate.Digest)
+				imageSizes.invalidate(candidate.Digest)
+				log.Printf("gc: deleted orphaned manifest %s@%s", candidate.Repo, candidate.Digest)
+			case http.StatusNotFound:
+			default:
+				log.Printf("gc: delete %s@%s refused: %d %s", candidate.Repo, candidate.Digest, status, message)
+			}
+		}
+
+		g.mu.Lock()
+		delete(g.pending, candidate)
+		g.mu.Unlock()
+	}
+}
+
+// digestTagged reports whether digest is still reachable from a tag in repo:
+// tagged itself, listed by a tagged index, or the subject of a tagged
+// manifest such as a signature.
+func digestTagged(ctx context.Context, repo, digest string) (bool, error) {
+	tags, err := fetchTags(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tagDigest, status, _, err := fetchTagDigest(ctx, repo, tag)
+		if err != nil {
+			return false, err
+		}
+		if status != 0 {
+			continue
+		}
+		reached, err := manifestReaches(ctx, client, repo, tagDigest, digest, seen)
+		if err != nil || reached {
+			return reached, err
+		}
+	}
+	return false, nil
+}
+
+// manifestReaches reports whether the manifest from is digest, lists it in
+// manifests[], directly or through a nested index, or names it as subject.
+// seen holds manifests already walked.
+func manifestReaches(ctx context.Context, client *http.Client, repo, from, digest string, seen map[string]bool) (bool, error) {
+	if from == digest {
+		return true, nil
+	}
+	if seen[from] {
+		return false, nil
+	}
+	seen[from] = true
+	body, _, _, err := fetchManifestPayload(ctx, client, repo, from)
+	if err != nil {
+		return false, err
+	}
+	var manifest struct {
+		Manifests []manifestDescriptor `json:"manifests"`
+		Subject   *manifestDescriptor  `json:"subject"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return false, nil
+	}
+	if manifest.Subject != nil && manifest.Subject.Digest == digest {
+		return true, nil
+	}
+	for _, child := range manifest.Manifests {
+		reached, err := manifestReaches(ctx, client, repo, child.Digest, digest, seen)
+		if err != nil || reached {
+			return reached, err
+		}
+	}
+	return false, nil
+}
+
+// recordOverwrittenTag remembers the current digest of a tag about to be
+// pushed so the response handler can schedule it once the push succeeds.
+func recordOverwrittenTag(r *http.Request) *http.Request {
+	if !overwriteCollector.enabled() || r.Method != http.MethodPut {
+		return r
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests || isDigestReference(route.Reference) {
+		return r
+	}
+	digest, status, _, err := fetchTagDigest(r.Context(), route.Repo, route.Reference)
+	if err != nil {
+		log.Printf("gc: unable to resolve %s:%s before overwrite: %v", route.Repo, route.Reference, err)
+		return r
+	}
+	if status != 0 || digest == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), overwrittenTagContextKey{}, overwrittenTag{
+		Repo:   route.Repo,
+		Tag:    route.Reference,
+		Digest: digest,
+	}))
+}
+
+// scheduleOverwriteGC schedules the previous digest of a successfully moved tag.
+func scheduleOverwriteGC(resp *http.Response) error {
+	if resp.Request == nil || resp.StatusCode != http.StatusCreated {
+		return nil
+	}
+	previous, ok := resp.Request.Context().Value(overwrittenTagContextKey{}).(overwrittenTag)
+	if !ok || previous.Digest == resp.Header.Get("Docker-Content-Digest") {
+		return nil
+	}
+	overwriteCollector.schedule(gcCandidate{Repo: previous.Repo, Digest: previous.Digest})
+	return nil
+}
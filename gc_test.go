@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOverwriteGCDeletesOrphanedManifest(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{OnOverwrite: true})
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	next := newTestRegistryImage(t, "layer-two")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	pending := collector.pendingCandidates()
+	if len(pending) != 1 || pending[0] != (gcCandidate{Repo: "team1/app", Digest: previous.ManifestDigest}) {
+		t.Fatalf("expected previous manifest to be scheduled, got %+v", pending)
+	}
+
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; ok {
+		t.Fatalf("expected orphaned manifest to be deleted")
+	}
+	if _, ok := registry.manifests["team1/app:v1"]; !ok {
+		t.Fatalf("expected the moved tag to remain")
+	}
+	if len(collector.pendingCandidates()) != 0 {
+		t.Fatalf("expected queue to be drained")
+	}
+}
+
+func TestOverwriteGCKeepsStillTaggedManifest(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{OnOverwrite: true})
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	registry.seed("team1/app", "stable", previous)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	next := newTestRegistryImage(t, "layer-two")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; !ok {
+		t.Fatalf("expected manifest still tagged as stable to be kept")
+	}
+}
+
+func TestOverwriteGCKeepsManifestListedByNewIndex(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{OnOverwrite: true})
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	index, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexMedia,
+		"manifests": []any{map[string]any{
+			"mediaType": ociManifestType,
+			"digest":    previous.ManifestDigest,
+			"size":      len(previous.Manifest),
+			"platform":  map[string]any{"os": "linux", "architecture": "amd64"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("marshal index: %v", err)
+	}
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(index))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(collector.pendingCandidates()) != 1 {
+		t.Fatalf("expected the previous manifest to be scheduled")
+	}
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; !ok {
+		t.Fatalf("expected the manifest listed by the tagged index to be kept")
+	}
+}
+
+func TestOverwriteGCKeepsSubjectOfTaggedManifest(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{OnOverwrite: true})
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	signature, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        map[string]any{"mediaType": "application/vnd.oci.empty.v1+json", "digest": previous.ConfigDigest, "size": len(previous.Blobs[previous.ConfigDigest])},
+		"layers":        []any{},
+		"subject":       map[string]any{"mediaType": ociManifestType, "digest": previous.ManifestDigest, "size": len(previous.Manifest)},
+	})
+	if err != nil {
+		t.Fatalf("marshal signature: %v", err)
+	}
+	registry.manifests["team1/app:sig"] = signature
+	registry.manifests["team1/app:"+testDigest(signature)] = signature
+
+	collector.schedule(gcCandidate{Repo: "team1/app", Digest: previous.ManifestDigest})
+	delete(registry.manifests, "team1/app:v1")
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; !ok {
+		t.Fatalf("expected the subject of a tagged manifest to be kept")
+	}
+}
+
+func TestOverwriteGCWaitsForDelay(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{OnOverwrite: true, Delay: time.Hour})
+	now := time.Unix(1000, 0)
+	collector.now = func() time.Time { return now }
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	collector.schedule(gcCandidate{Repo: "team1/app", Digest: previous.ManifestDigest})
+	delete(registry.manifests, "team1/app:v1")
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; !ok {
+		t.Fatalf("expected manifest to be kept during the grace period")
+	}
+
+	now = now.Add(time.Hour)
+	collector.process(context.Background())
+	if _, ok := registry.manifests["team1/app:"+previous.ManifestDigest]; ok {
+		t.Fatalf("expected manifest to be deleted after the grace period")
+	}
+}
+
+func TestOverwriteGCDisabledSchedulesNothing(t *testing.T) {
+	collector := withOverwriteGC(t, gcConfig{})
+	registry := newFakeRegistry()
+	registry.seed("team1/app", "v1", newTestRegistryImage(t, "layer-one"))
+	withProxyUpstream(t, registry.roundTrip)
+
+	next := newTestRegistryImage(t, "layer-two")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if len(collector.pendingCandidates()) != 0 {
+		t.Fatalf("expected nothing scheduled when disabled")
+	}
+}
+
+func withOverwriteGC(t *testing.T, cfg gcConfig) *overwriteGC {
+	t.Helper()
+	prev := overwriteCollector
+	overwriteCollector = newOverwriteGC(cfg)
+	t.Cleanup(func() {
+		overwriteCollector = prev
+	})
+	return overwriteCollector
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// groupSuffix is a group name ending that grants rights on the namespace
+// named by the rest of the group.
+type groupSuffix struct {
+	Suffix        string
+	PullOnly      bool
+	DeleteAllowed bool
+}
+
+// defaultGroupSuffixes is the team1_rwd / team1_rw / team1_rd / team1_r
+// convention used unless GROUP_PERMISSION_SUFFIXES overrides it.
+var defaultGroupSuffixes = []groupSuffix{
+	{Suffix: "_rwd", PullOnly: false, DeleteAllowed: true},
+	{Suffix: "_rw", PullOnly: false, DeleteAllowed: false},
+	{Suffix: "_rd", PullOnly: true, DeleteAllowed: true},
+	{Suffix: "_r", PullOnly: true, DeleteAllowed: false},
+}
+
+// permissionRights reads one of the permissions r, rw, rd or rwd.
+func permissionRights(perm string) (pullOnly, deleteAllowed, ok bool) {
+	switch perm {
+	case "r":
+		return true, false, true
+	case "rw":
+		return false, false, true
+	case "rd":
+		return true, true, true
+	case "rwd":
+		return false, true, true
+	}
+	return false, false, false
+}
+
+// loadGroupSuffixes parses GROUP_PERMISSION_SUFFIXES such as
+// "-admins=rwd,-writers=rw,-readers=r". Suffixes are tried longest first so
+// "-admin-readers" is not taken for "-readers".
+func loadGroupSuffixes() []groupSuffix {
+	raw := splitCommaList(os.Getenv("GROUP_PERMISSION_SUFFIXES"))
+	if len(raw) == 0 {
+		return defaultGroupSuffixes
+	}
+	var suffixes []groupSuffix
+	for _, entry := range raw {
+		suffix, perm, _ := strings.Cut(entry, "=")
+		suffix = strings.ToLower(strings.TrimSpace(suffix))
+		pullOnly, deleteAllowed, ok := permissionRights(strings.TrimSpace(perm))
+		if suffix == "" || !ok {
+			log.Printf("ignoring GROUP_PERMISSION_SUFFIXES entry %q: expected suffix=r, rw, rd or rwd", entry)
+			continue
+		}
+		suffixes = append(suffixes, groupSuffix{Suffix: suffix, PullOnly: pullOnly, DeleteAllowed: deleteAllowed})
+	}
+	if len(suffixes) == 0 {
+		log.Printf("GROUP_PERMISSION_SUFFIXES has no valid entry, using the _rwd/_rw/_rd/_r defaults")
+		return defaultGroupSuffixes
+	}
+	sort.SliceStable(suffixes, func(i, j int) bool {
+		return len(suffixes[i].Suffix) > len(suffixes[j].Suffix)
+	})
+	return suffixes
+}
+
+// groupForPermission names the group granting perm on namespace under the
+// configured suffixes, for access defined outside the directory.
+func groupForPermission(namespace, perm string) (string, bool) {
+	pullOnly, deleteAllowed, ok := permissionRights(perm)
+	if !ok {
+		return "", false
+	}
+	for _, s := range groupSuffixes {
+		if s.PullOnly == pullOnly && s.DeleteAllowed == deleteAllowed {
+			return namespace + s.Suffix, true
+		}
+	}
+	return "", false
+}
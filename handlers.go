@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"log"
@@ -38,6 +39,20 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user, access, err := ldapAuthenticateAccess(username, password)
+	if errors.Is(err, errLDAPBusy) {
+		serveLogin(w, "Directory busy, please try again.")
+		return
+	}
+	if errors.Is(err, errLDAPUnavailable) || errors.Is(err, errLDAPUnreachable) {
+		log.Printf("ldap unavailable for %s: %v", username, err)
+		serveLogin(w, "Directory unavailable, please try again later.")
+		return
+	}
+	if errors.Is(err, errLDAPSearchFailed) {
+		log.Printf("ldap group lookup failed for %s: %v", username, err)
+		serveLogin(w, "Directory unavailable, please try again later.")
+		return
+	}
 	if err != nil {
 		log.Printf("ldap auth failed for %s: %v", username, err)
 		serveLogin(w, "Invalid credentials.")
@@ -49,6 +64,7 @@ func handleLoginPost(w http.ResponseWriter, r *http.Request) {
 		serveLogin(w, "Login failed.")
 		return
 	}
+	auditEvent("login", user.Name, "")
 	http.Redirect(w, r, "/api/dashboard", http.StatusSeeOther)
 }
 
@@ -89,18 +105,8 @@ type namespacePermission struct {
 }
 
 func hasPermissionSuffix(group string) bool {
-	switch {
-	case strings.HasSuffix(group, "_rwd"):
-		return true
-	case strings.HasSuffix(group, "_rw"):
-		return true
-	case strings.HasSuffix(group, "_rd"):
-		return true
-	case strings.HasSuffix(group, "_r"):
-		return true
-	default:
-		return false
-	}
+	_, _, _, ok := permissionsFromGroup(group)
+	return ok
 }
 
 func buildNamespacePermissions(namespaces []string, access []Access) []namespacePermission {
@@ -213,9 +219,24 @@ func namespaceAllowed(allowed []string, namespace string) bool {
 	return false
 }
 
+// sessionNamespaceAllowed reports whether the session may use namespace,
+// through one of its groups or the admin grant on every namespace.
+func sessionNamespaceAllowed(sess sessionData, namespace string) bool {
+	return namespaceAllowed(sess.Namespaces, namespace) || allNamespacesAllowed(sess.Access)
+}
+
+func allNamespacesAllowed(access []Access) bool {
+	for _, entry := range access {
+		if entry.AllNamespaces {
+			return true
+		}
+	}
+	return false
+}
+
 func namespaceDeleteAllowed(access []Access, namespace string) bool {
 	for _, entry := range access {
-		if entry.Namespace == namespace && entry.DeleteAllowed {
+		if (entry.AllNamespaces || entry.Namespace == namespace) && entry.DeleteAllowed {
 			return true
 		}
 	}
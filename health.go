@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// healthConfig controls the unauthenticated probe endpoints. MetricsAllowed,
+// when non-empty, limits /metrics to clients whose address falls in one of
+// the prefixes.
+type healthConfig struct {
+	Enabled        bool
+	MetricsAllowed []netip.Prefix
+
+	// SaturationMetrics adds in-flight and queue gauges to /metrics.
+	SaturationMetrics bool
+}
+
+func loadHealthConfig() healthConfig {
+	cfg := healthConfig{Enabled: getEnvBool("HEALTH_ENDPOINTS", true), SaturationMetrics: getEnvBool("METRICS_SATURATION", false)}
+	for _, entry := range splitCommaList(os.Getenv("METRICS_ALLOWED_CIDRS")) {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				log.Printf("ignoring METRICS_ALLOWED_CIDRS entry %q: %v", entry, err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.MetricsAllowed = append(cfg.MetricsAllowed, prefix.Masked())
+	}
+	return cfg
+}
+
+// registerHealthRoutes mounts /healthz, /readyz and /metrics ahead of the
+// registry catch-all. They are exact routes that never reach authenticate or
+// the proxy, so no suffix or dot segment can turn them into a registry path.
+func registerHealthRoutes(router chi.Router, cfg healthConfig) {
+	if !cfg.Enabled {
+		return
+	}
+	router.Get("/healthz", handleHealthz)
+	router.Get("/readyz", handleReadyz)
+	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.metricsAllowed(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handleMetrics(w, r, cfg)
+	})
+}
+
+func (c healthConfig) metricsAllowed(remoteAddr string) bool {
+	if len(c.MetricsAllowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.MetricsAllowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleHealthz reports that the process is serving.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports ready only while the registry answers its /v2/ ping.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	setNoCacheHeaders(w)
+	if err := pingUpstream(r.Context()); err != nil {
+		log.Printf("readiness check failed: %v", err)
+		http.Error(w, "registry unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleMetrics serves a few gauges, the LDAP bind latency histogram and
+// cache counters, the served certificates' expiry, the blob scrub counters
+// and, with METRICS_SATURATION, the saturation gauges in the Prometheus text
+// format.
+func handleMetrics(w http.ResponseWriter, r *http.Request, cfg healthConfig) {
+	upstreamUp := 1
+	if err := pingUpstream(r.Context()); err != nil {
+		upstreamUp = 0
+	}
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP containervault_up Whether ContainerVault is serving.")
+	fmt.Fprintln(w, "# TYPE containervault_up gauge")
+	fmt.Fprintln(w, "containervault_up 1")
+	fmt.Fprintln(w, "# HELP containervault_upstream_up Whether the registry answers its /v2/ ping.")
+	fmt.Fprintln(w, "# TYPE containervault_upstream_up gauge")
+	fmt.Fprintf(w, "containervault_upstream_up %d\n", upstreamUp)
+	fmt.Fprintln(w, "# HELP containervault_goroutines Number of running goroutines.")
+	fmt.Fprintln(w, "# TYPE containervault_goroutines gauge")
+	fmt.Fprintf(w, "containervault_goroutines %d\n", runtime.NumGoroutine())
+	ldapBindDurations.write(w, "containervault_ldap_bind_duration_seconds", "Duration of LDAP binds, successful or not. Named ldap_bind_duration_seconds plus the containervault_ prefix all metrics here carry.")
+	ldapGroups.write(w)
+	tlsCertExpiry.write(w)
+	blobScrub.write(w)
+	if cfg.SaturationMetrics {
+		saturation.write(w)
+	}
+}
+
+// pingUpstream treats any non-5xx answer from /v2/ as a live registry, since
+// a registry with its own auth answers 401.
+func pingUpstream(ctx context.Context) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	pingURL := upstream.ResolveReference(&url.URL{Path: "/v2/"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pingURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("registry ping status: %s", resp.Status)
+	}
+	return nil
+}
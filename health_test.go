@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func withHealthConfig(t *testing.T, cfg healthConfig) {
+	t.Helper()
+	prev := healthCfg
+	healthCfg = cfg
+	t.Cleanup(func() {
+		healthCfg = prev
+	})
+}
+
+func serveUnauthenticated(t *testing.T, path, remoteAddr string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHealthzSkipsAuthButRegistryDoesNot(t *testing.T) {
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rec := serveUnauthenticated(t, path, "")
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok\n" {
+			t.Fatalf("expected %s to succeed without credentials, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+	for _, path := range []string{"/v2/", "/healthz/../v2/", "/healthz/v2/team1/app/tags/list"} {
+		rec := serveUnauthenticated(t, path, "")
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected %s to require credentials, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestReadyzFailsWhenRegistryIsDown(t *testing.T) {
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer cleanup()
+
+	if rec := serveUnauthenticated(t, "/readyz", ""); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec := serveUnauthenticated(t, "/healthz", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected liveness to ignore the registry, got %d", rec.Code)
+	}
+}
+
+func TestMetricsAllowlist(t *testing.T) {
+	withHealthConfig(t, healthConfig{Enabled: true, MetricsAllowed: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+
+	rec := serveUnauthenticated(t, "/metrics", "10.1.2.3:5555")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "containervault_upstream_up 1") || !strings.Contains(rec.Body.String(), "containervault_ldap_bind_duration_seconds_count ") {
+		t.Fatalf("expected metrics for allowed client, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "# HELP containervault_ldap_bind_duration_seconds Duration of LDAP binds, successful or not. Named ldap_bind_duration_seconds plus the containervault_ prefix") {
+		t.Fatalf("expected the bind histogram HELP to explain its prefixed name: %s", rec.Body.String())
+	}
+	if rec := serveUnauthenticated(t, "/metrics", "192.0.2.1:5555"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside the allowlist, got %d", rec.Code)
+	}
+}
+
+func TestHealthEndpointsDisabledRequireAuth(t *testing.T) {
+	withHealthConfig(t, healthConfig{})
+
+	if rec := serveUnauthenticated(t, "/healthz", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected disabled /healthz to fall through to auth, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultLDAPBindBuckets are the upper bounds, in seconds, of
+// containervault_ldap_bind_duration_seconds.
+var defaultLDAPBindBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// durationHistogram counts observations into fixed buckets for the
+// Prometheus text format.
+type durationHistogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newDurationHistogram(bounds []float64) *durationHistogram {
+	return &durationHistogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// write renders the histogram with cumulative buckets, as Prometheus expects.
+func (h *durationHistogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// loadLDAPBindBuckets reads LDAP_BIND_DURATION_BUCKETS, comma-separated
+// bucket bounds in seconds in ascending order.
+func loadLDAPBindBuckets() []float64 {
+	raw := os.Getenv("LDAP_BIND_DURATION_BUCKETS")
+	parts := splitCommaList(raw)
+	if len(parts) == 0 {
+		return defaultLDAPBindBuckets
+	}
+	bounds := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		bound, err := strconv.ParseFloat(part, 64)
+		if err != nil || bound <= 0 || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+			log.Printf("invalid LDAP_BIND_DURATION_BUCKETS %q, using defaults", raw)
+			return defaultLDAPBindBuckets
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds
+}
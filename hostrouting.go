@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// hostRoutingConfig maps <namespace>.<Domain> hosts onto /v2/<namespace>/... paths.
+type hostRoutingConfig struct {
+	Enabled bool
+	Domain  string
+}
+
+type hostNamespaceContextKey struct{}
+
+func loadHostRoutingConfig() hostRoutingConfig {
+	cfg := hostRoutingConfig{
+		Enabled: getEnvBool("HOST_NAMESPACE_ROUTING", false),
+		Domain:  strings.ToLower(strings.Trim(strings.TrimSpace(os.Getenv("HOST_NAMESPACE_DOMAIN")), ".")),
+	}
+	if cfg.Enabled && cfg.Domain == "" {
+		// Default to the first certmagic domain so routing follows the managed certificate names.
+		if domains := splitCommaList(os.Getenv("CERTMAGIC_DOMAINS")); len(domains) > 0 {
+			cfg.Domain = strings.ToLower(strings.TrimPrefix(domains[0], "*."))
+		}
+	}
+	return cfg
+}
+
+// hostNamespace returns the namespace encoded in the leftmost label of host,
+// e.g. team1.registry.example.com -> team1.
+func (c hostRoutingConfig) hostNamespace(host string) (string, bool) {
+	if !c.Enabled || c.Domain == "" {
+		return "", false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	label, ok := strings.CutSuffix(host, "."+c.Domain)
+	if !ok || label == "" || strings.Contains(label, ".") {
+		return "", false
+	}
+	return label, true
+}
+
+// routeHostNamespace rewrites /v2/<repo>/... to /v2/<namespace>/<repo>/... for
+// requests addressed to a namespace subdomain.
+func routeHostNamespace(r *http.Request) *http.Request {
+	namespace, ok := hostRouting.hostNamespace(r.Host)
+	if !ok {
+		return r
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok || rest == "" || strings.HasPrefix(rest, "_catalog") || "/v2/"+rest == capabilitiesPath {
+		return r
+	}
+
+	routed := r.Clone(context.WithValue(r.Context(), hostNamespaceContextKey{}, namespace))
+	routed.URL.Path = "/v2/" + namespace + "/" + rest
+	if routed.URL.RawPath != "" {
+		routed.URL.RawPath = "/v2/" + namespace + "/" + strings.TrimPrefix(routed.URL.RawPath, "/v2/")
+	}
+	return routed
+}
+
+// unrouteHostNamespaceResponse strips the namespace prefix from upstream
+// Location headers so clients keep addressing the subdomain form.
+func unrouteHostNamespaceResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+	namespace, ok := resp.Request.Context().Value(hostNamespaceContextKey{}).(string)
+	if !ok {
+		return nil
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil
+	}
+	prefix := "/v2/" + namespace + "/"
+	if rest, ok := strings.CutPrefix(loc.Path, prefix); ok {
+		loc.Path = "/v2/" + rest
+		loc.RawPath = ""
+		resp.Header.Set("Location", loc.String())
+	}
+	return nil
+}
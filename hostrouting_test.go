@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostNamespace(t *testing.T) {
+	cfg := hostRoutingConfig{Enabled: true, Domain: "registry.example.com"}
+	tests := []struct {
+		host      string
+		namespace string
+		ok        bool
+	}{
+		{"team1.registry.example.com", "team1", true},
+		{"TEAM1.registry.example.com:443", "team1", true},
+		{"registry.example.com", "", false},
+		{"a.b.registry.example.com", "", false},
+		{"team1.other.example.com", "", false},
+	}
+	for _, tt := range tests {
+		ns, ok := cfg.hostNamespace(tt.host)
+		if ok != tt.ok || ns != tt.namespace {
+			t.Fatalf("host %q: expected (%q, %v), got (%q, %v)", tt.host, tt.namespace, tt.ok, ns, ok)
+		}
+	}
+
+	if _, ok := (hostRoutingConfig{Domain: "registry.example.com"}).hostNamespace("team1.registry.example.com"); ok {
+		t.Fatalf("expected routing disabled without HOST_NAMESPACE_ROUTING")
+	}
+}
+
+func TestHostNamespaceRoutingProxiesToNamespace(t *testing.T) {
+	withHostRouting(t, hostRoutingConfig{Enabled: true, Domain: "registry.example.com"})
+	var gotPath string
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		gotPath = r.URL.Path
+		header := http.Header{}
+		header.Set("Location", "https://team1.registry.example.com/v2/team1/app/blobs/uploads/abc")
+		return proxyTestResponse(r, http.StatusAccepted, header, "")
+	})
+
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "https://team1.registry.example.com/v2/app/blobs/uploads/", nil)
+	req.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	if gotPath != "/v2/team1/app/blobs/uploads/" {
+		t.Fatalf("expected namespace-prefixed upstream path, got %q", gotPath)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://team1.registry.example.com/v2/app/blobs/uploads/abc" {
+		t.Fatalf("expected Location without namespace prefix, got %q", loc)
+	}
+}
+
+func TestHostNamespaceRoutingEnforcesNamespace(t *testing.T) {
+	withHostRouting(t, hostRoutingConfig{Enabled: true, Domain: "registry.example.com"})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://team2.registry.example.com/v2/app/manifests/latest", nil)
+	req.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for namespace outside access, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "https://team2.registry.example.com/v2/", nil)
+	req.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected ping to pass through unchanged, got %d", rec.Code)
+	}
+}
+
+func TestLoadHostRoutingConfigDefaultsToCertmagicDomain(t *testing.T) {
+	t.Setenv("HOST_NAMESPACE_ROUTING", "true")
+	t.Setenv("HOST_NAMESPACE_DOMAIN", "")
+	t.Setenv("CERTMAGIC_DOMAINS", "*.registry.example.com,registry.example.com")
+	cfg := loadHostRoutingConfig()
+	if !cfg.Enabled || cfg.Domain != "registry.example.com" {
+		t.Fatalf("unexpected host routing config: %#v", cfg)
+	}
+}
+
+func withHostRouting(t *testing.T, cfg hostRoutingConfig) {
+	t.Helper()
+	prev := hostRouting
+	hostRouting = cfg
+	t.Cleanup(func() {
+		hostRouting = prev
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// imageSizeCache remembers the compressed size (config plus layers) of
+// manifests by digest, so tag info does not re-sum an index's child manifest
+// on every page load. Manifests are immutable, so entries only leave the
+// cache when the manifest is deleted or evicted as least recently used.
+type imageSizeCache struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+
+	sums atomic.Int64
+}
+
+type imageSizeEntry struct {
+	digest string
+	size   int64
+}
+
+func newImageSizeCache(size int) *imageSizeCache {
+	return &imageSizeCache{size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *imageSizeCache) get(digest string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[digest]
+	if !ok {
+		return 0, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*imageSizeEntry).size, true
+}
+
+func (c *imageSizeCache) put(digest string, size int64) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[digest]; ok {
+		elem.Value.(*imageSizeEntry).size = size
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[digest] = c.order.PushFront(&imageSizeEntry{digest: digest, size: size})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*imageSizeEntry).digest)
+	}
+}
+
+func (c *imageSizeCache) invalidate(digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[digest]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, digest)
+	}
+}
+
+// compressedSize returns the cached size of digest, summing it from payload
+// on a miss. An empty digest is never cached.
+func (c *imageSizeCache) compressedSize(ctx context.Context, client *http.Client, repo, digest string, payload []byte, contentType string) (int64, error) {
+	if digest != "" {
+		if size, ok := c.get(digest); ok {
+			return size, nil
+		}
+	}
+	size, err := manifestCompressedSize(ctx, client, repo, payload, contentType)
+	if err != nil {
+		return 0, err
+	}
+	c.sums.Add(1)
+	if digest != "" {
+		c.put(digest, size)
+	}
+	return size, nil
+}
+
+// invalidateImageSizeResponse drops the cached size of a manifest deleted
+// through /v2/.
+func invalidateImageSizeResponse(resp *http.Response) error {
+	if resp.Request == nil || resp.Request.Method != http.MethodDelete || resp.StatusCode != http.StatusAccepted {
+		return nil
+	}
+	if route, ok := parseRegistryPath(resp.Request.URL.Path); ok && route.Kind == registryKindManifests {
+		imageSizes.invalidate(route.Reference)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func withImageSizeCache(t *testing.T, size int) *imageSizeCache {
+	t.Helper()
+	original := imageSizes
+	imageSizes = newImageSizeCache(size)
+	t.Cleanup(func() { imageSizes = original })
+	return imageSizes
+}
+
+func TestFetchTagInfoCachesImageSize(t *testing.T) {
+	cache := withImageSizeCache(t, 10)
+	childFetches := 0
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/team1/app/manifests/stable":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			w.Header().Set("Docker-Content-Digest", "sha256:list")
+			_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json","manifests":[{"digest":"sha256:linux","size":111,"platform":{"os":"linux","architecture":"amd64"}}]}`))
+		case "/v2/team1/app/manifests/sha256:linux":
+			childFetches++
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"size":3,"digest":"sha256:cfg"},"layers":[{"size":4,"digest":"sha256:a"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer cleanup()
+
+	for i := range 2 {
+		info, err := fetchTagInfo(context.Background(), "team1/app", "stable")
+		if err != nil {
+			t.Fatalf("fetchTagInfo #%d: %v", i+1, err)
+		}
+		if info.CompressedSize != 7 {
+			t.Fatalf("fetchTagInfo #%d: expected size 7, got %d", i+1, info.CompressedSize)
+		}
+	}
+	if got := cache.sums.Load(); got != 1 {
+		t.Fatalf("expected one size computation, got %d", got)
+	}
+	if childFetches != 1 {
+		t.Fatalf("expected the child manifest to be fetched once, got %d", childFetches)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/v2/team1/app/manifests/sha256:list", nil)
+	if err := invalidateImageSizeResponse(&http.Response{StatusCode: http.StatusAccepted, Request: req}); err != nil {
+		t.Fatalf("invalidateImageSizeResponse: %v", err)
+	}
+	if _, ok := cache.get("sha256:list"); ok {
+		t.Fatalf("expected the deleted manifest to leave the cache")
+	}
+	if _, err := fetchTagInfo(context.Background(), "team1/app", "stable"); err != nil {
+		t.Fatalf("fetchTagInfo after delete: %v", err)
+	}
+	if got := cache.sums.Load(); got != 2 {
+		t.Fatalf("expected the size to be recomputed after delete, got %d computations", got)
+	}
+}
+
+func TestImageSizeCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newImageSizeCache(2)
+	for i := range 3 {
+		cache.put("sha256:"+strconv.Itoa(i), int64(i))
+		if i == 1 {
+			cache.get("sha256:0")
+		}
+	}
+	if _, ok := cache.get("sha256:1"); ok {
+		t.Fatalf("expected the least recently used entry to be evicted")
+	}
+	for _, digest := range []string{"sha256:0", "sha256:2"} {
+		if _, ok := cache.get(digest); !ok {
+			t.Fatalf("expected %s to stay cached", digest)
+		}
+	}
+}
+
+func TestImageSizeCacheDisabled(t *testing.T) {
+	cache := newImageSizeCache(0)
+	cache.put("sha256:abc", 1)
+	if _, ok := cache.get("sha256:abc"); ok {
+		t.Fatalf("expected a zero-size cache to store nothing")
+	}
+}
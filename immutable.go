@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// immutableTagPush reports whether a push to repo:tag may not move an
+// existing tag: repo is in IMMUTABLE_NAMESPACES and tag is not one of
+// IMMUTABLE_NAMESPACES_MUTABLE_TAGS.
+func immutableTagPush(repo, tag string) bool {
+	namespace, _, _ := strings.Cut(repo, "/")
+	return slices.Contains(immutableNamespaces, namespace) && !slices.Contains(mutableTags, tag)
+}
+
+// enforceImmutableTags refuses manifest pushes that would overwrite an
+// existing tag in IMMUTABLE_NAMESPACES with 409. Pushing the manifest the tag
+// already points at is allowed, so retried pushes still succeed. The request
+// body must already be replayable, as enforceManifestSize leaves it.
+func enforceImmutableTags(w http.ResponseWriter, r *http.Request) bool {
+	if len(immutableNamespaces) == 0 || r.Method != http.MethodPut {
+		return true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests || isDigestReference(route.Reference) || !immutableTagPush(route.Repo, route.Reference) {
+		return true
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unable to read manifest")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	switch status, message := immutableTagRefusal(r.Context(), route.Repo, route.Reference, "sha256:"+hex.EncodeToString(sum[:])); status {
+	case 0:
+		return true
+	case http.StatusServiceUnavailable:
+		writeRegistryError(w, status, "UNAVAILABLE", message)
+	default:
+		writeRegistryError(w, status, "DENIED", message)
+	}
+	return false
+}
+
+// immutableTagRefusal reports whether pushing digest to repo:tag would move
+// an existing tag in IMMUTABLE_NAMESPACES. It returns the status and message
+// to refuse the push with, or zero when it may go ahead.
+func immutableTagRefusal(ctx context.Context, repo, tag, digest string) (int, string) {
+	if !immutableTagPush(repo, tag) {
+		return 0, ""
+	}
+	current, status, _, err := fetchTagDigest(ctx, repo, tag)
+	if err != nil || (status != 0 && status != http.StatusNotFound) {
+		log.Printf("immutable tag check for %s:%s failed: status %d, %v", repo, tag, status, err)
+		return http.StatusServiceUnavailable, "unable to check whether the tag exists"
+	}
+	if status == http.StatusNotFound || current == digest {
+		return 0, ""
+	}
+	namespace, _, _ := strings.Cut(repo, "/")
+	return http.StatusConflict, fmt.Sprintf("tag %s:%s already exists and tags in namespace %s are immutable", repo, tag, namespace)
+}
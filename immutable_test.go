@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withImmutableNamespaces(t *testing.T, namespaces, mutable []string) {
+	t.Helper()
+	prevNamespaces, prevMutable := immutableNamespaces, mutableTags
+	immutableNamespaces, mutableTags = namespaces, mutable
+	t.Cleanup(func() {
+		immutableNamespaces, mutableTags = prevNamespaces, prevMutable
+	})
+}
+
+func withImmutableRegistry(t *testing.T) (*fakeRegistry, testRegistryImage) {
+	t.Helper()
+	registry := newFakeRegistry()
+	previous := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", previous)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	t.Cleanup(cleanup)
+	return registry, previous
+}
+
+func TestImmutableNamespaceRejectsTagOverwrite(t *testing.T) {
+	withImmutableNamespaces(t, []string{"team1"}, nil)
+	registry, previous := withImmutableRegistry(t)
+
+	next := newTestRegistryImage(t, "layer-two")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "immutable") {
+		t.Fatalf("expected 409 for overwriting v1, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(registry.manifests["team1/app:v1"], previous.Manifest) {
+		t.Fatalf("expected v1 to keep its manifest")
+	}
+
+	// New tags and identical re-pushes are not overwrites.
+	if rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(next.Manifest)); rec.Code != http.StatusCreated {
+		t.Fatalf("expected a new tag to be pushed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(previous.Manifest)); rec.Code != http.StatusCreated {
+		t.Fatalf("expected re-pushing the same manifest to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTagOverwriteAllowedOutsideImmutableNamespaces(t *testing.T) {
+	withImmutableNamespaces(t, []string{"team2"}, nil)
+	registry, _ := withImmutableRegistry(t)
+
+	next := newTestRegistryImage(t, "layer-two")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected overwriting v1 in a mutable namespace to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(registry.manifests["team1/app:v1"], next.Manifest) {
+		t.Fatalf("expected v1 to point at the new manifest")
+	}
+}
+
+func TestImmutableNamespaceMutableTags(t *testing.T) {
+	withImmutableNamespaces(t, []string{"team1"}, []string{"v1"})
+	withImmutableRegistry(t)
+
+	next := newTestRegistryImage(t, "layer-two")
+	if rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(next.Manifest)); rec.Code != http.StatusCreated {
+		t.Fatalf("expected a listed mutable tag to be overwritten, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestImmutableNamespaceRejectsImportOverwrite(t *testing.T) {
+	withImmutableNamespaces(t, []string{"team1"}, nil)
+	registry, previous := withImmutableRegistry(t)
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	layer := []byte("imported layer")
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{"architecture":"amd64","os":"linux"}`), layer)
+
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "immutable") {
+		t.Fatalf("expected 409 for importing over v1, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(registry.manifests["team1/app:v1"], previous.Manifest) || registry.blobs[testDigest(layer)] != nil {
+		t.Fatalf("expected nothing to be imported")
+	}
+
+	if rec := serveImportRequest(t, token, "/api/repos/team1/app/import?tag=v2", archive); rec.Code != http.StatusCreated {
+		t.Fatalf("expected importing a new tag to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ociConfigType    = "application/vnd.oci.image.config.v1+json"
+	ociLayerType     = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerGzipType = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+var (
+	errImportInvalid  = errors.New("invalid image archive")
+	errImportTooLarge = errors.New("archive exceeds import quota")
+)
+
+type importPayload struct {
+	Repo   string `json:"repo"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest"`
+}
+
+// importArchive is an image tarball spooled to disk, keyed by cleaned entry name.
+type importArchive struct {
+	dir   string
+	files map[string]string
+}
+
+// importBlob is a spooled file whose sha256 digest has been computed.
+type importBlob struct {
+	Path      string
+	Digest    string
+	Size      int64
+	MediaType string
+}
+
+type importImage struct {
+	Tag            string
+	Manifest       []byte
+	ManifestDigest string
+	MediaType      string
+	Blobs          []importBlob
+}
+
+func handleImageImport(w http.ResponseWriter, r *http.Request, sess sessionData, serve registryHandler, repo string) {
+	repo, namespace, err := repoNamespace(repo)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid repo")
+		return
+	}
+	if !sessionNamespaceAllowed(sess, namespace) {
+		writeAPIError(w, http.StatusForbidden, "namespace not allowed")
+		return
+	}
+	if pullOnly, _, ok := namespacePermissions(sess.Access, namespace); !ok || pullOnly {
+		writeAPIError(w, http.StatusForbidden, "push not allowed")
+		return
+	}
+	if replica.cfg.Enabled {
+		writeAPIError(w, http.StatusConflict, "read-only replica; import on the primary")
+		return
+	}
+	if importMaxBytes > 0 {
+		if r.ContentLength > importMaxBytes {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "archive exceeds import quota")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+	}
+
+	archive, err := spoolImportArchive(r.Body, importMaxBytes)
+	if archive != nil {
+		defer archive.close()
+	}
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr), errors.Is(err, errImportTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "archive exceeds import quota")
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusBadRequest, "invalid image archive")
+		return
+	}
+
+	image, err := archive.image()
+	if errors.Is(err, errImportInvalid) {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("import %s failed: %v", repo, err)
+		writeAPIError(w, http.StatusInternalServerError, "import failed")
+		return
+	}
+	if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+		image.Tag = tag
+	}
+	if image.Tag == "" {
+		image.Tag = "latest"
+	}
+	if strings.Contains(image.Tag, "/") || strings.Contains(image.Tag, ":") {
+		writeAPIError(w, http.StatusBadRequest, "invalid tag")
+		return
+	}
+
+	if status, message := importRefusal(r.Context(), repo, image); status != 0 {
+		writeAPIError(w, status, message)
+		return
+	}
+
+	// Pushing can outlast any idle timeout and nothing more is read; the
+	// reply is small enough to go out without a deadline of its own.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	pusher := importPusher{parent: r, serve: serve, user: sess.User, access: sess.Access}
+	if err := pushImportImage(pusher, repo, image); err != nil {
+		var refused *importRefusedError
+		if errors.As(err, &refused) && refused.status < http.StatusInternalServerError {
+			if refused.retryAfter != "" {
+				w.Header().Set("Retry-After", refused.retryAfter)
+			}
+			writeAPIError(w, refused.status, refused.message)
+			return
+		}
+		log.Printf("import %s:%s failed: %v", repo, image.Tag, err)
+		writeAPIError(w, http.StatusBadGateway, "registry import failed")
+		return
+	}
+	auditEvent("import", sess.User.Name, repo+":"+image.Tag)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(importPayload{Repo: repo, Tag: image.Tag, Digest: image.ManifestDigest})
+}
+
+// importRefusal applies the push policies that need only the archive to an
+// image about to be imported, so a refused import uploads nothing. The
+// uploads themselves then go through every /v2 policy. It returns the status
+// and message to refuse the import with, or zero when it may go ahead.
+func importRefusal(ctx context.Context, repo string, image importImage) (int, string) {
+	if strictTagNames {
+		if problem := tagNameProblem(image.Tag); problem != "" {
+			return http.StatusBadRequest, problem
+		}
+	}
+	if problem := minLayersProblem(repo, image.Tag, image.Manifest); problem != "" {
+		return http.StatusBadRequest, problem
+	}
+	if len(manifestCfg.AllowedPlatforms) > 0 && len(image.Blobs) > 0 {
+		// The config is the first blob and is not in the registry yet.
+		var platform manifestPlatform
+		if data, err := os.ReadFile(filepath.Clean(image.Blobs[0].Path)); err == nil && json.Unmarshal(data, &platform) == nil {
+			if disallowed := disallowedConfigPlatform(platform); disallowed != "" {
+				return http.StatusBadRequest, platformProblem(disallowed)
+			}
+		}
+	}
+	if status, message := immutableTagRefusal(ctx, repo, image.Tag, image.ManifestDigest); status != 0 {
+		return status, message
+	}
+	// Last, so a refused import does not take a namespace slot.
+	namespace, _, _ := strings.Cut(repo, "/")
+	return namespaceLimitRefusal(ctx, namespace)
+}
+
+// spoolImportArchive extracts a (optionally gzipped) tar stream into a
+// temporary directory. Only regular files are kept. When maxBytes is
+// positive it also caps the extracted bytes, since a small gzip stream can
+// expand far beyond the request body limit.
+func spoolImportArchive(body io.Reader, maxBytes int64) (*importArchive, error) {
+	br := bufio.NewReader(body)
+	var src io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	dir, err := os.MkdirTemp("", "cv-import-")
+	if err != nil {
+		return nil, err
+	}
+	archive := &importArchive{dir: dir, files: map[string]string{}}
+	tr := tar.NewReader(src)
+	remaining := maxBytes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archive, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return archive, fmt.Errorf("%w: unsafe entry %q", errImportInvalid, hdr.Name)
+		}
+		f, err := os.CreateTemp(dir, "entry-")
+		if err != nil {
+			return archive, err
+		}
+		entry := io.Reader(tr)
+		if maxBytes > 0 {
+			entry = io.LimitReader(tr, remaining+1)
+		}
+		n, copyErr := io.Copy(f, entry)
+		closeErr := f.Close()
+		if copyErr != nil {
+			return archive, copyErr
+		}
+		if closeErr != nil {
+			return archive, closeErr
+		}
+		if remaining -= n; maxBytes > 0 && remaining < 0 {
+			return archive, errImportTooLarge
+		}
+		archive.files[name] = f.Name()
+	}
+	return archive, nil
+}
+
+func (a *importArchive) close() {
+	if err := os.RemoveAll(a.dir); err != nil {
+		log.Printf("import cleanup failed: %v", err)
+	}
+}
+
+func (a *importArchive) readFile(name string) ([]byte, error) {
+	p, ok := a.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing %s", errImportInvalid, name)
+	}
+	return os.ReadFile(filepath.Clean(p))
+}
+
+// blob hashes a spooled entry. Entries named after their digest
+// (blobs/sha256/<hex> or <hex>.json) must match it.
+func (a *importArchive) blob(name string) (importBlob, error) {
+	p, ok := a.files[name]
+	if !ok {
+		return importBlob{}, fmt.Errorf("%w: missing %s", errImportInvalid, name)
+	}
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return importBlob{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return importBlob{}, err
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if want, ok := digestFromEntryName(name); ok && want != digest {
+		return importBlob{}, fmt.Errorf("%w: %s digest mismatch: got %s", errImportInvalid, name, digest)
+	}
+	return importBlob{Path: p, Digest: digest, Size: size}, nil
+}
+
+func digestFromEntryName(name string) (string, bool) {
+	encoded, ok := strings.CutPrefix(name, "blobs/sha256/")
+	if !ok {
+		encoded, ok = strings.CutSuffix(path.Base(name), ".json")
+	}
+	if !ok {
+		return "", false
+	}
+	digest, err := (digestPolicy{RejectUppercase: true}).normalizeDigest("sha256:" + encoded)
+	if err != nil {
+		return "", false
+	}
+	return digest, true
+}
+
+// descriptorBlob resolves a manifest descriptor to its OCI layout blob and
+// checks the recorded size.
+func (a *importArchive) descriptorBlob(digest string, size int64, mediaType string) (importBlob, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return importBlob{}, fmt.Errorf("%w: unsupported digest %s", errImportInvalid, digest)
+	}
+	name, err := blobTarPath(digest)
+	if err != nil {
+		return importBlob{}, fmt.Errorf("%w: %v", errImportInvalid, err)
+	}
+	blob, err := a.blob(name)
+	if err != nil {
+		return importBlob{}, err
+	}
+	if blob.Size != size {
+		return importBlob{}, fmt.Errorf("%w: %s size mismatch: expected %d, got %d", errImportInvalid, digest, size, blob.Size)
+	}
+	blob.MediaType = mediaType
+	return blob, nil
+}
+
+// image prefers an OCI layout index and falls back to a docker-save manifest.json.
+func (a *importArchive) image() (importImage, error) {
+	if _, ok := a.files[ociIndexFile]; ok {
+		return a.ociImage()
+	}
+	if _, ok := a.files[dockerManifest]; ok {
+		return a.dockerSaveImage()
+	}
+	return importImage{}, fmt.Errorf("%w: no index.json or manifest.json", errImportInvalid)
+}
+
+func (a *importArchive) ociImage() (importImage, error) {
+	data, err := a.readFile(ociIndexFile)
+	if err != nil {
+		return importImage{}, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil || len(index.Manifests) == 0 {
+		return importImage{}, fmt.Errorf("%w: unreadable index.json", errImportInvalid)
+	}
+	desc := index.Manifests[0]
+	tag := desc.Annotations["org.opencontainers.image.ref.name"]
+
+	manifestBlob, err := a.descriptorBlob(desc.Digest, desc.Size, desc.MediaType)
+	if err != nil {
+		return importImage{}, err
+	}
+	if isManifestListContentType(desc.MediaType) {
+		// Nested index (e.g. containerd-backed docker save): pick a single platform.
+		body, err := os.ReadFile(filepath.Clean(manifestBlob.Path))
+		if err != nil {
+			return importImage{}, err
+		}
+		var list manifestList
+		if err := json.Unmarshal(body, &list); err != nil {
+			return importImage{}, fmt.Errorf("%w: unreadable image index", errImportInvalid)
+		}
+		selected, err := selectManifestDigest(list)
+		if err != nil {
+			return importImage{}, fmt.Errorf("%w: %v", errImportInvalid, err)
+		}
+		for _, m := range list.Manifests {
+			if m.Digest == selected {
+				desc = ociDescriptor{MediaType: ociManifestType, Digest: m.Digest, Size: m.Size}
+			}
+		}
+		if manifestBlob, err = a.descriptorBlob(desc.Digest, desc.Size, desc.MediaType); err != nil {
+			return importImage{}, err
+		}
+	}
+
+	body, err := os.ReadFile(filepath.Clean(manifestBlob.Path))
+	if err != nil {
+		return importImage{}, err
+	}
+	var manifest manifestSchema2
+	if err := json.Unmarshal(body, &manifest); err != nil || manifest.Config.Digest == "" {
+		return importImage{}, fmt.Errorf("%w: unreadable image manifest", errImportInvalid)
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	if mediaType == "" {
+		mediaType = ociManifestType
+	}
+
+	image := importImage{Tag: tag, Manifest: body, ManifestDigest: manifestBlob.Digest, MediaType: mediaType}
+	config, err := a.descriptorBlob(manifest.Config.Digest, manifest.Config.Size, manifest.Config.MediaType)
+	if err != nil {
+		return importImage{}, err
+	}
+	image.Blobs = append(image.Blobs, config)
+	for _, layer := range manifest.Layers {
+		blob, err := a.descriptorBlob(layer.Digest, layer.Size, layer.MediaType)
+		if err != nil {
+			return importImage{}, err
+		}
+		image.Blobs = append(image.Blobs, blob)
+	}
+	return image, nil
+}
+
+// dockerSaveImage builds an OCI manifest for a classic `docker save` archive,
+// whose layers are stored as uncompressed layer.tar files.
+func (a *importArchive) dockerSaveImage() (importImage, error) {
+	data, err := a.readFile(dockerManifest)
+	if err != nil {
+		return importImage{}, err
+	}
+	var entries []dockerSaveManifest
+	if err := json.Unmarshal(data, &entries); err != nil || len(entries) == 0 {
+		return importImage{}, fmt.Errorf("%w: unreadable manifest.json", errImportInvalid)
+	}
+	entry := entries[0]
+
+	config, err := a.blob(path.Clean(entry.Config))
+	if err != nil {
+		return importImage{}, err
+	}
+	config.MediaType = ociConfigType
+	image := importImage{Blobs: []importBlob{config}, MediaType: ociManifestType}
+	if len(entry.RepoTags) > 0 {
+		if idx := strings.LastIndex(entry.RepoTags[0], ":"); idx >= 0 {
+			image.Tag = entry.RepoTags[0][idx+1:]
+		}
+	}
+
+	manifest := struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Config        ociDescriptor   `json:"config"`
+		Layers        []ociDescriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        ociDescriptor{MediaType: config.MediaType, Digest: config.Digest, Size: config.Size},
+		Layers:        []ociDescriptor{},
+	}
+	for _, name := range entry.Layers {
+		layer, err := a.blob(path.Clean(name))
+		if err != nil {
+			return importImage{}, err
+		}
+		layer.MediaType = ociLayerType
+		if gzipped, err := isGzipFile(layer.Path); err != nil {
+			return importImage{}, err
+		} else if gzipped {
+			layer.MediaType = ociLayerGzipType
+		}
+		image.Blobs = append(image.Blobs, layer)
+		manifest.Layers = append(manifest.Layers, ociDescriptor{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return importImage{}, err
+	}
+	sum := sha256.Sum256(body)
+	image.Manifest = body
+	image.ManifestDigest = "sha256:" + hex.EncodeToString(sum[:])
+	return image, nil
+}
+
+func isGzipFile(p string) (bool, error) {
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// importPusher sends an import's registry requests through the /v2 policies
+// and proxy, as the importing user, so an import is refused, rate limited,
+// quarantined and audited exactly like the equivalent push.
+type importPusher struct {
+	parent *http.Request
+	serve  registryHandler
+	user   *User
+	access []Access
+}
+
+// importRefusedError is a registry request of an import that the policies or
+// the registry refused.
+type importRefusedError struct {
+	status     int
+	message    string
+	retryAfter string
+}
+
+func (e *importRefusedError) Error() string {
+	return fmt.Sprintf("registry status %d: %s", e.status, e.message)
+}
+
+// maxImportResponseBody bounds how much of each registry reply an import keeps.
+const maxImportResponseBody = 64 << 10
+
+// importResponse records the reply to one in-process registry request.
+type importResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *importResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *importResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *importResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if room := maxImportResponseBody - r.body.Len(); room > 0 {
+		r.body.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// Flush lets the reverse proxy flush as it streams.
+func (r *importResponse) Flush() {}
+
+// refused turns an unexpected reply into an importRefusedError, keeping the
+// message of a registry JSON error.
+func (r *importResponse) refused() error {
+	message := http.StatusText(r.status)
+	var envelope registryErrorResponse
+	if json.Unmarshal(r.body.Bytes(), &envelope) == nil && len(envelope.Errors) > 0 && envelope.Errors[0].Message != "" {
+		message = envelope.Errors[0].Message
+	}
+	return &importRefusedError{status: r.status, message: message, retryAfter: r.header.Get("Retry-After")}
+}
+
+func (p importPusher) do(method string, target *url.URL, body io.Reader, size int64, contentType string) (*importResponse, error) {
+	req, err := http.NewRequestWithContext(p.parent.Context(), method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = p.parent.Host
+	req.RemoteAddr = p.parent.RemoteAddr
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp := &importResponse{header: http.Header{}}
+	p.serve(resp, req, p.user, p.access)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp, nil
+}
+
+// pushImportImage uploads every blob the registry does not already have, then
+// tags the manifest.
+func pushImportImage(p importPusher, repo string, image importImage) error {
+	pushed := map[string]bool{}
+	for _, blob := range image.Blobs {
+		if pushed[blob.Digest] {
+			continue
+		}
+		if err := p.pushBlob(repo, blob); err != nil {
+			return err
+		}
+		pushed[blob.Digest] = true
+	}
+
+	manifestURL := &url.URL{Path: "/v2/" + repo + "/manifests/" + image.Tag}
+	resp, err := p.do(http.MethodPut, manifestURL, bytes.NewReader(image.Manifest), int64(len(image.Manifest)), image.MediaType)
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusCreated {
+		return resp.refused()
+	}
+	return nil
+}
+
+func (p importPusher) pushBlob(repo string, blob importBlob) error {
+	blobURL := &url.URL{Path: "/v2/" + repo + "/blobs/" + blob.Digest}
+	resp, err := p.do(http.MethodHead, blobURL, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	if resp.status == http.StatusOK {
+		return nil
+	}
+
+	uploadURL := &url.URL{Path: "/v2/" + repo + "/blobs/uploads/"}
+	resp, err = p.do(http.MethodPost, uploadURL, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusAccepted {
+		return resp.refused()
+	}
+	location, err := url.Parse(resp.header.Get("Location"))
+	if err != nil || resp.header.Get("Location") == "" {
+		return fmt.Errorf("blob upload location missing")
+	}
+	// Keep only the path, in case the registry answered with its own host.
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location = &url.URL{Path: location.Path, RawQuery: query.Encode()}
+
+	f, err := os.Open(filepath.Clean(blob.Path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resp, err = p.do(http.MethodPut, location, f, blob.Size, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	if resp.status != http.StatusCreated {
+		return resp.refused()
+	}
+	return nil
+}
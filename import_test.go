@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry is an in-memory registry supporting the push and pull calls used by import and export.
+// Like the real registry, blobs are only visible in repositories they were pushed to.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	links     map[string]bool
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte
+	sessions  int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{blobs: map[string][]byte{}, links: map[string]bool{}, manifests: map[string][]byte{}, types: map[string]string{}, uploads: map[string][]byte{}}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.URL.Path == "/v2/_catalog" {
+		_ = json.NewEncoder(w).Encode(catalogResponse{Repositories: f.repos()})
+		return
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case route.isUpload() && r.Method == http.MethodPost:
+		f.sessions++
+		session := fmt.Sprintf("session-%d", f.sessions)
+		f.uploads[session] = nil
+		w.Header().Set("Location", "/v2/"+route.Repo+"/blobs/uploads/"+session)
+		w.WriteHeader(http.StatusAccepted)
+	case route.isUpload() && (r.Method == http.MethodPatch || r.Method == http.MethodGet):
+		session := strings.TrimPrefix(route.Reference, "uploads/")
+		received, ok := f.uploads[session]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+			return
+		}
+		status := http.StatusNoContent
+		if r.Method == http.MethodPatch {
+			chunk, _ := io.ReadAll(r.Body)
+			received = append(received, chunk...)
+			f.uploads[session] = received
+			status = http.StatusAccepted
+		}
+		end := len(received) - 1
+		if end < 0 {
+			end = 0
+		}
+		w.Header().Set("Location", r.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+		w.Header().Set("Docker-Upload-UUID", session)
+		w.WriteHeader(status)
+	case route.isUpload() && r.Method == http.MethodPut:
+		session := strings.TrimPrefix(route.Reference, "uploads/")
+		chunk, _ := io.ReadAll(r.Body)
+		body := append(f.uploads[session], chunk...)
+		delete(f.uploads, session)
+		digest := r.URL.Query().Get("digest")
+		if testDigest(body) != digest {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+			return
+		}
+		f.blobs[digest] = body
+		f.links[route.Repo+"@"+digest] = true
+		w.WriteHeader(http.StatusCreated)
+	case route.Kind == registryKindBlobs:
+		blob, ok := f.blobs[route.Reference]
+		if !ok || !f.links[route.Repo+"@"+route.Reference] {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodHead {
+			_, _ = w.Write(blob)
+		}
+	case route.Kind == registryKindTags:
+		_ = json.NewEncoder(w).Encode(tagsResponse{Name: route.Repo, Tags: f.tags(route.Repo)})
+	case route.Kind == registryKindManifests && r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		digest := testDigest(body)
+		f.manifests[route.Repo+":"+route.Reference] = body
+		f.manifests[route.Repo+":"+digest] = body
+		f.types[digest] = r.Header.Get("Content-Type")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case route.Kind == registryKindManifests && r.Method == http.MethodDelete:
+		if _, ok := f.manifests[route.Repo+":"+route.Reference]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for key, body := range f.manifests {
+			if strings.HasPrefix(key, route.Repo+":") && testDigest(body) == route.Reference {
+				delete(f.manifests, key)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case route.Kind == registryKindManifests:
+		body, ok := f.manifests[route.Repo+":"+route.Reference]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[testDigest(body)])
+		w.Header().Set("Docker-Content-Digest", testDigest(body))
+		_, _ = w.Write(body)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRegistry) repos() []string {
+	seen := map[string]bool{}
+	repos := []string{}
+	for key := range f.manifests {
+		repo, ref, _ := strings.Cut(key, ":")
+		if !isDigestReference(ref) && !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func (f *fakeRegistry) tags(repo string) []string {
+	tags := []string{}
+	for key := range f.manifests {
+		if ref, ok := strings.CutPrefix(key, repo+":"); ok && !isDigestReference(ref) {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// roundTrip serves proxied registry requests directly from the fake registry.
+func (f *fakeRegistry) roundTrip(r *http.Request) *http.Response {
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, r)
+	resp := rec.Result()
+	resp.Request = r
+	return resp
+}
+
+func (f *fakeRegistry) seed(repo, tag string, image testRegistryImage) {
+	for digest, blob := range image.Blobs {
+		f.blobs[digest] = blob
+		f.links[repo+"@"+digest] = true
+	}
+	f.manifests[repo+":"+tag] = image.Manifest
+	f.manifests[repo+":"+image.ManifestDigest] = image.Manifest
+	f.types[image.ManifestDigest] = ociManifestType
+}
+
+// buildDockerSaveArchive builds a classic `docker save` tarball with one layer.
+func buildDockerSaveArchive(t *testing.T, repoTag string, config, layer []byte) []byte {
+	t.Helper()
+	configName := strings.TrimPrefix(testDigest(config), "sha256:") + ".json"
+	layerName := "0123456789abcdef/layer.tar"
+	manifest, err := json.Marshal([]dockerSaveManifest{{Config: configName, RepoTags: []string{repoTag}, Layers: []string{layerName}}})
+	if err != nil {
+		t.Fatalf("marshal manifest.json: %v", err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{configName, config},
+		{"0123456789abcdef/VERSION", []byte("1.0")},
+		{layerName, layer},
+		{dockerManifest, manifest},
+	} {
+		if err := writeTarFile(tw, entry.name, entry.data); err != nil {
+			t.Fatalf("write tar: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func serveImportRequest(t *testing.T, token, path string, archive []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(archive))
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestImageImportDockerSaveArchiveIsPullable(t *testing.T) {
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`)
+	layer := []byte("uncompressed layer tar")
+	archive := buildDockerSaveArchive(t, "docker.io/library/app:v2", config, layer)
+
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var payload importPayload
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if payload.Repo != "team1/app" || payload.Tag != "v2" || payload.Digest == "" {
+		t.Fatalf("unexpected payload: %#v", payload)
+	}
+
+	image, err := resolveExportImage(context.Background(), "team1/app", "v2")
+	if err != nil {
+		t.Fatalf("expected imported image to be pullable: %v", err)
+	}
+	if image.ManifestDigest != payload.Digest || image.Manifest.Config.Digest != testDigest(config) {
+		t.Fatalf("unexpected imported manifest: %#v", image.Manifest)
+	}
+	if len(image.Manifest.Layers) != 1 || image.Manifest.Layers[0].MediaType != ociLayerType {
+		t.Fatalf("unexpected layers: %#v", image.Manifest.Layers)
+	}
+	if err := writeImageTar(context.Background(), io.Discard, "team1/app", "v2", image); err != nil {
+		t.Fatalf("pull imported image: %v", err)
+	}
+	if !bytes.Equal(registry.blobs[testDigest(layer)], layer) {
+		t.Fatalf("expected layer blob to be stored")
+	}
+}
+
+func TestImageImportRoundTripsExport(t *testing.T) {
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	registry.seed("team1/app", "v1", image)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/repos/team1/app/tags/v1/export", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	cvRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export failed: %d", rec.Code)
+	}
+
+	rec = serveImportRequest(t, token, "/api/repos/team1/copy/import?tag=restored", rec.Body.Bytes())
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := registry.manifests["team1/copy:restored"]; !bytes.Equal(got, image.Manifest) {
+		t.Fatalf("expected manifest to be imported unchanged")
+	}
+}
+
+func TestImageImportRequiresPushPermission(t *testing.T) {
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{}`), []byte("layer"))
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1", PullOnly: true}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	rec = serveImportRequest(t, token, "/api/repos/team2/app/import", archive)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for foreign namespace, got %d", rec.Code)
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatalf("expected nothing to be pushed")
+	}
+}
+
+func TestImageImportRejectsDigestMismatch(t *testing.T) {
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	config := []byte(`{"os":"linux"}`)
+	archive := buildDockerSaveArchive(t, "app:v1", config, []byte("layer"))
+	// Keep the digest-derived config file name but tamper with its content.
+	archive = bytes.Replace(archive, config, []byte(`{"os":"LINUX"}`), 1)
+
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "digest mismatch") {
+		t.Fatalf("unexpected body: %q", rec.Body.String())
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatalf("expected nothing to be pushed")
+	}
+}
+
+func TestImageImportHonorsQuota(t *testing.T) {
+	prev := importMaxBytes
+	importMaxBytes = 512
+	t.Cleanup(func() { importMaxBytes = prev })
+
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{}`), bytes.Repeat([]byte("x"), 4096))
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rec.Code)
+	}
+}
+
+func TestImageImportCapsExtractedSize(t *testing.T) {
+	prev := importMaxBytes
+	importMaxBytes = 64 << 10
+	t.Cleanup(func() { importMaxBytes = prev })
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(buildDockerSaveArchive(t, "app:v1", []byte(`{}`), make([]byte, 4<<20))); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+	if int64(compressed.Len()) >= importMaxBytes {
+		t.Fatalf("expected the compressed archive to fit the quota, got %d bytes", compressed.Len())
+	}
+
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", compressed.Bytes())
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatalf("expected nothing to be pushed")
+	}
+}
+
+func TestImageImportAppliesRegistryPushPolicies(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{UniqueTagDigests: true})
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	logs := captureLogs(t)
+
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{}`), []byte("layer"))
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	if rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive); rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, entry := range []string{`audit action=push user="alice" target="team1/app:v1"`, `audit action=import user="alice" target="team1/app:v1"`} {
+		if !strings.Contains(logs.String(), entry) {
+			t.Fatalf("expected %q in the audit log, got %q", entry, logs.String())
+		}
+	}
+
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import?tag=v2", archive)
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "already tagged as") {
+		t.Fatalf("expected the duplicate tag to be refused with 409, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := registry.manifests["team1/app:v2"]; ok {
+		t.Fatalf("expected the duplicate tag not to be created")
+	}
+}
+
+func TestImageImportIsRateLimited(t *testing.T) {
+	withRepoRateLimiter(t, repoRateConfig{Rate: 0.001, Burst: 2})
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{}`), []byte("layer"))
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(registry.manifests) != 0 {
+		t.Fatalf("expected nothing to be tagged")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/sync/singleflight"
+)
+
+// jwtLeeway tolerates clock skew between us and the IdP when checking exp/nbf.
+const jwtLeeway = 30 * time.Second
+
+// jwksMinRefresh limits refetches triggered by tokens with an unknown key ID.
+const jwksMinRefresh = 30 * time.Second
+
+var errJWTInvalid = errors.New("invalid token")
+
+type oidcConfig struct {
+	JWKSURL       string
+	Issuer        string
+	Audience      string
+	GroupsClaim   string
+	UsernameClaim string
+	JWKSCacheTTL  time.Duration
+}
+
+func loadOIDCConfig() oidcConfig {
+	return oidcConfig{
+		JWKSURL:       strings.TrimSpace(getEnv("OIDC_JWKS_URL", "")),
+		Issuer:        strings.TrimSpace(getEnv("OIDC_ISSUER", "")),
+		Audience:      strings.TrimSpace(getEnv("OIDC_AUDIENCE", "")),
+		GroupsClaim:   strings.TrimSpace(getEnv("OIDC_GROUPS_CLAIM", "groups")),
+		UsernameClaim: strings.TrimSpace(getEnv("OIDC_USERNAME_CLAIM", "preferred_username")),
+		JWKSCacheTTL:  getEnvDuration("OIDC_JWKS_CACHE_TTL", 10*time.Minute),
+	}
+}
+
+// validateOIDCConfig refuses an enabled OIDC setup that would accept tokens
+// minted for any issuer or audience the JWKS keys sign for.
+func validateOIDCConfig(cfg oidcConfig) error {
+	if cfg.JWKSURL == "" {
+		return nil
+	}
+	if cfg.Issuer == "" {
+		return errors.New("OIDC_ISSUER must be set with OIDC_JWKS_URL")
+	}
+	if cfg.Audience == "" {
+		return errors.New("OIDC_AUDIENCE must be set with OIDC_JWKS_URL")
+	}
+	return nil
+}
+
+// oidcAuthenticator validates Bearer JWTs against the IdP's JWKS and maps a
+// groups claim onto namespace access.
+type oidcAuthenticator struct {
+	cfg    oidcConfig
+	client *http.Client
+	now    func() time.Time
+
+	// fetches collapses concurrent JWKS refreshes so none runs under mu.
+	fetches singleflight.Group
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func newOIDCAuthenticator(cfg oidcConfig) *oidcAuthenticator {
+	return &oidcAuthenticator{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		now:    time.Now,
+	}
+}
+
+func (a *oidcAuthenticator) enabled() bool {
+	return a.cfg.JWKSURL != ""
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authenticate verifies token and returns the user and access derived from
+// its groups claim, using the same group naming rules as LDAP.
+func (a *oidcAuthenticator) authenticate(ctx context.Context, token string) (*User, []Access, error) {
+	claims, err := a.verify(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	username := claimString(claims, a.cfg.UsernameClaim)
+	if username == "" {
+		username = claimString(claims, "sub")
+	}
+	if username == "" {
+		return nil, nil, fmt.Errorf("%w: no username claim", errJWTInvalid)
+	}
+
+	groups := claimStrings(claims, a.cfg.GroupsClaim)
+	access, user := accessFromGroups(username, groups, ldapCfg.GroupNamePrefix)
+	access, admin := withAdminAccess(access, groups)
+	if user == nil && admin {
+		user = &User{Name: username}
+	}
+	if user == nil {
+		return nil, nil, fmt.Errorf("no authorized groups for %s", username)
+	}
+	user.Admin = admin
+	return user, access, nil
+}
+
+// jwtAlgorithms are the signature algorithms accepted from the IdP; HMAC and
+// "none" are never accepted.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+}
+
+// verify checks the token signature, issuer, audience and validity window and
+// returns its claims.
+func (a *oidcAuthenticator) verify(ctx context.Context, token string) (map[string]any, error) {
+	jws, err := jose.ParseSignedCompact(token, jwtAlgorithms)
+	if err != nil || len(jws.Signatures) != 1 {
+		return nil, fmt.Errorf("%w: malformed", errJWTInvalid)
+	}
+
+	key, err := a.key(ctx, jws.Signatures[0].Header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := jws.Verify(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", errJWTInvalid)
+	}
+
+	var claims map[string]any
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: bad json", errJWTInvalid)
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *oidcAuthenticator) checkClaims(claims map[string]any) error {
+	now := a.now()
+	exp, ok := claimTime(claims, "exp")
+	if !ok {
+		return fmt.Errorf("%w: missing exp", errJWTInvalid)
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return fmt.Errorf("%w: expired", errJWTInvalid)
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return fmt.Errorf("%w: not yet valid", errJWTInvalid)
+	}
+	if claimString(claims, "iss") != a.cfg.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", errJWTInvalid)
+	}
+	for _, aud := range claimStrings(claims, "aud") {
+		if aud == a.cfg.Audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unexpected audience", errJWTInvalid)
+}
+
+// claimValue resolves a dotted claim path such as "realm_access.roles".
+func claimValue(claims map[string]any, path string) any {
+	var current any = claims
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]any)
+		if !ok {
+			return nil
+		}
+		current = obj[key]
+	}
+	return current
+}
+
+func claimString(claims map[string]any, path string) string {
+	s, _ := claimValue(claims, path).(string)
+	return s
+}
+
+// claimStrings accepts either a single string or an array of strings.
+func claimStrings(claims map[string]any, path string) []string {
+	switch v := claimValue(claims, path).(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func claimTime(claims map[string]any, name string) (time.Time, bool) {
+	n, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// key returns the signing key for kid, refreshing the JWKS when the cache has
+// expired or the key ID is new. The fetch itself runs outside mu so a slow IdP
+// does not stall requests whose keys are already cached.
+func (a *oidcAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	now := a.now()
+	key, ok := a.lookupKey(kid)
+	stale := now.Sub(a.fetchedAt) >= a.cfg.JWKSCacheTTL
+	refresh := stale || now.Sub(a.fetchedAt) >= jwksMinRefresh
+	a.mu.Unlock()
+	if ok && !stale {
+		return key, nil
+	}
+	if refresh {
+		if err := a.refreshKeys(ctx); err != nil {
+			if ok {
+				// Keep serving the cached key if the IdP is briefly unreachable.
+				return key, nil
+			}
+			return nil, err
+		}
+		a.mu.Lock()
+		key, ok = a.lookupKey(kid)
+		a.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errJWTInvalid, kid)
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the JWKS once for all concurrent callers and swaps it
+// into the cache. The fetch is detached from any one caller's cancellation.
+func (a *oidcAuthenticator) refreshKeys(ctx context.Context) error {
+	ch := a.fetches.DoChan("jwks", func() (any, error) {
+		keys, err := fetchJWKS(context.WithoutCancel(ctx), a.client, a.cfg.JWKSURL)
+		if err != nil {
+			return nil, err
+		}
+		a.mu.Lock()
+		a.keys = keys
+		a.fetchedAt = a.now()
+		a.mu.Unlock()
+		return nil, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lookupKey finds kid; tokens without a kid are accepted only when the JWKS
+// holds a single key.
+func (a *oidcAuthenticator) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	key, ok := a.keys[kid]
+	return key, ok
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, jwksURL string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	// Decode keys one by one so a single unsupported entry does not take the
+	// whole set down.
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(raw); err != nil {
+			continue
+		}
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if !jwk.Valid() || !jwk.IsPublic() {
+			continue
+		}
+		keys[jwk.KeyID] = jwk.Key
+	}
+	return keys, nil
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "container-vault"
+)
+
+type testSigner struct {
+	kid string
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newRSASigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	return testSigner{kid: kid, rsa: key}
+}
+
+func newECSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ec key: %v", err)
+	}
+	return testSigner{kid: kid, ec: key}
+}
+
+func (s testSigner) jwk() map[string]string {
+	if s.rsa != nil {
+		return map[string]string{
+			"kty": "RSA", "kid": s.kid, "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(s.rsa.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.rsa.E)).Bytes()),
+		}
+	}
+	x, y := make([]byte, 32), make([]byte, 32)
+	s.ec.X.FillBytes(x)
+	s.ec.Y.FillBytes(y)
+	return map[string]string{
+		"kty": "EC", "kid": s.kid, "crv": "P-256",
+		"x": base64.RawURLEncoding.EncodeToString(x),
+		"y": base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+func (s testSigner) sign(t *testing.T, alg string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": s.kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch {
+	case alg == "none":
+	case s.rsa != nil:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, digest[:])
+	default:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims(groups ...any) map[string]any {
+	return map[string]any{
+		"iss":                testIssuer,
+		"aud":                []string{"other", testAudience},
+		"sub":                "u-123",
+		"preferred_username": "alice",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nbf":                time.Now().Add(-time.Minute).Unix(),
+		"groups":             groups,
+	}
+}
+
+func withOIDCAuth(t *testing.T, signers ...testSigner) *oidcAuthenticator {
+	t.Helper()
+	keys := make([]map[string]string, 0, len(signers))
+	for _, s := range signers {
+		keys = append(keys, s.jwk())
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	}))
+	t.Cleanup(server.Close)
+
+	prev := oidcAuth
+	oidcAuth = newOIDCAuthenticator(oidcConfig{
+		JWKSURL:       server.URL,
+		Issuer:        testIssuer,
+		Audience:      testAudience,
+		GroupsClaim:   "groups",
+		UsernameClaim: "preferred_username",
+		JWKSCacheTTL:  time.Minute,
+	})
+	t.Cleanup(func() {
+		oidcAuth = prev
+	})
+	return oidcAuth
+}
+
+func serveBearerRequest(t *testing.T, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBearerJWTGrantsGroupAccess(t *testing.T) {
+	signer := newRSASigner(t, "key-1")
+	withOIDCAuth(t, signer)
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "manifest")
+	})
+
+	token := signer.sign(t, "RS256", validClaims("team1_rw", "unrelated"))
+	rec := serveBearerRequest(t, "/v2/team1/app/manifests/v1", token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveBearerRequest(t, "/v2/team2/app/manifests/v1", token)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 outside the token's groups, got %d", rec.Code)
+	}
+}
+
+func TestBearerJWTRejectsInvalidTokens(t *testing.T) {
+	signer := newRSASigner(t, "key-1")
+	other := newRSASigner(t, "key-1")
+	withOIDCAuth(t, signer)
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "manifest")
+	})
+
+	claimsWith := func(key string, value any) map[string]any {
+		claims := validClaims("team1_rw")
+		claims[key] = value
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", signer.sign(t, "RS256", claimsWith("exp", time.Now().Add(-time.Hour).Unix()))},
+		{"not yet valid", signer.sign(t, "RS256", claimsWith("nbf", time.Now().Add(time.Hour).Unix()))},
+		{"missing exp", signer.sign(t, "RS256", claimsWith("exp", nil))},
+		{"wrong issuer", signer.sign(t, "RS256", claimsWith("iss", "https://evil.example.com"))},
+		{"wrong audience", signer.sign(t, "RS256", claimsWith("aud", "someone-else"))},
+		{"bad signature", other.sign(t, "RS256", validClaims("team1_rw"))},
+		{"alg none", signer.sign(t, "none", validClaims("team1_rw"))},
+		{"unknown kid", newRSASigner(t, "key-2").sign(t, "RS256", validClaims("team1_rw"))},
+		{"no groups", signer.sign(t, "RS256", validClaims())},
+		{"garbage", "not.a.jwt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveBearerRequest(t, "/v2/team1/app/manifests/v1", tt.token)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", rec.Code)
+			}
+			if rec.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+				t.Fatalf("unexpected WWW-Authenticate: %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestOIDCAuthenticateES256AndNestedClaim(t *testing.T) {
+	signer := newECSigner(t, "ec-1")
+	auth := withOIDCAuth(t, signer)
+	auth.cfg.GroupsClaim = "realm_access.roles"
+
+	claims := validClaims()
+	claims["realm_access"] = map[string]any{"roles": []string{"cn=team3_rwd,ou=groups,dc=example,dc=com"}}
+	user, access, err := auth.authenticate(context.Background(), signer.sign(t, "ES256", claims))
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if user.Name != "alice" || len(access) != 1 || access[0].Namespace != "team3" || !access[0].DeleteAllowed {
+		t.Fatalf("unexpected result: %+v %+v", user, access)
+	}
+}
+
+func TestOIDCRejectsAlgorithmKeyMismatch(t *testing.T) {
+	signer := newECSigner(t, "ec-1")
+	auth := withOIDCAuth(t, signer)
+
+	token := signer.sign(t, "ES256", validClaims("team1_r"))
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"ec-1"}`))
+	tampered := header + token[len(base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256","kid":"ec-1","typ":"JWT"}`))):]
+	if _, _, err := auth.authenticate(context.Background(), tampered); !errors.Is(err, errJWTInvalid) {
+		t.Fatalf("expected errJWTInvalid, got %v", err)
+	}
+}
+
+func TestBearerIgnoredWhenOIDCDisabled(t *testing.T) {
+	prev := oidcAuth
+	oidcAuth = newOIDCAuthenticator(oidcConfig{})
+	t.Cleanup(func() {
+		oidcAuth = prev
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	if _, _, ok := authenticate(rec, req); ok {
+		t.Fatalf("expected authentication to fail")
+	}
+	if rec.Header().Get("WWW-Authenticate") != `Basic realm="Registry"` {
+		t.Fatalf("expected Basic challenge, got %q", rec.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestValidateOIDCConfigRequiresIssuerAndAudience(t *testing.T) {
+	if err := validateOIDCConfig(oidcConfig{}); err != nil {
+		t.Fatalf("disabled config should validate: %v", err)
+	}
+	if err := validateOIDCConfig(oidcConfig{JWKSURL: "https://idp", Audience: testAudience}); err == nil {
+		t.Fatalf("expected missing OIDC_ISSUER to be refused")
+	}
+	if err := validateOIDCConfig(oidcConfig{JWKSURL: "https://idp", Issuer: testIssuer}); err == nil {
+		t.Fatalf("expected missing OIDC_AUDIENCE to be refused")
+	}
+	if err := validateOIDCConfig(oidcConfig{JWKSURL: "https://idp", Issuer: testIssuer, Audience: testAudience}); err != nil {
+		t.Fatalf("complete config should validate: %v", err)
+	}
+}
+
+func TestOIDCCachedKeyNotBlockedByJWKSFetch(t *testing.T) {
+	signer := newRSASigner(t, "rsa-1")
+	auth := withOIDCAuth(t, signer)
+	token := signer.sign(t, "RS256", validClaims("team1_r"))
+	if _, _, err := auth.authenticate(context.Background(), token); err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{signer.jwk()}})
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	auth.cfg.JWKSURL = slow.URL
+	auth.fetchedAt = time.Now().Add(-jwksMinRefresh)
+
+	unknown := newRSASigner(t, "rsa-2").sign(t, "RS256", validClaims("team1_r"))
+	go func() {
+		_, _, _ = auth.authenticate(context.Background(), unknown)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := auth.authenticate(context.Background(), token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("authenticate with cached key: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("cached key lookup blocked behind the JWKS fetch")
+	}
+}
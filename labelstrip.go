@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sanitizedBlob is content ContainerVault serves in place of the registry:
+// a config with STRIP_CONFIG_LABELS removed, or a manifest rewritten to point
+// at one.
+type sanitizedBlob struct {
+	MediaType string `json:"media_type"`
+	Body      []byte `json:"body"`
+}
+
+// sanitizedContentStore keeps sanitized copies by the digest they are served
+// under, which digest each original manifest is served as, and which
+// original digests are hidden because they still carry stripped labels. The
+// registry keeps the original bytes. At most size entries are kept in
+// memory, least recently used first out; with a dir, copies are also written
+// there so digests handed out stay pullable after eviction or a restart.
+// Without one they are rebuilt on the next pull by tag.
+type sanitizedContentStore struct {
+	dir  string
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type sanitizedEntry struct {
+	key    string
+	blob   sanitizedBlob
+	served string
+}
+
+func loadSanitizedContentStore() *sanitizedContentStore {
+	return newSanitizedContentStore(strings.TrimSpace(os.Getenv("SANITIZED_CONTENT_DIR")), getEnvInt("SANITIZED_CONTENT_CACHE_SIZE", 10000))
+}
+
+func newSanitizedContentStore(dir string, size int) *sanitizedContentStore {
+	return &sanitizedContentStore{dir: dir, size: size, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (s *sanitizedContentStore) lookup(key string) (sanitizedEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.entries[key]
+	if !ok {
+		return sanitizedEntry{}, false
+	}
+	s.order.MoveToFront(elem)
+	return *elem.Value.(*sanitizedEntry), true
+}
+
+func (s *sanitizedContentStore) store(entry sanitizedEntry) {
+	if s.size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.entries[entry.key]; ok {
+		elem.Value = &entry
+		s.order.MoveToFront(elem)
+		return
+	}
+	s.entries[entry.key] = s.order.PushFront(&entry)
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*sanitizedEntry).key)
+	}
+}
+
+// put stores body for repo and returns the digest it is served under.
+func (s *sanitizedContentStore) put(repo, mediaType string, body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	blob := sanitizedBlob{MediaType: mediaType, Body: body}
+	if err := s.persist(repo, digest, blob); err != nil {
+		return "", err
+	}
+	s.store(sanitizedEntry{key: "blob " + repo + "@" + digest, blob: blob})
+	return digest, nil
+}
+
+func (s *sanitizedContentStore) get(repo, digest string) (sanitizedBlob, bool) {
+	key := "blob " + repo + "@" + digest
+	if entry, ok := s.lookup(key); ok {
+		return entry.blob, true
+	}
+	blob, ok := s.load(repo, digest)
+	if ok {
+		s.store(sanitizedEntry{key: key, blob: blob})
+	}
+	return blob, ok
+}
+
+// rewrite records that source is served as served; an empty served digest
+// means source needed no changes.
+func (s *sanitizedContentStore) rewrite(repo, source, served string) {
+	s.store(sanitizedEntry{key: "rewrite " + repo + "@" + source, served: served})
+}
+
+func (s *sanitizedContentStore) rewritten(repo, source string) (string, bool) {
+	entry, ok := s.lookup("rewrite " + repo + "@" + source)
+	return entry.served, ok
+}
+
+// hide records that the original config digest carries stripped labels, so
+// pulling it directly is refused.
+func (s *sanitizedContentStore) hide(repo, digest string) {
+	s.store(sanitizedEntry{key: "hidden " + repo + "@" + digest})
+}
+
+func (s *sanitizedContentStore) hidden(repo, digest string) bool {
+	_, ok := s.lookup("hidden " + repo + "@" + digest)
+	return ok
+}
+
+// path names the file holding repo@digest, hashed so repository names need
+// no escaping.
+func (s *sanitizedContentStore) path(repo, digest string) string {
+	sum := sha256.Sum256([]byte(repo + "@" + digest))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// persist writes blob through a temp file, so a crash never leaves a copy
+// half written.
+func (s *sanitizedContentStore) persist(repo, digest string, blob sanitizedBlob) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".sanitized-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(repo, digest))
+}
+
+func (s *sanitizedContentStore) load(repo, digest string) (sanitizedBlob, bool) {
+	if s.dir == "" {
+		return sanitizedBlob{}, false
+	}
+	data, err := os.ReadFile(s.path(repo, digest))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("unable to read sanitized copy of %s@%s: %v", repo, digest, err)
+		}
+		return sanitizedBlob{}, false
+	}
+	var blob sanitizedBlob
+	if err := json.Unmarshal(data, &blob); err != nil {
+		log.Printf("unable to read sanitized copy of %s@%s: %v", repo, digest, err)
+		return sanitizedBlob{}, false
+	}
+	return blob, true
+}
+
+// stripLabels returns labels without the keys in STRIP_CONFIG_LABELS.
+func stripLabels(labels map[string]string) map[string]string {
+	if len(strippedConfigLabels) == 0 || len(labels) == 0 {
+		return labels
+	}
+	out := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !slices.Contains(strippedConfigLabels, key) {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// stripConfigLabels removes STRIP_CONFIG_LABELS from an image config's
+// config and container_config label sets, reporting whether anything was
+// removed.
+func stripConfigLabels(body []byte) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var cfg map[string]any
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, false, err
+	}
+	changed := false
+	for _, field := range []string{"config", "container_config"} {
+		section, _ := cfg[field].(map[string]any)
+		labels, _ := section["Labels"].(map[string]any)
+		for _, key := range strippedConfigLabels {
+			if _, ok := labels[key]; ok {
+				delete(labels, key)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return body, false, nil
+	}
+	out, err := json.Marshal(cfg)
+	return out, true, err
+}
+
+// sanitizeManifest rewrites an image manifest to reference a stripped copy
+// of its config, or an index to reference sanitized child manifests. It
+// returns body unchanged when nothing had to be stripped.
+func sanitizeManifest(ctx context.Context, client *http.Client, repo, mediaType string, body []byte) ([]byte, bool, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var manifest map[string]any
+	if err := dec.Decode(&manifest); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	if isManifestListContentType(mediaType) {
+		children, _ := manifest["manifests"].([]any)
+		for _, raw := range children {
+			desc, ok := raw.(map[string]any)
+			if !ok {
+				continue
+			}
+			digest, _ := desc["digest"].(string)
+			childBody, childType, _, err := fetchManifestPayload(ctx, client, repo, digest)
+			if err != nil {
+				return nil, false, err
+			}
+			if isManifestListContentType(childType) {
+				continue
+			}
+			sanitized, childChanged, err := sanitizeManifest(ctx, client, repo, childType, childBody)
+			if err != nil {
+				return nil, false, err
+			}
+			if childChanged {
+				served, err := sanitizedContent.put(repo, childType, sanitized)
+				if err != nil {
+					return nil, false, err
+				}
+				sanitizedContent.rewrite(repo, digest, served)
+				desc["digest"] = served
+				desc["size"] = len(sanitized)
+				changed = true
+			}
+		}
+	} else {
+		config, _ := manifest["config"].(map[string]any)
+		configType, _ := config["mediaType"].(string)
+		if configType != dockerConfigType && configType != ociConfigType {
+			return body, false, nil
+		}
+		digest, _ := config["digest"].(string)
+		configBody, err := fetchBlob(ctx, client, repo, digest)
+		if err != nil {
+			return nil, false, err
+		}
+		stripped, configChanged, err := stripConfigLabels(configBody)
+		if err != nil {
+			return nil, false, err
+		}
+		if configChanged {
+			served, err := sanitizedContent.put(repo, configType, stripped)
+			if err != nil {
+				return nil, false, err
+			}
+			sanitizedContent.hide(repo, digest)
+			config["digest"] = served
+			config["size"] = len(stripped)
+			changed = true
+		}
+	}
+	if !changed {
+		return body, false, nil
+	}
+	out, err := json.Marshal(manifest)
+	return out, true, err
+}
+
+// sanitizeExportImage points an image about to be exported at a copy of its
+// config with STRIP_CONFIG_LABELS removed, as a pull by tag would see it.
+// copyBlobToTar writes that copy from sanitizedContent.
+func sanitizeExportImage(ctx context.Context, repo string, image exportImage) (exportImage, error) {
+	if len(strippedConfigLabels) == 0 {
+		return image, nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	sanitized, changed, err := sanitizeManifest(ctx, client, repo, image.MediaType, image.ManifestBody)
+	if err != nil || !changed {
+		return image, err
+	}
+	var manifest manifestSchema2
+	if err := json.Unmarshal(sanitized, &manifest); err != nil {
+		return image, err
+	}
+	sum := sha256.Sum256(sanitized)
+	image.ManifestBody = sanitized
+	image.ManifestDigest = "sha256:" + hex.EncodeToString(sum[:])
+	image.Manifest = manifest
+	return image, nil
+}
+
+func fetchBlob(ctx context.Context, client *http.Client, repo, digest string) ([]byte, error) {
+	if _, err := (digestPolicy{}).normalizeDigest(digest); err != nil {
+		return nil, err
+	}
+	blobURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/blobs/" + digest})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("blob status: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxManifestBytes {
+		return nil, fmt.Errorf("config %s exceeds %d bytes", digest, maxManifestBytes)
+	}
+	return body, nil
+}
+
+// serveSanitizedContent answers pulls of the digests sanitizeManifestResponse
+// handed out, which exist only in ContainerVault.
+func serveSanitizedContent(w http.ResponseWriter, r *http.Request) bool {
+	if len(strippedConfigLabels) == 0 || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || (route.Kind != registryKindManifests && route.Kind != registryKindBlobs) {
+		return false
+	}
+	blob, ok := sanitizedContent.get(route.Repo, route.Reference)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", blob.MediaType)
+	w.Header().Set("Docker-Content-Digest", route.Reference)
+	w.Header().Set("Content-Length", strconv.Itoa(len(blob.Body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(blob.Body)
+	}
+	return true
+}
+
+// sanitizeManifestResponse serves manifests pulled by tag with their config
+// labels stripped; the rewritten manifest's own digest is served by
+// serveSanitizedContent. Pulling an original manifest that needs stripping by
+// its digest is refused, since those bytes cannot be changed and still match
+// the digest. Failing to sanitize fails the pull rather than leaking the
+// labels.
+func sanitizeManifestResponse(resp *http.Response) error {
+	if len(strippedConfigLabels) == 0 || resp.Request == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	source := resp.Header.Get("Docker-Content-Digest")
+	if source == "" && isDigestReference(route.Reference) {
+		source = route.Reference
+	}
+
+	var body []byte
+	if resp.Request.Method == http.MethodGet {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(body) > maxManifestBytes {
+			return fmt.Errorf("manifest %s exceeds %d bytes", source, maxManifestBytes)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if source == "" {
+			sum := sha256.Sum256(body)
+			source = "sha256:" + hex.EncodeToString(sum[:])
+		}
+	}
+
+	served, ok := sanitizedContent.rewritten(route.Repo, source)
+	if !ok {
+		client := &http.Client{Timeout: 10 * time.Second}
+		if body == nil {
+			// HEAD carries no body; fetch the manifest to learn its served digest.
+			fetched, _, _, err := fetchManifestPayload(resp.Request.Context(), client, route.Repo, source)
+			if err != nil {
+				return fmt.Errorf("sanitize %s@%s: %w", route.Repo, source, err)
+			}
+			body = fetched
+		}
+		sanitized, changed, err := sanitizeManifest(resp.Request.Context(), client, route.Repo, mediaType, body)
+		if err != nil {
+			return fmt.Errorf("sanitize %s@%s: %w", route.Repo, source, err)
+		}
+		served = ""
+		if changed {
+			if served, err = sanitizedContent.put(route.Repo, resp.Header.Get("Content-Type"), sanitized); err != nil {
+				return fmt.Errorf("sanitize %s@%s: %w", route.Repo, source, err)
+			}
+		}
+		sanitizedContent.rewrite(route.Repo, source, served)
+	}
+	if served == "" {
+		return nil
+	}
+	if isDigestReference(route.Reference) {
+		return replaceWithRegistryError(resp, http.StatusForbidden, "DENIED", strippedDigestMessage(route.Repo, route.Reference, served))
+	}
+	blob, ok := sanitizedContent.get(route.Repo, served)
+	if !ok {
+		return fmt.Errorf("sanitized manifest %s missing", served)
+	}
+	resp.Header.Set("Docker-Content-Digest", served)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(blob.Body)))
+	resp.Header.Del("Etag")
+	resp.ContentLength = int64(len(blob.Body))
+	if resp.Request.Method == http.MethodGet {
+		resp.Body = io.NopCloser(bytes.NewReader(blob.Body))
+	}
+	return nil
+}
+
+func strippedDigestMessage(repo, digest, served string) string {
+	if served == "" {
+		return fmt.Sprintf("%s@%s carries labels removed by STRIP_CONFIG_LABELS and cannot be pulled by digest", repo, digest)
+	}
+	return fmt.Sprintf("%s@%s carries labels removed by STRIP_CONFIG_LABELS; pull it by tag or as %s@%s", repo, digest, repo, served)
+}
+
+// hideStrippedConfigResponse refuses direct pulls of an original config that
+// still carries STRIP_CONFIG_LABELS. Configs seen while sanitizing a manifest
+// are remembered; any other small JSON blob is checked as it is pulled, so a
+// client that guesses the original digest, or pulls it after a restart,
+// does not get the labels either. HEAD reveals no content and is let through
+// unless the digest is already known.
+func hideStrippedConfigResponse(resp *http.Response) error {
+	if len(strippedConfigLabels) == 0 || resp.Request == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindBlobs {
+		return nil
+	}
+	if sanitizedContent.hidden(route.Repo, route.Reference) {
+		return replaceWithRegistryError(resp, http.StatusForbidden, "DENIED", strippedDigestMessage(route.Repo, route.Reference, ""))
+	}
+	if resp.Request.Method != http.MethodGet || resp.ContentLength > maxManifestBytes {
+		return nil
+	}
+
+	// Layers are compressed tars and never start like a JSON object.
+	br := bufio.NewReader(resp.Body)
+	original := resp.Body
+	resp.Body = teeReadCloser{Reader: br, Closer: original}
+	if first, err := br.Peek(1); err != nil || first[0] != '{' {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(br, maxManifestBytes+1))
+	if err != nil {
+		return err
+	}
+	resp.Body = teeReadCloser{Reader: io.MultiReader(bytes.NewReader(body), br), Closer: original}
+	if len(body) > maxManifestBytes {
+		return nil
+	}
+	if _, changed, err := stripConfigLabels(body); err != nil || !changed {
+		return nil
+	}
+	sanitizedContent.hide(route.Repo, route.Reference)
+	return replaceWithRegistryError(resp, http.StatusForbidden, "DENIED", strippedDigestMessage(route.Repo, route.Reference, ""))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withStrippedLabels(t *testing.T, labels ...string) {
+	t.Helper()
+	prevLabels, prevStore := strippedConfigLabels, sanitizedContent
+	strippedConfigLabels = labels
+	sanitizedContent = newSanitizedContentStore("", 100)
+	t.Cleanup(func() {
+		strippedConfigLabels, sanitizedContent = prevLabels, prevStore
+	})
+}
+
+// newLabelledRegistryImage is an image without layers whose config carries
+// an internal label and a public one.
+func newLabelledRegistryImage(t *testing.T) testRegistryImage {
+	t.Helper()
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"internal.build-host":"ci-7.corp","org.opencontainers.image.title":"app"}}}`)
+	image := testRegistryImage{ConfigDigest: testDigest(config), Blobs: map[string][]byte{}}
+	image.Blobs[image.ConfigDigest] = config
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        map[string]any{"mediaType": ociConfigType, "digest": image.ConfigDigest, "size": len(config)},
+		"layers":        []any{},
+	})
+	if err != nil {
+		t.Fatalf("marshal manifest: %v", err)
+	}
+	image.Manifest = manifest
+	image.ManifestDigest = testDigest(manifest)
+	return image
+}
+
+func TestStripConfigLabelsOnPull(t *testing.T) {
+	withStrippedLabels(t, "internal.build-host")
+	reg := newFakeRegistry()
+	image := newLabelledRegistryImage(t)
+	reg.seed("team1/app", "latest", image)
+	withProxyUpstream(t, reg.roundTrip)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	served := rec.Header().Get("Docker-Content-Digest")
+	if served == image.ManifestDigest || served != testDigest(rec.Body.Bytes()) {
+		t.Fatalf("expected a rewritten manifest digest, got %s (original %s)", served, image.ManifestDigest)
+	}
+	var manifest manifestReferences
+	if err := json.Unmarshal(rec.Body.Bytes(), &manifest); err != nil || manifest.Config == nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if manifest.Config.Digest == image.ConfigDigest {
+		t.Fatalf("expected the manifest to reference a sanitized config")
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/"+manifest.Config.Digest)
+	if rec.Code != http.StatusOK || testDigest(rec.Body.Bytes()) != manifest.Config.Digest {
+		t.Fatalf("expected sanitized config matching its digest, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "internal.build-host") || !strings.Contains(rec.Body.String(), "org.opencontainers.image.title") {
+		t.Fatalf("expected only the stripped label removed, got %s", rec.Body.String())
+	}
+	if !bytes.Equal(reg.blobs[image.ConfigDigest], image.Blobs[image.ConfigDigest]) {
+		t.Fatalf("expected the stored config to be unchanged")
+	}
+
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+served); rec.Code != http.StatusOK || testDigest(rec.Body.Bytes()) != served {
+		t.Fatalf("expected the served digest to be pullable, got %d", rec.Code)
+	}
+	if rec := serveProxyRequest(t, http.MethodHead, "/v2/team1/app/manifests/latest"); rec.Header().Get("Docker-Content-Digest") != served {
+		t.Fatalf("expected HEAD to report %s, got %q", served, rec.Header().Get("Docker-Content-Digest"))
+	}
+}
+
+func TestStripConfigLabelsFromTagDetails(t *testing.T) {
+	withStrippedLabels(t, "internal.build-host")
+	reg := newFakeRegistry()
+	reg.seed("team1/app", "latest", newLabelledRegistryImage(t))
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	details, err := fetchTagDetails(context.Background(), "team1/app", "latest")
+	if err != nil {
+		t.Fatalf("fetchTagDetails: %v", err)
+	}
+	if _, ok := details.Config.Labels["internal.build-host"]; ok {
+		t.Fatalf("expected stripped label to be hidden, got %v", details.Config.Labels)
+	}
+	if details.Config.Labels["org.opencontainers.image.title"] != "app" {
+		t.Fatalf("expected other labels to be kept, got %v", details.Config.Labels)
+	}
+}
+
+func TestStripConfigLabelsOnExport(t *testing.T) {
+	withStrippedLabels(t, "internal.build-host")
+	reg := newFakeRegistry()
+	image := newLabelledRegistryImage(t)
+	reg.seed("team1/app", "latest", image)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+	token := seedSession(t, "alice", []string{"team1"})
+
+	rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/latest/export")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	entries := readTarEntries(t, rec.Body.Bytes())
+	var index ociIndex
+	if err := json.Unmarshal(entries[ociIndexFile], &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("decode index: %v", err)
+	}
+	manifestPath, _ := blobTarPath(index.Manifests[0].Digest)
+	var manifest manifestReferences
+	if err := json.Unmarshal(entries[manifestPath], &manifest); err != nil || manifest.Config == nil {
+		t.Fatalf("decode manifest %s: %v", manifestPath, err)
+	}
+	if index.Manifests[0].Digest == image.ManifestDigest || testDigest(entries[manifestPath]) != index.Manifests[0].Digest {
+		t.Fatalf("expected the index to reference the rewritten manifest")
+	}
+	configPath, _ := blobTarPath(manifest.Config.Digest)
+	config := entries[configPath]
+	if testDigest(config) != manifest.Config.Digest || strings.Contains(string(config), "internal.build-host") || !strings.Contains(string(config), "org.opencontainers.image.title") {
+		t.Fatalf("expected a sanitized config matching its descriptor, got %s", config)
+	}
+	if originalPath, _ := blobTarPath(image.ConfigDigest); entries[originalPath] != nil {
+		t.Fatalf("expected the labelled config to stay out of the archive")
+	}
+}
+
+func TestStripConfigLabelsRefusesOriginalDigests(t *testing.T) {
+	withStrippedLabels(t, "internal.build-host")
+	reg := newFakeRegistry()
+	image := newLabelledRegistryImage(t)
+	reg.seed("team1/app", "latest", image)
+	withProxyUpstream(t, reg.roundTrip)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	// Before and after anything was pulled by tag, as after a restart.
+	for _, pulled := range []bool{false, true} {
+		sanitizedContent = newSanitizedContentStore("", 100)
+		if pulled {
+			if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest"); rec.Code != http.StatusOK {
+				t.Fatalf("expected the tag to be pullable, got %d: %s", rec.Code, rec.Body.String())
+			}
+		}
+		for _, path := range []string{"/v2/team1/app/manifests/" + image.ManifestDigest, "/v2/team1/app/blobs/" + image.ConfigDigest} {
+			rec := serveProxyRequest(t, http.MethodGet, path)
+			if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "ci-7.corp") {
+				t.Fatalf("expected GET %s to be refused (pulled by tag first: %v), got %d: %s", path, pulled, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestSanitizedContentSurvivesRestart(t *testing.T) {
+	withStrippedLabels(t, "internal.build-host")
+	dir := t.TempDir()
+	sanitizedContent = newSanitizedContentStore(dir, 100)
+	reg := newFakeRegistry()
+	reg.seed("team1/app", "latest", newLabelledRegistryImage(t))
+	withProxyUpstream(t, reg.roundTrip)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	served := rec.Header().Get("Docker-Content-Digest")
+
+	sanitizedContent = newSanitizedContentStore(dir, 100)
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+served)
+	if rec.Code != http.StatusOK || testDigest(rec.Body.Bytes()) != served {
+		t.Fatalf("expected %s to stay pullable after a restart, got %d: %s", served, rec.Code, rec.Body.String())
+	}
+}
+
+func TestSanitizedContentStoreIsBounded(t *testing.T) {
+	store := newSanitizedContentStore("", 2)
+	first, _ := store.put("team1/app", ociConfigType, []byte(`{"a":1}`))
+	second, _ := store.put("team1/app", ociConfigType, []byte(`{"b":2}`))
+	if _, ok := store.get("team1/app", first); !ok {
+		t.Fatalf("expected %s to be stored", first)
+	}
+	third, _ := store.put("team1/app", ociConfigType, []byte(`{"c":3}`))
+	if _, ok := store.get("team1/app", second); ok {
+		t.Fatalf("expected the least recently used entry to be evicted")
+	}
+	for _, digest := range []string{first, third} {
+		if _, ok := store.get("team1/app", digest); !ok {
+			t.Fatalf("expected %s to be kept", digest)
+		}
+	}
+}
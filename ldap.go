@@ -1,9 +1,14 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-ldap/ldap/v3"
 )
@@ -13,45 +18,377 @@ func ldapAuthenticate(username, password string) (*User, error) {
 	return user, err
 }
 
+// errLDAPBusy is returned when no bind slot became available in time.
+var errLDAPBusy = errors.New("ldap directory busy")
+
+var errLDAPUserNotFound = errors.New("not found")
+
+// errLDAPInvalidCredentials is returned when the directory rejects the user's bind.
+var errLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// errLDAPSearchFailed is returned when the directory could not be read for a
+// reason other than the user's credentials, such as a failed group search or
+// service account bind.
+var errLDAPSearchFailed = errors.New("ldap search failed")
+
+// errLDAPNoServiceAccount is returned when a lookup has neither LDAP_BIND_USER
+// nor the caller's password to bind with, as for admins who authenticated
+// with a bearer token or client certificate.
+var errLDAPNoServiceAccount = errors.New("LDAP_BIND_USER is required to look up users without a password")
+
+var ldapDirectoryAuth = ldapAuthenticateDirectory
+
 func ldapAuthenticateAccess(username, password string) (*User, []Access, error) {
-	conn, err := dialLDAP(ldapCfg)
+	release, err := ldapBinds.acquire()
 	if err != nil {
 		return nil, nil, err
 	}
+	defer release()
+	if !ldapCircuit.allow() {
+		return nil, nil, errLDAPUnavailable
+	}
+	user, access, err := ldapDirectoryAuth(username, password)
+	ldapCircuit.record(!errors.Is(err, errLDAPUnreachable))
+	return user, access, err
+}
+
+// bindLimiter caps the number of outstanding LDAP binds. A nil limiter is unlimited.
+type bindLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+	waiting atomic.Int64
+}
+
+func newBindLimiter(limit int, timeout time.Duration) *bindLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &bindLimiter{
+		slots:   make(chan struct{}, limit),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a bind slot, waiting up to the queue timeout. A zero timeout fails fast.
+func (l *bindLimiter) acquire() (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if l.timeout <= 0 {
+		return nil, errLDAPBusy
+	}
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errLDAPBusy
+	}
+}
+
+// inUse reports the slots held by outstanding binds.
+func (l *bindLimiter) inUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// waiters reports the binds queued for a slot.
+func (l *bindLimiter) waiters() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.waiting.Load()
+}
+
+// ldapConn is the subset of *ldap.Conn used to authenticate a user.
+type ldapConn interface {
+	ldapSearcher
+	Bind(username, password string) error
+}
+
+func ldapAuthenticateDirectory(username, password string) (*User, []Access, error) {
+	conn, err := dialLDAP(ldapCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", errLDAPUnreachable, err)
+	}
 	defer conn.Close()
+	return authenticateCached(timeLDAP(conn, ldapCfg.SlowThreshold), username, password)
+}
+
+// slowLDAPConn logs binds and searches on conn that exceed threshold.
+type slowLDAPConn struct {
+	conn      ldapConn
+	threshold time.Duration
+}
+
+// timeLDAP wraps conn with slow-operation logging when threshold is positive.
+func timeLDAP(conn ldapConn, threshold time.Duration) ldapConn {
+	if threshold <= 0 {
+		return conn
+	}
+	return slowLDAPConn{conn: conn, threshold: threshold}
+}
 
-	mail := username
-	if !strings.Contains(username, "@") && ldapCfg.UserMailDomain != "" {
-		domain := ldapCfg.UserMailDomain
-		if !strings.HasPrefix(domain, "@") {
-			domain = "@" + domain
+func (c slowLDAPConn) Bind(username, password string) error {
+	start := time.Now()
+	err := c.conn.Bind(username, password)
+	c.observe("bind", start, err)
+	return err
+}
+
+func (c slowLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	start := time.Now()
+	sr, err := c.conn.Search(req)
+	c.observe("search base="+req.BaseDN, start, err)
+	return sr, err
+}
+
+func (c slowLDAPConn) observe(op string, start time.Time, err error) {
+	elapsed := time.Since(start)
+	if elapsed <= c.threshold {
+		return
+	}
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	log.Printf("WARN slow ldap %s took %s (threshold %s, %s)", op, elapsed.Round(time.Millisecond), c.threshold, outcome)
+}
+
+// authenticateConn binds as the user and reads their groups with that same
+// bound connection.
+func authenticateConn(conn ldapConn, username, password string) (*User, []Access, error) {
+	id, entry, err := locateUser(conn, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := bindUser(conn, id, password); err != nil {
+		return nil, nil, err
+	}
+
+	if entry == nil {
+		if entry, err = userEntry(conn, username); err != nil {
+			return nil, nil, err
 		}
-		mail = username + domain
 	}
+	groups, err := entryGroups(conn, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Println("groups for", username, ":", groups)
+	fmt.Println(groups)
+	name := canonicalUsername(entry, username)
+	access, user := accessFromGroups(name, groups, ldapCfg.GroupNamePrefix)
+	access, admin := withAdminAccess(access, groups)
+	if user == nil && admin {
+		user = &User{Name: name}
+	}
+	if user == nil {
+		return nil, nil, fmt.Errorf("no authorized groups for %s", username)
+	}
+	user.Admin = admin
+
+	return user, access, nil
+}
+
+var ldapLookup = ldapLookupAccess
+
+// ldapLookupAccess resolves the access of target without needing target's
+// password. It binds as the service account when LDAP_BIND_USER is set, and
+// otherwise as the given (already authenticated) user, which needs their
+// password.
+func ldapLookupAccess(bindUsername, bindPassword, target string) ([]Access, error) {
+	if ldapCfg.BindUser == "" && bindPassword == "" {
+		return nil, errLDAPNoServiceAccount
+	}
+	release, err := ldapBinds.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	conn, err := dialLDAP(ldapCfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	timed := timeLDAP(conn, ldapCfg.SlowThreshold)
+
+	if ldapCfg.BindUser != "" {
+		// The caller is already authenticated; read target as the service account.
+		err = bindServiceAccount(timed)
+	} else {
+		err = bindUser(timed, bindIdentity(bindUsername), bindPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups, err := userGroups(timed, target)
+	if err != nil {
+		return nil, err
+	}
+	access, _ := accessFromGroups(target, groups, ldapCfg.GroupNamePrefix)
+	access, _ = withAdminAccess(access, groups)
+	return access, nil
+}
+
+// userMail maps a bare username to its mail/UPN form using the configured domain.
+func userMail(username string) string {
+	if strings.Contains(username, "@") || ldapCfg.UserMailDomain == "" {
+		return username
+	}
+	domain := ldapCfg.UserMailDomain
+	if !strings.HasPrefix(domain, "@") {
+		domain = "@" + domain
+	}
+	return username + domain
+}
 
-	// Bind as the user using only the mail/UPN form.
-	bindIDs := []string{mail}
+// userDN builds the user's DN from LDAP_BIND_DN_TEMPLATE.
+func userDN(username string) string {
+	return fmt.Sprintf(ldapCfg.UserDNTemplate, ldap.EscapeDN(username))
+}
+
+// bindIdentity is the name the user binds as: their templated DN when
+// LDAP_BIND_DN_TEMPLATE is set, otherwise the mail/UPN form.
+func bindIdentity(username string) string {
+	if ldapCfg.UserDNTemplate != "" {
+		return userDN(username)
+	}
+	return userMail(username)
+}
+
+// locateUser finds the DN username binds as. With LDAP_BIND_USER the
+// service account binds first and searches LDAP_USER_BASE_DN for the user,
+// returning the entry found; otherwise the DN or mail/UPN is derived from the
+// username and entry is nil. A failed user bind leaves the connection
+// anonymous (RFC 4513), never bound as the service account, and callers
+// close it without issuing further requests.
+func locateUser(conn ldapConn, username string) (string, *ldap.Entry, error) {
+	if ldapCfg.BindUser == "" {
+		return bindIdentity(username), nil, nil
+	}
+	if err := bindServiceAccount(conn); err != nil {
+		return "", nil, err
+	}
+	entry, err := searchUserEntry(conn, userMail(username))
+	if err != nil {
+		return "", nil, err
+	}
+	return entry.DN, entry, nil
+}
+
+// bindServiceAccount binds as LDAP_BIND_USER. Its failure is the
+// deployment's, not the user's, so it is reported as errLDAPSearchFailed.
+func bindServiceAccount(conn ldapConn) error {
+	start := time.Now()
+	err := conn.Bind(ldapCfg.BindUser, ldapCfg.BindPassword)
+	ldapBindDurations.observe(time.Since(start))
+	if err != nil {
+		return fmt.Errorf("%w: service account bind: %w", errLDAPSearchFailed, err)
+	}
+	return nil
+}
+
+// userGroups reads the groups of username on an already bound connection.
+func userGroups(conn ldapSearcher, username string) ([]string, error) {
+	entry, err := userEntry(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	return entryGroups(conn, entry)
+}
+
+// userEntry reads the directory entry of username on an already bound connection.
+func userEntry(conn ldapSearcher, username string) (*ldap.Entry, error) {
+	if ldapCfg.UserDNTemplate != "" {
+		return searchEntry(conn, userDN(username))
+	}
+	return searchUserEntry(conn, userMail(username))
+}
+
+// canonicalUsername is the name recorded for a login: the LDAP_USERNAME_ATTR
+// value of entry when set, so a user signing in by email is logged under
+// e.g. their sAMAccountName, otherwise the name they signed in with.
+func canonicalUsername(entry *ldap.Entry, login string) string {
+	if ldapCfg.UsernameAttribute == "" {
+		return login
+	}
+	if name := strings.TrimSpace(entry.GetAttributeValue(ldapCfg.UsernameAttribute)); name != "" {
+		return name
+	}
+	return login
+}
+
+func bindUser(conn ldapConn, id, password string) error {
+	// Bind as the user using only the mail/UPN form or templated DN.
+	bindIDs := []string{id}
 
 	var bindErr error
 	for _, id := range bindIDs {
 		if id == "" {
 			continue
 		}
-		if err := conn.Bind(id, password); err == nil {
+		start := time.Now()
+		err := conn.Bind(id, password)
+		ldapBindDurations.observe(time.Since(start))
+		if err == nil {
 			bindErr = nil
 			break
-		} else {
-			bindErr = err
 		}
+		bindErr = err
+	}
+	if ldap.IsErrorWithCode(bindErr, ldap.LDAPResultInvalidCredentials) {
+		return fmt.Errorf("ldap bind failed: %w: %w", errLDAPInvalidCredentials, bindErr)
 	}
 	if bindErr != nil {
-		return nil, nil, fmt.Errorf("ldap bind failed: %w", bindErr)
+		return fmt.Errorf("ldap bind failed: %w", bindErr)
 	}
+	return nil
+}
+
+// ldapSearcher is the subset of *ldap.Conn used for directory searches.
+type ldapSearcher interface {
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+}
 
-	filter := fmt.Sprintf(ldapCfg.UserFilter, mail)
+// ldapFilter fills the %s placeholders of a configured filter with value,
+// escaped per RFC 4515 so user input cannot add clauses or wildcards. Every
+// filter built from user-supplied values goes through here.
+func ldapFilter(template, value string) string {
+	escaped := ldap.EscapeFilter(value)
+	return strings.ReplaceAll(template, "%s", escaped)
+}
+
+func searchUserGroups(conn ldapSearcher, mail string) ([]string, error) {
+	entry, err := searchUserEntry(conn, mail)
+	if err != nil {
+		return nil, err
+	}
+	return entryGroups(conn, entry)
+}
+
+// searchUserEntry finds the entry matching LDAP_USER_FILTER for mail.
+func searchUserEntry(conn ldapSearcher, mail string) (*ldap.Entry, error) {
+	filter := ldapFilter(ldapCfg.UserFilter, mail)
 	fmt.Println("filter", filter)
+	baseDN := ldapCfg.UserBaseDN
+	if baseDN == "" {
+		baseDN = ldapCfg.BaseDN
+	}
 	searchReq := ldap.NewSearchRequest(
-		ldapCfg.BaseDN,
+		baseDN,
 		ldap.ScopeWholeSubtree,
 		ldap.NeverDerefAliases, 1, 0, false,
 		filter,
@@ -61,38 +398,345 @@ func ldapAuthenticateAccess(username, password string) (*User, []Access, error)
 
 	sr, err := conn.Search(searchReq)
 	if err != nil {
-		return nil, nil, fmt.Errorf("ldap search: %w", err)
+		return nil, fmt.Errorf("%w: %w", errLDAPSearchFailed, err)
 	}
 	if len(sr.Entries) == 0 {
-		return nil, nil, fmt.Errorf("user %s not found", mail)
+		return nil, fmt.Errorf("user %s %w", mail, errLDAPUserNotFound)
+	}
+	return sr.Entries[0], nil
+}
+
+// searchEntryGroups reads the groups of the entry at dn with a base-scoped
+// search, for directories where users bind by DN.
+func searchEntryGroups(conn ldapSearcher, dn string) ([]string, error) {
+	entry, err := searchEntry(conn, dn)
+	if err != nil {
+		return nil, err
+	}
+	return entryGroups(conn, entry)
+}
+
+// searchEntry reads the group and username attributes of the entry at dn.
+func searchEntry(conn ldapSearcher, dn string) (*ldap.Entry, error) {
+	attributes := []string{ldapCfg.GroupAttribute}
+	if ldapCfg.UsernameAttribute != "" {
+		attributes = append(attributes, ldapCfg.UsernameAttribute)
 	}
+	searchReq := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)",
+		attributes,
+		nil,
+	)
 
-	entry := sr.Entries[0]
+	sr, err := conn.Search(searchReq)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, fmt.Errorf("user %s %w", dn, errLDAPUserNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errLDAPSearchFailed, err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, fmt.Errorf("user %s %w", dn, errLDAPUserNotFound)
+	}
+	return sr.Entries[0], nil
+}
 
+// entryGroups returns the group attribute values of entry plus, when
+// LDAP_GROUP_FILTER is set, the groups listing it as a member, and with
+// LDAP_NESTED_GROUPS or LDAP_NESTED_GROUP_DEPTH the groups containing those.
+func entryGroups(conn ldapSearcher, entry *ldap.Entry) ([]string, error) {
 	groups := entry.GetAttributeValues(ldapCfg.GroupAttribute)
-	fmt.Println("groups for", username, ":", groups)
-	fmt.Println(groups)
-	access, user := accessFromGroups(username, groups, ldapCfg.GroupNamePrefix)
-	if user == nil {
-		return nil, nil, fmt.Errorf("no authorized groups for %s", username)
+	if ldapCfg.GroupFilter != "" {
+		memberGroups, err := searchMemberGroups(conn, entry.DN)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, memberGroups...)
 	}
+	if ldapCfg.NestedGroups && ldapCfg.NestedGroupsMethod == nestedGroupsInChain {
+		chainGroups, err := searchGroupsInChain(conn, entry.DN)
+		if err != nil {
+			return nil, err
+		}
+		return append(groups, chainGroups...), nil
+	}
+	if ldapCfg.NestedGroupDepth <= 0 || (ldapCfg.GroupFilter == "" && !ldapCfg.NestedGroups) {
+		return groups, nil
+	}
+	return nestedGroups(conn, groups)
+}
 
-	return user, access, nil
+// nestedGroups adds the groups that contain groups, level by level up to
+// LDAP_NESTED_GROUP_DEPTH. Each group found is searched once, so membership
+// cycles end, and at most LDAP_GROUP_SEARCH_CONCURRENCY searches run at a
+// time so a user in many groups cannot flood the directory.
+func nestedGroups(conn ldapSearcher, groups []string) ([]string, error) {
+	seen := make(map[string]bool, len(groups))
+	all := make([]string, 0, len(groups))
+	for _, group := range groups {
+		if !seen[group] {
+			seen[group] = true
+			all = append(all, group)
+		}
+	}
+	level := all
+	for depth := 0; depth < ldapCfg.NestedGroupDepth && len(level) > 0; depth++ {
+		parents, err := groupParentsConcurrently(conn, level, ldapCfg.GroupSearchConcurrency)
+		if err != nil {
+			return nil, err
+		}
+		var next []string
+		for _, parent := range parents {
+			if !seen[parent] {
+				seen[parent] = true
+				next = append(next, parent)
+			}
+		}
+		all = append(all, next...)
+		level = next
+	}
+	return all, nil
 }
 
+// groupParentsConcurrently runs groupParents for every DN with at most limit
+// searches in flight, returning the groups in DN order.
+func groupParentsConcurrently(conn ldapSearcher, dns []string, limit int) ([]string, error) {
+	if limit <= 0 {
+		limit = 1
+	}
+	results := make([][]string, len(dns))
+	errs := make([]error, len(dns))
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, dn := range dns {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i], errs[i] = groupParents(conn, dn)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, result := range results {
+		groups = append(groups, result...)
+	}
+	return groups, nil
+}
+
+// groupParents finds the groups the group at dn belongs to: those listing it
+// under LDAP_GROUP_FILTER and, with LDAP_NESTED_GROUPS, those in its own
+// group attribute.
+func groupParents(conn ldapSearcher, dn string) ([]string, error) {
+	var parents []string
+	if ldapCfg.GroupFilter != "" {
+		memberGroups, err := searchMemberGroups(conn, dn)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, memberGroups...)
+	}
+	if ldapCfg.NestedGroups {
+		memberOf, err := searchGroupMemberOf(conn, dn)
+		if err != nil {
+			return nil, err
+		}
+		parents = append(parents, memberOf...)
+	}
+	return parents, nil
+}
+
+// searchGroupMemberOf reads the group attribute of the group entry at dn.
+// Values that are not readable entries, such as groups outside the bind
+// account's view or plain names, have no parents.
+func searchGroupMemberOf(conn ldapSearcher, dn string) ([]string, error) {
+	searchReq := ldap.NewSearchRequest(
+		dn,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases, 1, 0, false,
+		"(objectClass=*)",
+		[]string{ldapCfg.GroupAttribute},
+		nil,
+	)
+	sr, err := conn.Search(searchReq)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidDNSyntax) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: group search: %w", errLDAPSearchFailed, err)
+	}
+	if len(sr.Entries) == 0 {
+		return nil, nil
+	}
+	return sr.Entries[0].GetAttributeValues(ldapCfg.GroupAttribute), nil
+}
+
+// ldapMatchingRuleInChain is Active Directory's LDAP_MATCHING_RULE_IN_CHAIN,
+// which matches members through any number of nested groups.
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// searchGroupsInChain asks the directory for every group userDN belongs to,
+// directly or through nesting, in one paged search.
+func searchGroupsInChain(conn ldapSearcher, userDN string) ([]string, error) {
+	baseDN := ldapCfg.GroupBaseDN
+	if baseDN == "" {
+		baseDN = ldapCfg.BaseDN
+	}
+	searchReq := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false,
+		ldapFilter("(member:"+ldapMatchingRuleInChain+":=%s)", userDN),
+		[]string{"cn"},
+		nil,
+	)
+	entries, err := searchPaged(conn, searchReq, ldapCfg.PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: nested group search: %w", errLDAPSearchFailed, err)
+	}
+	groups := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// searchMemberGroups finds the groups listing userDN as a member, paging
+// through the results so large directories are not cut off by size limits.
+func searchMemberGroups(conn ldapSearcher, userDN string) ([]string, error) {
+	baseDN := ldapCfg.GroupBaseDN
+	if baseDN == "" {
+		baseDN = ldapCfg.BaseDN
+	}
+	searchReq := ldap.NewSearchRequest(
+		baseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false,
+		ldapFilter(ldapCfg.GroupFilter, userDN),
+		[]string{"cn"},
+		nil,
+	)
+
+	entries, err := searchPaged(conn, searchReq, ldapCfg.PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: group search: %w", errLDAPSearchFailed, err)
+	}
+	groups := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// searchPaged runs req with the RFC 2696 paged results control and returns the
+// entries of all pages. A page size of zero issues a single unpaged search.
+func searchPaged(conn ldapSearcher, req *ldap.SearchRequest, pageSize uint32) ([]*ldap.Entry, error) {
+	if pageSize == 0 {
+		sr, err := conn.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		return sr.Entries, nil
+	}
+
+	paging := ldap.NewControlPaging(pageSize)
+	req.Controls = append(req.Controls, paging)
+
+	var entries []*ldap.Entry
+	for {
+		sr, err := conn.Search(req)
+		if sr != nil {
+			entries = append(entries, sr.Entries...)
+		}
+		if err != nil {
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) && len(entries) > 0 {
+				log.Printf("ldap paged search hit the server size limit after %d entries", len(entries))
+				return entries, nil
+			}
+			return nil, err
+		}
+
+		control, ok := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			return entries, nil
+		}
+		paging.SetCookie(control.Cookie)
+	}
+}
+
+func isAdminMember(groups []string, adminGroup string) bool {
+	if adminGroup == "" {
+		return false
+	}
+	for _, g := range groups {
+		if strings.EqualFold(groupNameFromDN(g), adminGroup) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAdminAccess grants LDAP_ADMIN_GROUP members read, write and delete on
+// every namespace, and reports whether the user is an admin.
+func withAdminAccess(access []Access, groups []string) ([]Access, bool) {
+	if !isAdminMember(groups, ldapCfg.AdminGroup) {
+		return access, false
+	}
+	return append(access, Access{Group: ldapCfg.AdminGroup, DeleteAllowed: true, AllNamespaces: true}), true
+}
+
+// ldapServerInUse is the position in LDAP_URL of the server the last
+// connection was made to. Dials start there, so while one domain controller
+// is down logins do not wait for it to time out first.
+var ldapServerInUse atomic.Int64
+
+// dialLDAP connects to the first reachable server in LDAP_URL, starting
+// with the last one that answered, and fails only when none does.
 func dialLDAP(cfg LDAPConfig) (*ldap.Conn, error) {
+	servers := splitCommaList(cfg.URL)
+	if len(servers) <= 1 {
+		return dialLDAPServer(cfg)
+	}
+	start := int(ldapServerInUse.Load()) % len(servers)
+	var errs []error
+	for i := range servers {
+		index := (start + i) % len(servers)
+		server := cfg
+		server.URL = servers[index]
+		conn, err := dialLDAPServer(server)
+		if err != nil {
+			log.Printf("ldap server %s unreachable: %v", server.URL, err)
+			errs = append(errs, fmt.Errorf("%s: %w", server.URL, err))
+			continue
+		}
+		if i > 0 {
+			ldapServerInUse.Store(int64(index))
+			log.Printf("ldap failed over to %s", server.URL)
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("all ldap servers unreachable: %w", errors.Join(errs...))
+}
 
-	// #nosec G402 -- skip TLS verification if configured
-	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}))
+func dialLDAPServer(cfg LDAPConfig) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSConfig(ldapTLSConfig(cfg)), ldap.DialWithDialer(&net.Dialer{Timeout: cfg.DialTimeout}))
 	if err != nil {
 		return nil, err
 	}
 
+	// A failed upgrade closes the connection; the bind never goes out in
+	// plaintext.
 	if cfg.StartTLS && strings.HasPrefix(cfg.URL, "ldap://") {
-		// #nosec G402 -- skip TLS verification if configured
-		if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: cfg.SkipTLSVerify}); err != nil {
+		if err := conn.StartTLS(ldapTLSConfig(cfg)); err != nil {
 			_ = conn.Close()
-			return nil, err
+			return nil, fmt.Errorf("ldap StartTLS failed: %w", err)
 		}
 	}
 
@@ -156,23 +800,18 @@ func groupNameFromDN(dn string) string {
 	}
 }
 
+// permissionsFromGroup maps a group such as team1_rwd to its namespace and
+// rights using GROUP_PERMISSION_SUFFIXES. Docker only accepts lowercase
+// repository names, so the group is matched case-insensitively and the
+// namespace is always lowercase.
 func permissionsFromGroup(group string) (namespace string, pullOnly bool, deleteAllowed bool, ok bool) {
-	switch {
-	case strings.HasSuffix(group, "_rwd"):
-		ns := strings.TrimSuffix(group, "_rwd")
-		return ns, false, true, true
-	case strings.HasSuffix(group, "_rw"):
-		ns := strings.TrimSuffix(group, "_rw")
-		return ns, false, false, true
-	case strings.HasSuffix(group, "_rd"):
-		ns := strings.TrimSuffix(group, "_rd")
-		return ns, true, true, true
-	case strings.HasSuffix(group, "_r"):
-		ns := strings.TrimSuffix(group, "_r")
-		return ns, true, false, true
-	default:
-		return "", false, false, false
+	group = strings.ToLower(group)
+	for _, s := range groupSuffixes {
+		if ns, found := strings.CutSuffix(group, s.Suffix); found {
+			return ns, s.PullOnly, s.DeleteAllowed, true
+		}
 	}
+	return "", false, false, false
 }
 
 func morePermissive(a, b *User) bool {
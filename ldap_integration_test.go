@@ -142,7 +142,7 @@ func TestCvRouterProxyWithLDAP(t *testing.T) {
 	client := &http.Client{Timeout: 10 * time.Second}
 	accessCases := []requestCase{
 		{name: "ping", method: http.MethodGet, path: "/v2/", user: "hackers", pass: "dogood", wantStatus: http.StatusOK},
-		{name: "wrong namespace", method: http.MethodGet, path: "/v2/something", user: "hackers", pass: "dogood", wantStatus: http.StatusForbidden, wantBodyContains: []string{`forbidden by user "hackers"`, "repositories:", "team1_rwd"}},
+		{name: "wrong namespace", method: http.MethodGet, path: "/v2/something", user: "hackers", pass: "dogood", wantStatus: http.StatusForbidden, wantBodyContains: []string{`forbidden by user \"hackers\"`, "repositories:", "team1_rwd"}},
 		{name: "dashboard without auth", method: http.MethodGet, path: "/dashboard", wantStatus: http.StatusUnauthorized, wantBodyContains: []string{"auth required"}},
 		{name: "bad password", method: http.MethodGet, path: "/v2/", user: "hackers", pass: "wrongpass", wantStatus: http.StatusUnauthorized, wantBodyContains: []string{"invalid credentials"}},
 		{name: "bad user", method: http.MethodGet, path: "/v2/something", user: "wronguser", pass: "dogood", wantStatus: http.StatusUnauthorized, wantBodyContains: []string{"invalid credentials"}},
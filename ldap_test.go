@@ -1,6 +1,23 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
 
 func TestPermissionsFromGroupSuffixes(t *testing.T) {
 	tests := []struct {
@@ -16,6 +33,8 @@ func TestPermissionsFromGroupSuffixes(t *testing.T) {
 		{name: "rd", group: "team3_rd", namespace: "team3", pullOnly: true, deleteAllowed: true, ok: true},
 		{name: "r", group: "team4_r", namespace: "team4", pullOnly: true, deleteAllowed: false, ok: true},
 		{name: "bare", group: "team5", namespace: "", pullOnly: false, deleteAllowed: false, ok: false},
+		{name: "mixed case", group: "Team1_rwd", namespace: "team1", pullOnly: false, deleteAllowed: true, ok: true},
+		{name: "upper suffix", group: "TEAM2_RW", namespace: "team2", pullOnly: false, deleteAllowed: false, ok: true},
 	}
 
 	for _, tt := range tests {
@@ -39,6 +58,111 @@ func TestPermissionsFromGroupSuffixes(t *testing.T) {
 	}
 }
 
+func withGroupSuffixes(t *testing.T, raw string) {
+	t.Helper()
+	t.Setenv("GROUP_PERMISSION_SUFFIXES", raw)
+	prev := groupSuffixes
+	groupSuffixes = loadGroupSuffixes()
+	t.Cleanup(func() { groupSuffixes = prev })
+}
+
+func TestPermissionsFromCustomGroupSuffixes(t *testing.T) {
+	withGroupSuffixes(t, "-admins=rwd, -readers=r, -admin-readers=rd, -bad=x")
+	for group, want := range map[string]Access{
+		"team1-admins":        {Namespace: "team1", DeleteAllowed: true},
+		"Team2-Readers":       {Namespace: "team2", PullOnly: true},
+		"team3-admin-readers": {Namespace: "team3", PullOnly: true, DeleteAllowed: true},
+	} {
+		ns, pullOnly, deleteAllowed, ok := permissionsFromGroup(group)
+		if !ok || ns != want.Namespace || pullOnly != want.PullOnly || deleteAllowed != want.DeleteAllowed {
+			t.Fatalf("%s: got %q pullOnly=%v deleteAllowed=%v ok=%v, want %+v", group, ns, pullOnly, deleteAllowed, ok, want)
+		}
+	}
+	// The override replaces the default convention.
+	for _, group := range []string{"team1_rwd", "team1-bad"} {
+		if _, _, _, ok := permissionsFromGroup(group); ok {
+			t.Fatalf("expected %s to grant nothing under custom suffixes", group)
+		}
+	}
+}
+
+func TestGroupSuffixesDefaultWithoutValidOverride(t *testing.T) {
+	withGroupSuffixes(t, "-admins=all")
+	if ns, _, deleteAllowed, ok := permissionsFromGroup("team1_rwd"); !ok || ns != "team1" || !deleteAllowed {
+		t.Fatalf("expected the default suffixes when no override entry is valid")
+	}
+}
+
+func TestMixedCaseGroupAuthorizesPush(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		access, user := accessFromGroups(username, []string{"cn=Team1_rwd,ou=groups,dc=example,dc=com"}, "")
+		return user, access, nil
+	}
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected push to team1 to be authorized, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdminGroupGrantsEveryNamespace(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	ldapCfg.AdminGroup = "cv_admins"
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+	conn.entry.Attributes[0].Values = append(conn.entry.Attributes[0].Values, "cn=cv_admins,ou=groups,dc=glauth,dc=com")
+
+	user, access, err := authenticateConn(conn, "alice", "secret")
+	if err != nil {
+		t.Fatalf("authenticateConn: %v", err)
+	}
+	if !user.Admin {
+		t.Fatalf("expected alice to be an admin")
+	}
+	// team2_r is pull-only, but the admin grant wins over it.
+	for _, ns := range []string{"team1", "team2", "unlisted"} {
+		if pullOnly, deleteAllowed, ok := namespacePermissions(access, ns); !ok || pullOnly || !deleteAllowed {
+			t.Fatalf("%s: expected rwd, got pullOnly=%v delete=%v ok=%v", ns, pullOnly, deleteAllowed, ok)
+		}
+	}
+	if got := namespacesFromAccess(access); len(got) != 2 || got[0] != "team1" || got[1] != "team2" {
+		t.Fatalf("expected the admin grant not to be listed as a namespace, got %v", got)
+	}
+
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusAccepted, nil, "")
+	})
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return user, access, nil
+	}
+	for _, req := range []struct{ method, path string }{
+		{http.MethodDelete, "/v2/team2/app/manifests/v1"},
+		{http.MethodPut, "/v2/unlisted/app/manifests/v1"},
+	} {
+		if rec := serveProxyRequestBody(t, req.method, req.path, strings.NewReader(`{"schemaVersion":2}`)); rec.Code != http.StatusAccepted {
+			t.Fatalf("%s %s: expected the admin to be authorized, got %d: %s", req.method, req.path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAdminGroupRequiresExactGroup(t *testing.T) {
+	prev := ldapCfg
+	ldapCfg.AdminGroup = "cv_admins"
+	t.Cleanup(func() { ldapCfg = prev })
+
+	groups := []string{"cn=team1_r,ou=groups,dc=example,dc=com", "cn=cv_admins_r,ou=groups,dc=example,dc=com"}
+	access, _ := accessFromGroups("bob", groups, "")
+	access, admin := withAdminAccess(access, groups)
+	if admin {
+		t.Fatalf("expected a group only starting with the admin group not to grant admin")
+	}
+	if _, _, ok := namespacePermissions(access, "team2"); ok {
+		t.Fatalf("expected no access outside the user's groups, got %+v", access)
+	}
+}
+
 func TestMorePermissivePullOnly(t *testing.T) {
 	tests := []struct {
 		name string
@@ -68,3 +192,928 @@ func TestMorePermissivePullOnly(t *testing.T) {
 		})
 	}
 }
+
+func TestLDAPBindLimiterCapsConcurrency(t *testing.T) {
+	const limit = 3
+	withBindLimiter(t, newBindLimiter(limit, 5*time.Second))
+
+	var active, peak atomic.Int32
+	withDirectoryAuth(t, func(username, password string) (*User, []Access, error) {
+		n := active.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		active.Add(-1)
+		return &User{Name: username}, nil, nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := ldapAuthenticateAccess("alice", "secret"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("unexpected auth error: %v", err)
+	}
+	if got := peak.Load(); got > limit {
+		t.Fatalf("expected at most %d concurrent binds, got %d", limit, got)
+	}
+	if got := peak.Load(); got == 0 {
+		t.Fatalf("expected binds to run")
+	}
+}
+
+func TestLDAPBindLimiterFastFail(t *testing.T) {
+	limiter := newBindLimiter(1, 0)
+	withBindLimiter(t, limiter)
+	withDirectoryAuth(t, func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, nil, nil
+	})
+
+	release, err := limiter.acquire()
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	defer release()
+
+	if _, _, err := ldapAuthenticateAccess("alice", "secret"); !errors.Is(err, errLDAPBusy) {
+		t.Fatalf("expected errLDAPBusy, got %v", err)
+	}
+}
+
+func TestLDAPBindLimiterQueueTimeout(t *testing.T) {
+	limiter := newBindLimiter(1, 20*time.Millisecond)
+	release, err := limiter.acquire()
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := limiter.acquire(); !errors.Is(err, errLDAPBusy) {
+		t.Fatalf("expected errLDAPBusy, got %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected acquire to wait for the queue timeout")
+	}
+
+	release()
+	release, err = limiter.acquire()
+	if err != nil {
+		t.Fatalf("expected slot after release, got %v", err)
+	}
+	release()
+}
+
+func TestAuthenticateBusyReturns503(t *testing.T) {
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return nil, nil, errLDAPBusy
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("alice", "secret")
+	if _, _, ok := authenticate(rec, req); ok {
+		t.Fatalf("expected authenticate to fail")
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+}
+
+func withBindLimiter(t *testing.T, limiter *bindLimiter) {
+	t.Helper()
+	prev := ldapBinds
+	ldapBinds = limiter
+	t.Cleanup(func() {
+		ldapBinds = prev
+	})
+}
+
+func withDirectoryAuth(t *testing.T, fn func(username, password string) (*User, []Access, error)) {
+	t.Helper()
+	prev := ldapDirectoryAuth
+	ldapDirectoryAuth = fn
+	t.Cleanup(func() {
+		ldapDirectoryAuth = prev
+	})
+}
+
+// pagedSearcher serves canned entries in pages keyed by the paging cookie.
+type pagedSearcher struct {
+	pages    [][]*ldap.Entry
+	requests int
+	failAt   int
+}
+
+func (p *pagedSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	p.requests++
+	page := 0
+	if control, ok := ldap.FindControl(req.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok && len(control.Cookie) > 0 {
+		page, _ = strconv.Atoi(string(control.Cookie))
+	}
+	if p.failAt > 0 && page == p.failAt {
+		return nil, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	result := &ldap.SearchResult{Entries: p.pages[page]}
+	if page+1 < len(p.pages) {
+		next := ldap.NewControlPaging(2)
+		next.SetCookie([]byte(strconv.Itoa(page + 1)))
+		result.Controls = []ldap.Control{next}
+	}
+	return result, nil
+}
+
+func groupEntries(names ...string) []*ldap.Entry {
+	entries := make([]*ldap.Entry, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, ldap.NewEntry("cn="+name+",ou=groups,dc=glauth,dc=com", nil))
+	}
+	return entries
+}
+
+func TestSearchPagedCollectsAllPages(t *testing.T) {
+	searcher := &pagedSearcher{pages: [][]*ldap.Entry{
+		groupEntries("team1_r", "team2_rw"),
+		groupEntries("team3_rwd", "team4_rd"),
+		groupEntries("team5_r"),
+	}}
+	req := ldap.NewSearchRequest("dc=glauth,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(member=x)", nil, nil)
+
+	entries, err := searchPaged(searcher, req, 2)
+	if err != nil {
+		t.Fatalf("searchPaged: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries across pages, got %d", len(entries))
+	}
+	if searcher.requests != 3 {
+		t.Fatalf("expected 3 paged requests, got %d", searcher.requests)
+	}
+}
+
+func TestSearchPagedKeepsResultsOnSizeLimit(t *testing.T) {
+	searcher := &pagedSearcher{
+		pages:  [][]*ldap.Entry{groupEntries("team1_r"), groupEntries("team2_r")},
+		failAt: 1,
+	}
+	req := ldap.NewSearchRequest("dc=glauth,dc=com", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(member=x)", nil, nil)
+
+	entries, err := searchPaged(searcher, req, 1)
+	if err != nil {
+		t.Fatalf("expected partial results on size limit, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+}
+
+func TestSearchUserGroupsWithPagedGroupSearch(t *testing.T) {
+	prevCfg := ldapCfg
+	ldapCfg.GroupFilter = "(member=%s)"
+	ldapCfg.PageSize = 2
+	t.Cleanup(func() {
+		ldapCfg = prevCfg
+	})
+
+	user := ldap.NewEntry("cn=alice,ou=users,dc=glauth,dc=com", map[string][]string{
+		ldapCfg.GroupAttribute: {"cn=team0_rw,ou=groups,dc=glauth,dc=com"},
+	})
+	groups := &pagedSearcher{pages: [][]*ldap.Entry{
+		groupEntries("team1_r", "team2_rw"),
+		groupEntries("team3_rwd"),
+	}}
+	searcher := &userThenGroupsSearcher{user: user, groups: groups}
+
+	got, err := searchUserGroups(searcher, "alice@example.com")
+	if err != nil {
+		t.Fatalf("searchUserGroups: %v", err)
+	}
+	if len(got) != 4 {
+		t.Fatalf("expected memberOf plus all paged groups, got %v", got)
+	}
+	if searcher.groupFilter != "(member=cn=alice,ou=users,dc=glauth,dc=com)" {
+		t.Fatalf("unexpected group filter: %q", searcher.groupFilter)
+	}
+	access, _ := accessFromGroups("alice", got, "team")
+	if len(access) != 4 {
+		t.Fatalf("expected access from every group, got %+v", access)
+	}
+}
+
+type userThenGroupsSearcher struct {
+	user        *ldap.Entry
+	groups      *pagedSearcher
+	groupFilter string
+	calls       int
+}
+
+func (s *userThenGroupsSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.calls++
+	if s.calls == 1 {
+		return &ldap.SearchResult{Entries: []*ldap.Entry{s.user}}, nil
+	}
+	s.groupFilter = req.Filter
+	return s.groups.Search(req)
+}
+
+// directBindConn accepts a single DN/password pair and serves that user's
+// entry from base-scoped searches once bound.
+type directBindConn struct {
+	dn        string
+	password  string
+	entry     *ldap.Entry
+	searchErr error
+	bound     string
+	searches  []*ldap.SearchRequest
+}
+
+func (c *directBindConn) Bind(username, password string) error {
+	if username != c.dn || password != c.password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = username
+	return nil
+}
+
+func (c *directBindConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.searches = append(c.searches, req)
+	if c.bound == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("anonymous search"))
+	}
+	if c.searchErr != nil {
+		return nil, c.searchErr
+	}
+	if req.BaseDN != c.entry.DN || req.Scope != ldap.ScopeBaseObject {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{c.entry}}, nil
+}
+
+func withUserDNTemplate(t *testing.T, template string) {
+	t.Helper()
+	prev := ldapCfg
+	ldapCfg.UserDNTemplate = template
+	ldapCfg.GroupFilter = ""
+	t.Cleanup(func() {
+		ldapCfg = prev
+	})
+}
+
+func newDirectBindConn(dn string) *directBindConn {
+	return &directBindConn{
+		dn:       dn,
+		password: "secret",
+		entry: ldap.NewEntry(dn, map[string][]string{
+			"memberOf": {"cn=team1_rw,ou=groups,dc=glauth,dc=com", "cn=team2_r,ou=groups,dc=glauth,dc=com"},
+		}),
+	}
+}
+
+func TestAuthenticateConnDirectUserBind(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+
+	user, access, err := authenticateConn(conn, "alice", "secret")
+	if err != nil {
+		t.Fatalf("authenticateConn: %v", err)
+	}
+	if user.Name != "alice" || user.Namespace != "team1" || user.PullOnly {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	if len(access) != 2 {
+		t.Fatalf("expected access from both groups, got %+v", access)
+	}
+	if conn.bound != conn.dn {
+		t.Fatalf("expected bind as %q, got %q", conn.dn, conn.bound)
+	}
+	if len(conn.searches) != 1 || conn.searches[0].BaseDN != conn.dn {
+		t.Fatalf("expected one base search on the user DN, got %+v", conn.searches)
+	}
+}
+
+func TestAuthenticateConnDirectBindEscapesUsername(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	conn := newDirectBindConn(`uid=a\,b,ou=people,dc=glauth,dc=com`)
+
+	if _, _, err := authenticateConn(conn, "a,b", "secret"); err != nil {
+		t.Fatalf("expected escaped DN bind to succeed, got %v", err)
+	}
+}
+
+func TestAuthenticateConnDirectBindBadCredentials(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+
+	_, _, err := authenticateConn(conn, "alice", "wrong")
+	if !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("expected errLDAPInvalidCredentials, got %v", err)
+	}
+	if errors.Is(err, errLDAPSearchFailed) {
+		t.Fatalf("bind failure must not be reported as a search failure")
+	}
+	if len(conn.searches) != 0 {
+		t.Fatalf("expected no search after failed bind")
+	}
+}
+
+func TestAuthenticateConnDirectBindSearchFailure(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+	conn.searchErr = ldap.NewError(ldap.LDAPResultOperationsError, errors.New("backend down"))
+
+	_, _, err := authenticateConn(conn, "alice", "secret")
+	if !errors.Is(err, errLDAPSearchFailed) {
+		t.Fatalf("expected errLDAPSearchFailed, got %v", err)
+	}
+	if errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("search failure must not be reported as bad credentials")
+	}
+}
+
+func TestAuthenticateSearchFailureReturns502(t *testing.T) {
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return nil, nil, errLDAPSearchFailed
+	}
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("alice", "secret")
+	if _, _, ok := authenticate(rec, req); ok {
+		t.Fatalf("expected authenticate to fail")
+	}
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+}
+
+// slowSearchConn delays every search by delay.
+type slowSearchConn struct {
+	*directBindConn
+	delay time.Duration
+}
+
+func (c slowSearchConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	time.Sleep(c.delay)
+	return c.directBindConn.Search(req)
+}
+
+func TestSlowLDAPSearchIsLogged(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	conn := slowSearchConn{directBindConn: newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com"), delay: 30 * time.Millisecond}
+	if _, _, err := authenticateConn(timeLDAP(conn, 10*time.Millisecond), "alice", "secret"); err != nil {
+		t.Fatalf("authenticateConn: %v", err)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "WARN slow ldap search base=uid=alice,ou=people,dc=glauth,dc=com took") || !strings.Contains(out, "threshold 10ms") {
+		t.Fatalf("expected slow search log line, got %q", out)
+	}
+	if strings.Contains(out, "slow ldap bind") {
+		t.Fatalf("expected fast bind not to be logged, got %q", out)
+	}
+}
+
+func TestTimeLDAPDisabledReturnsConn(t *testing.T) {
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+	if got := timeLDAP(conn, 0); got != ldapConn(conn) {
+		t.Fatalf("expected connection to be returned unwrapped when the threshold is zero")
+	}
+}
+
+// filterSearcher records the filter of each search and finds nothing.
+type filterSearcher struct {
+	filters []string
+}
+
+func (s *filterSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.filters = append(s.filters, req.Filter)
+	return &ldap.SearchResult{}, nil
+}
+
+// baseSearcher records the base of each search and finds nothing.
+type baseSearcher struct {
+	bases []string
+}
+
+func (s *baseSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.bases = append(s.bases, req.BaseDN)
+	return &ldap.SearchResult{}, nil
+}
+
+func TestSearchUserEntryUsesUserBaseDN(t *testing.T) {
+	prevCfg := ldapCfg
+	ldapCfg.BaseDN = "dc=example,dc=com"
+	t.Cleanup(func() { ldapCfg = prevCfg })
+
+	searcher := &baseSearcher{}
+	_, _ = searchUserEntry(searcher, "alice@example.com")
+	ldapCfg.UserBaseDN = "ou=people,dc=example,dc=com"
+	_, _ = searchUserEntry(searcher, "alice@example.com")
+	if !slices.Equal(searcher.bases, []string{"dc=example,dc=com", "ou=people,dc=example,dc=com"}) {
+		t.Fatalf("expected LDAP_BASE_DN, then LDAP_USER_BASE_DN, got %v", searcher.bases)
+	}
+}
+
+func TestSearchUserGroupsEscapesFilter(t *testing.T) {
+	prevCfg := ldapCfg
+	ldapCfg.UserFilter = "(|(mail=%s)(uid=%s))"
+	t.Cleanup(func() {
+		ldapCfg = prevCfg
+	})
+
+	searcher := &filterSearcher{}
+	_, err := searchUserGroups(searcher, `*)(uid=*))(|(uid=*\`)
+	if !errors.Is(err, errLDAPUserNotFound) {
+		t.Fatalf("expected user not found, got %v", err)
+	}
+	want := `(|(mail=\2a\29\28uid=\2a\29\29\28|\28uid=\2a\5c)(uid=\2a\29\28uid=\2a\29\29\28|\28uid=\2a\5c))`
+	if len(searcher.filters) != 1 || searcher.filters[0] != want {
+		t.Fatalf("unexpected user filter %q", searcher.filters)
+	}
+	if _, err := ldap.CompileFilter(searcher.filters[0]); err != nil {
+		t.Fatalf("escaped filter does not compile: %v", err)
+	}
+}
+
+func TestLDAPFilterEscapesSpecialCharacters(t *testing.T) {
+	cases := map[string]string{
+		"*":            `(cn=\2a)`,
+		"a(b)c":        `(cn=a\28b\29c)`,
+		`back\slash`:   `(cn=back\5cslash)`,
+		"nul\x00byte":  `(cn=nul\00byte)`,
+		"alice@x.test": `(cn=alice@x.test)`,
+	}
+	for value, want := range cases {
+		if got := ldapFilter("(cn=%s)", value); got != want {
+			t.Fatalf("ldapFilter(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+// nestedGroupSearcher answers group searches for "(member=<dn>)": every
+// cn=groupN has parent cn=teamN_r, and parents have none. It records the
+// highest number of searches in flight.
+type nestedGroupSearcher struct {
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+	searches    atomic.Int32
+}
+
+func (s *nestedGroupSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		peak := s.maxInFlight.Load()
+		if n <= peak || s.maxInFlight.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	s.searches.Add(1)
+	time.Sleep(2 * time.Millisecond)
+
+	member := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(member="), ")")
+	name, ok := strings.CutPrefix(member, "cn=group")
+	if !ok {
+		return &ldap.SearchResult{}, nil
+	}
+	name, _, _ = strings.Cut(name, ",")
+	return &ldap.SearchResult{Entries: groupEntries("team" + name + "_r")}, nil
+}
+
+func TestNestedGroupsRespectsSearchConcurrency(t *testing.T) {
+	prevCfg := ldapCfg
+	ldapCfg.GroupFilter = "(member=%s)"
+	ldapCfg.PageSize = 0
+	ldapCfg.NestedGroupDepth = 3
+	ldapCfg.GroupSearchConcurrency = 3
+	t.Cleanup(func() {
+		ldapCfg = prevCfg
+	})
+
+	var direct []string
+	for i := 0; i < 40; i++ {
+		direct = append(direct, "cn=group"+strconv.Itoa(i)+",ou=groups,dc=glauth,dc=com")
+	}
+	searcher := &nestedGroupSearcher{}
+	got, err := nestedGroups(searcher, append(direct, direct[0]))
+	if err != nil {
+		t.Fatalf("nestedGroups: %v", err)
+	}
+	if len(got) != 80 {
+		t.Fatalf("expected 40 direct and 40 parent groups, got %d", len(got))
+	}
+	access, _ := accessFromGroups("alice", got, "team")
+	if len(access) != 40 {
+		t.Fatalf("expected access from every parent group, got %d", len(access))
+	}
+	if peak := searcher.maxInFlight.Load(); peak > 3 || peak < 2 {
+		t.Fatalf("expected up to 3 concurrent searches, peak was %d", peak)
+	}
+	// Each group is searched once: 40 direct groups, then 40 parents.
+	if n := searcher.searches.Load(); n != 80 {
+		t.Fatalf("expected 80 searches, got %d", n)
+	}
+}
+
+// memberOfSearcher answers base searches with the memberOf values in
+// memberOf, by DN, and counts them.
+type memberOfSearcher struct {
+	memberOf map[string][]string
+	searches atomic.Int32
+}
+
+func (s *memberOfSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.searches.Add(1)
+	parents, ok := s.memberOf[req.BaseDN]
+	if !ok {
+		return nil, ldap.NewError(ldap.LDAPResultNoSuchObject, errors.New("no such object"))
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{ldap.NewEntry(req.BaseDN, map[string][]string{"memberOf": parents})}}, nil
+}
+
+func withNestedGroups(t *testing.T, method string, depth int) {
+	t.Helper()
+	prevCfg := ldapCfg
+	ldapCfg.GroupAttribute = "memberOf"
+	ldapCfg.GroupFilter = ""
+	ldapCfg.PageSize = 0
+	ldapCfg.NestedGroups = true
+	ldapCfg.NestedGroupsMethod = method
+	ldapCfg.NestedGroupDepth = depth
+	ldapCfg.GroupSearchConcurrency = 4
+	t.Cleanup(func() {
+		ldapCfg = prevCfg
+	})
+}
+
+func TestNestedGroupsWalksMemberOf(t *testing.T) {
+	withNestedGroups(t, nestedGroupsMemberOf, 5)
+	const role = "cn=developers,ou=roles,dc=glauth,dc=com"
+	const team = "cn=team1_rw,ou=groups,dc=glauth,dc=com"
+	searcher := &memberOfSearcher{memberOf: map[string][]string{
+		role: {team},
+		// A cycle back to the role group ends the walk.
+		team: {role},
+	}}
+	user := ldap.NewEntry("uid=alice,ou=people,dc=glauth,dc=com", map[string][]string{"memberOf": {role}})
+
+	groups, err := entryGroups(searcher, user)
+	if err != nil {
+		t.Fatalf("entryGroups: %v", err)
+	}
+	if !slices.Equal(groups, []string{role, team}) {
+		t.Fatalf("expected the role group and the team group it belongs to, got %v", groups)
+	}
+	access, _ := accessFromGroups("alice", groups, "team")
+	if len(access) != 1 || access[0].Namespace != "team1" || access[0].PullOnly {
+		t.Fatalf("expected push access to team1 through the role group, got %+v", access)
+	}
+	if n := searcher.searches.Load(); n != 2 {
+		t.Fatalf("expected each group to be read once, got %d searches", n)
+	}
+}
+
+func TestNestedGroupsStopsAtMaxDepth(t *testing.T) {
+	withNestedGroups(t, nestedGroupsMemberOf, 2)
+	searcher := &memberOfSearcher{memberOf: map[string][]string{
+		"cn=a,ou=roles,dc=glauth,dc=com": {"cn=b,ou=roles,dc=glauth,dc=com"},
+		"cn=b,ou=roles,dc=glauth,dc=com": {"cn=c,ou=roles,dc=glauth,dc=com"},
+		"cn=c,ou=roles,dc=glauth,dc=com": {"cn=team1_r,ou=groups,dc=glauth,dc=com"},
+	}}
+	user := ldap.NewEntry("uid=alice,ou=people,dc=glauth,dc=com", map[string][]string{"memberOf": {"cn=a,ou=roles,dc=glauth,dc=com"}})
+
+	groups, err := entryGroups(searcher, user)
+	if err != nil {
+		t.Fatalf("entryGroups: %v", err)
+	}
+	if len(groups) != 3 || slices.Contains(groups, "cn=team1_r,ou=groups,dc=glauth,dc=com") {
+		t.Fatalf("expected the walk to stop two levels up, got %v", groups)
+	}
+}
+
+// inChainSearcher answers the matching-rule-in-chain group search.
+type inChainSearcher struct {
+	filters []string
+}
+
+func (s *inChainSearcher) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	s.filters = append(s.filters, req.Filter)
+	return &ldap.SearchResult{Entries: groupEntries("developers", "team1_rw")}, nil
+}
+
+func TestNestedGroupsInChain(t *testing.T) {
+	withNestedGroups(t, nestedGroupsInChain, 5)
+	searcher := &inChainSearcher{}
+	user := ldap.NewEntry("cn=alice (ops),ou=people,dc=glauth,dc=com", nil)
+
+	groups, err := entryGroups(searcher, user)
+	if err != nil {
+		t.Fatalf("entryGroups: %v", err)
+	}
+	want := []string{"(member:1.2.840.113556.1.4.1941:=cn=alice \\28ops\\29,ou=people,dc=glauth,dc=com)"}
+	if !slices.Equal(searcher.filters, want) {
+		t.Fatalf("expected one escaped in-chain search, got %q", searcher.filters)
+	}
+	if access, _ := accessFromGroups("alice", groups, "team"); len(access) != 1 || access[0].Namespace != "team1" {
+		t.Fatalf("expected access to team1 from the in-chain groups, got %+v", access)
+	}
+}
+
+func TestLoadLDAPConfigNestedGroups(t *testing.T) {
+	unsetEnv(t, "LDAP_NESTED_GROUP_DEPTH")
+	t.Setenv("LDAP_NESTED_GROUPS", "true")
+	t.Setenv("LDAP_NESTED_GROUPS_METHOD", "recursive")
+	cfg := loadLDAPConfig()
+	if !cfg.NestedGroups || cfg.NestedGroupsMethod != nestedGroupsMemberOf || cfg.NestedGroupDepth != defaultNestedGroupDepth {
+		t.Fatalf("unexpected nested group config: %+v", cfg)
+	}
+
+	t.Setenv("LDAP_NESTED_GROUPS_METHOD", "IN-CHAIN")
+	t.Setenv("LDAP_NESTED_GROUP_DEPTH", "2")
+	if cfg := loadLDAPConfig(); cfg.NestedGroupsMethod != nestedGroupsInChain || cfg.NestedGroupDepth != 2 {
+		t.Fatalf("unexpected nested group config: %+v", cfg)
+	}
+}
+
+// slowBindConn delays every bind by delay.
+type slowBindConn struct {
+	*directBindConn
+	delay time.Duration
+}
+
+func (c slowBindConn) Bind(username, password string) error {
+	time.Sleep(c.delay)
+	return c.directBindConn.Bind(username, password)
+}
+
+func TestLDAPBindDurationIsObserved(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	prev := ldapBindDurations
+	ldapBindDurations = newDurationHistogram([]float64{0.01, 10})
+	t.Cleanup(func() { ldapBindDurations = prev })
+
+	conn := slowBindConn{directBindConn: newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com"), delay: 20 * time.Millisecond}
+	if _, _, err := authenticateConn(conn, "alice", "secret"); err != nil {
+		t.Fatalf("authenticateConn: %v", err)
+	}
+	if _, _, err := authenticateConn(conn, "alice", "wrong"); err == nil {
+		t.Fatalf("expected bad credentials to fail")
+	}
+
+	var out bytes.Buffer
+	ldapBindDurations.write(&out, "containervault_ldap_bind_duration_seconds", "help")
+	for _, want := range []string{
+		"# TYPE containervault_ldap_bind_duration_seconds histogram\n",
+		"containervault_ldap_bind_duration_seconds_bucket{le=\"0.01\"} 0\n",
+		"containervault_ldap_bind_duration_seconds_bucket{le=\"10\"} 2\n",
+		"containervault_ldap_bind_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"containervault_ldap_bind_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadLDAPBindBuckets(t *testing.T) {
+	t.Setenv("LDAP_BIND_DURATION_BUCKETS", "0.1, 0.5,2")
+	if got := loadLDAPBindBuckets(); !slices.Equal(got, []float64{0.1, 0.5, 2}) {
+		t.Fatalf("unexpected buckets: %v", got)
+	}
+	for _, raw := range []string{"0.5,0.1", "fast", "0,1"} {
+		t.Setenv("LDAP_BIND_DURATION_BUCKETS", raw)
+		if got := loadLDAPBindBuckets(); !slices.Equal(got, defaultLDAPBindBuckets) {
+			t.Fatalf("LDAP_BIND_DURATION_BUCKETS=%q: expected defaults, got %v", raw, got)
+		}
+	}
+}
+
+// ldapTestServers returns URLs of a listening server and of an address that
+// refuses connections.
+func ldapTestServers(t *testing.T) (live, dead string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	dead = "ldap://" + closed.Addr().String()
+	closed.Close()
+	prev := ldapServerInUse.Load()
+	ldapServerInUse.Store(0)
+	t.Cleanup(func() { ldapServerInUse.Store(prev) })
+	return "ldap://" + listener.Addr().String(), dead
+}
+
+func TestDialLDAPFailsOverToNextServer(t *testing.T) {
+	live, dead := ldapTestServers(t)
+	logs := captureLogs(t)
+	cfg := LDAPConfig{URL: dead + ", " + live, DialTimeout: time.Second}
+
+	conn, err := dialLDAP(cfg)
+	if err != nil {
+		t.Fatalf("expected failover to %s, got %v", live, err)
+	}
+	conn.Close()
+	if !strings.Contains(logs.String(), "ldap server "+dead+" unreachable") || !strings.Contains(logs.String(), "ldap failed over to "+live) {
+		t.Fatalf("expected the failover to be logged, got:\n%s", logs.String())
+	}
+
+	// The server that answered is tried first from then on.
+	logs.Reset()
+	conn, err = dialLDAP(cfg)
+	if err != nil {
+		t.Fatalf("dialLDAP: %v", err)
+	}
+	conn.Close()
+	if logs.Len() != 0 {
+		t.Fatalf("expected the last good server to be used directly, got:\n%s", logs.String())
+	}
+}
+
+func TestDialLDAPFailsWhenAllServersUnreachable(t *testing.T) {
+	_, dead := ldapTestServers(t)
+	_, other := ldapTestServers(t)
+	captureLogs(t)
+
+	_, err := dialLDAP(LDAPConfig{URL: dead + "," + other, DialTimeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "all ldap servers unreachable") || !strings.Contains(err.Error(), dead) || !strings.Contains(err.Error(), other) {
+		t.Fatalf("expected an error naming both servers, got %v", err)
+	}
+}
+
+// serviceBindConn is a directory that refuses anonymous searches, so users
+// are found by a service account. A failed bind leaves it anonymous.
+type serviceBindConn struct {
+	passwords map[string]string
+	entry     *ldap.Entry
+	bound     string
+	binds     []string
+	searches  []string
+}
+
+func newServiceBindConn() *serviceBindConn {
+	return &serviceBindConn{
+		passwords: map[string]string{
+			"cn=registry,ou=services,dc=example,dc=com":  "service-secret",
+			"cn=Alice Smith,ou=people,dc=example,dc=com": "secret",
+		},
+		entry: ldap.NewEntry("cn=Alice Smith,ou=people,dc=example,dc=com", map[string][]string{
+			"memberOf": {"cn=team1_rw,ou=groups,dc=example,dc=com"},
+		}),
+	}
+}
+
+func (c *serviceBindConn) Bind(username, password string) error {
+	c.binds = append(c.binds, username)
+	if want, ok := c.passwords[username]; !ok || password != want {
+		c.bound = ""
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.bound = username
+	return nil
+}
+
+func (c *serviceBindConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	c.searches = append(c.searches, c.bound+" "+req.BaseDN)
+	if c.bound == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("anonymous search"))
+	}
+	if req.Filter != "(mail=alice@example.com)" {
+		return &ldap.SearchResult{}, nil
+	}
+	return &ldap.SearchResult{Entries: []*ldap.Entry{c.entry}}, nil
+}
+
+func withServiceAccount(t *testing.T) {
+	t.Helper()
+	prev := ldapCfg
+	ldapCfg.BindUser = "cn=registry,ou=services,dc=example,dc=com"
+	ldapCfg.BindPassword = "service-secret"
+	ldapCfg.UserBaseDN = "ou=people,dc=example,dc=com"
+	ldapCfg.UserFilter = "(mail=%s)"
+	ldapCfg.UserMailDomain = "@example.com"
+	ldapCfg.UserDNTemplate = ""
+	ldapCfg.GroupFilter = ""
+	ldapCfg.GroupNamePrefix = "team"
+	t.Cleanup(func() { ldapCfg = prev })
+}
+
+func TestAuthenticateConnServiceAccountLooksUpUser(t *testing.T) {
+	withServiceAccount(t)
+	conn := newServiceBindConn()
+
+	user, access, err := authenticateConn(conn, "alice", "secret")
+	if err != nil {
+		t.Fatalf("authenticateConn: %v", err)
+	}
+	if user.Name != "alice" || user.Namespace != "team1" || len(access) != 1 {
+		t.Fatalf("unexpected user %+v with access %+v", user, access)
+	}
+	if !slices.Equal(conn.binds, []string{ldapCfg.BindUser, conn.entry.DN}) {
+		t.Fatalf("expected the service account to bind before the found DN, got %v", conn.binds)
+	}
+	if !slices.Equal(conn.searches, []string{ldapCfg.BindUser + " ou=people,dc=example,dc=com"}) {
+		t.Fatalf("expected one search of LDAP_USER_BASE_DN as the service account, got %v", conn.searches)
+	}
+	if conn.bound != conn.entry.DN {
+		t.Fatalf("expected the connection to end bound as the user, got %q", conn.bound)
+	}
+}
+
+func TestAuthenticateConnServiceAccountWrongPassword(t *testing.T) {
+	withServiceAccount(t)
+	conn := newServiceBindConn()
+
+	if _, _, err := authenticateConn(conn, "alice", "wrong"); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("expected errLDAPInvalidCredentials, got %v", err)
+	}
+	if conn.bound != "" || len(conn.searches) != 1 {
+		t.Fatalf("expected no further requests on a connection left anonymous, bound %q after %v", conn.bound, conn.searches)
+	}
+
+	if _, _, err := authenticateConn(newServiceBindConn(), "bob", "secret"); !errors.Is(err, errLDAPUserNotFound) {
+		t.Fatalf("expected errLDAPUserNotFound for an unknown user, got %v", err)
+	}
+}
+
+func TestAuthenticateConnServiceAccountBindFails(t *testing.T) {
+	withServiceAccount(t)
+	ldapCfg.BindPassword = "rotated"
+	conn := newServiceBindConn()
+
+	_, _, err := authenticateConn(conn, "alice", "secret")
+	if !errors.Is(err, errLDAPSearchFailed) || errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("expected a service account failure not blamed on the user, got %v", err)
+	}
+	if len(conn.binds) != 1 || len(conn.searches) != 0 {
+		t.Fatalf("expected no user search or bind, got binds %v searches %v", conn.binds, conn.searches)
+	}
+}
+
+func TestAuthenticateCachedServiceAccountRebindsFoundDN(t *testing.T) {
+	withServiceAccount(t)
+	withLDAPGroupCache(t, time.Minute)
+
+	if _, _, err := authenticateCached(newServiceBindConn(), "alice", "secret"); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+	conn := newServiceBindConn()
+	if _, _, err := authenticateCached(conn, "alice", "secret"); err != nil {
+		t.Fatalf("cached login: %v", err)
+	}
+	if !slices.Equal(conn.binds, []string{ldapCfg.BindUser, conn.entry.DN}) {
+		t.Fatalf("expected a cached login to still bind as the found DN, got %v", conn.binds)
+	}
+}
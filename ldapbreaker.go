@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errLDAPUnreachable is returned when no LDAP server accepted a connection.
+var errLDAPUnreachable = errors.New("ldap directory unreachable")
+
+// errLDAPUnavailable is returned without contacting the directory while the
+// circuit breaker is open.
+var errLDAPUnavailable = errors.New("ldap circuit breaker open")
+
+// ldapBreaker stops dialing the directory after threshold consecutive
+// connection failures and fails logins fast for cooldown. When the cooldown
+// ends a single login probes the directory; it closes the breaker on success
+// and reopens it on failure. A nil breaker is disabled.
+type ldapBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newLDAPBreaker(threshold int, cooldown time.Duration) *ldapBreaker {
+	if threshold <= 0 || cooldown <= 0 {
+		return nil
+	}
+	return &ldapBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a login may contact the directory.
+func (b *ldapBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record notes whether a login that allow let through reached the directory.
+func (b *ldapBreaker) record(reachable bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if reachable {
+		if b.failures >= b.threshold {
+			log.Printf("ldap circuit breaker closed")
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+		log.Printf("ldap circuit breaker open for %s after %d failed connections", b.cooldown, b.failures)
+	}
+}
+
+// remaining is how long the breaker stays open, or zero when it is closed.
+func (b *ldapBreaker) remaining() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return 0
+	}
+	return max(b.openUntil.Sub(b.now()), 0)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withLDAPBreaker installs breaker on a clock the test advances.
+func withLDAPBreaker(t *testing.T, threshold int, cooldown time.Duration) (*ldapBreaker, *time.Time) {
+	t.Helper()
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	breaker := newLDAPBreaker(threshold, cooldown)
+	breaker.now = func() time.Time { return now }
+	prev := ldapCircuit
+	ldapCircuit = breaker
+	t.Cleanup(func() { ldapCircuit = prev })
+	return breaker, &now
+}
+
+func basicAuthRequest(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	req.SetBasicAuth("alice", "secret")
+	if _, _, ok := authenticate(rec, req); ok {
+		t.Fatalf("expected authenticate to fail")
+	}
+	return rec
+}
+
+func TestOpenLDAPBreakerRetryAfterReflectsCooldown(t *testing.T) {
+	withBindLimiter(t, nil)
+	_, now := withLDAPBreaker(t, 2, 30*time.Second)
+	dials := 0
+	withDirectoryAuth(t, func(username, password string) (*User, []Access, error) {
+		dials++
+		return nil, nil, errLDAPUnreachable
+	})
+
+	for range 2 {
+		if rec := basicAuthRequest(t); rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 while the directory is unreachable, got %d", rec.Code)
+		}
+	}
+
+	*now = now.Add(12500 * time.Millisecond)
+	rec := basicAuthRequest(t)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "18" {
+		t.Fatalf("expected 503 with Retry-After 18, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if dials != 2 {
+		t.Fatalf("expected the open breaker not to dial, got %d dials", dials)
+	}
+}
+
+func TestLDAPBreakerProbesAfterCooldown(t *testing.T) {
+	withBindLimiter(t, nil)
+	breaker, now := withLDAPBreaker(t, 1, 10*time.Second)
+	reachable := false
+	withDirectoryAuth(t, func(username, password string) (*User, []Access, error) {
+		if !reachable {
+			return nil, nil, errLDAPUnreachable
+		}
+		return &User{Name: username}, nil, nil
+	})
+
+	ldapAuthenticateAccess("alice", "secret")
+	if _, _, err := ldapAuthenticateAccess("alice", "secret"); !errors.Is(err, errLDAPUnavailable) {
+		t.Fatalf("expected errLDAPUnavailable, got %v", err)
+	}
+
+	// A failed probe reopens the breaker for a full cooldown.
+	*now = now.Add(10 * time.Second)
+	if _, _, err := ldapAuthenticateAccess("alice", "secret"); !errors.Is(err, errLDAPUnreachable) {
+		t.Fatalf("expected the probe to reach the dialer, got %v", err)
+	}
+	if got := breaker.remaining(); got != 10*time.Second {
+		t.Fatalf("expected a fresh 10s cooldown, got %s", got)
+	}
+
+	*now = now.Add(10 * time.Second)
+	reachable = true
+	if _, _, err := ldapAuthenticateAccess("alice", "secret"); err != nil {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if breaker.remaining() != 0 || !breaker.allow() {
+		t.Fatalf("expected a successful probe to close the breaker")
+	}
+}
+
+func TestLDAPBreakerIgnoresRejectedCredentials(t *testing.T) {
+	withBindLimiter(t, nil)
+	breaker, _ := withLDAPBreaker(t, 1, time.Minute)
+	withDirectoryAuth(t, func(username, password string) (*User, []Access, error) {
+		return nil, nil, errLDAPInvalidCredentials
+	})
+
+	for range 3 {
+		ldapAuthenticateAccess("alice", "wrong")
+	}
+	if breaker.remaining() != 0 {
+		t.Fatalf("expected bad passwords not to open the breaker")
+	}
+	if rec := basicAuthRequest(t); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ldapGroupCache keeps the permissions resolved for a user for LDAP_CACHE_TTL
+// so repeated requests skip the group searches. The password is still
+// checked with a bind on every request. A nil cache is disabled.
+type ldapGroupCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]ldapCacheEntry
+	lastSweep time.Time
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+type ldapCacheEntry struct {
+	user    User
+	access  []Access
+	expires time.Time
+}
+
+func newLDAPGroupCache(ttl time.Duration) *ldapGroupCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &ldapGroupCache{ttl: ttl, now: time.Now, entries: map[string]ldapCacheEntry{}}
+}
+
+func ldapCacheKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// get returns a copy of the unexpired result for username.
+func (c *ldapGroupCache) get(username string) (*User, []Access, bool) {
+	if c == nil {
+		return nil, nil, false
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[ldapCacheKey(username)]
+	c.mu.Unlock()
+	if !ok || !c.now().Before(entry.expires) {
+		c.misses.Add(1)
+		return nil, nil, false
+	}
+	c.hits.Add(1)
+	user := entry.user
+	return &user, slices.Clone(entry.access), true
+}
+
+// put stores the result for username, dropping expired entries at most once
+// per TTL so users who stop signing in do not accumulate.
+func (c *ldapGroupCache) put(username string, user *User, access []Access) {
+	if c == nil || user == nil {
+		return
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) >= c.ttl {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[ldapCacheKey(username)] = ldapCacheEntry{user: *user, access: slices.Clone(access), expires: now.Add(c.ttl)}
+}
+
+func (c *ldapGroupCache) forget(username string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.entries, ldapCacheKey(username))
+	c.mu.Unlock()
+}
+
+func (c *ldapGroupCache) write(w io.Writer) {
+	if c == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP containervault_ldap_cache_hits_total Logins whose groups were served from the LDAP_CACHE_TTL cache.")
+	fmt.Fprintln(w, "# TYPE containervault_ldap_cache_hits_total counter")
+	fmt.Fprintf(w, "containervault_ldap_cache_hits_total %d\n", c.hits.Load())
+	fmt.Fprintln(w, "# HELP containervault_ldap_cache_misses_total Logins whose groups were searched in the directory.")
+	fmt.Fprintln(w, "# TYPE containervault_ldap_cache_misses_total counter")
+	fmt.Fprintf(w, "containervault_ldap_cache_misses_total %d\n", c.misses.Load())
+}
+
+// authenticateCached binds as the user and serves their permissions from
+// ldapGroups when a fresh result is cached, otherwise resolves and caches
+// them with authenticateConn.
+func authenticateCached(conn ldapConn, username, password string) (*User, []Access, error) {
+	if user, access, ok := ldapGroups.get(username); ok {
+		id, _, err := locateUser(conn, username)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := bindUser(conn, id, password); err != nil {
+			ldapGroups.forget(username)
+			return nil, nil, err
+		}
+		return user, access, nil
+	}
+	user, access, err := authenticateConn(conn, username, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	ldapGroups.put(username, user, access)
+	return user, access, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withLDAPGroupCache(t *testing.T, ttl time.Duration) *ldapGroupCache {
+	t.Helper()
+	prev := ldapGroups
+	ldapGroups = newLDAPGroupCache(ttl)
+	t.Cleanup(func() { ldapGroups = prev })
+	return ldapGroups
+}
+
+func TestLDAPCacheSkipsGroupSearchButChecksPassword(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	cache := withLDAPGroupCache(t, time.Minute)
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+
+	for i := 0; i < 3; i++ {
+		conn.bound = ""
+		user, access, err := authenticateCached(conn, "alice", "secret")
+		if err != nil {
+			t.Fatalf("authenticateCached: %v", err)
+		}
+		if user.Namespace != "team1" || len(access) != 2 {
+			t.Fatalf("unexpected cached result %+v %+v", user, access)
+		}
+		if conn.bound != conn.dn {
+			t.Fatalf("expected every login to bind")
+		}
+	}
+	if len(conn.searches) != 1 {
+		t.Fatalf("expected one group lookup, got %d", len(conn.searches))
+	}
+	if cache.hits.Load() != 2 || cache.misses.Load() != 1 {
+		t.Fatalf("expected 2 hits and 1 miss, got %d and %d", cache.hits.Load(), cache.misses.Load())
+	}
+
+	if _, _, err := authenticateCached(conn, "alice", "wrong"); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("expected a wrong password to fail despite the cache, got %v", err)
+	}
+	if _, _, ok := cache.get("alice"); ok {
+		t.Fatalf("expected a failed bind to drop the cached entry")
+	}
+}
+
+func TestLDAPCacheExpires(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	cache := withLDAPGroupCache(t, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+
+	if _, _, err := authenticateCached(conn, "alice", "secret"); err != nil {
+		t.Fatalf("authenticateCached: %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, _, err := authenticateCached(conn, "alice", "secret"); err != nil {
+		t.Fatalf("authenticateCached: %v", err)
+	}
+	if len(conn.searches) != 2 {
+		t.Fatalf("expected the groups to be searched again after the TTL, got %d searches", len(conn.searches))
+	}
+}
+
+func TestLDAPCacheDisabledWithZeroTTL(t *testing.T) {
+	withUserDNTemplate(t, "uid=%s,ou=people,dc=glauth,dc=com")
+	withLDAPGroupCache(t, 0)
+	conn := newDirectBindConn("uid=alice,ou=people,dc=glauth,dc=com")
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := authenticateCached(conn, "alice", "secret"); err != nil {
+			t.Fatalf("authenticateCached: %v", err)
+		}
+	}
+	if len(conn.searches) != 2 {
+		t.Fatalf("expected every login to search without a cache, got %d searches", len(conn.searches))
+	}
+}
+
+func TestLDAPCacheConcurrentAccess(t *testing.T) {
+	cache := newLDAPGroupCache(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", i%3)
+			for j := 0; j < 100; j++ {
+				cache.put(name, &User{Name: name}, []Access{{Namespace: "team1"}})
+				if user, access, ok := cache.get(name); ok {
+					access[0].Namespace = "changed"
+					if user.Name != name {
+						t.Errorf("expected %s, got %s", name, user.Name)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, access, _ := cache.get("user0"); access[0].Namespace != "team1" {
+		t.Fatalf("expected callers to get copies of the cached access")
+	}
+}
+
+func TestLDAPCacheMetrics(t *testing.T) {
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+	cache := withLDAPGroupCache(t, time.Minute)
+	cache.get("alice")
+	cache.put("alice", &User{Name: "alice"}, nil)
+	cache.get("alice")
+
+	body := serveUnauthenticated(t, "/metrics", "").Body.String()
+	for _, line := range []string{"containervault_ldap_cache_hits_total 1\n", "containervault_ldap_cache_misses_total 1\n"} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expected %q in metrics, got:\n%s", line, body)
+		}
+	}
+}
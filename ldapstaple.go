@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ldapTLSConfig is the TLS configuration for LDAPS and StartTLS connections.
+// ServerName is taken from LDAP_URL, since StartTLS upgrades an established
+// connection and has no address to verify the certificate against otherwise.
+func ldapTLSConfig(cfg LDAPConfig) *tls.Config {
+	var serverName string
+	if u, err := url.Parse(cfg.URL); err == nil {
+		serverName = u.Hostname()
+	}
+	// #nosec G402 -- skip TLS verification if configured
+	tlsCfg := &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            cfg.TLSRootCAs,
+		InsecureSkipVerify: cfg.SkipTLSVerify,
+		MinVersion:         cfg.TLSMinVersion,
+		MaxVersion:         cfg.TLSMaxVersion,
+		Renegotiation:      cfg.TLSRenegotiation,
+	}
+	if cfg.RequireOCSPStaple {
+		tlsCfg.VerifyConnection = verifyOCSPStaple
+	}
+	return tlsCfg
+}
+
+// verifyOCSPStaple fails the handshake unless the server stapled a current
+// OCSP response, signed for its certificate's issuer, reporting it as good.
+// The issuer comes from the verified chain, or from the chain the server sent
+// when LDAP_TLS_INSECURE is set.
+func verifyOCSPStaple(cs tls.ConnectionState) error {
+	if len(cs.OCSPResponse) == 0 {
+		return errors.New("ldap server did not staple an OCSP response")
+	}
+	chain := cs.PeerCertificates
+	if len(cs.VerifiedChains) > 0 {
+		chain = cs.VerifiedChains[0]
+	}
+	if len(chain) < 2 {
+		return errors.New("ldap server certificate issuer is unknown; cannot check its OCSP staple")
+	}
+	leaf, issuer := chain[0], chain[1]
+	resp, err := ocsp.ParseResponseForCert(cs.OCSPResponse, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("ldap server OCSP staple is invalid: %w", err)
+	}
+	return checkOCSPStatus(resp, leaf, time.Now())
+}
+
+func checkOCSPStatus(resp *ocsp.Response, leaf *x509.Certificate, now time.Time) error {
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return fmt.Errorf("ldap server certificate %s was revoked at %s", leaf.SerialNumber, resp.RevokedAt.UTC().Format(time.RFC3339))
+	default:
+		return fmt.Errorf("ldap server certificate %s has unknown OCSP status", leaf.SerialNumber)
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("ldap server OCSP staple expired at %s", resp.NextUpdate.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
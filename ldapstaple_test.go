@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newLDAPServerCert issues a certificate for 127.0.0.1 from a test CA written
+// to caPath, stapling an OCSP response with status when status is
+// non-negative.
+func newLDAPServerCert(t *testing.T, status int) (cert tls.Certificate, caPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	caPath = filepath.Join(dir, "ca.crt")
+	ca, caKey := writeTestCA(t, caPath, filepath.Join(dir, "ca.key"))
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "ldap.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create cert: %v", err)
+	}
+	cert = tls.Certificate{Certificate: [][]byte{der, ca.Raw}, PrivateKey: priv}
+	if status >= 0 {
+		staple := ocsp.Response{
+			Status:       status,
+			SerialNumber: template.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+			RevokedAt:    time.Now().Add(-time.Minute),
+		}
+		cert.OCSPStaple, err = ocsp.CreateResponse(ca, ca, staple, caKey)
+		if err != nil {
+			t.Fatalf("create OCSP response: %v", err)
+		}
+	}
+	return cert, caPath
+}
+
+// startStaplingLDAPServer serves TLS on a loopback port with a certificate
+// from newLDAPServerCert.
+func startStaplingLDAPServer(t *testing.T, status int) string {
+	t.Helper()
+	cert, _ := newLDAPServerCert(t, status)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	return "ldaps://" + listener.Addr().String()
+}
+
+func TestLDAPRequireStapleAcceptsGoodStaple(t *testing.T) {
+	url := startStaplingLDAPServer(t, ocsp.Good)
+	conn, err := dialLDAP(LDAPConfig{URL: url, SkipTLSVerify: true, RequireOCSPStaple: true})
+	if err != nil {
+		t.Fatalf("expected stapled server to be accepted: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestLDAPRequireStapleRejectsMissingStaple(t *testing.T) {
+	url := startStaplingLDAPServer(t, -1)
+	if _, err := dialLDAP(LDAPConfig{URL: url, SkipTLSVerify: true, RequireOCSPStaple: true}); err == nil || !strings.Contains(err.Error(), "did not staple") {
+		t.Fatalf("expected server without a staple to be rejected, got %v", err)
+	}
+
+	conn, err := dialLDAP(LDAPConfig{URL: url, SkipTLSVerify: true})
+	if err != nil {
+		t.Fatalf("expected the staple not to be required by default: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestLDAPRequireStapleRejectsRevokedStaple(t *testing.T) {
+	url := startStaplingLDAPServer(t, ocsp.Revoked)
+	if _, err := dialLDAP(LDAPConfig{URL: url, SkipTLSVerify: true, RequireOCSPStaple: true}); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("expected revoked staple to be rejected, got %v", err)
+	}
+}
+
+func TestCheckOCSPStatusRejectsExpiredStaple(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(1)}
+	resp := &ocsp.Response{Status: ocsp.Good, NextUpdate: now.Add(-time.Minute)}
+	if err := checkOCSPStatus(resp, leaf, now); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("expected expired staple to be rejected, got %v", err)
+	}
+}
+
+func TestLDAPTLSConfigCarriesVersionBounds(t *testing.T) {
+	tlsCfg := ldapTLSConfig(LDAPConfig{TLSMinVersion: tls.VersionTLS10, TLSMaxVersion: tls.VersionTLS12, TLSRenegotiation: tls.RenegotiateOnceAsClient})
+	if tlsCfg.MinVersion != tls.VersionTLS10 || tlsCfg.MaxVersion != tls.VersionTLS12 || tlsCfg.Renegotiation != tls.RenegotiateOnceAsClient {
+		t.Fatalf("unexpected LDAP tls.Config: min %x max %x renegotiation %d", tlsCfg.MinVersion, tlsCfg.MaxVersion, tlsCfg.Renegotiation)
+	}
+}
+
+// startStartTLSLDAPServer serves plain LDAP on a loopback port, answering
+// StartTLS with resultCode and, on success, upgrading to TLS with cert and
+// accepting any bind. Operations the server sees before an upgrade are sent
+// on the returned channel, which is closed when the connection ends.
+func startStartTLSLDAPServer(t *testing.T, cert tls.Certificate, resultCode int64) (string, <-chan ber.Tag) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	plaintext := make(chan ber.Tag, 8)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(plaintext)
+		var rw io.ReadWriter = conn
+		for {
+			packet, err := ber.ReadPacket(rw)
+			if err != nil || len(packet.Children) < 2 {
+				return
+			}
+			msgID, _ := packet.Children[0].Value.(int64)
+			op := packet.Children[1].Tag
+			if _, upgraded := rw.(*tls.Conn); !upgraded {
+				plaintext <- op
+			}
+			switch op {
+			case ldap.ApplicationExtendedRequest:
+				if _, err := rw.Write(ldapResultPacket(msgID, ldap.ApplicationExtendedResponse, resultCode).Bytes()); err != nil {
+					return
+				}
+				if resultCode == ldap.LDAPResultSuccess {
+					rw = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+				}
+			case ldap.ApplicationBindRequest:
+				if _, err := rw.Write(ldapResultPacket(msgID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess).Bytes()); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return "ldap://" + listener.Addr().String(), plaintext
+}
+
+func ldapResultPacket(msgID int64, op ber.Tag, resultCode int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "MessageID"))
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, "resultCode"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	packet.AppendChild(result)
+	return packet
+}
+
+func TestLDAPStartTLSVerifiesAgainstConfiguredCA(t *testing.T) {
+	cert, caPath := newLDAPServerCert(t, -1)
+	url, plaintext := startStartTLSLDAPServer(t, cert, ldap.LDAPResultSuccess)
+	conn, err := dialLDAP(LDAPConfig{URL: url, StartTLS: true, TLSRootCAs: loadLDAPRootCAs(caPath)})
+	if err != nil {
+		t.Fatalf("expected StartTLS to verify against LDAP_TLS_CA: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.TLSConnectionState(); !ok {
+		t.Fatalf("expected the connection to be upgraded")
+	}
+	if err := conn.Bind("cn=svc,dc=example,dc=com", "secret"); err != nil {
+		t.Fatalf("bind over StartTLS: %v", err)
+	}
+	_ = conn.Close()
+	for op := range plaintext {
+		if op != ldap.ApplicationExtendedRequest {
+			t.Fatalf("expected only the StartTLS request in plaintext, got operation %d", op)
+		}
+	}
+}
+
+func TestLDAPStartTLSRejectsUntrustedCertificate(t *testing.T) {
+	cert, _ := newLDAPServerCert(t, -1)
+	_, otherCA := newLDAPServerCert(t, -1)
+	url, _ := startStartTLSLDAPServer(t, cert, ldap.LDAPResultSuccess)
+	if _, err := dialLDAP(LDAPConfig{URL: url, StartTLS: true, TLSRootCAs: loadLDAPRootCAs(otherCA)}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate from another CA to be rejected, got %v", err)
+	}
+}
+
+func TestLDAPStartTLSFailureDoesNotFallBackToPlaintext(t *testing.T) {
+	cert, _ := newLDAPServerCert(t, -1)
+	url, plaintext := startStartTLSLDAPServer(t, cert, ldap.LDAPResultUnavailable)
+	if _, err := dialLDAP(LDAPConfig{URL: url, StartTLS: true, SkipTLSVerify: true}); err == nil || !strings.Contains(err.Error(), "StartTLS failed") {
+		t.Fatalf("expected a refused StartTLS to fail the dial, got %v", err)
+	}
+	for op := range plaintext {
+		if op != ldap.ApplicationExtendedRequest {
+			t.Fatalf("expected nothing after the refused StartTLS, got operation %d", op)
+		}
+	}
+}
+
+func TestLDAPSBindFailsWithInvalidCA(t *testing.T) {
+	url := startStaplingLDAPServer(t, -1)
+	_, otherCA := newLDAPServerCert(t, -1)
+	garbageCA := filepath.Join(t.TempDir(), "garbage.crt")
+	if err := os.WriteFile(garbageCA, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+	prev := ldapCfg
+	t.Cleanup(func() { ldapCfg = prev })
+
+	for name, caPath := range map[string]string{"other CA": otherCA, "unparseable CA": garbageCA} {
+		ldapCfg = LDAPConfig{URL: url, TLSRootCAs: loadLDAPRootCAs(caPath)}
+		if _, _, err := ldapAuthenticateDirectory("alice@example.com", "secret"); err == nil || !strings.Contains(err.Error(), "certificate") {
+			t.Fatalf("%s: expected the bind to fail certificate verification, got %v", name, err)
+		}
+	}
+}
+
+func TestLoadLDAPRootCAsFailsClosed(t *testing.T) {
+	if pool := loadLDAPRootCAs(""); pool != nil {
+		t.Fatalf("expected no pool without LDAP_TLS_CA")
+	}
+	pool := loadLDAPRootCAs(filepath.Join(t.TempDir(), "missing.crt"))
+	if pool == nil || !pool.Equal(x509.NewCertPool()) {
+		t.Fatalf("expected an unreadable bundle to leave an empty pool")
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
@@ -23,7 +29,7 @@ func cvRouter() http.Handler {
 
 	// Use single-host reverse proxy to forward traffic to the registry
 	proxy := &httputil.ReverseProxy{
-		Transport: proxyTransport,
+		Transport: newManifestPullTransport(proxyTransport),
 		Rewrite: func(pr *httputil.ProxyRequest) {
 			pr.SetURL(upstream)
 			pr.Out.Header.Del("Forwarded")
@@ -35,11 +41,21 @@ func cvRouter() http.Handler {
 			pr.Out.Host = upstream.Host
 			pr.SetXForwarded()
 		},
+		ModifyResponse: modifyProxyResponse,
 	}
 
 	proxy.FlushInterval = -1 // important for streaming blobs
 
 	router := chi.NewRouter()
+	router.Use(extraResponseHeadersMiddleware(extraResponseHeaders))
+	router.Use(requestIDMiddleware)
+	if canonicalHost.enabled() {
+		router.Use(canonicalHostMiddleware(canonicalHost))
+	}
+	if healthCfg.SaturationMetrics {
+		router.Use(trackInFlight)
+	}
+	router.Use(chaosDelayMiddleware(chaosCfg))
 	router.Use(sessionManager.LoadAndSave)
 	staticHandler := http.StripPrefix("/static/", http.FileServer(http.Dir(staticDir)))
 	router.Handle("/static/*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -54,9 +70,15 @@ func cvRouter() http.Handler {
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 	})
+	registerHealthRoutes(router, healthCfg)
 	router.Post("/login", handleLoginPost)
 	router.Get("/login", handleLoginGet)
 	router.HandleFunc("/logout", handleLogout)
+	router.Get("/admin/users/{username}/permissions", handleAdminUserPermissions)
+	router.Get("/admin/storage", handleAdminStorage)
+	router.Get("/admin/cert", handleAdminCert)
+	router.Get("/admin/quarantine/{digest}", handleAdminQuarantine)
+	router.Put("/admin/quarantine/{digest}", handleAdminQuarantine)
 
 	apiCfg := huma.DefaultConfig("ContainerVault", "1.0.0")
 	apiCfg.OpenAPIPath = ""
@@ -65,13 +87,22 @@ func cvRouter() http.Handler {
 	api := humachi.New(router, apiCfg)
 	registerAPI(api)
 
-	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
-		user, access, ok := authenticate(w, r)
-		if !ok {
-			// http.Error already sent
+	// serveRegistry applies the registry policies to an authenticated /v2
+	// request and proxies what they allow. Image imports push through it.
+	serveRegistry := func(w http.ResponseWriter, r *http.Request, user *User, access []Access) {
+		var ok bool
+		if !enforceRegistryMethod(w, r) {
+			return
+		}
+
+		if serveCapabilities(w, r, access) {
 			return
 		}
 
+		if debugAuthHeader {
+			w.Header().Set("X-Auth-Decision", authDecision(access, r))
+		}
+
 		if !authorize(access, r) {
 			forbiddenMessage := "forbidden by user \"" + user.Name + "\" only allowed access to "
 			if len(access) == 0 {
@@ -84,20 +115,198 @@ func cvRouter() http.Handler {
 				forbiddenMessage += "repositories: " + strings.Join(repos, ", ")
 			}
 
-			http.Error(w, forbiddenMessage, http.StatusForbidden)
+			writeRegistryError(w, http.StatusForbidden, "DENIED", forbiddenMessage)
+			return
+		}
+
+		if !enforceDeleteWindow(w, r, user) {
+			return
+		}
+
+		r = withAuditUser(r, user)
+
+		if !enforceRepoRateLimit(w, r) {
+			return
+		}
+
+		if forwardReplicaWrite(w, r) {
+			return
+		}
+
+		r, ok = enforceDigestPolicy(w, r)
+		if !ok {
+			return
+		}
+
+		if !enforceTagName(w, r) {
+			return
+		}
+
+		r, ok = enforceBlobLength(w, r)
+		if !ok {
+			return
+		}
+
+		r, ok = enforceUploadDigest(w, r)
+		if !ok {
+			return
+		}
+
+		r, ok = enforceManifestSize(w, r)
+		if !ok {
+			return
+		}
+
+		r, ok = enforceManifestPolicy(w, r)
+		if !ok {
+			return
+		}
+
+		if !enforceImmutableTags(w, r) {
+			return
+		}
+
+		if blockedRequest(r) {
+			writeRegistryError(w, http.StatusUnavailableForLegalReasons, "DENIED", blockedDigestMessage)
+			return
+		}
+
+		w, r = applyBlobIdleDeadline(w, r)
+
+		if serveSanitizedContent(w, r) {
+			return
+		}
+
+		if serveReferrers(w, r) {
+			return
+		}
+
+		if serveRemotePull(w, r) {
+			return
+		}
+
+		if !enforceNamespaceLimit(w, r) {
 			return
 		}
 
+		r, ok = enforceUploadLimit(w, r)
+		if !ok {
+			return
+		}
+
+		r = recordOverwrittenTag(r)
+		r = prepareManifestConversion(r)
+		r = prepareReferrer(r)
+		r = prepareTimestampTag(r)
 		proxy.ServeHTTP(w, r)
+	}
+
+	router.HandleFunc("/api/repos/*", func(w http.ResponseWriter, r *http.Request) {
+		handleRepoAction(w, r, serveRegistry)
+	})
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		r = routeHostNamespace(r)
+
+		user, access, ok := authenticate(w, r)
+		if !ok {
+			// http.Error already sent
+			return
+		}
+		serveRegistry(w, r, user, access)
 	})
 	return router
 }
 
+// registryHandler serves a /v2 request on behalf of an authenticated user.
+type registryHandler func(w http.ResponseWriter, r *http.Request, user *User, access []Access)
+
+// proxyResponseModifiers run in order on every upstream registry response.
+var proxyResponseModifiers = []func(*http.Response) error{
+	blockBlockedDigestResponse,
+	blockQuarantinedResponse,
+	requireSignedManifest,
+	sanitizeManifestResponse,
+	hideStrippedConfigResponse,
+	convertManifestResponse,
+	invalidateImageSizeResponse,
+	unrouteHostNamespaceResponse,
+	trackUploadSession,
+	trackUploadDigest,
+	scheduleOverwriteGC,
+	quarantinePushedManifest,
+	advertiseSpecFeatures,
+	indexReferrer,
+	applyTimestampTag,
+	warnSchema1Response,
+	auditRegistryChange,
+	tagRegistryErrorResponse,
+}
+
+func modifyProxyResponse(resp *http.Response) error {
+	for _, modify := range proxyResponseModifiers {
+		if err := modify(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
+	if err := validateLDAPConfig(ldapCfg); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+	if err := validateOIDCConfig(oidcAuth.cfg); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+	if err := startupSelfTest(loadSelfTestConfig()); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go blockedDigests.watch(reloadSignals)
+
+	if blobScrub.enabled() {
+		go blobScrub.run(context.Background())
+	}
+	if overwriteCollector.enabled() {
+		go overwriteCollector.run(context.Background())
+	}
+	blobCollector := newBlobGC(loadBlobGCConfig())
+	if blobCollector.enabled() {
+		go blobCollector.run(context.Background())
+	}
 
 	router := cvRouter()
 
-	listenAddr := ":8443"
+	redirectCfg, err := loadRedirectConfig()
+	if err != nil {
+		log.Fatalf("http redirect setup failed: %v", err)
+	}
+	if redirectCfg.enabled() {
+		go func() {
+			log.Printf("redirecting http on %s to https with %d", redirectCfg.Addr, redirectCfg.Code)
+			log.Fatal(newServer(redirectCfg.Addr, httpsRedirectHandler(redirectCfg.Code)).ListenAndServe())
+		}()
+	}
+
+	listenAddr := ":" + strconv.Itoa(tlsListenPort)
+	var listener net.Listener
+	if certmagicSharesListener() {
+		// Bind before certmagic starts so its TLS-ALPN solver finds the port
+		// taken and leaves challenges to the main listener.
+		if listener, err = net.Listen("tcp", listenAddr); err != nil {
+			log.Fatalf("unable to listen on %s: %v", listenAddr, err)
+		}
+	}
+	minVersion, err := tlsMinVersion()
+	if err != nil {
+		log.Fatalf("tls setup failed: %v", err)
+	}
+	cipherSuites, err := tlsCipherSuites(minVersion)
+	if err != nil {
+		log.Fatalf("tls setup failed: %v", err)
+	}
 	tlsCfg, certmagicEnabled, err := certmagicTLSConfig()
 	if err != nil {
 		log.Fatalf("certmagic setup failed: %v", err)
@@ -106,18 +315,32 @@ func main() {
 	certPath := "/certs/registry.crt"
 	keyPath := "/certs/registry.key"
 
-	server := &http.Server{
-		Addr:              listenAddr,
-		Handler:           router,
-		ReadTimeout:       15 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       60 * time.Second,
-		ReadHeaderTimeout: 10 * time.Second,
-	}
+	server := newServer(listenAddr, router)
 
+	server.TLSConfig = &tls.Config{MinVersion: minVersion, CipherSuites: cipherSuites}
 	if certmagicEnabled {
 		server.TLSConfig = tlsCfg
+	}
+	if allowed := loadSNIAllowlist(); len(allowed) > 0 {
+		applySNIAllowlist(server.TLSConfig, allowed)
+	}
+	if mtlsCfg.enabled() {
+		pool, err := mtlsCfg.clientCAs()
+		if err != nil {
+			log.Fatalf("unable to load client CA bundle: %v", err)
+		}
+		applyClientCertAuth(server.TLSConfig, pool, mtlsCfg.Require)
+	}
+	if debugTLS {
+		applyTLSDebugLog(server.TLSConfig)
+	}
+
+	if certmagicEnabled {
+		servedCertificate, certSource = tlsConfigCertificate(tlsCfg), "certmagic"
 		log.Printf("listening on %s with certmagic", listenAddr)
+		if listener != nil {
+			log.Fatal(server.ServeTLS(listener, "", ""))
+		}
 		log.Fatal(server.ListenAndServeTLS("", ""))
 	}
 
@@ -125,8 +348,33 @@ func main() {
 		log.Fatalf("unable to ensure TLS certificate: %v", err)
 	}
 
+	listenerCert, err := loadReloadableCertificate(certPath, keyPath)
+	if err != nil {
+		log.Fatalf("unable to load TLS certificate: %v", err)
+	}
+	certReloadSignals := make(chan os.Signal, 1)
+	signal.Notify(certReloadSignals, syscall.SIGHUP)
+	go listenerCert.watch(certReloadSignals)
+	server.TLSConfig.GetCertificate = listenerCert.GetCertificate
+
+	servedCertificate, certSource = tlsConfigCertificate(server.TLSConfig), "file"
 	log.Printf("listening on %s", listenAddr)
-	log.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+	if listener != nil {
+		log.Fatal(server.ServeTLS(listener, "", ""))
+	}
+	log.Fatal(server.ListenAndServeTLS("", ""))
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
 }
 
 func resolveStaticDir() string {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -85,6 +86,43 @@ func TestCvRouterStaticSetsNoCache(t *testing.T) {
 	}
 }
 
+func TestCvRouterProxyReportsUploadOffset(t *testing.T) {
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	rec := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", rec.Code)
+	}
+	location := rec.Header().Get("Location")
+
+	rec = serveProxyRequest(t, http.MethodGet, location)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Range") != "0-0" {
+		t.Fatalf("expected empty upload, got %d %q", rec.Code, rec.Header().Get("Range"))
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPatch, location, strings.NewReader("0123456789"))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 for PATCH, got %d", rec.Code)
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, location)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Range"); got != "0-9" {
+		t.Fatalf("expected Range 0-9 after a 10 byte chunk, got %q", got)
+	}
+	if rec.Header().Get("Docker-Upload-UUID") == "" || rec.Header().Get("Location") != location {
+		t.Fatalf("expected upload UUID and Location, got %v", rec.Header())
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPut, location+"?digest="+testDigest([]byte("0123456789abc")), strings.NewReader("abc"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected resumed upload to complete, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
 func TestCvRouterProxyForwards(t *testing.T) {
 	originalAuth := ldapAuth
 	ldapAuth = func(username, password string) (*User, []Access, error) {
@@ -149,3 +187,90 @@ type roundTripperFunc func(*http.Request) (*http.Response, error)
 func (fn roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
 	return fn(r)
 }
+
+func withProxyUpstream(t *testing.T, fn func(*http.Request) *http.Response) *int {
+	t.Helper()
+	originalAuth := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1"}}, nil
+	}
+	originalUpstream := upstream
+	upstream = mustParse("http://registry.test")
+	originalTransport := proxyTransport
+	calls := 0
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		calls++
+		return fn(r), nil
+	})
+	t.Cleanup(func() {
+		ldapAuth = originalAuth
+		upstream = originalUpstream
+		proxyTransport = originalTransport
+	})
+	return &calls
+}
+
+func proxyTestResponse(r *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}
+}
+
+func serveProxyRequest(t *testing.T, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serveProxyRequestBody(t, method, path, nil)
+}
+
+func serveProxyRequestBody(t *testing.T, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	t.Helper()
+	router := cvRouter()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, body)
+	req.SetBasicAuth("alice", "secret")
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewServerRejectsOversizedHeaders(t *testing.T) {
+	prev := maxHeaderBytes
+	maxHeaderBytes = 1024
+	t.Cleanup(func() { maxHeaderBytes = prev })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := newServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	send := func(headerSize int) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("X-Padding", strings.Repeat("a", headerSize))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := send(100); status != http.StatusNoContent {
+		t.Fatalf("expected normal request to succeed, got %d", status)
+	}
+	// net/http reads with some slack past MaxHeaderBytes, so go well beyond it.
+	if status := send(64 << 10); status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("expected 431 for oversized headers, got %d", status)
+	}
+}
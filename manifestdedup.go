@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// manifestPullTransport shares one upstream fetch between concurrent,
+// identical manifest GET and HEAD requests, so a deploy storm pulling the
+// same tag costs the registry storage one read instead of thousands. Each
+// caller gets its own copy of the buffered response; nothing is cached once
+// the shared fetch has been fanned out.
+type manifestPullTransport struct {
+	base  http.RoundTripper
+	group singleflight.Group
+}
+
+type sharedManifestResponse struct {
+	status        int
+	header        http.Header
+	body          []byte
+	contentLength int64
+}
+
+// newManifestPullTransport wraps base when DEDUPE_MANIFEST_PULLS is enabled.
+func newManifestPullTransport(base http.RoundTripper) http.RoundTripper {
+	if !dedupeManifestPulls {
+		return base
+	}
+	return &manifestPullTransport{base: base}
+}
+
+func (t *manifestPullTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+	route, ok := parseRegistryPath(req.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return t.base.RoundTrip(req)
+	}
+
+	// Everything the registry varies a manifest response on is part of the
+	// key, so callers negotiating different media types never share.
+	key := strings.Join([]string{
+		req.Method,
+		req.URL.String(),
+		strings.Join(req.Header.Values("Accept"), ","),
+		req.Header.Get("If-None-Match"),
+	}, "\n")
+	value, err, _ := t.group.Do(key, func() (any, error) {
+		// The fetch outlives a leader that disconnects, since other pulls
+		// may be waiting on it.
+		resp, err := t.base.RoundTrip(req.WithContext(context.WithoutCancel(req.Context())))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		length := int64(len(body))
+		if req.Method == http.MethodHead {
+			length = resp.ContentLength
+		}
+		return &sharedManifestResponse{status: resp.StatusCode, header: resp.Header, body: body, contentLength: length}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	shared := value.(*sharedManifestResponse)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", shared.status, http.StatusText(shared.status)),
+		StatusCode:    shared.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        shared.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(shared.body)),
+		ContentLength: shared.contentLength,
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withCountingManifestUpstream serves manifest requests from body after
+// release is closed, counting how many reach the upstream.
+func withCountingManifestUpstream(t *testing.T, body string, release <-chan struct{}) *atomic.Int32 {
+	t.Helper()
+	var fetches atomic.Int32
+	withProxyUpstream(t, nil)
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		fetches.Add(1)
+		<-release
+		header := http.Header{"Content-Type": {ociManifestType}, "Docker-Content-Digest": {testDigest([]byte(body))}}
+		return proxyTestResponse(r, http.StatusOK, header, body), nil
+	})
+	prev := dedupeManifestPulls
+	dedupeManifestPulls = true
+	t.Cleanup(func() { dedupeManifestPulls = prev })
+	return &fetches
+}
+
+func TestConcurrentManifestPullsShareOneFetch(t *testing.T) {
+	const pulls = 64
+	body := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	release := make(chan struct{})
+	fetches := withCountingManifestUpstream(t, body, release)
+	router := cvRouter()
+
+	var started, done sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, pulls)
+	for i := range results {
+		started.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+			req.SetBasicAuth("alice", "secret")
+			req.Header.Set("Accept", ociManifestType)
+			rec := httptest.NewRecorder()
+			started.Done()
+			router.ServeHTTP(rec, req)
+			results[i] = rec
+		}()
+	}
+	started.Wait()
+	// Give every pull time to join the fetch that is held open.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected one upstream manifest read, got %d", got)
+	}
+	for i, rec := range results {
+		if rec.Code != http.StatusOK || rec.Body.String() != body {
+			t.Fatalf("pull %d: unexpected response %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Once fanned out nothing is cached.
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusOK || fetches.Load() != 2 {
+		t.Fatalf("expected a later pull to fetch again, got %d after %d fetches", rec.Code, fetches.Load())
+	}
+}
+
+func TestManifestPullsWithDifferentAcceptDoNotShare(t *testing.T) {
+	release := make(chan struct{})
+	fetches := withCountingManifestUpstream(t, `{}`, release)
+	router := cvRouter()
+
+	var done sync.WaitGroup
+	for _, accept := range []string{ociManifestType, ociIndexMedia} {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/latest", nil)
+			req.SetBasicAuth("alice", "secret")
+			req.Header.Set("Accept", accept)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	done.Wait()
+
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("expected separate fetches per Accept header, got %d", got)
+	}
+}
+
+func TestManifestPullDedupOnlyWhenEnabled(t *testing.T) {
+	prev := dedupeManifestPulls
+	t.Cleanup(func() { dedupeManifestPulls = prev })
+
+	dedupeManifestPulls = false
+	if _, ok := newManifestPullTransport(http.DefaultTransport).(*manifestPullTransport); ok {
+		t.Fatalf("expected the base transport when DEDUPE_MANIFEST_PULLS is off")
+	}
+	dedupeManifestPulls = true
+	if _, ok := newManifestPullTransport(http.DefaultTransport).(*manifestPullTransport); !ok {
+		t.Fatalf("expected the deduplicating transport when DEDUPE_MANIFEST_PULLS is on")
+	}
+}
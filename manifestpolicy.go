@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxManifestBytes matches the registry's own manifest size limit and is the
+// default MAX_MANIFEST_SIZE.
+const maxManifestBytes = 4 << 20
+
+// peekManifestBody reads a manifest PUT body and puts it back so the request
+// can still be proxied. It reports false for unreadable or oversized bodies,
+// leaving those for the registry to reject.
+func peekManifestBody(r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, manifestSizeLimit+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil || int64(len(body)) > manifestSizeLimit {
+		return nil, false
+	}
+	return body, true
+}
+
+// manifestPolicy holds optional checks applied to manifest pushes before they
+// reach the registry.
+type manifestPolicy struct {
+	// UniqueTagDigests rejects tagging a digest that another tag in the
+	// namespace already points at.
+	UniqueTagDigests bool
+	// StrictBlobs requires every blob and child manifest a manifest references
+	// to already exist in the target repository.
+	StrictBlobs bool
+	// AllowedPlatforms lists the os/arch[/variant] platforms images may be
+	// pushed for; empty allows every platform.
+	AllowedPlatforms []string
+	// RejectSchema1 refuses Docker schema 1 manifest pushes; existing
+	// schema 1 manifests are still served, with a deprecation Warning.
+	RejectSchema1 bool
+	// VerifyBlobDigests re-hashes the config and layer blobs a manifest
+	// references and refuses it when stored content does not match the
+	// digest it is stored under.
+	VerifyBlobDigests bool
+	// MinLayers is the fewest layers an image pushed to a namespace must
+	// have, keyed by namespace; the "" entry applies to every other namespace.
+	MinLayers map[string]int
+}
+
+// manifestReferences is the union of the image manifest and index fields
+// naming content that must be present in the registry.
+type manifestReferences struct {
+	Config    *manifestDescriptor  `json:"config"`
+	Layers    []manifestDescriptor `json:"layers"`
+	Manifests []manifestDescriptor `json:"manifests"`
+}
+
+type manifestDescriptor struct {
+	Digest      string            `json:"digest"`
+	URLs        []string          `json:"urls"`
+	Platform    *manifestPlatform `json:"platform"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func loadManifestPolicy() manifestPolicy {
+	return manifestPolicy{
+		UniqueTagDigests: getEnvBool("UNIQUE_TAG_DIGESTS", false),
+		StrictBlobs:      getEnvBool("STRICT_MANIFEST_BLOBS", false),
+		AllowedPlatforms: splitCommaList(os.Getenv("ALLOWED_PLATFORMS")),
+		RejectSchema1:    getEnvBool("REJECT_SCHEMA1_PUSH", false),
+
+		VerifyBlobDigests: getEnvBool("VERIFY_MANIFEST_BLOB_DIGESTS", false),
+		MinLayers:         parseMinManifestLayers(os.Getenv("MIN_MANIFEST_LAYERS")),
+	}
+}
+
+// parseMinManifestLayers parses "prod=2,release=1" into namespace -> minimum
+// layer count. A bare count, as in "1,prod=2", applies to every namespace
+// without an entry of its own. Malformed entries are logged and skipped.
+func parseMinManifestLayers(raw string) map[string]int {
+	minimums := map[string]int{}
+	for _, entry := range splitCommaList(raw) {
+		namespace, count, ok := strings.Cut(entry, "=")
+		if !ok {
+			namespace, count = "", entry
+		}
+		namespace = strings.TrimSpace(namespace)
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 || (ok && namespace == "") {
+			log.Printf("ignoring MIN_MANIFEST_LAYERS entry %q: expected namespace=count or count", entry)
+			continue
+		}
+		minimums[namespace] = n
+	}
+	return minimums
+}
+
+func (p manifestPolicy) enabled() bool {
+	return p.UniqueTagDigests || p.StrictBlobs || len(p.AllowedPlatforms) > 0 || p.RejectSchema1 || p.VerifyBlobDigests || len(p.MinLayers) > 0
+}
+
+// minLayers returns the MIN_MANIFEST_LAYERS minimum for repo's namespace.
+func (p manifestPolicy) minLayers(repo string) int {
+	namespace, _, _ := strings.Cut(repo, "/")
+	if n, ok := p.MinLayers[namespace]; ok {
+		return n
+	}
+	return p.MinLayers[""]
+}
+
+// enforceManifestPolicy buffers manifest PUT bodies and applies manifestCfg.
+// The returned request carries a replayable copy of the body.
+func enforceManifestPolicy(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !manifestCfg.enabled() || r.Method != http.MethodPut {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return r, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, manifestSizeLimit+1))
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unable to read manifest")
+		return nil, false
+	}
+	if int64(len(body)) > manifestSizeLimit {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest too large")
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	if manifestCfg.RejectSchema1 && isSchema1Manifest(r.Header.Get("Content-Type"), body) {
+		writeRegistryError(w, http.StatusUnsupportedMediaType, "MANIFEST_INVALID", "Docker schema 1 manifests are no longer accepted; push the image again with a current Docker or buildx to produce schema 2 or OCI")
+		return nil, false
+	}
+
+	var refs manifestReferences
+	if manifestCfg.StrictBlobs || len(manifestCfg.AllowedPlatforms) > 0 || manifestCfg.VerifyBlobDigests {
+		if err := json.Unmarshal(body, &refs); err != nil {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "manifest is not valid JSON")
+			return nil, false
+		}
+	}
+
+	if manifestCfg.StrictBlobs {
+		code, missing, err := missingManifestReference(r.Context(), route.Repo, refs)
+		if err != nil {
+			log.Printf("manifest reference check for %s failed: %v", route.Repo, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to verify manifest references")
+			return nil, false
+		}
+		if missing != "" {
+			writeRegistryError(w, http.StatusBadRequest, code, fmt.Sprintf("%s is not present in %s", missing, route.Repo))
+			return nil, false
+		}
+	}
+
+	if manifestCfg.VerifyBlobDigests {
+		mismatched, err := mismatchedBlobDigest(r.Context(), route.Repo, refs)
+		if err != nil {
+			log.Printf("blob digest check for %s failed: %v", route.Repo, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to verify blob digests")
+			return nil, false
+		}
+		if mismatched != "" {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("content stored as %s in %s does not match its digest", mismatched, route.Repo))
+			return nil, false
+		}
+	}
+
+	if problem := minLayersProblem(route.Repo, route.Reference, body); problem != "" {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", problem)
+		return nil, false
+	}
+
+	if len(manifestCfg.AllowedPlatforms) > 0 {
+		platform, err := disallowedPlatform(r.Context(), &http.Client{Timeout: 10 * time.Second}, route.Repo, refs)
+		if err != nil {
+			log.Printf("platform check for %s failed: %v", route.Repo, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to verify manifest platform")
+			return nil, false
+		}
+		if platform != "" {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", platformProblem(platform))
+			return nil, false
+		}
+	}
+
+	if manifestCfg.UniqueTagDigests && !isDigestReference(route.Reference) {
+		namespace, err := namespaceFromRepo(route.Repo)
+		if err != nil {
+			return r, true
+		}
+		existing, err := findTagForDigest(r.Context(), namespace, digest, route.Repo, route.Reference)
+		if err != nil {
+			log.Printf("unique tag check for %s:%s failed: %v", route.Repo, route.Reference, err)
+			writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to verify tag uniqueness")
+			return nil, false
+		}
+		if existing != "" {
+			writeRegistryError(w, http.StatusConflict, "DENIED", fmt.Sprintf("digest %s is already tagged as %s", digest, existing))
+			return nil, false
+		}
+	}
+	return r, true
+}
+
+// minLayersProblem explains why the manifest body pushed to repo:reference
+// has too few layers for MIN_MANIFEST_LAYERS, or returns "" when it has
+// enough. Cosign's sha256-<hex> tags are not images and are not checked.
+func minLayersProblem(repo, reference string, body []byte) string {
+	minimum := manifestCfg.minLayers(repo)
+	if minimum <= 0 || signatureArtifactTag.MatchString(reference) {
+		return ""
+	}
+	if layers, ok := imageLayerCount(body); ok && layers < minimum {
+		return fmt.Sprintf("image has %d layers; images pushed to %s need at least %d", layers, repo, minimum)
+	}
+	return ""
+}
+
+// layerCountManifest holds the fields that tell an image manifest apart from
+// an index or an artifact attached to another manifest.
+type layerCountManifest struct {
+	ArtifactType string               `json:"artifactType"`
+	Subject      *manifestDescriptor  `json:"subject"`
+	Config       *manifestDescriptor  `json:"config"`
+	Layers       []manifestDescriptor `json:"layers"`
+}
+
+// imageLayerCount returns the number of layers in an image manifest. Indexes,
+// whose children are checked as they are pushed, artifacts and schema 1
+// manifests report false.
+func imageLayerCount(body []byte) (int, bool) {
+	var manifest layerCountManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return 0, false
+	}
+	if manifest.Config == nil || manifest.Subject != nil || manifest.ArtifactType != "" {
+		return 0, false
+	}
+	return len(manifest.Layers), true
+}
+
+// findTagForDigest returns the first repo:tag in namespace that resolves to
+// digest, ignoring skipRepo:skipTag so re-pushing a tag is not a conflict.
+func findTagForDigest(ctx context.Context, namespace, digest, skipRepo, skipTag string) (string, error) {
+	repos, err := fetchRepos(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	for _, repo := range repos {
+		tags, err := fetchTags(ctx, repo)
+		if err != nil {
+			return "", err
+		}
+		for _, tag := range tags {
+			if repo == skipRepo && tag == skipTag {
+				continue
+			}
+			tagDigest, status, _, err := fetchTagDigest(ctx, repo, tag)
+			if err != nil {
+				return "", err
+			}
+			if status == http.StatusNotFound {
+				continue
+			}
+			if status != 0 {
+				return "", fmt.Errorf("manifest status %d for %s:%s", status, repo, tag)
+			}
+			if tagDigest == digest {
+				return repo + ":" + tag, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// missingManifestReference returns the registry error code and digest of the
+// first referenced blob or child manifest that repo does not hold. Foreign
+// layers, which are fetched from their URLs, are not checked.
+func missingManifestReference(ctx context.Context, repo string, refs manifestReferences) (string, string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	blobs := refs.Layers
+	if refs.Config != nil {
+		blobs = append([]manifestDescriptor{*refs.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		ok, err := registryObjectExists(ctx, client, repo, registryKindBlobs, blob.Digest)
+		if err != nil {
+			return "", "", err
+		}
+		if !ok {
+			return "BLOB_UNKNOWN", blob.Digest, nil
+		}
+	}
+	for _, manifest := range refs.Manifests {
+		ok, err := registryObjectExists(ctx, client, repo, registryKindManifests, manifest.Digest)
+		if err != nil {
+			return "", "", err
+		}
+		if !ok {
+			return "MANIFEST_UNKNOWN", manifest.Digest, nil
+		}
+	}
+	return "", "", nil
+}
+
+// registryObjectExists HEADs /v2/<repo>/<kind>/<digest>. The registry only
+// reports blobs linked into repo, so content held by other repositories is
+// treated as missing.
+func registryObjectExists(ctx context.Context, client *http.Client, repo, kind, digest string) (bool, error) {
+	if _, err := (digestPolicy{}).normalizeDigest(digest); err != nil {
+		return false, nil
+	}
+	objectURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/" + kind + "/" + digest})
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, objectURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	if kind == registryKindManifests {
+		req.Header.Set("Accept", manifestAcceptHeader)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s %s status: %s", kind, digest, resp.Status)
+	}
+}
+
+// mismatchedBlobDigest downloads the config and every layer repo serves for
+// refs and returns the first digest whose content hashes to something else.
+// Missing blobs are left to STRICT_MANIFEST_BLOBS and the registry itself;
+// foreign layers are not checked.
+func mismatchedBlobDigest(ctx context.Context, repo string, refs manifestReferences) (string, error) {
+	// Layers can be large, so the push's own context bounds the download
+	// rather than a fixed client timeout.
+	client := &http.Client{}
+	blobs := refs.Layers
+	if refs.Config != nil {
+		blobs = append([]manifestDescriptor{*refs.Config}, blobs...)
+	}
+	for _, blob := range blobs {
+		if len(blob.URLs) > 0 {
+			continue
+		}
+		ok, err := blobMatchesDigest(ctx, client, repo, blob.Digest)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return blob.Digest, nil
+		}
+	}
+	return "", nil
+}
+
+// blobMatchesDigest streams /v2/<repo>/blobs/<digest> through the digest's
+// hash. Unparseable digests and missing blobs report a match.
+func blobMatchesDigest(ctx context.Context, client *http.Client, repo, digest string) (bool, error) {
+	normalized, err := (digestPolicy{}).normalizeDigest(digest)
+	if err != nil {
+		return true, nil
+	}
+	alg, want, _ := strings.Cut(normalized, ":")
+	h := sha256.New()
+	if alg == "sha512" {
+		h = sha512.New()
+	}
+
+	blobURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/blobs/" + digest})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return true, nil
+	default:
+		return false, fmt.Errorf("blob %s status: %s", digest, resp.Status)
+	}
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == want, nil
+}
+
+const (
+	schema1ManifestType       = "application/vnd.docker.distribution.manifest.v1+json"
+	schema1SignedManifestType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// schema1Warning is sent on pulls of schema 1 manifests while
+// REJECT_SCHEMA1_PUSH is set.
+const schema1Warning = `299 - "Docker schema 1 manifests are deprecated and can no longer be pushed"`
+
+// isSchema1Manifest reports whether a manifest is Docker schema 1, by media
+// type or, for clients that send a generic type, by schemaVersion.
+func isSchema1Manifest(contentType string, body []byte) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == schema1ManifestType || mediaType == schema1SignedManifestType {
+		return true
+	}
+	var version struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	return json.Unmarshal(body, &version) == nil && version.SchemaVersion == 1
+}
+
+// warnSchema1Response adds schema1Warning to schema 1 manifest pulls.
+func warnSchema1Response(resp *http.Response) error {
+	if !manifestCfg.RejectSchema1 || resp.Request == nil || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	if resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == schema1ManifestType || mediaType == schema1SignedManifestType {
+		resp.Header.Add("Warning", schema1Warning)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUniqueTagDigestsRejectsDuplicateContent(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{UniqueTagDigests: true})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	for _, path := range []string{"/v2/team1/app/manifests/v2", "/v2/team1/other/manifests/latest"} {
+		rec := serveProxyRequestBody(t, http.MethodPut, path, bytes.NewReader(image.Manifest))
+		if rec.Code != http.StatusConflict {
+			t.Fatalf("expected 409 for %s, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), "team1/app:v1") {
+			t.Fatalf("expected conflicting tag in body, got %q", rec.Body.String())
+		}
+	}
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected re-push of the same tag to succeed, got %d", rec.Code)
+	}
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+image.ManifestDigest, bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected push by digest to succeed, got %d", rec.Code)
+	}
+
+	other := newTestRegistryImage(t, "layer-two")
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(other.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected new content to be tagged, got %d", rec.Code)
+	}
+	if !bytes.Equal(registry.manifests["team1/app:v2"], other.Manifest) {
+		t.Fatalf("expected manifest body to be forwarded unchanged")
+	}
+}
+
+func TestUniqueTagDigestsDisabledAllowsDuplicateContent(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func withManifestPolicy(t *testing.T, policy manifestPolicy) {
+	t.Helper()
+	prev := manifestCfg
+	manifestCfg = policy
+	t.Cleanup(func() {
+		manifestCfg = prev
+	})
+}
+
+func TestStrictManifestBlobsRequiresBlobsInTargetRepo(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{StrictBlobs: true})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	registry.seed("team1/source", "v1", image)
+	calls := withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var payload registryErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Errors) != 1 {
+		t.Fatalf("expected registry error body, got %q", rec.Body.String())
+	}
+	if payload.Errors[0].Code != "BLOB_UNKNOWN" || !strings.Contains(payload.Errors[0].Message, image.ConfigDigest) {
+		t.Fatalf("unexpected error: %+v", payload.Errors[0])
+	}
+	if *calls != 0 {
+		t.Fatalf("expected rejected manifest not to be proxied, got %d calls", *calls)
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/source/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 when blobs are in the repo, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStrictManifestBlobsChecksIndexChildren(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{StrictBlobs: true})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	index := func(digest string) *bytes.Reader {
+		return bytes.NewReader([]byte(`{"schemaVersion":2,"mediaType":"` + ociIndexMedia + `","manifests":[{"mediaType":"` + ociManifestType + `","digest":"` + digest + `","size":1}]}`))
+	}
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/multi", index(testDigest([]byte("missing"))))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "MANIFEST_UNKNOWN") {
+		t.Fatalf("expected MANIFEST_UNKNOWN, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/multi", index(image.ManifestDigest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStrictManifestBlobsDisabledAllowsCrossRepoBlobs(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/source", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAllowedPlatformsRejectsDisallowedIndexEntry(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{AllowedPlatforms: []string{"linux/amd64", "linux/arm64"}})
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	index := func(platforms ...string) *bytes.Reader {
+		var entries []string
+		for i, platform := range platforms {
+			os, arch, _ := strings.Cut(platform, "/")
+			entries = append(entries, `{"mediaType":"`+ociManifestType+`","digest":"`+testDigest([]byte{byte(i)})+`","size":1,"platform":{"os":"`+os+`","architecture":"`+arch+`"}}`)
+		}
+		return bytes.NewReader([]byte(`{"schemaVersion":2,"mediaType":"` + ociIndexMedia + `","manifests":[` + strings.Join(entries, ",") + `]}`))
+	}
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/multi", index("linux/amd64", "windows/amd64"))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "windows/amd64") {
+		t.Fatalf("expected disallowed platform to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := registry.manifests["team1/app:multi"]; ok {
+		t.Fatalf("expected rejected index not to reach the registry")
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/multi", index("linux/amd64", "linux/arm64"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected allowed platforms to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAllowedPlatformsChecksSingleArchConfig(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{AllowedPlatforms: []string{"linux/arm64"}})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "linux/amd64") {
+		t.Fatalf("expected linux/amd64 image to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	withManifestPolicy(t, manifestPolicy{AllowedPlatforms: []string{"linux/amd64"}})
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected linux/amd64 image to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPlatformAllowedMatchesVariants(t *testing.T) {
+	allowed := []string{"linux/arm64", "linux/arm/v7"}
+	cases := map[manifestPlatform]bool{
+		{OS: "linux", Architecture: "arm64", Variant: "v8"}: true,
+		{OS: "linux", Architecture: "arm", Variant: "v7"}:   true,
+		{OS: "linux", Architecture: "arm", Variant: "v6"}:   false,
+		{OS: "linux", Architecture: "amd64"}:                false,
+	}
+	for platform, want := range cases {
+		if got := platformAllowed(allowed, platform); got != want {
+			t.Fatalf("platformAllowed(%s) = %v, want %v", platform, got, want)
+		}
+	}
+}
+
+func TestRejectSchema1Push(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{RejectSchema1: true})
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	push := func(contentType string, body []byte) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(body))
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("Content-Type", contentType)
+		cvRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	schema1 := []byte(`{"schemaVersion":1,"name":"team1/app","tag":"v1","fsLayers":[],"history":[]}`)
+	for _, contentType := range []string{schema1SignedManifestType, schema1ManifestType, "application/json"} {
+		rec := push(contentType, schema1)
+		if rec.Code != http.StatusUnsupportedMediaType || !strings.Contains(rec.Body.String(), "schema 1") {
+			t.Fatalf("expected schema 1 push as %s to be rejected, got %d: %s", contentType, rec.Code, rec.Body.String())
+		}
+	}
+	if _, ok := registry.manifests["team1/app:v1"]; ok {
+		t.Fatalf("expected rejected manifest not to reach the registry")
+	}
+
+	image := newTestRegistryImage(t, "layer-one")
+	if rec := push(ociManifestType, image.Manifest); rec.Code != http.StatusCreated {
+		t.Fatalf("expected schema 2 push to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRejectSchema1StillServesPullsWithWarning(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{RejectSchema1: true})
+	registry := newFakeRegistry()
+	schema1 := []byte(`{"schemaVersion":1,"name":"team1/legacy","tag":"old"}`)
+	registry.manifests["team1/legacy:old"] = schema1
+	registry.types[testDigest(schema1)] = schema1SignedManifestType
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/legacy/manifests/old")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(schema1) {
+		t.Fatalf("expected schema 1 pull to be served, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Warning"); got != schema1Warning {
+		t.Fatalf("expected deprecation warning, got %q", got)
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v1")
+	if rec.Code != http.StatusOK || rec.Header().Get("Warning") != "" {
+		t.Fatalf("expected schema 2 pull without warning, got %d %q", rec.Code, rec.Header().Get("Warning"))
+	}
+}
+
+func TestVerifyBlobDigestsRejectsTamperedLayer(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{VerifyBlobDigests: true})
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one", "layer-two")
+	registry.seed("team1/app", "v1", image)
+	calls := withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for intact blobs, got %d: %s", rec.Code, rec.Body.String())
+	}
+	pushes := *calls
+
+	tampered := image.LayerDigests[1]
+	registry.blobs[tampered] = []byte("swapped content")
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v3", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var payload registryErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Errors) != 1 {
+		t.Fatalf("expected registry error body, got %q", rec.Body.String())
+	}
+	if payload.Errors[0].Code != "DIGEST_INVALID" || !strings.Contains(payload.Errors[0].Message, tampered) {
+		t.Fatalf("unexpected error: %+v", payload.Errors[0])
+	}
+	if *calls != pushes {
+		t.Fatalf("expected rejected manifest not to be proxied")
+	}
+}
+
+func TestMinManifestLayersRejectsThinImages(t *testing.T) {
+	withManifestPolicy(t, manifestPolicy{MinLayers: map[string]int{"team1": 2}})
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1"}, {Namespace: "team2"}}, nil
+	}
+
+	thin := newTestRegistryImage(t, "layer-one")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(thin.Manifest))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "at least 2") {
+		t.Fatalf("expected single-layer image to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := registry.manifests["team1/app:v1"]; ok {
+		t.Fatalf("expected rejected manifest not to reach the registry")
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team2/app/manifests/v1", bytes.NewReader(thin.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected unrestricted namespace to accept the image, got %d: %s", rec.Code, rec.Body.String())
+	}
+	thick := newTestRegistryImage(t, "layer-one", "layer-two")
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(thick.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected two-layer image to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	signature := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","artifactType":"application/vnd.dev.cosign.artifact.sig.v1+json","config":{"digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"},"layers":[],"subject":{"digest":"` + thick.ManifestDigest + `"}}`
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+testDigest([]byte(signature)), strings.NewReader(signature))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected attached artifact to be exempt, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseMinManifestLayers(t *testing.T) {
+	got := parseMinManifestLayers("1, prod=3,=2,release=x,dev=-1")
+	if len(got) != 2 || got[""] != 1 || got["prod"] != 3 {
+		t.Fatalf("unexpected minimums: %v", got)
+	}
+	policy := manifestPolicy{MinLayers: got}
+	if policy.minLayers("prod/app") != 3 || policy.minLayers("team1/app") != 1 {
+		t.Fatalf("unexpected lookups: prod=%d team1=%d", policy.minLayers("prod/app"), policy.minLayers("team1/app"))
+	}
+}
+
+func TestImportAppliesManifestPolicy(t *testing.T) {
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{"architecture":"arm64","os":"linux"}`), []byte("layer"))
+
+	withManifestPolicy(t, manifestPolicy{AllowedPlatforms: []string{"linux/amd64"}})
+	rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "platform linux/arm64 is not allowed") {
+		t.Fatalf("expected a disallowed platform to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	withManifestPolicy(t, manifestPolicy{MinLayers: map[string]int{"team1": 2}})
+	rec = serveImportRequest(t, token, "/api/repos/team1/app/import", archive)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "need at least 2") {
+		t.Fatalf("expected a single-layer image to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatalf("expected nothing to be pushed")
+	}
+
+	withManifestPolicy(t, manifestPolicy{AllowedPlatforms: []string{"linux/arm64"}, MinLayers: map[string]int{"team1": 1}})
+	if rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive); rec.Code != http.StatusCreated {
+		t.Fatalf("expected a conforming image to import, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+func loadManifestSizeLimit() int64 {
+	limit := getEnvInt("MAX_MANIFEST_SIZE", maxManifestBytes)
+	if limit <= 0 {
+		log.Printf("invalid MAX_MANIFEST_SIZE %d, using default %d", limit, maxManifestBytes)
+		limit = maxManifestBytes
+	}
+	return int64(limit)
+}
+
+// enforceManifestSize reads manifest PUT bodies through http.MaxBytesReader,
+// so a client that declares or streams more than MAX_MANIFEST_SIZE is cut off
+// with 413 after at most that many bytes instead of being buffered. The
+// returned request carries a replayable copy of the body.
+func enforceManifestSize(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if r.Method != http.MethodPut {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return r, true
+	}
+	message := fmt.Sprintf("manifest exceeds the %d byte limit", manifestSizeLimit)
+	if r.ContentLength > manifestSizeLimit {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", message)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, manifestSizeLimit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, "SIZE_INVALID", message)
+		return nil, false
+	}
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "unable to read manifest")
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r, true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// endlessReader streams '{' forever and counts the bytes handed out.
+type endlessReader struct {
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = '{'
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func withManifestSizeLimit(t *testing.T, limit int64) {
+	t.Helper()
+	prev := manifestSizeLimit
+	manifestSizeLimit = limit
+	t.Cleanup(func() { manifestSizeLimit = prev })
+}
+
+func TestOversizedManifestStreamIsCutOff(t *testing.T) {
+	withManifestSizeLimit(t, 1024)
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("oversized manifest reached the registry")
+		return nil
+	})
+
+	body := &endlessReader{}
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", body)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "SIZE_INVALID") {
+		t.Fatalf("expected 413 SIZE_INVALID, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// io.ReadAll asks for at least 512 bytes at a time, so allow one extra read.
+	if body.read > 1024+4096 {
+		t.Fatalf("expected the read to stop near the limit, read %d bytes", body.read)
+	}
+	if *calls != 0 {
+		t.Fatalf("expected no registry calls, got %d", *calls)
+	}
+}
+
+func TestOversizedManifestContentLengthIsRefusedUnread(t *testing.T) {
+	withManifestSizeLimit(t, 1024)
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("oversized manifest reached the registry")
+		return nil
+	})
+
+	body := &endlessReader{}
+	req := httptest.NewRequest(http.MethodPut, "/v2/team1/app/manifests/v1", body)
+	req.ContentLength = 1 << 30
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body.read != 0 {
+		t.Fatalf("expected the body to be left unread, read %d bytes", body.read)
+	}
+}
+
+func TestManifestWithinLimitIsProxied(t *testing.T) {
+	withManifestSizeLimit(t, 1024)
+	manifest := `{"schemaVersion":2}`
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		if r.ContentLength != int64(len(manifest)) {
+			t.Errorf("expected Content-Length %d, got %d", len(manifest), r.ContentLength)
+		}
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", strings.NewReader(manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
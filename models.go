@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+)
 
 const sessionTTL = 30 * time.Minute
 
@@ -17,6 +21,7 @@ type User struct {
 	Namespace     string
 	PullOnly      bool
 	DeleteAllowed bool
+	Admin         bool
 }
 
 type Access struct {
@@ -24,17 +29,69 @@ type Access struct {
 	Namespace     string
 	PullOnly      bool
 	DeleteAllowed bool
+	// AllNamespaces grants the entry's rights on every namespace; Namespace
+	// is empty. It is set for LDAP_ADMIN_GROUP members.
+	AllNamespaces bool
 }
 
 type LDAPConfig struct {
+	// URL is one server, or a comma-separated list of servers tried in turn.
 	URL             string
 	BaseDN          string
 	UserFilter      string
+	UserBaseDN      string
 	GroupAttribute  string
 	GroupNamePrefix string
 	UserMailDomain  string
 	StartTLS        bool
 	SkipTLSVerify   bool
+	UserDNTemplate  string
+	AdminGroup      string
+	// BindUser and BindPassword are the service account that looks users
+	// up before they bind; empty searches as the user.
+	BindUser     string
+	BindPassword string
+	// UsernameAttribute names the attribute holding the username recorded in
+	// logs and audit entries; empty keeps the login name.
+	UsernameAttribute string
+	GroupFilter       string
+	GroupBaseDN       string
+	PageSize          uint32
+
+	MaxConcurrentBinds int
+	BindQueueTimeout   time.Duration
+	// DialTimeout bounds connecting to each server, including the LDAPS
+	// handshake; zero leaves it to the OS.
+	DialTimeout time.Duration
+
+	// SlowThreshold logs binds and searches taking longer than this; zero disables.
+	SlowThreshold time.Duration
+
+	// NestedGroupDepth follows group-in-group membership this many levels
+	// through GroupFilter; zero disables nesting.
+	NestedGroupDepth int
+	// GroupSearchConcurrency caps the nested group searches run at once for
+	// one login.
+	GroupSearchConcurrency int
+	// NestedGroups resolves group-in-group membership through the groups'
+	// own group attribute or, with NestedGroupsMethod "in-chain", Active
+	// Directory's matching rule.
+	NestedGroups       bool
+	NestedGroupsMethod string
+
+	// RequireOCSPStaple fails LDAP TLS handshakes without a good stapled
+	// OCSP response for the server certificate.
+	RequireOCSPStaple bool
+
+	// TLSMinVersion and TLSMaxVersion bound the TLS versions offered to the
+	// LDAP server; a zero max leaves Go's default.
+	TLSMinVersion    uint16
+	TLSMaxVersion    uint16
+	TLSRenegotiation tls.RenegotiationSupport
+
+	// TLSRootCAs verifies the LDAP server certificate instead of the system
+	// roots when LDAP_TLS_CA is set.
+	TLSRootCAs *x509.CertPool
 }
 
 type repoInfo struct {
@@ -55,6 +112,8 @@ type tagInfo struct {
 	Tag            string `json:"tag"`
 	Digest         string `json:"digest"`
 	CompressedSize int64  `json:"compressed_size"`
+	// Signed is set when TAG_SIGNATURES is enabled and the lookup succeeded.
+	Signed *bool `json:"signed,omitempty"`
 }
 
 type layerInfo struct {
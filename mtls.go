@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// mtlsConfig enables client certificate authentication. Certificates signed
+// by the CA bundle at CAPath are authenticated by subject CN or a SAN, and
+// Groups maps each name to permission groups such as team1_rwd, named with
+// the GROUP_PERMISSION_SUFFIXES in effect. Require refuses handshakes
+// without a client certificate.
+type mtlsConfig struct {
+	CAPath  string
+	Groups  map[string][]string
+	Require bool
+}
+
+func loadMTLSConfig() mtlsConfig {
+	caPath := strings.TrimSpace(os.Getenv("MTLS_CA"))
+	if caPath == "" {
+		caPath = strings.TrimSpace(os.Getenv("TLS_CLIENT_CA"))
+	}
+	return mtlsConfig{
+		CAPath:  caPath,
+		Groups:  parseCNMap(os.Getenv("MTLS_CN_MAP")),
+		Require: getEnvBool("TLS_CLIENT_CERT_REQUIRED", false),
+	}
+}
+
+func (c mtlsConfig) enabled() bool {
+	return c.CAPath != ""
+}
+
+// parseCNMap parses "ci-runner=team1:rwd,ci-runner=team2:r" into CN ->
+// groups. Entries with an unknown permission are skipped.
+func parseCNMap(raw string) map[string][]string {
+	groups := map[string][]string{}
+	for _, entry := range splitCommaList(raw) {
+		cn, grant, _ := strings.Cut(entry, "=")
+		ns, perm, ok := strings.Cut(grant, ":")
+		cn, ns = strings.TrimSpace(cn), strings.TrimSpace(ns)
+		if !ok || cn == "" || ns == "" {
+			log.Printf("ignoring MTLS_CN_MAP entry %q: expected cn=namespace:permission", entry)
+			continue
+		}
+		perm = strings.TrimSpace(perm)
+		if _, _, ok := permissionRights(perm); !ok {
+			log.Printf("ignoring MTLS_CN_MAP entry %q: permission must be r, rw, rd or rwd", entry)
+			continue
+		}
+		group, ok := groupForPermission(ns, perm)
+		if !ok {
+			log.Printf("ignoring MTLS_CN_MAP entry %q: GROUP_PERMISSION_SUFFIXES has no suffix for %s", entry, perm)
+			continue
+		}
+		groups[cn] = append(groups[cn], group)
+	}
+	return groups
+}
+
+// clientCAs loads the CA bundle client certificates must chain to.
+func (c mtlsConfig) clientCAs() (*x509.CertPool, error) {
+	pemBytes, err := os.ReadFile(c.CAPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemBytes) {
+		return nil, fmt.Errorf("no certificates found in %s", c.CAPath)
+	}
+	return pool, nil
+}
+
+// applyClientCertAuth asks for client certificates. Unless require is set
+// they are optional, so clients without one can still use basic or bearer
+// auth.
+func applyClientCertAuth(cfg *tls.Config, pool *x509.CertPool, require bool) {
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if require {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	cfg.ClientCAs = pool
+}
+
+// verifiedClientCert returns the leaf of a verified client certificate.
+func verifiedClientCert(r *http.Request) (*x509.Certificate, bool) {
+	if !mtlsCfg.enabled() || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return r.TLS.VerifiedChains[0][0], true
+}
+
+// clientCertNames lists the identities a client certificate can be mapped
+// by: the subject CN, then its DNS, email and URI SANs.
+func clientCertNames(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// authenticateClientCert maps the first name of a verified client
+// certificate that has an MTLS_CN_MAP entry to access. A certificate without
+// a mapping is denied rather than falling back to other auth.
+func authenticateClientCert(w http.ResponseWriter, cert *x509.Certificate) (*User, []Access, bool) {
+	names := clientCertNames(cert)
+	for _, name := range names {
+		if access, user := accessFromGroups(name, mtlsCfg.Groups[name], ""); user != nil {
+			return user, access, true
+		}
+	}
+	log.Printf("client certificate %q has no MTLS_CN_MAP entry", names)
+	writeRegistryError(w, http.StatusForbidden, "DENIED", "client certificate not authorized")
+	return nil, nil, false
+}
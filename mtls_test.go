@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCNMap(t *testing.T) {
+	got := parseCNMap("ci-runner=team1:rwd, ci-runner=team2:r,deploy=team3:rw,bad=team4:x,noperm=team5,=team6:r")
+	want := map[string][]string{
+		"ci-runner": {"team1_rwd", "team2_r"},
+		"deploy":    {"team3_rw"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected CN map: %v", got)
+	}
+}
+
+func TestParseCNMapUsesGroupSuffixes(t *testing.T) {
+	withGroupSuffixes(t, "-admins=rwd,-readers=r")
+	got := parseCNMap("ci-runner=team1:rwd,ci-runner=team2:r,deploy=team3:rw")
+	want := map[string][]string{"ci-runner": {"team1-admins", "team2-readers"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected groups named with the configured suffixes and no rw group, got %v", got)
+	}
+	if access, _ := accessFromGroups("ci-runner", got["ci-runner"], ""); len(access) != 2 || !access[0].DeleteAllowed || !access[1].PullOnly {
+		t.Fatalf("expected the mapped groups to grant their permissions, got %+v", access)
+	}
+}
+
+func TestClientCertAuthMapsCN(t *testing.T) {
+	ca, caKey := withMTLSServerCA(t, "ci-runner=team1:r")
+	server := startMTLSServer(t, false)
+
+	mapped := issueClientCert(t, ca, caKey, "ci-runner")
+	if status := mtlsRequest(t, server, &mapped, http.MethodGet); status != http.StatusOK {
+		t.Fatalf("expected mapped CN to pull, got %d", status)
+	}
+	if status := mtlsRequest(t, server, &mapped, http.MethodPut); status != http.StatusForbidden {
+		t.Fatalf("expected read-only CN to be refused a push, got %d", status)
+	}
+	unmapped := issueClientCert(t, ca, caKey, "stranger")
+	if status := mtlsRequest(t, server, &unmapped, http.MethodGet); status != http.StatusForbidden {
+		t.Fatalf("expected unmapped CN to be denied, got %d", status)
+	}
+	if status := mtlsRequest(t, server, nil, http.MethodGet); status != http.StatusUnauthorized {
+		t.Fatalf("expected request without a certificate to need credentials, got %d", status)
+	}
+}
+
+func TestClientCertAuthMapsSAN(t *testing.T) {
+	ca, caKey := withMTLSServerCA(t, "runner.ci.example.com=team1:rw")
+	server := startMTLSServer(t, false)
+
+	cert := issueClientCert(t, ca, caKey, "unmapped-cn", "runner.ci.example.com")
+	if status := mtlsRequest(t, server, &cert, http.MethodPut); status != http.StatusOK {
+		t.Fatalf("expected SAN mapping to allow a push, got %d", status)
+	}
+}
+
+func TestClientCertRequired(t *testing.T) {
+	ca, caKey := withMTLSServerCA(t, "ci-runner=team1:r")
+	server := startMTLSServer(t, true)
+
+	cert := issueClientCert(t, ca, caKey, "ci-runner")
+	if status := mtlsRequest(t, server, &cert, http.MethodGet); status != http.StatusOK {
+		t.Fatalf("expected mapped CN to pull, got %d", status)
+	}
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	if resp, err := (&http.Client{Transport: transport}).Get(server.URL + "/v2/"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the handshake to fail without a client certificate, got %d", resp.StatusCode)
+	}
+}
+
+func TestLoadMTLSConfigClientCAFallback(t *testing.T) {
+	t.Setenv("TLS_CLIENT_CA", "/pki/clients.pem")
+	t.Setenv("TLS_CLIENT_CERT_REQUIRED", "true")
+	cfg := loadMTLSConfig()
+	if cfg.CAPath != "/pki/clients.pem" || !cfg.Require {
+		t.Fatalf("unexpected config: %+v", cfg)
+	}
+	t.Setenv("MTLS_CA", "/pki/mtls.pem")
+	if cfg := loadMTLSConfig(); cfg.CAPath != "/pki/mtls.pem" {
+		t.Fatalf("expected MTLS_CA to take precedence, got %q", cfg.CAPath)
+	}
+}
+
+// withMTLSServerCA writes a client CA, enables client certificates with the
+// given MTLS_CN_MAP and stubs the registry.
+func withMTLSServerCA(t *testing.T, cnMap string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	ca, caKey := writeTestCA(t, caPath, filepath.Join(dir, "ca.key"))
+	withMTLSConfig(t, mtlsConfig{CAPath: caPath, Groups: parseCNMap(cnMap)})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+	return ca, caKey
+}
+
+func startMTLSServer(t *testing.T, require bool) *httptest.Server {
+	t.Helper()
+	pool, err := mtlsCfg.clientCAs()
+	if err != nil {
+		t.Fatalf("load client CAs: %v", err)
+	}
+	server := httptest.NewUnstartedServer(cvRouter())
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	applyClientCertAuth(server.TLS, pool, require)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func mtlsRequest(t *testing.T, server *httptest.Server, cert *tls.Certificate, method string) int {
+	t.Helper()
+	// A fresh transport per call so connections are not reused across certificates.
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest(method, server.URL+"/v2/team1/app/manifests/v1", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func issueClientCert(t *testing.T, ca *x509.Certificate, caKey *rsa.PrivateKey, cn string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate client key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca, &priv.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("create client cert: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+}
+
+func withMTLSConfig(t *testing.T, cfg mtlsConfig) {
+	t.Helper()
+	prev := mtlsCfg
+	mtlsCfg = cfg
+	t.Cleanup(func() { mtlsCfg = prev })
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// namespaceLimiter caps how many namespaces may hold repositories. Namespaces
+// are learned from the catalog and admitted ones are remembered, so pushes to
+// an existing namespace skip the catalog and concurrent first pushes cannot
+// both take the last slot. A namespace emptied later still counts until
+// restart, or until blob GC prunes it.
+type namespaceLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	known map[string]struct{}
+}
+
+func newNamespaceLimiter(max int) *namespaceLimiter {
+	return &namespaceLimiter{max: max, known: map[string]struct{}{}}
+}
+
+// admit reports whether a push may create or extend namespace.
+func (l *namespaceLimiter) admit(ctx context.Context, namespace string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.known[namespace]; ok {
+		return true, nil
+	}
+	repos, err := fetchAllRepos(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, repo := range repos {
+		if existing, _, ok := strings.Cut(repo, "/"); ok {
+			l.known[existing] = struct{}{}
+		}
+	}
+	if _, ok := l.known[namespace]; ok {
+		return true, nil
+	}
+	if len(l.known) >= l.max {
+		return false, nil
+	}
+	l.known[namespace] = struct{}{}
+	return true, nil
+}
+
+// forget frees the slot of a namespace that no longer exists.
+func (l *namespaceLimiter) forget(namespace string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.known, namespace)
+}
+
+// enforceNamespaceLimit refuses blob uploads and manifest pushes that would
+// create a namespace beyond MAX_NAMESPACES. It reports whether the request
+// may continue.
+func enforceNamespaceLimit(w http.ResponseWriter, r *http.Request) bool {
+	if namespaceLimit.max <= 0 {
+		return true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok {
+		return true
+	}
+	push := (route.isUpload() && r.Method == http.MethodPost) || (route.Kind == registryKindManifests && r.Method == http.MethodPut)
+	namespace, _, hasNamespace := strings.Cut(route.Repo, "/")
+	if !push || !hasNamespace {
+		return true
+	}
+	switch status, message := namespaceLimitRefusal(r.Context(), namespace); status {
+	case 0:
+		return true
+	case http.StatusBadGateway:
+		writeRegistryError(w, status, "UNAVAILABLE", message)
+	default:
+		writeRegistryError(w, status, "DENIED", message)
+	}
+	return false
+}
+
+// namespaceLimitRefusal admits a push to namespace under MAX_NAMESPACES. It
+// returns the status and message to refuse the push with, or zero when it
+// may go ahead.
+func namespaceLimitRefusal(ctx context.Context, namespace string) (int, string) {
+	if namespaceLimit.max <= 0 {
+		return 0, ""
+	}
+	allowed, err := namespaceLimit.admit(ctx, namespace)
+	if err != nil {
+		log.Printf("namespace limit check for %s failed: %v", namespace, err)
+		return http.StatusBadGateway, "unable to verify namespace limit"
+	}
+	if !allowed {
+		return http.StatusForbidden, fmt.Sprintf("namespace %s cannot be created: the limit of %d namespaces is reached", namespace, namespaceLimit.max)
+	}
+	return 0, ""
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func withNamespaceLimit(t *testing.T, max int) {
+	t.Helper()
+	prev := namespaceLimit
+	namespaceLimit = newNamespaceLimiter(max)
+	t.Cleanup(func() {
+		namespaceLimit = prev
+	})
+}
+
+func TestNamespaceLimitRejectsNamespacesBeyondCap(t *testing.T) {
+	withNamespaceLimit(t, 2)
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/existing", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1"}, {Namespace: "team2"}, {Namespace: "team3"}}, nil
+	}
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	push := func(repo string) int {
+		return serveProxyRequestBody(t, http.MethodPut, "/v2/"+repo+"/manifests/v1", bytes.NewReader(image.Manifest)).Code
+	}
+	if code := push("team1/app"); code != http.StatusCreated {
+		t.Fatalf("expected push to an existing namespace, got %d", code)
+	}
+	if code := push("team2/app"); code != http.StatusCreated {
+		t.Fatalf("expected second namespace to be created, got %d", code)
+	}
+
+	rec := serveProxyRequest(t, http.MethodPost, "/v2/team3/app/blobs/uploads/")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "limit of 2 namespaces") {
+		t.Fatalf("expected third namespace to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if code := push("team3/app"); code != http.StatusForbidden {
+		t.Fatalf("expected manifest push to a third namespace to be refused, got %d", code)
+	}
+	if code := push("team2/other"); code != http.StatusCreated {
+		t.Fatalf("expected pushes to existing namespaces to continue, got %d", code)
+	}
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team3/app/manifests/v1"); rec.Code == http.StatusForbidden {
+		t.Fatalf("expected pulls to be unaffected by the limit")
+	}
+}
+
+func TestNamespaceLimitCountsCatalogNamespaces(t *testing.T) {
+	withNamespaceLimit(t, 1)
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/existing", "v1", image)
+	registry.seed("team2/existing", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team2"}, {Namespace: "team3"}}, nil
+	}
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	// Already over the cap: existing namespaces keep working, new ones do not.
+	if rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team2/app/manifests/v1", bytes.NewReader(image.Manifest)); rec.Code != http.StatusCreated {
+		t.Fatalf("expected push to an existing namespace, got %d", rec.Code)
+	}
+	if rec := serveProxyRequest(t, http.MethodPost, "/v2/team3/app/blobs/uploads/"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected new namespace to be refused, got %d", rec.Code)
+	}
+}
+
+func TestNamespaceLimitAppliesToImports(t *testing.T) {
+	withNamespaceLimit(t, 1)
+	registry := newFakeRegistry()
+	registry.seed("team1/existing", "v1", newTestRegistryImage(t, "layer-one"))
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}, {Namespace: "team2"}})
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{"architecture":"amd64","os":"linux"}`), []byte("layer"))
+
+	rec := serveImportRequest(t, token, "/api/repos/team2/app/import", archive)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "limit of 1 namespaces") {
+		t.Fatalf("expected an import creating a second namespace to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if slices.Contains(registry.repos(), "team2/app") {
+		t.Fatalf("expected nothing to be imported into team2")
+	}
+	if rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive); rec.Code != http.StatusCreated {
+		t.Fatalf("expected imports into an existing namespace to continue, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// manifestPlatform is the platform of an index entry or image config.
+type manifestPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant"`
+}
+
+func (p manifestPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// platformAllowed reports whether p matches an os/arch[/variant] entry of
+// allowed. An entry without a variant accepts every variant.
+func platformAllowed(allowed []string, p manifestPlatform) bool {
+	for _, entry := range allowed {
+		parts := strings.Split(entry, "/")
+		if len(parts) < 2 || parts[0] != p.OS || parts[1] != p.Architecture {
+			continue
+		}
+		if len(parts) == 2 || parts[2] == p.Variant {
+			return true
+		}
+	}
+	return false
+}
+
+// disallowedPlatform returns the first platform of the pushed manifest that
+// ALLOWED_PLATFORMS does not list. Index entries are judged by their platform
+// field; attestation manifests and entries without one are skipped. Image
+// manifests are judged by the os and architecture of their config blob, so
+// configs without them, such as artifacts, pass.
+func disallowedPlatform(ctx context.Context, client *http.Client, repo string, refs manifestReferences) (string, error) {
+	for _, manifest := range refs.Manifests {
+		if manifest.Platform == nil || manifest.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+			continue
+		}
+		if !platformAllowed(manifestCfg.AllowedPlatforms, *manifest.Platform) {
+			return manifest.Platform.String(), nil
+		}
+	}
+	if refs.Config == nil || refs.Config.Digest == "" {
+		return "", nil
+	}
+	platform, ok, err := fetchConfigPlatform(ctx, client, repo, refs.Config.Digest)
+	if err != nil || !ok {
+		return "", err
+	}
+	return disallowedConfigPlatform(platform), nil
+}
+
+// disallowedConfigPlatform returns the platform an image config declares
+// when ALLOWED_PLATFORMS does not list it. Configs without os and
+// architecture pass.
+func disallowedConfigPlatform(platform manifestPlatform) string {
+	if platform.OS == "" || platform.Architecture == "" || platformAllowed(manifestCfg.AllowedPlatforms, platform) {
+		return ""
+	}
+	return platform.String()
+}
+
+// platformProblem explains the refusal of an image for platform.
+func platformProblem(platform string) string {
+	return fmt.Sprintf("platform %s is not allowed; allowed platforms: %s", platform, strings.Join(manifestCfg.AllowedPlatforms, ", "))
+}
+
+// fetchConfigPlatform reads the platform from an image config blob. It
+// reports false when the blob is missing, leaving the registry to reject the
+// manifest.
+func fetchConfigPlatform(ctx context.Context, client *http.Client, repo, digest string) (manifestPlatform, bool, error) {
+	var platform manifestPlatform
+	if _, err := (digestPolicy{}).normalizeDigest(digest); err != nil {
+		return platform, false, nil
+	}
+	blobURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/blobs/" + digest})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL.String(), nil)
+	if err != nil {
+		return platform, false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return platform, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return platform, false, nil
+	default:
+		return platform, false, fmt.Errorf("config blob status: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestBytes)).Decode(&platform); err != nil {
+		// Not an image config; nothing to judge.
+		return platform, false, nil
+	}
+	return platform, true, nil
+}
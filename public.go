@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// publicNamespaceSet lists namespaces anyone may pull from without
+// credentials. Whether a listed namespace actually holds repositories is
+// cached for ttl so anonymous traffic does not scan the catalog on every blob.
+type publicNamespaceSet struct {
+	names map[string]bool
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	checked map[string]publicNamespaceCheck
+}
+
+type publicNamespaceCheck struct {
+	exists bool
+	at     time.Time
+}
+
+func loadPublicNamespaces() *publicNamespaceSet {
+	return newPublicNamespaceSet(splitCommaList(os.Getenv("PUBLIC_NAMESPACES")), getEnvDuration("PUBLIC_NAMESPACE_CHECK_TTL", 30*time.Second))
+}
+
+func newPublicNamespaceSet(names []string, ttl time.Duration) *publicNamespaceSet {
+	set := &publicNamespaceSet{names: map[string]bool{}, ttl: ttl, now: time.Now, checked: map[string]publicNamespaceCheck{}}
+	for _, name := range names {
+		set.names[name] = true
+	}
+	return set
+}
+
+// anonymousAccess returns pull-only access for unauthenticated pulls from a
+// public namespace. Pushes, deletes and upload sessions still need credentials.
+func (s *publicNamespaceSet) anonymousAccess(r *http.Request) (*User, []Access, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, nil, false
+	}
+	namespace, ok := requestNamespace(r)
+	if !ok || !s.names[namespace] {
+		return nil, nil, false
+	}
+	if route, ok := parseRegistryPath(r.URL.Path); ok && route.isUpload() {
+		return nil, nil, false
+	}
+	return &User{Name: "anonymous"}, []Access{{Namespace: namespace, PullOnly: true}}, true
+}
+
+// exists reports whether namespace holds at least one repository.
+func (s *publicNamespaceSet) exists(ctx context.Context, namespace string) (bool, error) {
+	s.mu.Lock()
+	check, ok := s.checked[namespace]
+	s.mu.Unlock()
+	if ok && s.now().Sub(check.at) < s.ttl {
+		return check.exists, nil
+	}
+	repos, err := fetchRepos(ctx, namespace)
+	if err != nil {
+		return false, err
+	}
+	check = publicNamespaceCheck{exists: len(repos) > 0, at: s.now()}
+	s.mu.Lock()
+	s.checked[namespace] = check
+	s.mu.Unlock()
+	return check.exists, nil
+}
+
+// requirePublicNamespace answers anonymous pulls from a listed namespace that
+// has no repositories with a single NAME_UNKNOWN, instead of letting them
+// descend into per-object 404s.
+func requirePublicNamespace(w http.ResponseWriter, r *http.Request, namespace string) bool {
+	exists, err := publicNamespaces.exists(r.Context(), namespace)
+	if err != nil {
+		log.Printf("public namespace check for %s failed: %v", namespace, err)
+		writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to look up namespace")
+		return false
+	}
+	if !exists {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "namespace "+namespace+" does not exist")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnonymousPullFromPublicNamespace(t *testing.T) {
+	withPublicNamespaces(t, "public", "typo")
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("public/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	rec := serveAnonymousRequest(t, http.MethodGet, "/v2/public/app/manifests/v1")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(image.Manifest) {
+		t.Fatalf("expected anonymous pull to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveAnonymousRequest(t, http.MethodGet, "/v2/public/app/blobs/"+image.LayerDigests[0])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected anonymous blob pull to succeed, got %d", rec.Code)
+	}
+
+	for _, path := range []string{"/v2/typo/app/manifests/v1", "/v2/typo/app/blobs/" + image.LayerDigests[0]} {
+		rec = serveAnonymousRequest(t, http.MethodGet, path)
+		if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "NAME_UNKNOWN") {
+			t.Fatalf("expected NAME_UNKNOWN for %s, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAnonymousAccessRequiresPublicPull(t *testing.T) {
+	withPublicNamespaces(t, "public")
+	registry := newFakeRegistry()
+	registry.seed("public/app", "v1", newTestRegistryImage(t, "layer-one"))
+	registry.seed("team1/app", "v1", newTestRegistryImage(t, "layer-two"))
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/v2/team1/app/manifests/v1"},
+		{http.MethodPut, "/v2/public/app/manifests/v2"},
+		{http.MethodPost, "/v2/public/app/blobs/uploads/"},
+		{http.MethodDelete, "/v2/public/app/manifests/v1"},
+	} {
+		rec := serveAnonymousRequest(t, tc.method, tc.path)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for anonymous %s %s, got %d", tc.method, tc.path, rec.Code)
+		}
+	}
+}
+
+func TestPublicNamespaceExistenceIsCached(t *testing.T) {
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	set := newPublicNamespaceSet([]string{"public"}, time.Minute)
+	now := time.Unix(0, 0)
+	set.now = func() time.Time { return now }
+
+	if exists, err := set.exists(t.Context(), "public"); err != nil || exists {
+		t.Fatalf("expected empty namespace, got %v, %v", exists, err)
+	}
+	registry.seed("public/app", "v1", newTestRegistryImage(t, "layer-one"))
+	if exists, _ := set.exists(t.Context(), "public"); exists {
+		t.Fatalf("expected cached result within the TTL")
+	}
+	now = now.Add(time.Minute)
+	if exists, _ := set.exists(t.Context(), "public"); !exists {
+		t.Fatalf("expected namespace to be re-checked after the TTL")
+	}
+}
+
+func serveAnonymousRequest(t *testing.T, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	return rec
+}
+
+func withPublicNamespaces(t *testing.T, names ...string) {
+	t.Helper()
+	prev := publicNamespaces
+	publicNamespaces = newPublicNamespaceSet(names, time.Minute)
+	t.Cleanup(func() { publicNamespaces = prev })
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteConfig mirrors a remote registry under Namespace: pulls of
+// <Namespace>/<repo> are fetched from URL, authenticating with either a static
+// Token or Username/Password.
+type remoteConfig struct {
+	URL       *url.URL
+	Namespace string
+	Username  string
+	Password  string
+	Token     string
+}
+
+func loadRemoteConfig() remoteConfig {
+	cfg := remoteConfig{
+		Namespace: getEnv("PROXY_NAMESPACE", "hub"),
+		Username:  getEnvSecret("PROXY_REMOTE_USERNAME"),
+		Password:  getEnvSecret("PROXY_REMOTE_PASSWORD"),
+		Token:     getEnvSecret("PROXY_REMOTE_TOKEN"),
+	}
+	if raw := strings.TrimSpace(os.Getenv("PROXY_REMOTE_URL")); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			log.Printf("ignoring PROXY_REMOTE_URL %q: expected an absolute URL", raw)
+		} else {
+			cfg.URL = u
+		}
+	}
+	return cfg
+}
+
+func (c remoteConfig) enabled() bool {
+	return c.URL != nil
+}
+
+// remoteRepo maps a mirrored repository to its name on the remote. Docker Hub
+// keeps official images under library/.
+func (c remoteConfig) remoteRepo(repo string) string {
+	if !strings.Contains(repo, "/") && strings.HasSuffix(c.URL.Hostname(), "docker.io") {
+		return "library/" + repo
+	}
+	return repo
+}
+
+// remoteTransport is the base transport for requests to the remote registry.
+var remoteTransport http.RoundTripper = http.DefaultTransport
+
+// remoteAuthTransport adds the configured credentials to remote requests. With
+// a static token every request carries it; otherwise a 401 Bearer challenge is
+// answered by fetching a token from the challenge realm with the username and
+// password, and a Basic challenge by sending them directly.
+type remoteAuthTransport struct {
+	cfg  remoteConfig
+	base http.RoundTripper
+	now  func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]remoteToken
+}
+
+type remoteToken struct {
+	value   string
+	expires time.Time
+}
+
+func newRemoteAuthTransport(cfg remoteConfig, base http.RoundTripper) *remoteAuthTransport {
+	return &remoteAuthTransport{cfg: cfg, base: base, now: time.Now, tokens: map[string]remoteToken{}}
+}
+
+// RoundTrip is only used for GET and HEAD, so retrying after a challenge never
+// needs to replay a body.
+func (t *remoteAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	switch {
+	case t.cfg.Token != "":
+		out.Header.Set("Authorization", "Bearer "+t.cfg.Token)
+	default:
+		if token, ok := t.cachedToken(req.URL.Host); ok {
+			out.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	resp, err := t.base.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || t.cfg.Token != "" {
+		return resp, err
+	}
+
+	scheme, params := parseAuthChallenge(resp.Header.Get("WWW-Authenticate"))
+	retry := req.Clone(req.Context())
+	switch scheme {
+	case "bearer":
+		token, err := t.fetchToken(req.Context(), req.URL.Host, params)
+		if err != nil {
+			log.Printf("remote registry token request failed: %v", err)
+			return resp, nil
+		}
+		retry.Header.Set("Authorization", "Bearer "+token)
+	case "basic":
+		if t.cfg.Username == "" {
+			return resp, nil
+		}
+		retry.SetBasicAuth(t.cfg.Username, t.cfg.Password)
+	default:
+		return resp, nil
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	_ = resp.Body.Close()
+	return t.base.RoundTrip(retry)
+}
+
+func (t *remoteAuthTransport) cachedToken(host string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	token, ok := t.tokens[host]
+	if !ok || !t.now().Before(token.expires) {
+		return "", false
+	}
+	return token.value, true
+}
+
+// fetchToken requests a bearer token from the challenge realm. Tokens are
+// cached per remote host; a challenge with another scope replaces the entry.
+func (t *remoteAuthTransport) fetchToken(ctx context.Context, host string, params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if t.cfg.Username != "" {
+		req.SetBasicAuth(t.cfg.Username, t.cfg.Password)
+	}
+	client := &http.Client{Transport: t.base, Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token status: %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	token := body.Token
+	if token == "" {
+		token = body.AccessToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("token response without token")
+	}
+	// Tokens without an expiry are valid for 60 seconds per the token spec.
+	ttl := time.Duration(body.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = 60 * time.Second
+	}
+	t.mu.Lock()
+	t.tokens[host] = remoteToken{value: token, expires: t.now().Add(ttl - ttl/10)}
+	t.mu.Unlock()
+	return token, nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+// into its lower-cased scheme and parameters.
+func parseAuthChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = strings.TrimPrefix(strings.TrimSpace(value[end+2:]), ",")
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+		rest = strings.TrimSpace(rest)
+	}
+	return strings.ToLower(scheme), params
+}
+
+// remotePuller serves the mirror namespace from the remote registry.
+type remotePuller struct {
+	cfg   remoteConfig
+	proxy *httputil.ReverseProxy
+}
+
+func newRemotePuller(cfg remoteConfig) *remotePuller {
+	p := &remotePuller{cfg: cfg}
+	if !cfg.enabled() {
+		return p
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Transport: newRemoteAuthTransport(cfg, remoteTransport),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(cfg.URL)
+			pr.Out.Header.Del("Forwarded")
+			pr.Out.Header.Del("X-Forwarded-For")
+			pr.Out.Header.Del("X-Forwarded-Host")
+			pr.Out.Header.Del("X-Forwarded-Proto")
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("Proxy-Authorization")
+			pr.Out.Header.Del("Cookie")
+			pr.Out.Host = cfg.URL.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if err := blockBlockedDigestResponse(resp); err != nil {
+				return err
+			}
+			return tagRegistryErrorResponse(resp)
+		},
+		FlushInterval: -1,
+	}
+	return p
+}
+
+// serveRemotePull forwards pulls from the mirror namespace to the remote
+// registry. Content is streamed through, not stored in the local registry, and
+// the namespace is read-only. It reports whether the request was handled.
+func serveRemotePull(w http.ResponseWriter, r *http.Request) bool {
+	if !remotePull.cfg.enabled() {
+		return false
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok {
+		return false
+	}
+	namespace, repo, ok := strings.Cut(route.Repo, "/")
+	if !ok || namespace != remotePull.cfg.Namespace {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, []string{http.MethodGet, http.MethodHead}, "namespace "+namespace+" mirrors a remote registry and is read-only")
+		return true
+	}
+	if route.Kind != registryKindManifests && route.Kind != registryKindBlobs && route.Kind != registryKindTags {
+		writeRegistryError(w, http.StatusNotFound, "UNSUPPORTED", "not available for mirrored repositories")
+		return true
+	}
+
+	out := r.Clone(r.Context())
+	out.URL.Path = "/v2/" + remotePull.cfg.remoteRepo(repo) + strings.TrimPrefix(r.URL.Path, "/v2/"+route.Repo)
+	out.URL.RawPath = ""
+	remotePull.proxy.ServeHTTP(w, out)
+	return true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withRemotePull(t *testing.T, cfg remoteConfig, fn func(*http.Request) *http.Response) {
+	t.Helper()
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("mirrored pull reached the local registry: %s %s", r.Method, r.URL.Path)
+		return nil
+	})
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "hub"}}, nil
+	}
+	originalTransport := remoteTransport
+	originalPull := remotePull
+	remoteTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return fn(r), nil
+	})
+	remotePull = newRemotePuller(cfg)
+	t.Cleanup(func() {
+		remoteTransport = originalTransport
+		remotePull = originalPull
+	})
+}
+
+func TestRemotePullFetchesTokenWithCredentials(t *testing.T) {
+	var manifestAuth []string
+	withRemotePull(t, remoteConfig{
+		URL:       mustParse("https://registry-1.docker.io"),
+		Namespace: "hub",
+		Username:  "mirror",
+		Password:  "s3cret",
+	}, func(r *http.Request) *http.Response {
+		switch r.URL.Host {
+		case "auth.docker.io":
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "mirror" || pass != "s3cret" {
+				return proxyTestResponse(r, http.StatusUnauthorized, nil, "")
+			}
+			if got := r.URL.Query().Get("scope"); got != "repository:library/alpine:pull" {
+				t.Errorf("unexpected token scope %q", got)
+			}
+			return proxyTestResponse(r, http.StatusOK, nil, `{"token":"remote-token","expires_in":300}`)
+		case "registry-1.docker.io":
+			if r.URL.Path != "/v2/library/alpine/manifests/3.20" {
+				t.Errorf("unexpected remote path %s", r.URL.Path)
+			}
+			manifestAuth = append(manifestAuth, r.Header.Get("Authorization"))
+			if r.Header.Get("Authorization") != "Bearer remote-token" {
+				header := http.Header{"Www-Authenticate": {`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`}}
+				return proxyTestResponse(r, http.StatusUnauthorized, header, "")
+			}
+			return proxyTestResponse(r, http.StatusOK, http.Header{"Content-Type": {"application/vnd.oci.image.index.v1+json"}}, `{"schemaVersion":2}`)
+		}
+		t.Errorf("unexpected remote host %s", r.URL.Host)
+		return proxyTestResponse(r, http.StatusBadGateway, nil, "")
+	})
+
+	for i := 0; i < 2; i++ {
+		rec := serveProxyRequest(t, http.MethodGet, "/v2/hub/alpine/manifests/3.20")
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"schemaVersion":2}` {
+			t.Fatalf("expected mirrored manifest, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	// The first pull is challenged; the second reuses the cached token.
+	want := []string{"", "Bearer remote-token", "Bearer remote-token"}
+	if strings.Join(manifestAuth, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected remote Authorization headers %q", manifestAuth)
+	}
+}
+
+func TestRemotePullSendsStaticToken(t *testing.T) {
+	withRemotePull(t, remoteConfig{URL: mustParse("https://mirror.test"), Namespace: "hub", Token: "pat"}, func(r *http.Request) *http.Response {
+		if got := r.Header.Get("Authorization"); got != "Bearer pat" {
+			t.Errorf("expected static token, got %q", got)
+		}
+		if r.URL.Path != "/v2/alpine/blobs/sha256:abc" {
+			t.Errorf("unexpected remote path %s", r.URL.Path)
+		}
+		return proxyTestResponse(r, http.StatusOK, nil, "blob")
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/hub/alpine/blobs/sha256:abc")
+	if rec.Code != http.StatusOK || rec.Body.String() != "blob" {
+		t.Fatalf("expected mirrored blob, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRemotePullIsReadOnly(t *testing.T) {
+	withRemotePull(t, remoteConfig{URL: mustParse("https://mirror.test"), Namespace: "hub"}, func(r *http.Request) *http.Response {
+		t.Fatalf("unexpected remote request %s %s", r.Method, r.URL.Path)
+		return nil
+	})
+
+	rec := serveProxyRequest(t, http.MethodPut, "/v2/hub/alpine/manifests/latest")
+	if rec.Code != http.StatusMethodNotAllowed || !strings.Contains(rec.Body.String(), "UNSUPPORTED") {
+		t.Fatalf("expected mirrored push to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestGetEnvSecretReadsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	t.Setenv("PROXY_REMOTE_PASSWORD_FILE", path)
+	if got := getEnvSecret("PROXY_REMOTE_PASSWORD"); got != "from-file" {
+		t.Fatalf("expected secret from file, got %q", got)
+	}
+	t.Setenv("PROXY_REMOTE_PASSWORD", "from-env")
+	if got := getEnvSecret("PROXY_REMOTE_PASSWORD"); got != "from-env" {
+		t.Fatalf("expected env to take precedence, got %q", got)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	quarantineVerdictPending = "pending"
+	quarantineVerdictClear   = "clear"
+)
+
+// quarantineStore tracks the scan verdict of manifests pushed while
+// QUARANTINE_PUSHES is set. Pending manifests are stored by the registry but
+// not served until a scanner marks them clear. Digests pushed before the
+// option was enabled have no entry and are served as before.
+type quarantineStore struct {
+	enabled bool
+	path    string
+
+	mu       sync.Mutex
+	verdicts map[string]string
+}
+
+type quarantineVerdictResponse struct {
+	Digest  string `json:"digest"`
+	Verdict string `json:"verdict"`
+}
+
+func loadQuarantineStore() *quarantineStore {
+	store := newQuarantineStore(getEnvBool("QUARANTINE_PUSHES", false), strings.TrimSpace(os.Getenv("QUARANTINE_STATE_FILE")))
+	if err := store.load(); err != nil {
+		log.Printf("unable to load QUARANTINE_STATE_FILE: %v", err)
+	}
+	return store
+}
+
+func newQuarantineStore(enabled bool, path string) *quarantineStore {
+	return &quarantineStore{enabled: enabled, path: path, verdicts: map[string]string{}}
+}
+
+func (q *quarantineStore) load() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return json.Unmarshal(data, &q.verdicts)
+}
+
+// saveLocked writes the verdicts to the state file through a temp file, so a
+// crash never leaves it half written. q.mu must be held.
+func (q *quarantineStore) saveLocked() error {
+	if q.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(q.verdicts)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), ".quarantine-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
+
+func (q *quarantineStore) verdict(digest string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	verdict, ok := q.verdicts[digest]
+	return verdict, ok
+}
+
+func (q *quarantineStore) quarantined(digest string) bool {
+	verdict, ok := q.verdict(digest)
+	return ok && verdict != quarantineVerdictClear
+}
+
+// markPending quarantines a newly pushed digest. Content that was already
+// scanned keeps its verdict, so re-pushing a cleared image stays pullable.
+func (q *quarantineStore) markPending(digest string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.verdicts[digest]; ok {
+		return nil
+	}
+	q.verdicts[digest] = quarantineVerdictPending
+	return q.saveLocked()
+}
+
+func (q *quarantineStore) setVerdict(digest, verdict string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.verdicts[digest] = verdict
+	return q.saveLocked()
+}
+
+// quarantinePushedManifest records manifests the registry accepted as
+// pending a scan.
+func quarantinePushedManifest(resp *http.Response) error {
+	if !quarantine.enabled || resp.Request == nil || resp.Request.Method != http.MethodPut || resp.StatusCode != http.StatusCreated {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return nil
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return nil
+	}
+	if err := quarantine.markPending(digest); err != nil {
+		log.Printf("quarantine state update for %s failed: %v", digest, err)
+	}
+	return nil
+}
+
+// blockQuarantinedResponse answers pulls of a manifest awaiting a clear scan
+// verdict with 403 QUARANTINED, whether it was requested by tag or digest.
+func blockQuarantinedResponse(resp *http.Response) error {
+	if !quarantine.enabled || resp.Request == nil || (resp.Request.Method != http.MethodGet && resp.Request.Method != http.MethodHead) {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return nil
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" || !quarantine.quarantined(digest) {
+		return nil
+	}
+	return replaceWithRegistryError(resp, http.StatusForbidden, "QUARANTINED", fmt.Sprintf("%s is quarantined pending a security scan", digest))
+}
+
+// handleAdminQuarantine reads (GET) or sets (PUT {"verdict":"clear"}) the
+// scan verdict of a manifest digest. A verdict of "pending" quarantines it
+// again.
+func handleAdminQuarantine(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	digest, err := (digestPolicy{RejectUppercase: true}).normalizeDigest(chi.URLParam(r, "digest"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid digest")
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req struct {
+			Verdict string `json:"verdict"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid verdict")
+			return
+		}
+		if req.Verdict != quarantineVerdictClear && req.Verdict != quarantineVerdictPending {
+			writeAPIError(w, http.StatusBadRequest, `verdict must be "clear" or "pending"`)
+			return
+		}
+		if err := quarantine.setVerdict(digest, req.Verdict); err != nil {
+			log.Printf("quarantine verdict for %s failed: %v", digest, err)
+			writeAPIError(w, http.StatusInternalServerError, "unable to store verdict")
+			return
+		}
+	}
+
+	verdict, ok := quarantine.verdict(digest)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "digest not tracked")
+		return
+	}
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(quarantineVerdictResponse{Digest: digest, Verdict: verdict})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withQuarantine(t *testing.T, store *quarantineStore) {
+	t.Helper()
+	prev := quarantine
+	quarantine = store
+	t.Cleanup(func() {
+		quarantine = prev
+	})
+}
+
+func setQuarantineVerdict(t *testing.T, username, digest, verdict string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/admin/quarantine/"+digest, strings.NewReader(`{"verdict":"`+verdict+`"}`))
+	req.SetBasicAuth(username, "secret")
+	cvRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestQuarantinedPushIsUnpullableUntilClear(t *testing.T) {
+	withQuarantine(t, newQuarantineStore(true, ""))
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	withAdminAuth(t)
+	image := newTestRegistryImage(t, "layer-one")
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected push to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range []string{"/v2/team1/app/manifests/v1", "/v2/team1/app/manifests/" + image.ManifestDigest} {
+		rec = serveProxyRequest(t, http.MethodGet, path)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "QUARANTINED") {
+			t.Fatalf("expected %s to be quarantined, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec = setQuarantineVerdict(t, "alice", image.ManifestDigest, "clear"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin verdict to be refused, got %d", rec.Code)
+	}
+	rec = setQuarantineVerdict(t, "root", image.ManifestDigest, "clear")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"verdict":"clear"`) {
+		t.Fatalf("expected verdict to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v1")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(image.Manifest) {
+		t.Fatalf("expected cleared image to be pullable, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Re-pushing scanned content keeps its verdict.
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v2", bytes.NewReader(image.Manifest))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected re-push to succeed, got %d", rec.Code)
+	}
+	if rec = serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v2"); rec.Code != http.StatusOK {
+		t.Fatalf("expected cleared digest to stay pullable, got %d", rec.Code)
+	}
+}
+
+func TestQuarantineDisabledServesPushes(t *testing.T) {
+	withQuarantine(t, newQuarantineStore(false, ""))
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	image := newTestRegistryImage(t, "layer-one")
+
+	serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", bytes.NewReader(image.Manifest))
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v1"); rec.Code != http.StatusOK {
+		t.Fatalf("expected pull without quarantine, got %d", rec.Code)
+	}
+}
+
+func TestQuarantineStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quarantine.json")
+	digest := testDigest([]byte("manifest"))
+	store := newQuarantineStore(true, path)
+	if err := store.markPending(digest); err != nil {
+		t.Fatalf("markPending: %v", err)
+	}
+
+	reloaded := newQuarantineStore(true, path)
+	if err := reloaded.load(); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if !reloaded.quarantined(digest) {
+		t.Fatalf("expected pending verdict to survive a restart")
+	}
+}
+
+func TestQuarantinedImageIsNotExportable(t *testing.T) {
+	withQuarantine(t, newQuarantineStore(true, ""))
+	withAdminAuth(t)
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	token := seedSession(t, "alice", []string{"team1"})
+
+	if err := quarantine.markPending(image.ManifestDigest); err != nil {
+		t.Fatalf("markPending: %v", err)
+	}
+	rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/v1/export")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "quarantined") {
+		t.Fatalf("expected a quarantined image not to export, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	setQuarantineVerdict(t, "root", image.ManifestDigest, "clear")
+	if rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/v1/export"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a cleared image to export, got %d", rec.Code)
+	}
+}
+
+func TestImportedImageIsQuarantined(t *testing.T) {
+	withQuarantine(t, newQuarantineStore(true, ""))
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	archive := buildDockerSaveArchive(t, "app:v1", []byte(`{"architecture":"amd64","os":"linux"}`), []byte("layer"))
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+	if rec := serveImportRequest(t, token, "/api/repos/team1/app/import", archive); rec.Code != http.StatusCreated {
+		t.Fatalf("expected import to be stored, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v1")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "QUARANTINED") {
+		t.Fatalf("expected the imported image to be quarantined, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
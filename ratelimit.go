@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// repoLimiterIdle is how long an unused repository bucket is kept before it
+// is swept.
+const repoLimiterIdle = 10 * time.Minute
+
+type repoRateConfig struct {
+	// Rate is the sustained requests per second allowed for one repository,
+	// summed over all clients. Zero disables the limiter.
+	Rate  float64
+	Burst int
+}
+
+func loadRepoRateConfig() repoRateConfig {
+	cfg := repoRateConfig{
+		Rate:  getEnvFloat("REPO_RATE_LIMIT", 0),
+		Burst: getEnvInt("REPO_RATE_BURST", 0),
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Max(1, math.Ceil(cfg.Rate)))
+	}
+	return cfg
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// repoRateLimiter keeps one token bucket per repository.
+type repoRateLimiter struct {
+	cfg repoRateConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRepoRateLimiter(cfg repoRateConfig) *repoRateLimiter {
+	return &repoRateLimiter{cfg: cfg, now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+func (l *repoRateLimiter) enabled() bool {
+	return l.cfg.Rate > 0
+}
+
+// allow takes a token for repo. When the bucket is empty it reports how long
+// until the next token is available.
+func (l *repoRateLimiter) allow(repo string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[repo]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[repo] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.cfg.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.cfg.Rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.cfg.Rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *repoRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < repoLimiterIdle {
+		return
+	}
+	l.lastSweep = now
+	for repo, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= repoLimiterIdle {
+			delete(l.buckets, repo)
+		}
+	}
+}
+
+// enforceRepoRateLimit rejects registry requests for a repository whose
+// aggregate request rate is exhausted.
+func enforceRepoRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if !repoLimiter.enabled() {
+		return true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok {
+		return true
+	}
+	allowed, wait := repoLimiter.allow(route.Repo)
+	if allowed {
+		return true
+	}
+	saturation.rateLimited.Add(1)
+	setRetryAfter(w, wait)
+	writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "repository "+route.Repo+" request rate exceeded")
+	return false
+}
+
+// setRetryAfter asks the client to wait at least wait, in whole seconds.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRepoRateLimitIsolatesRepositories(t *testing.T) {
+	limiter := withRepoRateLimiter(t, repoRateConfig{Rate: 1, Burst: 3})
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+
+	for i := 0; i < 3; i++ {
+		if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/hot/manifests/latest"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/hot/blobs/"+testAllowedDigest)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the burst, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After 1, got %q", rec.Header().Get("Retry-After"))
+	}
+
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/cold/manifests/latest"); rec.Code != http.StatusOK {
+		t.Fatalf("expected other repository to be unaffected, got %d", rec.Code)
+	}
+	if *calls != 4 {
+		t.Fatalf("expected limited request not to reach upstream, got %d calls", *calls)
+	}
+
+	now = now.Add(time.Second)
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/hot/manifests/latest"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a token after refill, got %d", rec.Code)
+	}
+}
+
+func TestRepoRateLimitDisabled(t *testing.T) {
+	withRepoRateLimiter(t, repoRateConfig{})
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "ok")
+	})
+	for i := 0; i < 20; i++ {
+		if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/hot/manifests/latest"); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 with limiter disabled, got %d", rec.Code)
+		}
+	}
+}
+
+func TestRepoRateLimiterSweepsIdleBuckets(t *testing.T) {
+	limiter := newRepoRateLimiter(repoRateConfig{Rate: 1, Burst: 1})
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	limiter.allow("team1/a")
+	now = now.Add(repoLimiterIdle)
+	limiter.allow("team1/b")
+	if _, ok := limiter.buckets["team1/a"]; ok {
+		t.Fatalf("expected idle bucket to be swept")
+	}
+}
+
+func withRepoRateLimiter(t *testing.T, cfg repoRateConfig) *repoRateLimiter {
+	t.Helper()
+	prev := repoLimiter
+	repoLimiter = newRepoRateLimiter(cfg)
+	t.Cleanup(func() {
+		repoLimiter = prev
+	})
+	return repoLimiter
+}
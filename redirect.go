@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// redirectConfig enables a plain HTTP listener on Addr that sends every
+// request to the HTTPS origin with status Code.
+type redirectConfig struct {
+	Addr string
+	Code int
+}
+
+func loadRedirectConfig() (redirectConfig, error) {
+	cfg := redirectConfig{Addr: strings.TrimSpace(os.Getenv("HTTP_REDIRECT_ADDR")), Code: http.StatusPermanentRedirect}
+	if raw := strings.TrimSpace(os.Getenv("HTTP_REDIRECT_CODE")); raw != "" {
+		code, err := strconv.Atoi(raw)
+		if err != nil || !isRedirectCode(code) {
+			return cfg, fmt.Errorf("invalid HTTP_REDIRECT_CODE: %q (want 301, 302, 303, 307 or 308)", raw)
+		}
+		cfg.Code = code
+	}
+	return cfg, nil
+}
+
+func (c redirectConfig) enabled() bool {
+	return c.Addr != ""
+}
+
+func isRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// httpsRedirectHandler redirects to the same host and request URI over
+// HTTPS on the default port, which the TLS listener is published on.
+func httpsRedirectHandler(code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadRedirectConfigDefaultsTo308(t *testing.T) {
+	t.Setenv("HTTP_REDIRECT_ADDR", ":8080")
+	t.Setenv("HTTP_REDIRECT_CODE", "")
+	cfg, err := loadRedirectConfig()
+	if err != nil || cfg.Code != http.StatusPermanentRedirect || !cfg.enabled() {
+		t.Fatalf("expected enabled 308 default, got %+v, %v", cfg, err)
+	}
+}
+
+func TestLoadRedirectConfigRejectsInvalidCode(t *testing.T) {
+	for _, raw := range []string{"200", "304", "399", "abc"} {
+		t.Setenv("HTTP_REDIRECT_CODE", raw)
+		if _, err := loadRedirectConfig(); err == nil {
+			t.Fatalf("expected HTTP_REDIRECT_CODE=%s to be rejected", raw)
+		}
+	}
+}
+
+func TestHTTPSRedirectUsesConfiguredCode(t *testing.T) {
+	t.Setenv("HTTP_REDIRECT_CODE", "301")
+	cfg, err := loadRedirectConfig()
+	if err != nil {
+		t.Fatalf("loadRedirectConfig: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://registry.example.com:8080/v2/team1/app/tags/list?n=10", nil)
+	httpsRedirectHandler(cfg.Code).ServeHTTP(rec, req)
+	if rec.Code != http.StatusMovedPermanently {
+		t.Fatalf("expected 301, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Location"); got != "https://registry.example.com/v2/team1/app/tags/list?n=10" {
+		t.Fatalf("unexpected Location %q", got)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Lua scripts that touch a lock only while it still carries our token.
+const (
+	redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRenewScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisStorage is a certmagic.Storage on Redis, so replicas share
+// certificates, ACME accounts and issuance locks. Each key is a hash holding
+// the value and its modification time under <prefix>/<key>; locks are plain
+// keys under <prefix>:lock:<name> with a renewed expiry.
+type redisStorage struct {
+	addr     string
+	username string
+	password string
+	db       int
+	useTLS   bool
+	prefix   string
+
+	// mu serialises commands on the single connection, which is dialled on
+	// first use and again after a network error.
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+
+	leases lockLeases
+}
+
+var _ certmagic.Storage = (*redisStorage)(nil)
+
+// redisError is an error reply from the server; the connection stays usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (s *redisStorage) key(key string) string {
+	return joinStorageKey(s.prefix, key)
+}
+
+func (s *redisStorage) Store(ctx context.Context, key string, value []byte) error {
+	_, err := s.do(ctx, "HSET", s.key(key), "value", string(value), "modified", strconv.FormatInt(time.Now().UnixNano(), 10))
+	return err
+}
+
+func (s *redisStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.do(ctx, "HGET", s.key(key), "value")
+	if err != nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return []byte(value), nil
+}
+
+func (s *redisStorage) Delete(ctx context.Context, key string) error {
+	keys, err := s.scan(ctx, s.key(key)+"/")
+	if err != nil {
+		return err
+	}
+	args := append([]string{"DEL", s.key(key)}, keys...)
+	_, err = s.do(ctx, args...)
+	return err
+}
+
+func (s *redisStorage) Exists(ctx context.Context, key string) bool {
+	reply, err := s.do(ctx, "EXISTS", s.key(key))
+	if err == nil && reply == int64(1) {
+		return true
+	}
+	keys, err := s.scan(ctx, s.key(key)+"/")
+	return err == nil && len(keys) > 0
+}
+
+func (s *redisStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	base := s.key(path)
+	keys, err := s.scan(ctx, joinStorageKey(base, "")+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	seen := map[string]struct{}{}
+	for _, key := range keys {
+		dirs := storageDirs(base, key)
+		if !recursive {
+			dirs = dirs[:1]
+		}
+		for _, dir := range dirs {
+			seen[strings.TrimPrefix(strings.TrimPrefix(dir, s.prefix), "/")] = struct{}{}
+		}
+	}
+	list := make([]string, 0, len(seen))
+	for key := range seen {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (s *redisStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	modified, err := s.do(ctx, "HGET", s.key(key), "modified")
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if raw, ok := modified.(string); ok {
+		size, err := s.do(ctx, "HSTRLEN", s.key(key), "value")
+		if err != nil {
+			return certmagic.KeyInfo{}, err
+		}
+		nanos, _ := strconv.ParseInt(raw, 10, 64)
+		length, _ := size.(int64)
+		return certmagic.KeyInfo{Key: key, Modified: time.Unix(0, nanos), Size: length, IsTerminal: true}, nil
+	}
+	if keys, err := s.scan(ctx, s.key(key)+"/"); err != nil {
+		return certmagic.KeyInfo{}, err
+	} else if len(keys) > 0 {
+		return certmagic.KeyInfo{Key: key}, nil
+	}
+	return certmagic.KeyInfo{}, fs.ErrNotExist
+}
+
+func (s *redisStorage) lockKey(name string) string {
+	return s.prefix + ":lock:" + name
+}
+
+func (s *redisStorage) Lock(ctx context.Context, name string) error {
+	token, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	ttl := strconv.FormatInt(lockLeaseTTL.Milliseconds(), 10)
+	for {
+		reply, err := s.do(ctx, "SET", s.lockKey(name), token, "NX", "PX", ttl)
+		if err != nil {
+			return err
+		}
+		if reply == "OK" {
+			s.leases.hold(name, token, func(ctx context.Context) error {
+				_, err := s.do(ctx, "EVAL", redisRenewScript, "1", s.lockKey(name), token, ttl)
+				return err
+			})
+			return nil
+		}
+		if err := waitForLock(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *redisStorage) Unlock(ctx context.Context, name string) error {
+	token, ok := s.leases.release(name)
+	if !ok {
+		return fmt.Errorf("lock %s is not held", name)
+	}
+	_, err := s.do(ctx, "EVAL", redisUnlockScript, "1", s.lockKey(name), token)
+	return err
+}
+
+// scan returns every key starting with prefix.
+func (s *redisStorage) scan(ctx context.Context, prefix string) ([]string, error) {
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("redis: unexpected SCAN reply %v", reply)
+		}
+		cursor, _ = page[0].(string)
+		batch, _ := page[1].([]any)
+		for _, key := range batch {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// do sends one command and returns its reply: a string, an int64, nil, or
+// a []any of those.
+func (s *redisStorage) do(ctx context.Context, args ...string) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(ctx, args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = s.conn.Close()
+		s.conn = nil
+	}
+	return reply, err
+}
+
+func (s *redisStorage) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: certStorageTimeout}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		host, _, _ := net.SplitHostPort(s.addr)
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn, s.reader = conn, bufio.NewReader(conn)
+	if s.password != "" {
+		auth := []string{"AUTH", s.password}
+		if s.username != "" {
+			auth = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := s.roundTrip(ctx, auth); err != nil {
+			_ = conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip(ctx, []string{"SELECT", strconv.Itoa(s.db)}); err != nil {
+			_ = conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStorage) roundTrip(ctx context.Context, args []string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(certStorageTimeout)
+	}
+	_ = s.conn.SetDeadline(deadline)
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(s.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(s.reader)
+}
+
+// readRESP reads one RESP2 reply.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// specFeaturesHeader lists the OCI distribution spec features ContainerVault
+// serves itself on the /v2/ handshake, e.g. "referrers".
+const specFeaturesHeader = "OCI-Distribution-Spec-Features"
+
+// referrersMu serialises read-modify-write updates of referrer indexes.
+var referrersMu sync.Mutex
+
+type referrerContextKey struct{}
+
+// referrerManifest is the subset of an image manifest needed to list it as a
+// referrer of its subject.
+type referrerManifest struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Config       *ociDescriptor    `json:"config"`
+	Subject      *ociDescriptor    `json:"subject"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+// advertiseSpecFeatures adds specFeaturesHeader to successful /v2/ handshakes.
+func advertiseSpecFeatures(resp *http.Response) error {
+	if !referrersEnabled || resp.Request == nil || resp.Request.URL.Path != "/v2/" || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	resp.Header.Set(specFeaturesHeader, "referrers")
+	return nil
+}
+
+// referrersTag is the OCI 1.1 fallback tag holding the referrers index for
+// digest, e.g. sha256-<hex>.
+func referrersTag(digest string) (string, error) {
+	normalized, err := (digestPolicy{RejectUppercase: true}).normalizeDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	tag := strings.Replace(normalized, ":", "-", 1)
+	if len(tag) > 128 {
+		tag = tag[:128]
+	}
+	return tag, nil
+}
+
+// serveReferrers answers GET /v2/<repo>/referrers/<digest> from the fallback
+// tag index, which indexReferrer keeps up to date on push. It reports whether
+// the request was handled.
+func serveReferrers(w http.ResponseWriter, r *http.Request) bool {
+	if !referrersEnabled {
+		return false
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindReferrers {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, []string{http.MethodGet, http.MethodHead}, "referrers only supports GET")
+		return true
+	}
+	tag, err := referrersTag(route.Reference)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return true
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	index, err := fetchReferrersIndex(r.Context(), client, route.Repo, tag)
+	if err != nil {
+		log.Printf("referrers for %s@%s failed: %v", route.Repo, route.Reference, err)
+		writeRegistryError(w, http.StatusBadGateway, "UNAVAILABLE", "unable to read referrers")
+		return true
+	}
+	if artifactType := r.URL.Query().Get("artifactType"); artifactType != "" {
+		filtered := make([]ociDescriptor, 0, len(index.Manifests))
+		for _, desc := range index.Manifests {
+			if desc.ArtifactType == artifactType {
+				filtered = append(filtered, desc)
+			}
+		}
+		index.Manifests = filtered
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "unable to encode referrers")
+		return true
+	}
+	w.Header().Set("Content-Type", ociIndexMedia)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(body)
+	}
+	return true
+}
+
+// fetchReferrersIndex reads the index stored under tag, returning an empty
+// index when the tag does not exist.
+func fetchReferrersIndex(ctx context.Context, client *http.Client, repo, tag string) (ociIndex, error) {
+	index := ociIndex{SchemaVersion: 2, MediaType: ociIndexMedia, Manifests: []ociDescriptor{}}
+	manifestURL := upstream.ResolveReference(&url.URL{Path: "/v2/" + repo + "/manifests/" + tag})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL.String(), nil)
+	if err != nil {
+		return index, err
+	}
+	req.Header.Set("Accept", ociIndexMedia)
+	resp, err := client.Do(req)
+	if err != nil {
+		return index, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return index, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return index, fmt.Errorf("referrers index status: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestBytes)).Decode(&index); err != nil {
+		return index, err
+	}
+	if index.Manifests == nil {
+		index.Manifests = []ociDescriptor{}
+	}
+	return index, nil
+}
+
+// prepareReferrer records manifest pushes that carry a subject so
+// indexReferrer can add them to the subject's referrers index once the
+// registry accepts them.
+func prepareReferrer(r *http.Request) *http.Request {
+	if !referrersEnabled || r.Method != http.MethodPut {
+		return r
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests {
+		return r
+	}
+	body, ok := peekManifestBody(r)
+	if !ok {
+		return r
+	}
+	var manifest referrerManifest
+	if err := json.Unmarshal(body, &manifest); err != nil || manifest.Subject == nil || manifest.Subject.Digest == "" {
+		return r
+	}
+	artifactType := manifest.ArtifactType
+	if artifactType == "" && manifest.Config != nil {
+		artifactType = manifest.Config.MediaType
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = r.Header.Get("Content-Type")
+	}
+	sum := sha256.Sum256(body)
+	desc := ociDescriptor{
+		MediaType:    mediaType,
+		Digest:       "sha256:" + hex.EncodeToString(sum[:]),
+		Size:         int64(len(body)),
+		ArtifactType: artifactType,
+		Annotations:  manifest.Annotations,
+	}
+	ctx := context.WithValue(r.Context(), referrerContextKey{}, referrerPush{Subject: manifest.Subject.Digest, Descriptor: desc})
+	return r.WithContext(ctx)
+}
+
+type referrerPush struct {
+	Subject    string
+	Descriptor ociDescriptor
+}
+
+// indexReferrer adds an accepted referrer to its subject's fallback tag index
+// and answers with OCI-Subject, telling the client not to maintain the index
+// itself. On failure the header is left out so the client falls back.
+func indexReferrer(resp *http.Response) error {
+	if resp.Request == nil || resp.StatusCode != http.StatusCreated {
+		return nil
+	}
+	push, ok := resp.Request.Context().Value(referrerContextKey{}).(referrerPush)
+	if !ok {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok {
+		return nil
+	}
+	if err := addReferrer(resp.Request.Context(), route.Repo, push); err != nil {
+		log.Printf("referrers index update for %s@%s failed: %v", route.Repo, push.Subject, err)
+		return nil
+	}
+	resp.Header.Set("OCI-Subject", push.Subject)
+	return nil
+}
+
+func addReferrer(ctx context.Context, repo string, push referrerPush) error {
+	tag, err := referrersTag(push.Subject)
+	if err != nil {
+		return err
+	}
+	referrersMu.Lock()
+	defer referrersMu.Unlock()
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	index, err := fetchReferrersIndex(ctx, client, repo, tag)
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Digest == push.Descriptor.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, push.Descriptor)
+	body, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return putManifest(ctx, repo, tag, ociIndexMedia, body)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestHandshakeAdvertisesReferrers(t *testing.T) {
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/")
+	if rec.Code != http.StatusOK || rec.Header().Get(specFeaturesHeader) != "" {
+		t.Fatalf("expected no advertised features when disabled, got %d %q", rec.Code, rec.Header().Get(specFeaturesHeader))
+	}
+
+	withReferrers(t, true)
+	rec = serveProxyRequest(t, http.MethodGet, "/v2/")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if got := rec.Header().Get(specFeaturesHeader); got != "referrers" {
+		t.Fatalf("expected referrers to be advertised, got %q", got)
+	}
+}
+
+func TestReferrersIndexedOnPush(t *testing.T) {
+	withReferrers(t, true)
+	registry := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer-one")
+	registry.seed("team1/app", "v1", image)
+	withProxyUpstream(t, registry.roundTrip)
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+
+	signature := referrerArtifact(t, image, "application/vnd.example.signature")
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+testDigest(signature), bytes.NewReader(signature))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("OCI-Subject"); got != image.ManifestDigest {
+		t.Fatalf("expected OCI-Subject %s, got %q", image.ManifestDigest, got)
+	}
+	sbom := referrerArtifact(t, image, "application/vnd.example.sbom")
+	serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+testDigest(sbom), bytes.NewReader(sbom))
+
+	index := getReferrers(t, "/v2/team1/app/referrers/"+image.ManifestDigest)
+	if len(index.Manifests) != 2 || index.Manifests[0].Digest != testDigest(signature) || index.Manifests[0].ArtifactType != "application/vnd.example.signature" {
+		t.Fatalf("unexpected referrers: %+v", index.Manifests)
+	}
+
+	filtered := getReferrers(t, "/v2/team1/app/referrers/"+image.ManifestDigest+"?artifactType=application/vnd.example.sbom")
+	if len(filtered.Manifests) != 1 || filtered.Manifests[0].Digest != testDigest(sbom) {
+		t.Fatalf("unexpected filtered referrers: %+v", filtered.Manifests)
+	}
+
+	empty := getReferrers(t, "/v2/team1/app/referrers/"+testDigest([]byte("unknown")))
+	if len(empty.Manifests) != 0 {
+		t.Fatalf("expected no referrers, got %+v", empty.Manifests)
+	}
+}
+
+func TestReferrersRejectsInvalidDigest(t *testing.T) {
+	withReferrers(t, true)
+	withProxyUpstream(t, newFakeRegistry().roundTrip)
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/referrers/latest")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func referrerArtifact(t *testing.T, subject testRegistryImage, artifactType string) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"artifactType":  artifactType,
+		"config":        map[string]any{"mediaType": "application/vnd.oci.empty.v1+json", "digest": testDigest([]byte("{}")), "size": 2},
+		"layers":        []any{},
+		"subject":       map[string]any{"mediaType": ociManifestType, "digest": subject.ManifestDigest, "size": len(subject.Manifest)},
+	})
+	if err != nil {
+		t.Fatalf("marshal artifact: %v", err)
+	}
+	return body
+}
+
+func getReferrers(t *testing.T, path string) ociIndex {
+	t.Helper()
+	rec := serveProxyRequest(t, http.MethodGet, path)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 for %s, got %d: %s", path, rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != ociIndexMedia {
+		t.Fatalf("expected index content type, got %q", ct)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatalf("decode referrers: %v", err)
+	}
+	return index
+}
+
+func withReferrers(t *testing.T, enabled bool) {
+	t.Helper()
+	prev := referrersEnabled
+	referrersEnabled = enabled
+	t.Cleanup(func() { referrersEnabled = prev })
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	registryKindManifests = "manifests"
+	registryKindBlobs     = "blobs"
+	registryKindTags      = "tags"
+	registryKindReferrers = "referrers"
+)
+
+// registryRoute describes a /v2/<name>/<kind>/<reference> registry path.
+type registryRoute struct {
+	Repo      string
+	Kind      string
+	Reference string
+}
+
+// parseRegistryPath splits a registry API path into repository, endpoint kind
+// and reference. Blob upload paths are reported with Kind "blobs" and a
+// reference starting with "uploads".
+func parseRegistryPath(path string) (registryRoute, bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok || rest == "" {
+		return registryRoute{}, false
+	}
+	for _, kind := range []string{registryKindManifests, registryKindBlobs, registryKindTags, registryKindReferrers} {
+		marker := "/" + kind + "/"
+		idx := strings.LastIndex(rest, marker)
+		if kind == registryKindBlobs {
+			if uploadIdx := strings.LastIndex(rest, "/blobs/uploads"); uploadIdx >= 0 {
+				idx = uploadIdx
+			}
+		}
+		if idx <= 0 {
+			continue
+		}
+		return registryRoute{
+			Repo:      rest[:idx],
+			Kind:      kind,
+			Reference: rest[idx+len(marker):],
+		}, true
+	}
+	return registryRoute{}, false
+}
+
+func (r registryRoute) isUpload() bool {
+	return r.Kind == registryKindBlobs && strings.HasPrefix(r.Reference, "uploads")
+}
+
+func isDigestReference(ref string) bool {
+	return strings.Contains(ref, ":")
+}
+
+type registryErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+}
+
+type registryErrorResponse struct {
+	Errors    []registryErrorDetail `json:"errors"`
+	RequestID string                `json:"request_id,omitempty"`
+}
+
+// writeRegistryError writes an error in the distribution/OCI JSON error format,
+// tagged with the request id set by requestIDMiddleware.
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(registryErrorResponse{
+		Errors:    []registryErrorDetail{{Code: code, Message: message}},
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// replaceWithRegistryError discards an upstream response and turns it into a
+// registry JSON error, for response modifiers that refuse to serve content.
+func replaceWithRegistryError(resp *http.Response, status int, code, message string) error {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	_ = resp.Body.Close()
+
+	body, err := json.Marshal(registryErrorResponse{
+		Errors:    []registryErrorDetail{{Code: code, Message: message}},
+		RequestID: requestIDFromContext(resp.Request.Context()),
+	})
+	if err != nil {
+		return err
+	}
+	resp.StatusCode = status
+	resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header = make(http.Header)
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return nil
+}
+
+// registryMethods returns the methods the distribution API defines for path,
+// or nil for paths it does not know.
+func registryMethods(path string) []string {
+	if path == "/v2/" || path == "/v2/_catalog" || path == capabilitiesPath {
+		return []string{http.MethodGet, http.MethodHead}
+	}
+	route, ok := parseRegistryPath(path)
+	if !ok {
+		return nil
+	}
+	switch {
+	case route.isUpload() && strings.Trim(strings.TrimPrefix(route.Reference, "uploads"), "/") == "":
+		return []string{http.MethodPost}
+	case route.isUpload():
+		return []string{http.MethodGet, http.MethodPatch, http.MethodPut, http.MethodDelete}
+	case route.Kind == registryKindManifests:
+		return []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+	case route.Kind == registryKindBlobs:
+		return []string{http.MethodGet, http.MethodHead, http.MethodDelete}
+	default:
+		return []string{http.MethodGet, http.MethodHead}
+	}
+}
+
+// writeMethodNotAllowed answers 405 with an UNSUPPORTED error and an Allow
+// header listing allowed.
+func writeMethodNotAllowed(w http.ResponseWriter, allowed []string, message string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", message)
+}
+
+// enforceRegistryMethod rejects methods the distribution API does not define
+// for a registry path before they reach authorization or the registry.
+func enforceRegistryMethod(w http.ResponseWriter, r *http.Request) bool {
+	allowed := registryMethods(r.URL.Path)
+	if allowed == nil || slices.Contains(allowed, r.Method) {
+		return true
+	}
+	writeMethodNotAllowed(w, allowed, r.Method+" is not supported on "+r.URL.Path)
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUnsupportedMethodReturnsRegistryError(t *testing.T) {
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, nil, "")
+	})
+
+	rec := serveProxyRequest(t, http.MethodPatch, "/v2/team1/app/manifests/latest")
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Allow"); got != "GET, HEAD, PUT, DELETE" {
+		t.Fatalf("unexpected Allow header %q", got)
+	}
+	var payload registryErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Errors) != 1 || payload.Errors[0].Code != "UNSUPPORTED" {
+		t.Fatalf("expected UNSUPPORTED envelope, got %q", rec.Body.String())
+	}
+	if *calls != 0 {
+		t.Fatalf("expected unsupported method not to reach the registry")
+	}
+}
+
+func TestRegistryMethods(t *testing.T) {
+	cases := map[string]string{
+		"/v2/":                             "GET, HEAD",
+		"/v2/_catalog":                     "GET, HEAD",
+		"/v2/team1/app/tags/list":          "GET, HEAD",
+		"/v2/team1/app/blobs/sha256:abc":   "GET, HEAD, DELETE",
+		"/v2/team1/app/blobs/uploads/":     "POST",
+		"/v2/team1/app/blobs/uploads/uuid": "GET, PATCH, PUT, DELETE",
+	}
+	for path, want := range cases {
+		if got := strings.Join(registryMethods(path), ", "); got != want {
+			t.Fatalf("registryMethods(%s) = %q, want %q", path, got, want)
+		}
+	}
+	if registryMethods("/login") != nil {
+		t.Fatalf("expected non-registry paths to be left alone")
+	}
+}
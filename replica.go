@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// replicaConfig turns ContainerVault into a read-only replica: reads are
+// served from the local registry, which holds replicated storage, and writes
+// are forwarded to the primary ContainerVault at Primary.
+type replicaConfig struct {
+	Enabled bool
+	Primary *url.URL
+}
+
+func loadReplicaConfig() replicaConfig {
+	cfg := replicaConfig{Enabled: getEnvBool("REPLICA_MODE", false)}
+	if !cfg.Enabled {
+		return cfg
+	}
+	raw := strings.TrimSpace(os.Getenv("PRIMARY_URL"))
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		log.Printf("REPLICA_MODE without a valid PRIMARY_URL %q: writes will be refused", raw)
+		return cfg
+	}
+	cfg.Primary = u
+	return cfg
+}
+
+// replicaTransport is the base transport for requests to the primary.
+var replicaTransport http.RoundTripper = http.DefaultTransport
+
+type replicaForwarder struct {
+	cfg   replicaConfig
+	proxy *httputil.ReverseProxy
+}
+
+func newReplicaForwarder(cfg replicaConfig) *replicaForwarder {
+	f := &replicaForwarder{cfg: cfg}
+	if cfg.Primary == nil {
+		return f
+	}
+	primary := cfg.Primary
+	f.proxy = &httputil.ReverseProxy{
+		Transport: replicaTransport,
+		// The primary authenticates the client again, so Authorization is
+		// passed through unchanged.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(primary)
+			pr.Out.Header.Del("Forwarded")
+			pr.Out.Header.Del("X-Forwarded-For")
+			pr.Out.Header.Del("X-Forwarded-Host")
+			pr.Out.Header.Del("X-Forwarded-Proto")
+			pr.Out.Header.Del("Cookie")
+			pr.Out.Host = primary.Host
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			keepUploadOnReplica(resp, primary)
+			return tagRegistryErrorResponse(resp)
+		},
+		FlushInterval: -1,
+	}
+	return f
+}
+
+// keepUploadOnReplica turns an absolute Location pointing at the primary
+// into a path, so upload chunks keep coming through the replica, which may be
+// the only address the client can reach.
+func keepUploadOnReplica(resp *http.Response, primary *url.URL) {
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Host != primary.Host {
+		return
+	}
+	resp.Header.Set("Location", location.RequestURI())
+}
+
+// isReplicaWrite reports whether r changes registry content. Upload sessions
+// live on the primary, so every request under /blobs/uploads/ counts.
+func isReplicaWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		route, ok := parseRegistryPath(r.URL.Path)
+		return ok && route.isUpload()
+	}
+	return true
+}
+
+// forwardReplicaWrite sends pushes and deletes on a replica to the primary.
+// It reports whether the request was handled.
+func forwardReplicaWrite(w http.ResponseWriter, r *http.Request) bool {
+	if !replica.cfg.Enabled || !isReplicaWrite(r) {
+		return false
+	}
+	if replica.proxy == nil {
+		writeRegistryError(w, http.StatusServiceUnavailable, "UNAVAILABLE", "read-only replica has no primary configured")
+		return true
+	}
+	replica.proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withReplica(t *testing.T, cfg replicaConfig, fn func(*http.Request) *http.Response) {
+	t.Helper()
+	originalTransport := replicaTransport
+	originalReplica := replica
+	replicaTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return fn(r), nil
+	})
+	replica = newReplicaForwarder(cfg)
+	t.Cleanup(func() {
+		replicaTransport = originalTransport
+		replica = originalReplica
+	})
+}
+
+func TestReplicaForwardsPushToPrimary(t *testing.T) {
+	local := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("push reached the replica's registry: %s %s", r.Method, r.URL.Path)
+		return nil
+	})
+	var forwarded []string
+	withReplica(t, replicaConfig{Enabled: true, Primary: mustParse("https://primary.example.com")}, func(r *http.Request) *http.Response {
+		forwarded = append(forwarded, r.Method+" "+r.URL.Path)
+		if r.URL.Host != "primary.example.com" || r.Host != "primary.example.com" {
+			t.Errorf("expected request for the primary, got host %q", r.URL.Host)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			t.Errorf("expected client credentials to reach the primary")
+		}
+		if strings.HasSuffix(r.URL.Path, "/blobs/uploads/") {
+			header := http.Header{"Location": {"https://primary.example.com/v2/team1/app/blobs/uploads/abc?_state=x"}}
+			return proxyTestResponse(r, http.StatusAccepted, header, "")
+		}
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+
+	rec := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 from the primary, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Location"); got != "/v2/team1/app/blobs/uploads/abc?_state=x" {
+		t.Fatalf("expected upload location on the replica, got %q", got)
+	}
+	// Upload status is a GET but the session only exists on the primary.
+	serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/uploads/abc")
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 from the primary, got %d", rec.Code)
+	}
+
+	want := []string{
+		"POST /v2/team1/app/blobs/uploads/",
+		"GET /v2/team1/app/blobs/uploads/abc",
+		"PUT /v2/team1/app/manifests/v1",
+	}
+	if strings.Join(forwarded, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected forwarded requests: %v", forwarded)
+	}
+	if *local != 0 {
+		t.Fatalf("expected no local registry calls, got %d", *local)
+	}
+}
+
+func TestReplicaServesPullLocally(t *testing.T) {
+	local := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusOK, http.Header{"Content-Type": {ociManifestType}}, `{"schemaVersion":2}`)
+	})
+	withReplica(t, replicaConfig{Enabled: true, Primary: mustParse("https://primary.example.com")}, func(r *http.Request) *http.Response {
+		t.Fatalf("pull reached the primary: %s %s", r.Method, r.URL.Path)
+		return nil
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/v1")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected local pull, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if *local != 1 {
+		t.Fatalf("expected one local registry call, got %d", *local)
+	}
+}
+
+func TestReplicaWithoutPrimaryRefusesWrites(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("write reached the replica's registry: %s %s", r.Method, r.URL.Path)
+		return nil
+	})
+	withReplica(t, replicaConfig{Enabled: true}, nil)
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1", strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "UNAVAILABLE") {
+		t.Fatalf("expected 503 UNAVAILABLE, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
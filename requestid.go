@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maxRequestIDLength bounds request ids accepted from clients or a load
+// balancer in front of ContainerVault.
+const maxRequestIDLength = 128
+
+type requestIDContextKey struct{}
+
+// requestIDMiddleware gives every request an id, reusing a well-formed one
+// from the incoming requestIDHeader, and echoes it on the response so a
+// user can quote it when reporting an error.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// tagRegistryErrorResponse adds the request id to JSON error envelopes
+// returned by the registry, so proxied errors carry it like our own.
+func tagRegistryErrorResponse(resp *http.Response) error {
+	if resp.Request == nil || resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	id := requestIDFromContext(resp.Request.Context())
+	if id == "" {
+		return nil
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) > 1<<20 {
+		return nil
+	}
+	var envelope registryErrorResponse
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Errors) == 0 {
+		return nil
+	}
+	envelope.RequestID = id
+	tagged, err := json.Marshal(envelope)
+	if err != nil {
+		return nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(tagged))
+	resp.ContentLength = int64(len(tagged))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(tagged)))
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForbiddenErrorCarriesRequestID(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		t.Fatalf("forbidden request reached the registry")
+		return nil
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team2/app/manifests/latest")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d: %s", rec.Code, rec.Body.String())
+	}
+	id := rec.Header().Get("X-Request-ID")
+	if len(id) != 32 {
+		t.Fatalf("expected generated request id header, got %q", id)
+	}
+	var payload registryErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("expected JSON error body, got %q", rec.Body.String())
+	}
+	if len(payload.Errors) != 1 || payload.Errors[0].Code != "DENIED" {
+		t.Fatalf("expected DENIED error, got %+v", payload.Errors)
+	}
+	if payload.RequestID != id {
+		t.Fatalf("expected request_id %q in body, got %q", id, payload.RequestID)
+	}
+}
+
+func TestRequestIDReusesIncomingHeader(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusNotFound, http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+			`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+	})
+
+	send := func(incoming string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/team1/app/manifests/missing", nil)
+		req.SetBasicAuth("alice", "secret")
+		req.Header.Set("X-Request-ID", incoming)
+		cvRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("lb-1234.abc")
+	if got := rec.Header().Get("X-Request-ID"); got != "lb-1234.abc" {
+		t.Fatalf("expected incoming request id to be kept, got %q", got)
+	}
+	var payload registryErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Errors) != 1 {
+		t.Fatalf("expected registry error body, got %q", rec.Body.String())
+	}
+	if payload.Errors[0].Code != "MANIFEST_UNKNOWN" || payload.RequestID != "lb-1234.abc" {
+		t.Fatalf("expected proxied error tagged with request id, got %+v", payload)
+	}
+
+	rec = send("bad id\nwith newline")
+	if got := rec.Header().Get("X-Request-ID"); got == "" || got == "bad id\nwith newline" {
+		t.Fatalf("expected malformed request id to be replaced, got %q", got)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// protectedResponseHeaders are never taken from EXTRA_RESPONSE_HEADERS:
+// security headers, authentication and session headers, and the framing and
+// content headers registry clients depend on.
+var protectedResponseHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Content-Range",
+	"Content-Security-Policy",
+	"Content-Type",
+	"Docker-Content-Digest",
+	"Docker-Distribution-Api-Version",
+	"Docker-Upload-Uuid",
+	"Location",
+	"Range",
+	"Set-Cookie",
+	"Strict-Transport-Security",
+	"Transfer-Encoding",
+	"Www-Authenticate",
+	"X-Content-Type-Options",
+	"X-Frame-Options",
+}
+
+// loadExtraResponseHeaders parses EXTRA_RESPONSE_HEADERS, e.g.
+// "X-Environment=prod;Cache-Control=no-store". Malformed and protected
+// entries are logged and skipped.
+func loadExtraResponseHeaders() http.Header {
+	headers := http.Header{}
+	for _, entry := range strings.Split(os.Getenv("EXTRA_RESPONSE_HEADERS"), ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+		if !ok || key == "" || strings.ContainsAny(key, " \t:") {
+			log.Printf("ignoring EXTRA_RESPONSE_HEADERS entry %q: expected key=value", entry)
+			continue
+		}
+		if slices.Contains(protectedResponseHeaders, key) || key == requestIDHeader {
+			log.Printf("ignoring EXTRA_RESPONSE_HEADERS entry %q: %s cannot be overridden", entry, key)
+			continue
+		}
+		headers.Set(key, strings.TrimSpace(value))
+	}
+	return headers
+}
+
+// extraHeaderWriter sets the configured headers just before the status line
+// goes out, so they replace values set by handlers or the registry.
+type extraHeaderWriter struct {
+	http.ResponseWriter
+	headers     http.Header
+	wroteHeader bool
+}
+
+func (w *extraHeaderWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		for key, values := range w.headers {
+			w.Header()[key] = values
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *extraHeaderWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach Flush and Hijack.
+func (w *extraHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// extraResponseHeadersMiddleware adds EXTRA_RESPONSE_HEADERS to every
+// response.
+func extraResponseHeadersMiddleware(headers http.Header) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(headers) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&extraHeaderWriter{ResponseWriter: w, headers: headers}, r)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withExtraResponseHeaders(t *testing.T, raw string) {
+	t.Helper()
+	t.Setenv("EXTRA_RESPONSE_HEADERS", raw)
+	prev := extraResponseHeaders
+	extraResponseHeaders = loadExtraResponseHeaders()
+	t.Cleanup(func() {
+		extraResponseHeaders = prev
+	})
+}
+
+func TestExtraResponseHeadersOnAPIAndBlobResponses(t *testing.T) {
+	withExtraResponseHeaders(t, "X-Environment=prod; Cache-Control=no-store")
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		header := http.Header{"Cache-Control": {"max-age=31536000"}, "Docker-Content-Digest": {testDigest([]byte("blob"))}}
+		return proxyTestResponse(r, http.StatusOK, header, "blob")
+	})
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/blobs/"+testDigest([]byte("blob")))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected blob pull, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Environment") != "prod" {
+		t.Fatalf("expected X-Environment on blob response, got %v", rec.Header())
+	}
+	if got := rec.Header().Values("Cache-Control"); len(got) != 1 || got[0] != "no-store" {
+		t.Fatalf("expected configured Cache-Control to replace the registry's, got %v", got)
+	}
+
+	token := seedSession(t, "alice", []string{"team1"})
+	req := httptest.NewRequest(http.MethodGet, "/api/dashboard", nil)
+	req.AddCookie(&http.Cookie{Name: "cv_session", Value: token})
+	rec = httptest.NewRecorder()
+	cvRouter().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected dashboard, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Environment") != "prod" {
+		t.Fatalf("expected X-Environment on API response, got %v", rec.Header())
+	}
+}
+
+func TestExtraResponseHeadersSkipProtectedHeaders(t *testing.T) {
+	withExtraResponseHeaders(t, "Content-Security-Policy=none;Set-Cookie=x=1;X-Content-Type-Options=off;X-Request-ID=fixed;broken;X-Team=registry")
+
+	if got := len(extraResponseHeaders); got != 1 || extraResponseHeaders.Get("X-Team") != "registry" {
+		t.Fatalf("expected only X-Team to be kept, got %v", extraResponseHeaders)
+	}
+
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusNotFound, nil, "")
+	})
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/missing")
+	if rec.Header().Get("X-Request-ID") == "fixed" || rec.Header().Get("Content-Security-Policy") != "" {
+		t.Fatalf("expected protected headers to be left alone, got %v", rec.Header())
+	}
+	if rec.Header().Get("X-Team") != "registry" {
+		t.Fatalf("expected X-Team on error response")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// s3Storage is a certmagic.Storage on an S3 bucket, addressed path-style so
+// S3-compatible stores such as MinIO work too. Locks are objects under
+// <prefix>/locks/ created with If-None-Match, rewritten while held and
+// treated as stale once they have not been rewritten for lockLeaseTTL.
+type s3Storage struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	prefix   string
+	creds    awsCredentials
+	client   *http.Client
+	now      func() time.Time
+
+	leases lockLeases
+}
+
+var _ certmagic.Storage = (*s3Storage)(nil)
+
+func newS3Storage(endpoint *url.URL, bucket, region, prefix string, creds awsCredentials) *s3Storage {
+	return &s3Storage{
+		endpoint: endpoint,
+		bucket:   bucket,
+		region:   region,
+		prefix:   prefix,
+		creds:    creds,
+		client:   &http.Client{Timeout: certStorageTimeout},
+		now:      time.Now,
+	}
+}
+
+func (s *s3Storage) key(key string) string {
+	return joinStorageKey(s.prefix, key)
+}
+
+func (s *s3Storage) Store(ctx context.Context, key string, value []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.key(key), nil, value, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.key(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	keys, _, err := s.listObjects(ctx, s.key(key)+"/", "")
+	if err != nil {
+		return err
+	}
+	for _, object := range append(keys, s.key(key)) {
+		resp, err := s.do(ctx, http.MethodDelete, object, nil, nil, nil)
+		if err != nil && err != fs.ErrNotExist {
+			return err
+		}
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+func (s *s3Storage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	base := s.key(path)
+	delimiter := "/"
+	if recursive {
+		delimiter = ""
+	}
+	keys, prefixes, err := s.listObjects(ctx, joinStorageKey(base, "")+"/", delimiter)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && len(prefixes) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	seen := map[string]struct{}{}
+	for _, key := range append(keys, prefixes...) {
+		dirs := storageDirs(base, key)
+		if !recursive {
+			dirs = dirs[:1]
+		}
+		for _, dir := range dirs {
+			seen[strings.TrimPrefix(strings.TrimPrefix(dir, s.prefix), "/")] = struct{}{}
+		}
+	}
+	list := make([]string, 0, len(seen))
+	for key := range seen {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.key(key), nil, nil, nil)
+	if err == nil {
+		_ = resp.Body.Close()
+		modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return certmagic.KeyInfo{Key: key, Modified: modified, Size: resp.ContentLength, IsTerminal: true}, nil
+	}
+	if err != fs.ErrNotExist {
+		return certmagic.KeyInfo{}, err
+	}
+	keys, _, err := s.listObjects(ctx, s.key(key)+"/", "")
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if len(keys) == 0 {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{Key: key}, nil
+}
+
+func (s *s3Storage) lockKey(name string) string {
+	return s.key("locks/" + name + ".lock")
+}
+
+func (s *s3Storage) Lock(ctx context.Context, name string) error {
+	token, err := newLockToken()
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := s.do(ctx, http.MethodPut, s.lockKey(name), nil, []byte(token), http.Header{"If-None-Match": {"*"}})
+		if err == nil {
+			_ = resp.Body.Close()
+			s.leases.hold(name, token, func(ctx context.Context) error {
+				resp, err := s.do(ctx, http.MethodPut, s.lockKey(name), nil, []byte(token), nil)
+				if err != nil {
+					return err
+				}
+				return resp.Body.Close()
+			})
+			return nil
+		}
+		var s3Err *s3Error
+		if !asS3Error(err, &s3Err) || (s3Err.Status != http.StatusPreconditionFailed && s3Err.Status != http.StatusConflict) {
+			return err
+		}
+		if err := s.clearStaleLock(ctx, name); err != nil {
+			return err
+		}
+		if err := waitForLock(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// clearStaleLock deletes the lock for name when its holder has not renewed
+// it for lockLeaseTTL.
+func (s *s3Storage) clearStaleLock(ctx context.Context, name string) error {
+	info, err := s.Stat(ctx, "locks/"+name+".lock")
+	if err == fs.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Modified.IsZero() || s.now().Sub(info.Modified) < lockLeaseTTL {
+		return nil
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.lockKey(name), nil, nil, nil)
+	if err != nil && err != fs.ErrNotExist {
+		return err
+	}
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *s3Storage) Unlock(ctx context.Context, name string) error {
+	if _, ok := s.leases.release(name); !ok {
+		return fmt.Errorf("lock %s is not held", name)
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.lockKey(name), nil, nil, nil)
+	if err != nil && err != fs.ErrNotExist {
+		return err
+	}
+	if resp != nil {
+		_ = resp.Body.Close()
+	}
+	return nil
+}
+
+// listObjects pages through ListObjectsV2 under prefix, returning object
+// keys and, with a delimiter, the common prefixes without their trailing
+// delimiter.
+func (s *s3Storage) listObjects(ctx context.Context, prefix, delimiter string) ([]string, []string, error) {
+	var keys, prefixes []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err == fs.ErrNotExist {
+			return nil, nil, fmt.Errorf("s3 bucket %s not found", s.bucket)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, common := range page.CommonPrefixes {
+			prefixes = append(prefixes, strings.TrimSuffix(common.Prefix, delimiter))
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, prefixes, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// s3Error is an S3 error response other than a missing key, which do reports
+// as fs.ErrNotExist.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s %s", e.Status, e.Code, e.Message)
+}
+
+func asS3Error(err error, target **s3Error) bool {
+	e, ok := err.(*s3Error)
+	if ok {
+		*target = e
+	}
+	return ok
+}
+
+// do sends a signed request for key in the bucket, or for the bucket itself
+// when key is empty. A 404 is returned as fs.ErrNotExist.
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := *s.endpoint
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + s.bucket
+	if key != "" {
+		target.Path += "/" + key
+	}
+	target.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payload := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+	signAWSv4(req, body, s.creds, s.region, "s3", s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, fs.ErrNotExist
+	}
+	failure := &s3Error{Status: resp.StatusCode}
+	_ = xml.NewDecoder(resp.Body).Decode(&struct {
+		Code    *string `xml:"Code"`
+		Message *string `xml:"Message"`
+	}{&failure.Code, &failure.Message})
+	return nil, failure
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// saturation counts the work in progress that /metrics reports when
+// METRICS_SATURATION is set, so an autoscaler can scale on load instead of
+// CPU.
+var saturation = &saturationGauges{}
+
+type saturationGauges struct {
+	inFlight    atomic.Int64
+	uploads     atomic.Int64
+	rateLimited atomic.Int64
+}
+
+// trackInFlight counts requests, and blob upload requests separately, while
+// they are served. Health checks and scrapes are left out so they never show
+// up as load.
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		saturation.inFlight.Add(1)
+		defer saturation.inFlight.Add(-1)
+		if route, ok := parseRegistryPath(r.URL.Path); ok && route.isUpload() {
+			saturation.uploads.Add(1)
+			defer saturation.uploads.Add(-1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *saturationGauges) write(w io.Writer) {
+	fmt.Fprintln(w, "# HELP containervault_inflight_requests Requests being served, excluding health checks and scrapes.")
+	fmt.Fprintln(w, "# TYPE containervault_inflight_requests gauge")
+	fmt.Fprintf(w, "containervault_inflight_requests %d\n", s.inFlight.Load())
+	fmt.Fprintln(w, "# HELP containervault_inflight_uploads Blob upload requests being served.")
+	fmt.Fprintln(w, "# TYPE containervault_inflight_uploads gauge")
+	fmt.Fprintf(w, "containervault_inflight_uploads %d\n", s.uploads.Load())
+	fmt.Fprintln(w, "# HELP containervault_ldap_binds_in_flight LDAP binds holding one of the LDAP_MAX_CONCURRENT_BINDS slots.")
+	fmt.Fprintln(w, "# TYPE containervault_ldap_binds_in_flight gauge")
+	fmt.Fprintf(w, "containervault_ldap_binds_in_flight %d\n", ldapBinds.inUse())
+	fmt.Fprintln(w, "# HELP containervault_ldap_bind_waiting LDAP binds waiting for a free slot.")
+	fmt.Fprintln(w, "# TYPE containervault_ldap_bind_waiting gauge")
+	fmt.Fprintf(w, "containervault_ldap_bind_waiting %d\n", ldapBinds.waiters())
+	fmt.Fprintln(w, "# HELP containervault_rate_limited_requests_total Registry requests refused by the per-repository rate limit.")
+	fmt.Fprintln(w, "# TYPE containervault_rate_limited_requests_total counter")
+	fmt.Fprintf(w, "containervault_rate_limited_requests_total %d\n", s.rateLimited.Load())
+}
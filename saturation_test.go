@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func withSaturationGauges(t *testing.T) {
+	t.Helper()
+	prev := saturation
+	saturation = &saturationGauges{}
+	t.Cleanup(func() { saturation = prev })
+}
+
+// waitForMetric scrapes /metrics until it contains line.
+func waitForMetric(t *testing.T, line string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		body := serveUnauthenticated(t, "/metrics", "").Body.String()
+		if strings.Contains(body, line+"\n") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %q in metrics, got:\n%s", line, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInFlightGaugeFollowsRequests(t *testing.T) {
+	withSaturationGauges(t)
+	withHealthConfig(t, healthConfig{Enabled: true, SaturationMetrics: true})
+	release := make(chan struct{})
+	withProxyUpstream(t, nil)
+	proxyTransport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		<-release
+		return proxyTestResponse(r, http.StatusAccepted, nil, ""), nil
+	})
+	router := cvRouter()
+
+	var done sync.WaitGroup
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/v2/team1/app/manifests/latest"},
+		{http.MethodGet, "/v2/team1/app/manifests/v1"},
+		{http.MethodPatch, "/v2/team1/app/blobs/uploads/session-1"},
+	} {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			r := httptest.NewRequest(req.method, req.path, strings.NewReader("chunk"))
+			r.SetBasicAuth("alice", "secret")
+			router.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+	}
+	waitForMetric(t, "containervault_inflight_requests 3")
+	waitForMetric(t, "containervault_inflight_uploads 1")
+
+	close(release)
+	done.Wait()
+	waitForMetric(t, "containervault_inflight_requests 0")
+	waitForMetric(t, "containervault_inflight_uploads 0")
+}
+
+func TestSaturationMetricsOnlyWhenEnabled(t *testing.T) {
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+
+	if body := serveUnauthenticated(t, "/metrics", "").Body.String(); strings.Contains(body, "containervault_inflight_requests") {
+		t.Fatalf("expected no saturation gauges without METRICS_SATURATION, got:\n%s", body)
+	}
+}
+
+func TestBindLimiterReportsWaiters(t *testing.T) {
+	limiter := newBindLimiter(1, time.Second)
+	release, err := limiter.acquire()
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	acquired := make(chan struct{})
+	go func() {
+		next, err := limiter.acquire()
+		if err == nil {
+			next()
+		}
+		close(acquired)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for limiter.waiters() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one waiting bind, got %d", limiter.waiters())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if limiter.inUse() != 1 {
+		t.Fatalf("expected one slot in use, got %d", limiter.inUse())
+	}
+	release()
+	<-acquired
+	if limiter.waiters() != 0 || limiter.inUse() != 0 {
+		t.Fatalf("expected an idle limiter, got %d waiting and %d in use", limiter.waiters(), limiter.inUse())
+	}
+}
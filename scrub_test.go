@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobScrubberFlagsCorruptedBlob(t *testing.T) {
+	root := t.TempDir()
+	good := writeTestBlob(t, root, []byte("layer contents"), nil)
+	bad := writeTestBlob(t, root, []byte("original contents"), []byte("bit rot"))
+
+	scrubber := newBlobScrubber(scrubConfig{StorageRoot: root, Interval: time.Hour})
+	result, err := scrubber.scrub(context.Background())
+	if err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+	if result.Scanned != 2 {
+		t.Fatalf("expected 2 blobs scanned, got %d", result.Scanned)
+	}
+	if len(result.Corrupted) != 1 || result.Corrupted[0] != bad {
+		t.Fatalf("expected %s to be flagged, got %v", bad, result.Corrupted)
+	}
+	for _, digest := range result.Corrupted {
+		if digest == good {
+			t.Fatalf("expected %s to verify", good)
+		}
+	}
+	if scrubber.corrupted.Load() != 1 || scrubber.scanned.Load() != 2 {
+		t.Fatalf("unexpected counters: scanned=%d corrupted=%d", scrubber.scanned.Load(), scrubber.corrupted.Load())
+	}
+}
+
+func TestBlobScrubCountersOnMetrics(t *testing.T) {
+	root := t.TempDir()
+	writeTestBlob(t, root, []byte("layer contents"), nil)
+	writeTestBlob(t, root, []byte("original contents"), []byte("bit rot"))
+	prev := blobScrub
+	blobScrub = newBlobScrubber(scrubConfig{StorageRoot: root, Interval: time.Hour})
+	t.Cleanup(func() { blobScrub = prev })
+	withHealthConfig(t, healthConfig{Enabled: true})
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	defer cleanup()
+
+	if _, err := blobScrub.scrub(context.Background()); err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+	body := serveUnauthenticated(t, "/metrics", "").Body.String()
+	for _, line := range []string{
+		"containervault_blob_scrub_scanned_total 2",
+		"containervault_blob_scrub_corrupted_total 1",
+		"containervault_blob_scrub_errors_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expected %q in metrics, got:\n%s", line, body)
+		}
+	}
+
+	blobScrub = newBlobScrubber(scrubConfig{Interval: time.Hour})
+	if body := serveUnauthenticated(t, "/metrics", "").Body.String(); strings.Contains(body, "containervault_blob_scrub") {
+		t.Fatalf("expected no scrub counters without SCRUB_STORAGE_ROOT")
+	}
+}
+
+func TestBlobScrubberMissingStorageRoot(t *testing.T) {
+	scrubber := newBlobScrubber(scrubConfig{StorageRoot: filepath.Join(t.TempDir(), "missing"), Interval: time.Hour})
+	result, err := scrubber.scrub(context.Background())
+	if err != nil {
+		t.Fatalf("expected missing root to be ignored, got %v", err)
+	}
+	if result.Scanned != 0 {
+		t.Fatalf("expected no blobs scanned, got %d", result.Scanned)
+	}
+}
+
+func TestBlobScrubberThrottlesReads(t *testing.T) {
+	root := t.TempDir()
+	writeTestBlob(t, root, []byte(strings.Repeat("x", 4096)), nil)
+
+	var slept time.Duration
+	scrubber := newBlobScrubber(scrubConfig{StorageRoot: root, Interval: time.Hour, BytesPerSecond: 1024})
+	scrubber.sleep = func(d time.Duration) { slept += d }
+	if _, err := scrubber.scrub(context.Background()); err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+	if slept < 3*time.Second {
+		t.Fatalf("expected throttled read to wait ~4s, waited %s", slept)
+	}
+}
+
+func TestLoadScrubConfig(t *testing.T) {
+	t.Setenv("SCRUB_STORAGE_ROOT", "/var/lib/registry")
+	t.Setenv("SCRUB_INTERVAL", "6h")
+	t.Setenv("SCRUB_RATE_BYTES", "1048576")
+	cfg := loadScrubConfig()
+	if cfg.StorageRoot != "/var/lib/registry" || cfg.Interval != 6*time.Hour || cfg.BytesPerSecond != 1048576 {
+		t.Fatalf("unexpected scrub config: %#v", cfg)
+	}
+	if !newBlobScrubber(cfg).enabled() {
+		t.Fatalf("expected scrubber enabled")
+	}
+	if newBlobScrubber(scrubConfig{Interval: time.Hour}).enabled() {
+		t.Fatalf("expected scrubber disabled without storage root")
+	}
+}
+
+// writeTestBlob stores content under its digest and optionally overwrites it with corrupt bytes.
+func writeTestBlob(t *testing.T, root string, content, corrupt []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	hexDigest := hex.EncodeToString(sum[:])
+	dir := filepath.Join(root, "docker", "registry", "v2", "blobs", "sha256", hexDigest[:2], hexDigest)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir blob dir: %v", err)
+	}
+	data := content
+	if corrupt != nil {
+		data = corrupt
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), data, 0o600); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return "sha256:" + hexDigest
+}
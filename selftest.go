@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// selfTestConfig describes the canary login main performs at boot when
+// STARTUP_SELFTEST is set: a bind as Username that must resolve at least
+// ExpectGroups. Required refuses to start when it fails.
+type selfTestConfig struct {
+	Enabled      bool
+	Username     string
+	Password     string
+	ExpectGroups []string
+	Required     bool
+}
+
+func loadSelfTestConfig() selfTestConfig {
+	return selfTestConfig{
+		Enabled:      getEnvBool("STARTUP_SELFTEST", false),
+		Username:     strings.TrimSpace(os.Getenv("STARTUP_SELFTEST_USERNAME")),
+		Password:     getEnvSecret("STARTUP_SELFTEST_PASSWORD"),
+		ExpectGroups: splitCommaList(os.Getenv("STARTUP_SELFTEST_EXPECT_GROUPS")),
+		Required:     getEnvBool("STARTUP_SELFTEST_REQUIRED", false),
+	}
+}
+
+// runSelfTest binds as the canary account through ldapAuth, as a registry
+// login would, and checks that every expected group was resolved.
+func runSelfTest(cfg selfTestConfig) error {
+	if cfg.Username == "" || cfg.Password == "" {
+		return fmt.Errorf("STARTUP_SELFTEST_USERNAME and STARTUP_SELFTEST_PASSWORD must be set")
+	}
+	_, access, err := ldapAuth(cfg.Username, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("bind as %s failed: %w", cfg.Username, err)
+	}
+	resolved := make([]string, 0, len(access))
+	for _, a := range access {
+		resolved = append(resolved, a.Group)
+	}
+	var missing []string
+	for _, group := range cfg.ExpectGroups {
+		if !slices.Contains(resolved, group) {
+			missing = append(missing, group)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s resolved groups [%s], missing %s", cfg.Username, strings.Join(resolved, ", "), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// startupSelfTest runs the self-test when enabled and logs the outcome. The
+// error is only returned when the test failed and STARTUP_SELFTEST_REQUIRED
+// is set, so main can refuse to start.
+func startupSelfTest(cfg selfTestConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if err := runSelfTest(cfg); err != nil {
+		log.Printf("startup self-test failed: %v", err)
+		if cfg.Required {
+			return err
+		}
+		return nil
+	}
+	log.Printf("startup self-test passed: %s resolved %d expected groups", cfg.Username, len(cfg.ExpectGroups))
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func withSelfTestLDAP(t *testing.T, groups []string, err error) {
+	t.Helper()
+	prev := ldapAuth
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		if err != nil {
+			return nil, nil, err
+		}
+		if username != "canary" || password != "secret" {
+			return nil, nil, errLDAPInvalidCredentials
+		}
+		var access []Access
+		for _, group := range groups {
+			access = append(access, Access{Group: group, Namespace: group})
+		}
+		return &User{Name: username}, access, nil
+	}
+	t.Cleanup(func() { ldapAuth = prev })
+}
+
+func TestStartupSelfTestPassesWhenGroupsResolve(t *testing.T) {
+	withSelfTestLDAP(t, []string{"team1_rw", "team2_r"}, nil)
+	cfg := selfTestConfig{Enabled: true, Username: "canary", Password: "secret", ExpectGroups: []string{"team1_rw", "team2_r"}, Required: true}
+	if err := startupSelfTest(cfg); err != nil {
+		t.Fatalf("expected the self-test to pass: %v", err)
+	}
+}
+
+func TestStartupSelfTestFailures(t *testing.T) {
+	withSelfTestLDAP(t, []string{"team1_rw"}, nil)
+	cfg := selfTestConfig{Enabled: true, Username: "canary", Password: "secret", ExpectGroups: []string{"team1_rw", "team2_r"}}
+	if err := runSelfTest(cfg); err == nil || !strings.Contains(err.Error(), "missing team2_r") {
+		t.Fatalf("expected a missing group to fail the self-test, got %v", err)
+	}
+	if err := startupSelfTest(cfg); err != nil {
+		t.Fatalf("expected a failure to only be logged without STARTUP_SELFTEST_REQUIRED, got %v", err)
+	}
+	cfg.Required = true
+	if err := startupSelfTest(cfg); err == nil {
+		t.Fatalf("expected a required self-test failure to block startup")
+	}
+
+	cfg.ExpectGroups = []string{"team1_rw"}
+	cfg.Password = "wrong"
+	if err := startupSelfTest(cfg); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("expected the bind failure to block startup, got %v", err)
+	}
+
+	withSelfTestLDAP(t, nil, errLDAPBusy)
+	cfg.Password = "secret"
+	if err := startupSelfTest(cfg); !errors.Is(err, errLDAPBusy) {
+		t.Fatalf("expected an unreachable directory to block startup, got %v", err)
+	}
+
+	cfg.Username = ""
+	if err := startupSelfTest(cfg); err == nil || !strings.Contains(err.Error(), "STARTUP_SELFTEST_USERNAME") {
+		t.Fatalf("expected a missing canary account to fail, got %v", err)
+	}
+}
+
+func TestStartupSelfTestDisabledByDefault(t *testing.T) {
+	t.Setenv("STARTUP_SELFTEST_USERNAME", "canary")
+	unsetEnv(t, "STARTUP_SELFTEST")
+	withSelfTestLDAP(t, nil, errLDAPBusy)
+	cfg := loadSelfTestConfig()
+	if cfg.Enabled {
+		t.Fatalf("expected the self-test to be off by default")
+	}
+	if err := startupSelfTest(cfg); err != nil {
+		t.Fatalf("expected a disabled self-test not to run, got %v", err)
+	}
+}
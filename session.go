@@ -60,6 +60,9 @@ func namespacesFromAccess(access []Access) []string {
 	seen := make(map[string]struct{})
 	var namespaces []string
 	for _, a := range access {
+		if a.AllNamespaces {
+			continue
+		}
 		if _, ok := seen[a.Namespace]; ok {
 			continue
 		}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	sigstoreBundlePrefix        = "application/vnd.dev.sigstore.bundle"
+)
+
+type signatureEntry struct {
+	signed  bool
+	expires time.Time
+}
+
+// signatureCache remembers whether a manifest digest has a cosign signature,
+// so the tag API does not repeat the referrers lookup for every tag on every
+// page load. Entries expire after ttl so signatures added later show up.
+type signatureCache struct {
+	enabled bool
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]signatureEntry
+}
+
+func newSignatureCache(enabled bool, ttl time.Duration) *signatureCache {
+	return &signatureCache{enabled: enabled, ttl: ttl, now: time.Now, entries: map[string]signatureEntry{}}
+}
+
+// signed reports whether digest in repo has a cosign signature, either as an
+// OCI referrer or under cosign's sha256-<hex>.sig tag.
+func (c *signatureCache) signed(ctx context.Context, client *http.Client, repo, digest string) (bool, error) {
+	key := repo + "@" + digest
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.signed, nil
+	}
+
+	signed, err := lookupSignature(ctx, client, repo, digest)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.entries[key] = signatureEntry{signed: signed, expires: c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return signed, nil
+}
+
+// approve marks digest as covered by a signature found elsewhere, e.g. on the
+// index that lists it.
+func (c *signatureCache) approve(repo, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[repo+"@"+digest] = signatureEntry{signed: true, expires: c.now().Add(c.ttl)}
+}
+
+func lookupSignature(ctx context.Context, client *http.Client, repo, digest string) (bool, error) {
+	tag, err := referrersTag(digest)
+	if err != nil {
+		return false, err
+	}
+	index, err := fetchReferrersIndex(ctx, client, repo, tag)
+	if err != nil {
+		return false, err
+	}
+	for _, desc := range index.Manifests {
+		if desc.ArtifactType == cosignSignatureArtifactType || strings.HasPrefix(desc.ArtifactType, sigstoreBundlePrefix) {
+			return true, nil
+		}
+	}
+	_, status, _, err := fetchTagDigest(ctx, repo, tag+".sig")
+	if err != nil {
+		return false, err
+	}
+	return status == 0, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withTagSignatures(t *testing.T) *signatureCache {
+	t.Helper()
+	prev := tagSignatures
+	tagSignatures = newSignatureCache(true, time.Minute)
+	t.Cleanup(func() { tagSignatures = prev })
+	return tagSignatures
+}
+
+func seedSignatureReferrer(t *testing.T, reg *fakeRegistry, repo, subject string) {
+	t.Helper()
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexMedia, Manifests: []ociDescriptor{{
+		MediaType:    ociManifestType,
+		Digest:       testDigest([]byte("signature")),
+		Size:         9,
+		ArtifactType: cosignSignatureArtifactType,
+	}}})
+	if err != nil {
+		t.Fatalf("marshal index: %v", err)
+	}
+	reg.manifests[repo+":"+strings.Replace(subject, ":", "-", 1)] = index
+	reg.types[testDigest(index)] = ociIndexMedia
+}
+
+func TestTagInfoReportsSignature(t *testing.T) {
+	withTagSignatures(t)
+	reg := newFakeRegistry()
+	signed := newTestRegistryImage(t, "signed-layer")
+	unsigned := newTestRegistryImage(t, "unsigned-layer")
+	reg.seed("team1/app", "signed", signed)
+	reg.seed("team1/app", "unsigned", unsigned)
+	seedSignatureReferrer(t, reg, "team1/app", signed.ManifestDigest)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	for tag, want := range map[string]bool{"signed": true, "unsigned": false} {
+		info, err := fetchTagInfo(context.Background(), "team1/app", tag)
+		if err != nil {
+			t.Fatalf("fetchTagInfo(%s): %v", tag, err)
+		}
+		if info.Signed == nil || *info.Signed != want {
+			t.Fatalf("expected %s to report signed=%v, got %v", tag, want, info.Signed)
+		}
+	}
+}
+
+func TestTagInfoDetectsCosignSignatureTag(t *testing.T) {
+	withTagSignatures(t)
+	reg := newFakeRegistry()
+	image := newTestRegistryImage(t, "layer")
+	reg.seed("team1/app", "latest", image)
+	reg.seed("team1/app", strings.Replace(image.ManifestDigest, ":", "-", 1)+".sig", newTestRegistryImage(t, "signature"))
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	info, err := fetchTagInfo(context.Background(), "team1/app", "latest")
+	if err != nil {
+		t.Fatalf("fetchTagInfo: %v", err)
+	}
+	if info.Signed == nil || !*info.Signed {
+		t.Fatalf("expected the .sig tag to mark the image signed, got %v", info.Signed)
+	}
+}
+
+func TestSignatureLookupIsCached(t *testing.T) {
+	cache := withTagSignatures(t)
+	lookups := 0
+	reg := newFakeRegistry()
+	cleanup := withUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		reg.ServeHTTP(w, r)
+	})
+	defer cleanup()
+
+	client := &http.Client{Timeout: time.Second}
+	digest := testDigest([]byte("manifest"))
+	for i := 0; i < 3; i++ {
+		if signed, err := cache.signed(context.Background(), client, "team1/app", digest); err != nil || signed {
+			t.Fatalf("expected unsigned, got %v, %v", signed, err)
+		}
+	}
+	if lookups != 2 {
+		t.Fatalf("expected one referrers and one tag lookup, got %d requests", lookups)
+	}
+
+	now := time.Now().Add(2 * time.Minute)
+	cache.now = func() time.Time { return now }
+	if _, err := cache.signed(context.Background(), client, "team1/app", digest); err != nil {
+		t.Fatalf("signed: %v", err)
+	}
+	if lookups != 4 {
+		t.Fatalf("expected an expired entry to be looked up again, got %d requests", lookups)
+	}
+}
+
+func TestTagInfoOmitsSignatureWhenDisabled(t *testing.T) {
+	reg := newFakeRegistry()
+	reg.seed("team1/app", "latest", newTestRegistryImage(t, "layer"))
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	defer cleanup()
+
+	info, err := fetchTagInfo(context.Background(), "team1/app", "latest")
+	if err != nil {
+		t.Fatalf("fetchTagInfo: %v", err)
+	}
+	if info.Signed != nil {
+		t.Fatalf("expected no signed field when TAG_SIGNATURES is off")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// signatureArtifactTag matches cosign's sha256-<hex>.sig/.att/.sbom tags and
+// the OCI referrers fallback tag, which are never signed themselves.
+var signatureArtifactTag = regexp.MustCompile(`^sha256-[0-9a-f]{64}(\.(sig|att|sbom))?$`)
+
+// signedPullRequired reports whether repo is in SIGNED_PULL_NAMESPACES.
+func signedPullRequired(repo string) bool {
+	namespace, _, _ := strings.Cut(repo, "/")
+	return slices.Contains(signedPullNamespaces, namespace)
+}
+
+// requireSignedManifest refuses manifest pulls from SIGNED_PULL_NAMESPACES
+// whose digest has no cosign signature. Signatures and other artifacts
+// attached through a subject are served, so clients can verify. Children of
+// a signed index are approved along with it, since cosign signs the index.
+// HEAD only reveals the digest and is left alone.
+func requireSignedManifest(resp *http.Response) error {
+	if len(signedPullNamespaces) == 0 || resp.Request == nil || resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || route.Kind != registryKindManifests || !signedPullRequired(route.Repo) || signatureArtifactTag.MatchString(route.Reference) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if len(body) > maxManifestBytes {
+		return replaceWithRegistryError(resp, http.StatusForbidden, "DENIED", "manifest too large to verify")
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		sum := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	status, message := manifestSignatureRefusal(resp.Request.Context(), route.Repo, digest, resp.Header.Get("Content-Type"), body)
+	switch status {
+	case 0:
+	case http.StatusServiceUnavailable:
+		return replaceWithRegistryError(resp, status, "UNAVAILABLE", message)
+	default:
+		return replaceWithRegistryError(resp, status, "DENIED", message)
+	}
+	return nil
+}
+
+// manifestSignatureRefusal checks a manifest from a SIGNED_PULL_NAMESPACES
+// repo, with the given digest and content type, for a cosign signature. It
+// returns the status and message to refuse it with, or zero when it may be
+// served.
+func manifestSignatureRefusal(ctx context.Context, repo, digest, contentType string, body []byte) (int, string) {
+	var manifest referrerManifest
+	if err := json.Unmarshal(body, &manifest); err == nil && manifest.Subject != nil {
+		return 0, ""
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	signed, err := tagSignatures.signed(ctx, client, repo, digest)
+	if err != nil {
+		log.Printf("signature check for %s@%s failed: %v", repo, digest, err)
+		return http.StatusServiceUnavailable, "unable to verify image signature"
+	}
+	if !signed {
+		return http.StatusForbidden, fmt.Sprintf("%s@%s is not signed", repo, digest)
+	}
+	if isManifestListContentType(contentType) {
+		var index ociIndex
+		if err := json.Unmarshal(body, &index); err == nil {
+			for _, child := range index.Manifests {
+				tagSignatures.approve(repo, child.Digest)
+			}
+		}
+	}
+	return 0, ""
+}
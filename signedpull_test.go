@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withSignedPullNamespaces(t *testing.T, namespaces ...string) {
+	t.Helper()
+	withTagSignatures(t)
+	prev := signedPullNamespaces
+	signedPullNamespaces = namespaces
+	t.Cleanup(func() { signedPullNamespaces = prev })
+}
+
+func newSignedPullRegistry(t *testing.T) (*fakeRegistry, testRegistryImage, testRegistryImage) {
+	t.Helper()
+	reg := newFakeRegistry()
+	signed := newTestRegistryImage(t, "signed-layer")
+	unsigned := newTestRegistryImage(t, "unsigned-layer")
+	reg.seed("team1/app", "signed", signed)
+	reg.seed("team1/app", "unsigned", unsigned)
+	seedSignatureReferrer(t, reg, "team1/app", signed.ManifestDigest)
+	reg.seed("team1/app", strings.Replace(signed.ManifestDigest, ":", "-", 1)+".sig", newTestRegistryImage(t, "signature"))
+	withProxyUpstream(t, reg.roundTrip)
+	cleanup := withUpstream(t, reg.ServeHTTP)
+	t.Cleanup(cleanup)
+	return reg, signed, unsigned
+}
+
+func TestSignedPullNamespaceServesSignedImage(t *testing.T) {
+	withSignedPullNamespaces(t, "team1")
+	_, signed, _ := newSignedPullRegistry(t)
+
+	for _, ref := range []string{"signed", signed.ManifestDigest} {
+		rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+ref)
+		if rec.Code != http.StatusOK || rec.Body.String() != string(signed.Manifest) {
+			t.Fatalf("expected signed manifest for %s, got %d: %s", ref, rec.Code, rec.Body.String())
+		}
+	}
+	sigTag := strings.Replace(signed.ManifestDigest, ":", "-", 1) + ".sig"
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+sigTag); rec.Code != http.StatusOK {
+		t.Fatalf("expected the signature itself to be pullable, got %d", rec.Code)
+	}
+}
+
+func TestSignedPullNamespaceRejectsUnsignedImage(t *testing.T) {
+	withSignedPullNamespaces(t, "team1")
+	_, _, unsigned := newSignedPullRegistry(t)
+
+	for _, ref := range []string{"unsigned", unsigned.ManifestDigest} {
+		rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+ref)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for unsigned %s, got %d", ref, rec.Code)
+		}
+		var payload registryErrorResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil || len(payload.Errors) != 1 || payload.Errors[0].Code != "DENIED" {
+			t.Fatalf("expected DENIED envelope, got %s", rec.Body.String())
+		}
+		if strings.Contains(rec.Body.String(), "schemaVersion") {
+			t.Fatalf("expected the manifest not to be served")
+		}
+	}
+}
+
+func TestSignedPullOtherNamespacesUnaffected(t *testing.T) {
+	withSignedPullNamespaces(t, "prod")
+	_, _, unsigned := newSignedPullRegistry(t)
+
+	rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/unsigned")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(unsigned.Manifest) {
+		t.Fatalf("expected unsigned image outside signed namespaces to be served, got %d", rec.Code)
+	}
+}
+
+func TestSignedIndexApprovesChildManifests(t *testing.T) {
+	withSignedPullNamespaces(t, "team1")
+	reg, _, unsigned := newSignedPullRegistry(t)
+	index, err := json.Marshal(ociIndex{SchemaVersion: 2, MediaType: ociIndexMedia, Manifests: []ociDescriptor{{
+		MediaType: ociManifestType,
+		Digest:    unsigned.ManifestDigest,
+		Size:      int64(len(unsigned.Manifest)),
+	}}})
+	if err != nil {
+		t.Fatalf("marshal index: %v", err)
+	}
+	indexDigest := testDigest(index)
+	reg.manifests["team1/app:multi"] = index
+	reg.manifests["team1/app:"+indexDigest] = index
+	reg.types[indexDigest] = ociIndexMedia
+	seedSignatureReferrer(t, reg, "team1/app", indexDigest)
+
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/multi"); rec.Code != http.StatusOK {
+		t.Fatalf("expected signed index to be served, got %d", rec.Code)
+	}
+	if rec := serveProxyRequest(t, http.MethodGet, "/v2/team1/app/manifests/"+unsigned.ManifestDigest); rec.Code != http.StatusOK {
+		t.Fatalf("expected the signed index's child to be served, got %d", rec.Code)
+	}
+}
+
+func TestSignedPullNamespaceRefusesUnsignedExport(t *testing.T) {
+	withSignedPullNamespaces(t, "team1")
+	newSignedPullRegistry(t)
+	token := seedSession(t, "alice", []string{"team1"})
+
+	rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/unsigned/export")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "is not signed") {
+		t.Fatalf("expected 403 for an unsigned export, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serveExportRequest(t, token, "/api/repos/team1/app/tags/signed/export"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the signed image to export, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type storageConfig struct {
+	// Root is the registry filesystem root, the same directory the registry
+	// uses as REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY.
+	Root     string
+	CacheTTL time.Duration
+}
+
+// loadStorageRoot reads the registry filesystem root shared by the storage
+// summary, the blob scrubber and blob GC. SCRUB_STORAGE_ROOT predates
+// STORAGE_ROOT and is still honoured when only it is set.
+func loadStorageRoot() string {
+	if root := strings.TrimSpace(os.Getenv("STORAGE_ROOT")); root != "" {
+		return root
+	}
+	return strings.TrimSpace(os.Getenv("SCRUB_STORAGE_ROOT"))
+}
+
+func loadStorageConfig() storageConfig {
+	return storageConfig{
+		Root:     loadStorageRoot(),
+		CacheTTL: getEnvDuration("STORAGE_SUMMARY_TTL", time.Minute),
+	}
+}
+
+type storageSummary struct {
+	TotalBytes    int64                     `json:"total_bytes"`
+	BlobCount     int                       `json:"blob_count"`
+	ManifestCount int                       `json:"manifest_count"`
+	Namespaces    []namespaceStorageSummary `json:"namespaces"`
+	ComputedAt    time.Time                 `json:"computed_at"`
+}
+
+// namespaceStorageSummary counts the distinct blobs linked from the
+// namespace's repositories. Blobs shared between namespaces are counted in
+// each of them, so namespace bytes can add up to more than TotalBytes.
+type namespaceStorageSummary struct {
+	Namespace     string `json:"namespace"`
+	Repositories  int    `json:"repositories"`
+	Bytes         int64  `json:"bytes"`
+	BlobCount     int    `json:"blob_count"`
+	ManifestCount int    `json:"manifest_count"`
+}
+
+// storageReporter computes storage summaries and caches them for CacheTTL.
+type storageReporter struct {
+	cfg storageConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	cached   *storageSummary
+	cachedAt time.Time
+}
+
+func newStorageReporter(cfg storageConfig) *storageReporter {
+	return &storageReporter{cfg: cfg, now: time.Now}
+}
+
+func (s *storageReporter) summary() (storageSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cached != nil && s.now().Sub(s.cachedAt) < s.cfg.CacheTTL {
+		return *s.cached, nil
+	}
+	summary, err := computeStorageSummary(s.cfg.Root)
+	if err != nil {
+		return storageSummary{}, err
+	}
+	summary.ComputedAt = s.now().UTC()
+	s.cached = &summary
+	s.cachedAt = s.now()
+	return summary, nil
+}
+
+type namespaceUsage struct {
+	repos     map[string]struct{}
+	blobs     map[string]struct{}
+	manifests map[string]struct{}
+}
+
+// computeStorageSummary walks the registry's blob store for sizes and its
+// repository link files for per-namespace usage.
+func computeStorageSummary(root string) (storageSummary, error) {
+	v2 := filepath.Join(root, "docker", "registry", "v2")
+	blobsDir := filepath.Join(v2, "blobs")
+	sizes := map[string]int64{}
+	var summary storageSummary
+
+	err := filepath.WalkDir(blobsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		digest, ok := blobDigestFromPath(blobsDir, path)
+		if !ok {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sizes[digest] = info.Size()
+		summary.TotalBytes += info.Size()
+		summary.BlobCount++
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return storageSummary{}, err
+	}
+
+	reposDir := filepath.Join(v2, "repositories")
+	usage := map[string]*namespaceUsage{}
+	manifests := map[string]struct{}{}
+	err = filepath.WalkDir(reposDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == "_uploads" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "link" {
+			return nil
+		}
+		rel, err := filepath.Rel(reposDir, path)
+		if err != nil {
+			return nil
+		}
+		repo, digest, isManifest, ok := parseRepositoryLink(filepath.ToSlash(rel))
+		if !ok {
+			return nil
+		}
+		namespace, _, _ := strings.Cut(repo, "/")
+		ns := usage[namespace]
+		if ns == nil {
+			ns = &namespaceUsage{repos: map[string]struct{}{}, blobs: map[string]struct{}{}, manifests: map[string]struct{}{}}
+			usage[namespace] = ns
+		}
+		ns.repos[repo] = struct{}{}
+		ns.blobs[digest] = struct{}{}
+		if isManifest {
+			ns.manifests[digest] = struct{}{}
+			manifests[digest] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return storageSummary{}, err
+	}
+	summary.ManifestCount = len(manifests)
+
+	summary.Namespaces = make([]namespaceStorageSummary, 0, len(usage))
+	for namespace, ns := range usage {
+		entry := namespaceStorageSummary{
+			Namespace:     namespace,
+			Repositories:  len(ns.repos),
+			BlobCount:     len(ns.blobs),
+			ManifestCount: len(ns.manifests),
+		}
+		for digest := range ns.blobs {
+			entry.Bytes += sizes[digest]
+		}
+		summary.Namespaces = append(summary.Namespaces, entry)
+	}
+	sort.Slice(summary.Namespaces, func(i, j int) bool {
+		return summary.Namespaces[i].Namespace < summary.Namespaces[j].Namespace
+	})
+	return summary, nil
+}
+
+// parseRepositoryLink recognizes <repo>/_layers/<alg>/<hex>/link and
+// <repo>/_manifests/revisions/<alg>/<hex>/link. Tag links are ignored since
+// they point at revisions that are already counted.
+func parseRepositoryLink(rel string) (repo, digest string, isManifest, ok bool) {
+	parts := strings.Split(rel, "/")
+	n := len(parts)
+	switch {
+	case n >= 5 && parts[n-4] == "_layers":
+		return strings.Join(parts[:n-4], "/"), parts[n-3] + ":" + parts[n-2], false, true
+	case n >= 6 && parts[n-5] == "_manifests" && parts[n-4] == "revisions":
+		return strings.Join(parts[:n-5], "/"), parts[n-3] + ":" + parts[n-2], true, true
+	default:
+		return "", "", false, false
+	}
+}
+
+func handleAdminStorage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+	if storageReport.cfg.Root == "" {
+		writeAPIError(w, http.StatusServiceUnavailable, "storage root not configured")
+		return
+	}
+	summary, err := storageReport.summary()
+	if err != nil {
+		log.Printf("storage summary failed: %v", err)
+		writeAPIError(w, http.StatusInternalServerError, "storage summary failed")
+		return
+	}
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summary)
+}
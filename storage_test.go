@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedStorageLayout writes two namespaces sharing one layer blob.
+func seedStorageLayout(t *testing.T, root string) map[string]string {
+	t.Helper()
+	digests := map[string]string{
+		"shared":    writeTestBlob(t, root, []byte("shared-layer"), nil),
+		"app":       writeTestBlob(t, root, []byte("app-layer-content"), nil),
+		"appConfig": writeTestBlob(t, root, []byte(`{"os":"linux"}`), nil),
+		"appMan":    writeTestBlob(t, root, []byte(`{"schemaVersion":2,"app":true}`), nil),
+		"webMan":    writeTestBlob(t, root, []byte(`{"schemaVersion":2}`), nil),
+	}
+	writeRepoLink(t, root, "team1/app", "_layers", digests["shared"])
+	writeRepoLink(t, root, "team1/app", "_layers", digests["app"])
+	writeRepoLink(t, root, "team1/app", "_layers", digests["appConfig"])
+	writeRepoLink(t, root, "team1/app", "_manifests/revisions", digests["appMan"])
+	writeRepoLink(t, root, "team1/app", "_manifests/tags/v1/current", digests["appMan"])
+	writeRepoLink(t, root, "team2/web/frontend", "_layers", digests["shared"])
+	writeRepoLink(t, root, "team2/web/frontend", "_manifests/revisions", digests["webMan"])
+
+	uploads := filepath.Join(root, "docker", "registry", "v2", "repositories", "team1", "app", "_uploads", "abc")
+	if err := os.MkdirAll(uploads, 0o755); err != nil {
+		t.Fatalf("mkdir uploads: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(uploads, "link"), []byte("ignored"), 0o600); err != nil {
+		t.Fatalf("write upload link: %v", err)
+	}
+	return digests
+}
+
+func writeRepoLink(t *testing.T, root, repo, kind, digest string) {
+	t.Helper()
+	dir := filepath.Join(root, "docker", "registry", "v2", "repositories", filepath.FromSlash(repo), filepath.FromSlash(kind))
+	if !strings.Contains(kind, "tags") {
+		alg, encoded, _ := strings.Cut(digest, ":")
+		dir = filepath.Join(dir, alg, encoded)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir link dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "link"), []byte(digest), 0o600); err != nil {
+		t.Fatalf("write link: %v", err)
+	}
+}
+
+func TestComputeStorageSummary(t *testing.T) {
+	root := t.TempDir()
+	seedStorageLayout(t, root)
+	shared := int64(len("shared-layer"))
+	team1 := shared + int64(len("app-layer-content")+len(`{"os":"linux"}`)+len(`{"schemaVersion":2,"app":true}`))
+	team2 := shared + int64(len(`{"schemaVersion":2}`))
+
+	summary, err := computeStorageSummary(root)
+	if err != nil {
+		t.Fatalf("computeStorageSummary: %v", err)
+	}
+	if summary.TotalBytes != team1+team2-shared {
+		t.Fatalf("expected total %d, got %d", team1+team2-shared, summary.TotalBytes)
+	}
+	if summary.BlobCount != 5 || summary.ManifestCount != 2 {
+		t.Fatalf("unexpected counts: blobs=%d manifests=%d", summary.BlobCount, summary.ManifestCount)
+	}
+	want := []namespaceStorageSummary{
+		{Namespace: "team1", Repositories: 1, Bytes: team1, BlobCount: 4, ManifestCount: 1},
+		{Namespace: "team2", Repositories: 1, Bytes: team2, BlobCount: 2, ManifestCount: 1},
+	}
+	if len(summary.Namespaces) != len(want) {
+		t.Fatalf("unexpected namespaces: %+v", summary.Namespaces)
+	}
+	for i := range want {
+		if summary.Namespaces[i] != want[i] {
+			t.Fatalf("namespace %d: expected %+v, got %+v", i, want[i], summary.Namespaces[i])
+		}
+	}
+}
+
+func TestComputeStorageSummaryEmptyRoot(t *testing.T) {
+	summary, err := computeStorageSummary(t.TempDir())
+	if err != nil {
+		t.Fatalf("computeStorageSummary: %v", err)
+	}
+	if summary.TotalBytes != 0 || summary.BlobCount != 0 || len(summary.Namespaces) != 0 {
+		t.Fatalf("expected empty summary, got %+v", summary)
+	}
+}
+
+func TestStorageReporterCachesSummary(t *testing.T) {
+	root := t.TempDir()
+	writeTestBlob(t, root, []byte("first"), nil)
+	reporter := newStorageReporter(storageConfig{Root: root, CacheTTL: time.Minute})
+	now := time.Unix(1000, 0)
+	reporter.now = func() time.Time { return now }
+
+	first, err := reporter.summary()
+	if err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+	writeTestBlob(t, root, []byte("second"), nil)
+	cached, _ := reporter.summary()
+	if cached.BlobCount != first.BlobCount {
+		t.Fatalf("expected cached summary within TTL")
+	}
+
+	now = now.Add(time.Minute)
+	fresh, _ := reporter.summary()
+	if fresh.BlobCount != 2 {
+		t.Fatalf("expected recomputed summary after TTL, got %d blobs", fresh.BlobCount)
+	}
+}
+
+func TestAdminStorageEndpoint(t *testing.T) {
+	withAdminAuth(t)
+	root := t.TempDir()
+	seedStorageLayout(t, root)
+	withStorageReporter(t, storageConfig{Root: root, CacheTTL: time.Minute})
+
+	rec := serveAdminRequest(t, "alice", "/admin/storage")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for non-admin, got %d", rec.Code)
+	}
+
+	rec = serveAdminRequest(t, "root", "/admin/storage")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var summary storageSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("decode summary: %v", err)
+	}
+	if summary.BlobCount != 5 || summary.ManifestCount != 2 || len(summary.Namespaces) != 2 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestAdminStorageRequiresStorageRoot(t *testing.T) {
+	withAdminAuth(t)
+	withStorageReporter(t, storageConfig{})
+
+	rec := serveAdminRequest(t, "root", "/admin/storage")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+}
+
+func withStorageReporter(t *testing.T, cfg storageConfig) {
+	t.Helper()
+	prev := storageReport
+	storageReport = newStorageReporter(cfg)
+	t.Cleanup(func() {
+		storageReport = prev
+	})
+}
+
+func TestStorageRootSharedByScrubGCAndSummary(t *testing.T) {
+	t.Setenv("SCRUB_STORAGE_ROOT", "/legacy")
+	t.Setenv("STORAGE_ROOT", "")
+	if got := []string{loadStorageConfig().Root, loadScrubConfig().StorageRoot, loadBlobGCConfig().StorageRoot}; got[0] != "/legacy" || got[1] != "/legacy" || got[2] != "/legacy" {
+		t.Fatalf("expected SCRUB_STORAGE_ROOT fallback everywhere, got %v", got)
+	}
+
+	t.Setenv("STORAGE_ROOT", "/var/lib/registry")
+	if got := []string{loadStorageConfig().Root, loadScrubConfig().StorageRoot, loadBlobGCConfig().StorageRoot}; got[0] != "/var/lib/registry" || got[1] != "/var/lib/registry" || got[2] != "/var/lib/registry" {
+		t.Fatalf("expected STORAGE_ROOT everywhere, got %v", got)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var (
+	// validTagName is the distribution spec's tag grammar.
+	validTagName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	// digestLikeTag matches tags that read as a digest or bare digest hex,
+	// e.g. sha256_<hex> or <hex>, which tooling mistakes for content references.
+	digestLikeTag = regexp.MustCompile(`^(?i)(sha(256|384|512)[-_.])?[0-9a-f]{64}([0-9a-f]{32}|[0-9a-f]{64})?$`)
+)
+
+// tagNameProblem explains why tag is refused, or returns "" for a valid tag.
+// Cosign's and the OCI referrers fallback sha256-<hex> tags are allowed.
+func tagNameProblem(tag string) string {
+	if !validTagName.MatchString(tag) {
+		return fmt.Sprintf("tag %q must match %s", tag, validTagName)
+	}
+	if digestLikeTag.MatchString(tag) && !signatureArtifactTag.MatchString(tag) {
+		return fmt.Sprintf("tag %q looks like a digest; push by digest or choose another tag", tag)
+	}
+	return ""
+}
+
+// enforceTagName refuses manifest pushes to tags that are invalid or look
+// like digests with 400 TAG_INVALID when STRICT_TAG_NAMES is set. Pushes by
+// digest are left to the digest policy.
+func enforceTagName(w http.ResponseWriter, r *http.Request) bool {
+	if !strictTagNames || r.Method != http.MethodPut {
+		return true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || route.Kind != registryKindManifests || isDigestReference(route.Reference) {
+		return true
+	}
+	if problem := tagNameProblem(route.Reference); problem != "" {
+		writeRegistryError(w, http.StatusBadRequest, "TAG_INVALID", problem)
+		return false
+	}
+	return true
+}
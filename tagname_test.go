@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withStrictTagNames(t *testing.T) {
+	t.Helper()
+	prev := strictTagNames
+	strictTagNames = true
+	t.Cleanup(func() { strictTagNames = prev })
+}
+
+func TestTagNameProblem(t *testing.T) {
+	hex := strings.Repeat("ab", 32)
+	cases := []struct {
+		tag   string
+		valid bool
+	}{
+		{"v1.2.3", true},
+		{"latest", true},
+		{"_build-7", true},
+		{strings.Repeat("v", 128), true},
+		{"sha256-" + hex, true},
+		{"sha256-" + hex + ".sig", true},
+		{"sha256-" + hex + ".att", true},
+		{hex, false},
+		{strings.ToUpper(hex), false},
+		{"sha256_" + hex, false},
+		{"sha512-" + hex + hex, false},
+		{strings.Repeat("v", 129), false},
+		{".hidden", false},
+		{"-dash", false},
+	}
+	for _, tc := range cases {
+		if got := tagNameProblem(tc.tag) == ""; got != tc.valid {
+			t.Errorf("tagNameProblem(%q): valid=%v, want %v", tc.tag, got, tc.valid)
+		}
+	}
+}
+
+func TestStrictTagNamesRejectsInvalidTags(t *testing.T) {
+	withStrictTagNames(t)
+	calls := withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+
+	for _, tag := range []string{strings.Repeat("0f", 32), strings.Repeat("v", 129)} {
+		rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+tag, strings.NewReader(`{"schemaVersion":2}`))
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "TAG_INVALID") {
+			t.Fatalf("expected 400 TAG_INVALID for %q, got %d: %s", tag, rec.Code, rec.Body.String())
+		}
+	}
+	if *calls != 0 {
+		t.Fatalf("expected no registry calls, got %d", *calls)
+	}
+
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/v1.0", strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected valid tag to be pushed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/sha256:"+strings.Repeat("0f", 32), strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected push by digest to be left alone, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestTagNamesUncheckedByDefault(t *testing.T) {
+	withProxyUpstream(t, func(r *http.Request) *http.Response {
+		return proxyTestResponse(r, http.StatusCreated, nil, "")
+	})
+	rec := serveProxyRequestBody(t, http.MethodPut, "/v2/team1/app/manifests/"+strings.Repeat("0f", 32), strings.NewReader(`{"schemaVersion":2}`))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected push without STRICT_TAG_NAMES, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStrictTagNamesRejectsInvalidImportTags(t *testing.T) {
+	withStrictTagNames(t)
+	registry := newFakeRegistry()
+	cleanup := withUpstream(t, registry.ServeHTTP)
+	defer cleanup()
+	token := seedSessionWithAccess(t, "alice", []Access{{Namespace: "team1"}})
+
+	// One tag comes from the query string, the other from the archive.
+	for _, c := range []struct{ repoTag, query string }{
+		{"app:v1", "?tag=" + strings.Repeat("0f", 32)},
+		{"app:" + strings.Repeat("v", 129), ""},
+	} {
+		archive := buildDockerSaveArchive(t, c.repoTag, []byte(`{"architecture":"amd64","os":"linux"}`), []byte("layer"))
+		rec := serveImportRequest(t, token, "/api/repos/team1/app/import"+c.query, archive)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "tag") {
+			t.Fatalf("expected 400 for %s%s, got %d: %s", c.repoTag, c.query, rec.Code, rec.Body.String())
+		}
+	}
+	if len(registry.blobs) != 0 {
+		t.Fatalf("expected nothing to be pushed")
+	}
+}
@@ -1,83 +1,534 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"log"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/certmagic"
+	"github.com/mholt/acmez/v3/acme"
 )
 
 var certmagicTLS = certmagic.TLS
 
-// ensureTLSCert creates a self-signed cert/key pair if either file is missing.
+// tlsListenPort is the port the registry's TLS listener binds inside the container.
+const tlsListenPort = 8443
+
+// certmagicDNSProvider is the DNS provider used for DNS-01 challenges; nil disables DNS-01.
+var certmagicDNSProvider certmagic.DNSProvider
+
+const (
+	defaultCATTL   = 10 * 365 * 24 * time.Hour
+	defaultCertTTL = 365 * 24 * time.Hour
+
+	defaultNotBeforeSkew = time.Hour
+	defaultRenewBefore   = 30 * 24 * time.Hour
+)
+
+// selfSignedConfig controls the locally generated CA and the leaf it signs.
+type selfSignedConfig struct {
+	CATTL   time.Duration
+	CertTTL time.Duration
+	// NotBeforeSkew backdates NotBefore on the CA and leaf so clients whose
+	// clocks run behind still accept a freshly generated certificate.
+	NotBeforeSkew time.Duration
+	// RenewBefore regenerates a leaf that expires within this window at
+	// startup; zero waits until it has expired.
+	RenewBefore time.Duration
+	// KeyType is the leaf key algorithm, one of selfSignedKeyTypes.
+	KeyType string
+
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+
+	// SigningCACert and SigningCAKey name an operator-supplied CA that signs
+	// the leaf instead of the generated one; both or neither are set.
+	SigningCACert string
+	SigningCAKey  string
+}
+
+// selfSignedKeyTypes lists the TLS_SELF_SIGNED_KEY_TYPE values.
+var selfSignedKeyTypes = []string{"rsa2048", "rsa4096", "ecdsa-p256", "ecdsa-p384", "ed25519"}
+
+func loadSelfSignedConfig() (selfSignedConfig, error) {
+	cfg := selfSignedConfig{
+		CATTL:         defaultCATTL,
+		CertTTL:       defaultCertTTL,
+		NotBeforeSkew: defaultNotBeforeSkew,
+		RenewBefore:   defaultRenewBefore,
+		KeyType:       "rsa2048",
+		CommonName:    "registry",
+		DNSNames:      []string{"registry", "localhost"},
+	}
+	if cn := strings.TrimSpace(os.Getenv("TLS_SELF_SIGNED_CN")); cn != "" {
+		cfg.CommonName = cn
+	}
+	for _, name := range splitCommaList(os.Getenv("TLS_SELF_SIGNED_SANS")) {
+		if !slices.Contains(cfg.DNSNames, name) {
+			cfg.DNSNames = append(cfg.DNSNames, name)
+		}
+	}
+	for _, raw := range splitCommaList(os.Getenv("TLS_SELF_SIGNED_IPS")) {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return selfSignedConfig{}, fmt.Errorf("TLS_SELF_SIGNED_IPS: %q is not an IP address", raw)
+		}
+		cfg.IPAddresses = append(cfg.IPAddresses, ip)
+	}
+	cfg.SigningCACert = strings.TrimSpace(os.Getenv("TLS_SIGNING_CA_CERT"))
+	cfg.SigningCAKey = strings.TrimSpace(os.Getenv("TLS_SIGNING_CA_KEY"))
+	if (cfg.SigningCACert == "") != (cfg.SigningCAKey == "") {
+		return selfSignedConfig{}, fmt.Errorf("TLS_SIGNING_CA_CERT and TLS_SIGNING_CA_KEY must be set together")
+	}
+	if keyType := strings.ToLower(strings.TrimSpace(os.Getenv("TLS_SELF_SIGNED_KEY_TYPE"))); keyType != "" {
+		if !slices.Contains(selfSignedKeyTypes, keyType) {
+			return selfSignedConfig{}, fmt.Errorf("TLS_SELF_SIGNED_KEY_TYPE %q is not one of %s", keyType, strings.Join(selfSignedKeyTypes, ", "))
+		}
+		cfg.KeyType = keyType
+	}
+	caTTL, err := parseEnvDuration("TLS_CA_TTL")
+	if err != nil {
+		return selfSignedConfig{}, err
+	}
+	if caTTL > 0 {
+		cfg.CATTL = caTTL
+	}
+	// TLS_SELF_SIGNED_VALIDITY is another name for TLS_CERT_TTL. Both are
+	// validated alike, and setting them to different values fails rather
+	// than letting one win silently.
+	var certTTLKey string
+	for _, key := range []string{"TLS_CERT_TTL", "TLS_SELF_SIGNED_VALIDITY"} {
+		raw := strings.TrimSpace(os.Getenv(key))
+		if raw == "" {
+			continue
+		}
+		ttl, err := parseEnvDuration(key)
+		if err != nil {
+			return selfSignedConfig{}, err
+		}
+		if ttl <= 0 {
+			return selfSignedConfig{}, fmt.Errorf("%s must be positive, got %q", key, raw)
+		}
+		if certTTLKey != "" && ttl != cfg.CertTTL {
+			return selfSignedConfig{}, fmt.Errorf("%s=%s conflicts with %s=%s; set only one", key, ttl, certTTLKey, cfg.CertTTL)
+		}
+		certTTLKey = key
+		cfg.CertTTL = ttl
+	}
+	if raw := strings.TrimSpace(os.Getenv("TLS_SELF_SIGNED_NOT_BEFORE_SKEW")); raw != "" {
+		skew, err := parseEnvDuration("TLS_SELF_SIGNED_NOT_BEFORE_SKEW")
+		if err != nil {
+			return selfSignedConfig{}, err
+		}
+		if skew < 0 {
+			return selfSignedConfig{}, fmt.Errorf("TLS_SELF_SIGNED_NOT_BEFORE_SKEW must not be negative, got %q", raw)
+		}
+		cfg.NotBeforeSkew = skew
+	}
+	if raw := strings.TrimSpace(os.Getenv("TLS_SELF_SIGNED_RENEW_BEFORE")); raw != "" {
+		renewBefore, err := parseEnvDuration("TLS_SELF_SIGNED_RENEW_BEFORE")
+		if err != nil {
+			return selfSignedConfig{}, err
+		}
+		if renewBefore < 0 {
+			return selfSignedConfig{}, fmt.Errorf("TLS_SELF_SIGNED_RENEW_BEFORE must not be negative, got %q", raw)
+		}
+		cfg.RenewBefore = renewBefore
+	}
+	return cfg, nil
+}
+
+// ensureTLSCert creates a CA-signed cert/key pair if either file is missing,
+// and replaces a pair it generated earlier once the leaf is within
+// RenewBefore of expiring. The CA is kept next to the certificate as
+// ca.crt/ca.key and reused, so clients only have to trust the root once.
+// Generation holds a lock in the certificate directory, so instances
+// starting together never pair one's key with another's certificate.
 func ensureTLSCert(certPath, keyPath string) error {
-	if _, err := os.Stat(certPath); err == nil {
-		if _, err := os.Stat(keyPath); err == nil {
-			return nil
+	cfg, err := loadSelfSignedConfig()
+	if err != nil {
+		return err
+	}
+	if pending, note := selfSignedPending(certPath, keyPath, cfg); !pending {
+		if note != "" {
+			log.Print(note)
 		}
+		return nil
 	}
 
 	if err := os.MkdirAll(filepath.Dir(certPath), 0o750); err != nil {
 		return err
 	}
+	unlock, err := lockCertDir(filepath.Dir(certPath))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Another instance may have written the pair while this one waited.
+	pending, note := selfSignedPending(certPath, keyPath, cfg)
+	if note != "" {
+		log.Print(note)
+	}
+	if !pending {
+		return nil
+	}
+	return generateSelfSigned(certPath, keyPath, cfg)
+}
 
-	log.Printf("generating self-signed certificate at %s", certPath)
-	return generateSelfSigned(certPath, keyPath)
+// selfSignedPending reports whether the pair at certPath and keyPath is
+// missing or is a generated leaf due for renewal, with a note saying why.
+func selfSignedPending(certPath, keyPath string, cfg selfSignedConfig) (bool, string) {
+	if !fileExists(certPath) || !fileExists(keyPath) {
+		return true, fmt.Sprintf("generating self-signed certificate at %s", certPath)
+	}
+	caCertPath, _ := cfg.issuerPaths(certPath)
+	notAfter, renew, err := selfSignedNeedsRenewal(certPath, caCertPath, cfg.RenewBefore)
+	if err != nil {
+		return false, fmt.Sprintf("not renewing %s: %v", certPath, err)
+	}
+	if !renew {
+		return false, ""
+	}
+	return true, fmt.Sprintf("renewing self-signed certificate at %s, which expires %s", certPath, notAfter.Format(time.RFC3339))
 }
 
-func generateSelfSigned(certPath, keyPath string) error {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// selfSignedNeedsRenewal reports whether the leaf at certPath expires within
+// renewBefore. Only leaves signed by the CA at caCertPath are renewed, so a
+// certificate the operator mounted is never replaced.
+func selfSignedNeedsRenewal(certPath, caCertPath string, renewBefore time.Duration) (time.Time, bool, error) {
+	leaf, err := readCertificate(certPath)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if time.Until(leaf.NotAfter) > renewBefore {
+		return leaf.NotAfter, false, nil
+	}
+	ca, err := readCertificate(caCertPath)
+	if err != nil {
+		return leaf.NotAfter, false, fmt.Errorf("expires %s but its CA is unreadable: %w", leaf.NotAfter.Format(time.RFC3339), err)
+	}
+	if err := leaf.CheckSignatureFrom(ca); err != nil {
+		return leaf.NotAfter, false, fmt.Errorf("expires %s but was not issued by %s", leaf.NotAfter.Format(time.RFC3339), caCertPath)
+	}
+	return leaf.NotAfter, true, nil
+}
+
+// readCertificate parses the first certificate in a PEM file.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is the configured certificate location
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// atomicFile is one file written by writeFilesAtomic.
+type atomicFile struct {
+	path string
+	data []byte
+}
+
+// writeFilesAtomic replaces each path through a temporary file in the same
+// directory, so a concurrently starting instance never reads a partial
+// certificate or key. Every temporary file is written before the first
+// rename, which keeps the window where a key and certificate disagree down
+// to the renames themselves; readers close it by holding lockCertDir. The
+// files are created with mode 0600.
+func writeFilesAtomic(files ...atomicFile) error {
+	temps := make([]string, 0, len(files))
+	defer func() {
+		for _, tmp := range temps {
+			_ = os.Remove(tmp)
+		}
+	}()
+	for _, file := range files {
+		tmp, err := os.CreateTemp(filepath.Dir(file.path), "."+filepath.Base(file.path)+"-*")
+		if err != nil {
+			return err
+		}
+		temps = append(temps, tmp.Name())
+		if _, err := tmp.Write(file.data); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+	}
+	for i, file := range files {
+		if err := os.Rename(temps[i], file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caPaths(certPath string) (string, string) {
+	dir := filepath.Dir(certPath)
+	return filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+}
+
+// issuerPaths returns the CA that signs the leaf at certPath: the
+// operator-supplied one if configured, otherwise the generated one next to it.
+func (cfg selfSignedConfig) issuerPaths(certPath string) (string, string) {
+	if cfg.SigningCACert != "" {
+		return cfg.SigningCACert, cfg.SigningCAKey
+	}
+	return caPaths(certPath)
+}
+
+func generateSelfSigned(certPath, keyPath string, cfg selfSignedConfig) error {
+	var caCert *x509.Certificate
+	var caKey crypto.Signer
+	var err error
+	if cfg.SigningCACert != "" {
+		caCert, caKey, err = loadSigningCA(cfg.SigningCACert, cfg.SigningCAKey)
+	} else {
+		caCert, caKey, err = loadOrCreateCA(certPath, cfg)
+	}
 	if err != nil {
 		return err
 	}
 
-	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialLimit)
+	priv, keyBlock, err := generateLeafKey(cfg.KeyType)
 	if err != nil {
 		return err
 	}
 
+	serialNumber, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			CommonName: "registry",
+			CommonName: cfg.CommonName,
 		},
-		NotBefore:             time.Now().Add(-time.Hour),
-		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		NotBefore:             time.Now().Add(-cfg.NotBeforeSkew),
+		NotAfter:              time.Now().Add(cfg.CertTTL),
+		KeyUsage:              keyUsage,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{"registry", "localhost"},
+		DNSNames:              cfg.DNSNames,
+		IPAddresses:           cfg.IPAddresses,
+		// Lets clients pick the right issuer when the CA has been re-keyed
+		// under the same name; empty if the CA has no subject key id.
+		AuthorityKeyId: caCert.SubjectKeyId,
+	}
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCert, priv.Public(), caKey)
 	if err != nil {
 		return err
 	}
 
 	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	if err := os.WriteFile(certPath, certOut, 0o600); err != nil {
-		return err
+	certOut = append(certOut, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})...)
+	// The key goes first: a reader that sees the new certificate also finds
+	// its key.
+	return writeFilesAtomic(
+		atomicFile{path: keyPath, data: pem.EncodeToMemory(keyBlock)},
+		atomicFile{path: certPath, data: certOut},
+	)
+}
+
+// generateLeafKey creates a key of keyType and its PEM encoding: PKCS#1 for
+// RSA, SEC 1 for ECDSA and PKCS#8 for Ed25519, which has no other form.
+func generateLeafKey(keyType string) (crypto.Signer, *pem.Block, error) {
+	switch keyType {
+	case "", "rsa2048", "rsa4096":
+		bits := 2048
+		if keyType == "rsa4096" {
+			bits = 4096
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+	case "ecdsa-p256", "ecdsa-p384":
+		curve := elliptic.P256()
+		if keyType == "ecdsa-p384" {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	case "ed25519":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported self-signed key type %q", keyType)
+	}
+}
+
+// loadSigningCA reads the operator-supplied CA and checks that it can sign
+// the leaf.
+func loadSigningCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	cert, key, err := readCA(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("TLS_SIGNING_CA_CERT/TLS_SIGNING_CA_KEY: %w", err)
+	}
+	if !cert.IsCA || (cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0) {
+		return nil, nil, fmt.Errorf("TLS_SIGNING_CA_CERT: %s is not a CA allowed to sign certificates", certPath)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+		return nil, nil, fmt.Errorf("TLS_SIGNING_CA_KEY: %s does not match %s", keyPath, certPath)
+	}
+	return cert, key, nil
+}
+
+// loadOrCreateCA reuses an existing CA next to certPath or generates a new one.
+func loadOrCreateCA(certPath string, cfg selfSignedConfig) (*x509.Certificate, crypto.Signer, error) {
+	caCertPath, caKeyPath := caPaths(certPath)
+	if cert, key, err := readCA(caCertPath, caKeyPath); err == nil {
+		return cert, key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	log.Printf("generating self-signed CA at %s", caCertPath)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
 	}
 
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: "ContainerVault CA",
+		},
+		NotBefore:             time.Now().Add(-cfg.NotBeforeSkew),
+		NotAfter:              time.Now().Add(cfg.CATTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certOut := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
 	keyOut := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-	if err := os.WriteFile(keyPath, keyOut, 0o600); err != nil {
-		return err
+	if err := writeFilesAtomic(atomicFile{path: caKeyPath, data: keyOut}, atomicFile{path: caCertPath, data: certOut}); err != nil {
+		return nil, nil, err
 	}
+	return cert, priv, nil
+}
 
-	return nil
+func readCA(certPath, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certPath) // #nosec G304 -- CA location is derived from the configured cert path
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath) // #nosec G304 -- CA location is derived from the configured cert path
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no private key found in %s", keyPath)
+	}
+	key, err := parsePrivateKey(keyBlock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return cert, key, nil
+}
+
+// parsePrivateKey accepts the PKCS#1, SEC 1 and PKCS#8 encodings that
+// generateLeafKey writes and common PKI tooling produces.
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	serialLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, serialLimit)
 }
 
 type certmagicConfig struct {
@@ -88,6 +539,41 @@ type certmagicConfig struct {
 	StoragePath    string
 	AltHTTPPort    int
 	AltTLSALPNPort int
+	// SharedTLSALPN answers TLS-ALPN challenges on the main listener instead
+	// of a separate solver listener.
+	SharedTLSALPN bool
+
+	// ExternalAccount binds the ACME account to an account at a CA that
+	// requires External Account Binding; nil when unused.
+	ExternalAccount *acme.EAB
+
+	// Storage replaces the file storage when CERTMAGIC_STORAGE_BACKEND
+	// selects a shared backend; nil keeps StoragePath.
+	Storage certmagic.Storage
+
+	// DNSProvider solves DNS-01 challenges when CERTMAGIC_DNS_PROVIDER is set.
+	DNSProvider           certmagic.DNSProvider
+	DNSPropagationTimeout time.Duration
+	DNSPropagationDelay   time.Duration
+
+	// MaxConcurrentIssuance caps simultaneous certificate obtain calls; zero is unlimited.
+	MaxConcurrentIssuance int
+
+	// OnDemand obtains certificates during the first handshake for each
+	// name instead of at startup, for Domains and for hosts one label below
+	// an OnDemandSuffixes entry.
+	OnDemand         bool
+	OnDemandSuffixes []string
+	// MaxDomains caps the distinct on-demand names certificates are managed
+	// for; zero is unlimited.
+	MaxDomains int
+
+	// OCSPStapling fetches OCSP responses for managed certificates and
+	// staples them to the handshake; on by default.
+	OCSPStapling bool
+
+	MinVersion   uint16
+	CipherSuites []uint16
 }
 
 func certmagicTLSConfig() (*tls.Config, bool, error) {
@@ -102,9 +588,12 @@ func certmagicTLSConfig() (*tls.Config, bool, error) {
 	if cfg.CA != "" {
 		certmagic.DefaultACME.CA = cfg.CA
 	}
+	if cfg.ExternalAccount != nil {
+		certmagic.DefaultACME.ExternalAccount = cfg.ExternalAccount
+	}
 	if cfg.AltTLSALPNPort == 0 {
 		// Align ACME TLS-ALPN with the internal listener (443 -> 8443 mapping).
-		cfg.AltTLSALPNPort = 8443
+		cfg.AltTLSALPNPort = tlsListenPort
 	}
 	if cfg.AltHTTPPort != 0 {
 		certmagic.DefaultACME.AltHTTPPort = cfg.AltHTTPPort
@@ -126,25 +615,65 @@ func certmagicTLSConfig() (*tls.Config, bool, error) {
 		}
 		certmagic.DefaultACME.TrustedRoots = roots
 	}
-	if cfg.StoragePath != "" {
+	if cfg.DNSProvider != nil {
+		certmagicDNSProvider = cfg.DNSProvider
+	}
+	if solver := dns01Solver(cfg, certmagicDNSProvider); solver != nil {
+		certmagic.DefaultACME.DNS01Solver = solver
+	}
+	if cfg.OnDemand {
+		certmagic.Default.OnDemand = &certmagic.OnDemandConfig{
+			DecisionFunc: onDemandDecision(cfg.Domains, cfg.OnDemandSuffixes, cfg.MaxDomains),
+		}
+	}
+	if cfg.Storage != nil {
+		certmagic.Default.Storage = cfg.Storage
+	} else if cfg.StoragePath != "" {
 		certmagic.Default.Storage = &certmagic.FileStorage{Path: cfg.StoragePath}
 	}
+	// certmagic's GetCertificate serves the staple cached with each
+	// certificate, so this is the only switch needed.
+	certmagic.Default.OCSP.DisableStapling = !cfg.OCSPStapling
+	certmagic.Default.OnEvent = tlsCertExpiry.certmagicEvent(certmagic.Default.Storage)
 
-	tlsCfg, err := certmagicTLS(cfg.Domains)
+	manage := certmagicTLS
+	switch {
+	case cfg.SharedTLSALPN:
+		manage = func(domains []string) (*tls.Config, error) {
+			return certmagicSharedTLS(domains, cfg.MaxConcurrentIssuance)
+		}
+	case cfg.MaxConcurrentIssuance > 0:
+		manage = func(domains []string) (*tls.Config, error) {
+			return certmagicLimitedTLS(domains, cfg.MaxConcurrentIssuance)
+		}
+	}
+	tlsCfg, err := manage(cfg.Domains)
 	if err != nil {
 		return nil, true, err
 	}
+	// On demand, nothing is cached yet and a lookup could start issuance;
+	// the cache events fill the gauge in as handshakes arrive.
+	expiryDomains := cfg.Domains
+	if cfg.OnDemand {
+		expiryDomains = nil
+	}
+	tlsCertExpiry.trackCertmagic(tlsConfigCertificate(tlsCfg), expiryDomains)
 	tlsCfg.NextProtos = append([]string{"h2", "http/1.1"}, tlsCfg.NextProtos...)
+	tlsCfg.MinVersion = cfg.MinVersion
+	if cfg.CipherSuites != nil {
+		tlsCfg.CipherSuites = cfg.CipherSuites
+	}
 	return tlsCfg, true, nil
 }
 
 func loadCertmagicConfig() (certmagicConfig, bool, error) {
 	domains := splitCommaList(os.Getenv("CERTMAGIC_DOMAINS"))
 	enabled := getEnvBool("CERTMAGIC_ENABLE", false)
-	if !enabled && len(domains) == 0 {
+	onDemand := getEnvBool("CERTMAGIC_ON_DEMAND", false)
+	if !enabled && len(domains) == 0 && !onDemand {
 		return certmagicConfig{}, false, nil
 	}
-	if len(domains) == 0 {
+	if len(domains) == 0 && !onDemand {
 		return certmagicConfig{}, false, fmt.Errorf("CERTMAGIC_DOMAINS must be set when certmagic is enabled")
 	}
 
@@ -154,9 +683,34 @@ func loadCertmagicConfig() (certmagicConfig, bool, error) {
 		CA:          strings.TrimSpace(os.Getenv("CERTMAGIC_CA")),
 		CARootPath:  strings.TrimSpace(os.Getenv("CERTMAGIC_CA_ROOT")),
 		StoragePath: strings.TrimSpace(os.Getenv("CERTMAGIC_STORAGE")),
+
+		OCSPStapling: getEnvBool("CERTMAGIC_OCSP_STAPLING", true),
+
+		OnDemand: onDemand,
 	}
 
 	var err error
+	if cfg.OnDemand {
+		cfg.OnDemandSuffixes, err = loadOnDemandSuffixes()
+		if err != nil {
+			return certmagicConfig{}, false, err
+		}
+		cfg.MaxDomains, err = parseEnvCount("CERTMAGIC_MAX_DOMAINS")
+		if err != nil {
+			return certmagicConfig{}, false, err
+		}
+	}
+	cfg.ExternalAccount, err = loadExternalAccountBinding()
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.Storage, err = loadCertmagicStorage()
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	if cfg.Storage != nil && cfg.StoragePath != "" {
+		return certmagicConfig{}, false, fmt.Errorf("CERTMAGIC_STORAGE only applies to the file storage backend")
+	}
 	cfg.AltHTTPPort, err = parseEnvPort("CERTMAGIC_HTTP_PORT")
 	if err != nil {
 		return certmagicConfig{}, false, err
@@ -165,10 +719,344 @@ func loadCertmagicConfig() (certmagicConfig, bool, error) {
 	if err != nil {
 		return certmagicConfig{}, false, err
 	}
+	cfg.SharedTLSALPN = certmagicSharesListener()
+	if cfg.SharedTLSALPN && cfg.AltTLSALPNPort != 0 && cfg.AltTLSALPNPort != tlsListenPort {
+		return certmagicConfig{}, false, fmt.Errorf("CERTMAGIC_TLS_ALPN_PORT must be unset or %d when CERTMAGIC_TLS_ALPN_SHARED is enabled", tlsListenPort)
+	}
+	if name := strings.ToLower(strings.TrimSpace(os.Getenv("CERTMAGIC_DNS_PROVIDER"))); name != "" {
+		cfg.DNSProvider, err = newDNSProvider(name)
+		if err != nil {
+			return certmagicConfig{}, false, err
+		}
+	}
+	if err := validateCertmagicDomains(cfg.Domains, cfg.DNSProvider != nil || certmagicDNSProvider != nil); err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.DNSPropagationTimeout, err = parseEnvDuration("CERTMAGIC_DNS_PROPAGATION_TIMEOUT")
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.DNSPropagationDelay, err = parseEnvDuration("CERTMAGIC_DNS_PROPAGATION_DELAY")
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.MaxConcurrentIssuance, err = parseEnvCount("CERTMAGIC_MAX_CONCURRENT_ISSUANCE")
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.MinVersion, err = tlsMinVersion()
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
+	cfg.CipherSuites, err = tlsCipherSuites(cfg.MinVersion)
+	if err != nil {
+		return certmagicConfig{}, false, err
+	}
 
 	return cfg, true, nil
 }
 
+// loadExternalAccountBinding reads CERTMAGIC_EAB_KEY_ID and
+// CERTMAGIC_EAB_HMAC_KEY, which must be set together. The HMAC key is the
+// base64url value the CA hands out; trailing padding is accepted and dropped.
+func loadExternalAccountBinding() (*acme.EAB, error) {
+	keyID := strings.TrimSpace(os.Getenv("CERTMAGIC_EAB_KEY_ID"))
+	macKey := strings.TrimRight(strings.TrimSpace(os.Getenv("CERTMAGIC_EAB_HMAC_KEY")), "=")
+	if keyID == "" && macKey == "" {
+		return nil, nil
+	}
+	if keyID == "" || macKey == "" {
+		return nil, fmt.Errorf("CERTMAGIC_EAB_KEY_ID and CERTMAGIC_EAB_HMAC_KEY must be set together")
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(macKey); err != nil {
+		return nil, fmt.Errorf("CERTMAGIC_EAB_HMAC_KEY must be base64url-encoded: %w", err)
+	}
+	return &acme.EAB{KeyID: keyID, MACKey: macKey}, nil
+}
+
+// validateCertmagicDomains checks wildcard entries in CERTMAGIC_DOMAINS. A
+// wildcard may only cover the leftmost label, as in *.registry.example.com,
+// and needs a DNS-01 solver since the CA cannot validate it over HTTP or
+// TLS-ALPN.
+func validateCertmagicDomains(domains []string, dnsSolver bool) error {
+	for _, domain := range domains {
+		if !strings.Contains(domain, "*") {
+			continue
+		}
+		base, ok := strings.CutPrefix(domain, "*.")
+		if !ok || base == "" || strings.Contains(base, "*") {
+			return fmt.Errorf("invalid wildcard domain %q in CERTMAGIC_DOMAINS: only the leftmost label may be *, as in *.example.com", domain)
+		}
+		if !dnsSolver {
+			return fmt.Errorf("wildcard domain %q in CERTMAGIC_DOMAINS requires DNS-01; set CERTMAGIC_DNS_PROVIDER", domain)
+		}
+	}
+	return nil
+}
+
+// loadOnDemandSuffixes reads CERTMAGIC_ON_DEMAND_SUFFIXES, the domains whose
+// direct subdomains may get a certificate on demand. It is required with
+// CERTMAGIC_ON_DEMAND, since without it any name a client sends as SNI
+// would be sent to the CA. Entries may be written as example.com,
+// .example.com or *.example.com.
+func loadOnDemandSuffixes() ([]string, error) {
+	var suffixes []string
+	for _, raw := range splitCommaList(os.Getenv("CERTMAGIC_ON_DEMAND_SUFFIXES")) {
+		suffix := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(raw, "*"), "."), "."))
+		if suffix == "" || strings.Contains(suffix, "*") || !strings.Contains(suffix, ".") {
+			return nil, fmt.Errorf("invalid CERTMAGIC_ON_DEMAND_SUFFIXES entry %q: want a domain such as tenants.example.com", raw)
+		}
+		suffixes = append(suffixes, suffix)
+	}
+	if len(suffixes) == 0 {
+		return nil, fmt.Errorf("CERTMAGIC_ON_DEMAND_SUFFIXES must be set when CERTMAGIC_ON_DEMAND is enabled")
+	}
+	return suffixes, nil
+}
+
+// onDemandAllowlist returns the sniAllowed entries for on-demand issuance:
+// the configured domains plus a one-label wildcard under each suffix.
+func onDemandAllowlist(domains, suffixes []string) []string {
+	allowed := slices.Clone(domains)
+	for _, suffix := range suffixes {
+		allowed = append(allowed, "*."+suffix)
+	}
+	return allowed
+}
+
+// onDemandDecision is the on-demand DecisionFunc: it allows names in
+// CERTMAGIC_DOMAINS or one label under an on-demand suffix. With maxDomains,
+// only that many distinct suffix names are admitted, so a flood of SNI values
+// cannot start unbounded issuance. Names already admitted keep being served
+// and renewed; CERTMAGIC_DOMAINS do not count towards the cap.
+func onDemandDecision(domains, suffixes []string, maxDomains int) func(context.Context, string) error {
+	allowed := onDemandAllowlist(domains, suffixes)
+	var mu sync.Mutex
+	admitted := map[string]struct{}{}
+	return func(_ context.Context, name string) error {
+		if !sniAllowed(name, allowed) {
+			return fmt.Errorf("%s is not covered by CERTMAGIC_DOMAINS or CERTMAGIC_ON_DEMAND_SUFFIXES", name)
+		}
+		if maxDomains <= 0 || sniAllowed(name, domains) {
+			return nil
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := admitted[name]; ok {
+			return nil
+		}
+		if len(admitted) >= maxDomains {
+			return fmt.Errorf("refusing %s: CERTMAGIC_MAX_DOMAINS=%d on-demand domains are already managed", name, maxDomains)
+		}
+		admitted[name] = struct{}{}
+		return nil
+	}
+}
+
+// certmagicLimitedTLS is certmagic.TLS with issuance limited to maxIssuance
+// concurrent obtain calls.
+var certmagicLimitedTLS = func(domains []string, maxIssuance int) (*tls.Config, error) {
+	magic := newManagedCertmagic(maxIssuance)
+	return magic.TLSConfig(), magic.ManageSync(context.Background(), domains)
+}
+
+// certmagicSharedTLS obtains certificates in the background instead of
+// before the server starts, so the main listener is already accepting when
+// the CA connects to validate a TLS-ALPN challenge and certmagic's
+// GetCertificate answers the acme-tls/1 handshake.
+var certmagicSharedTLS = func(domains []string, maxIssuance int) (*tls.Config, error) {
+	magic := newManagedCertmagic(maxIssuance)
+	return magic.TLSConfig(), magic.ManageAsync(context.Background(), domains)
+}
+
+// certmagicSharesListener reports whether CERTMAGIC_TLS_ALPN_SHARED is set,
+// which main needs before certmagic starts to bind the listener first.
+func certmagicSharesListener() bool {
+	return getEnvBool("CERTMAGIC_TLS_ALPN_SHARED", false)
+}
+
+// newManagedCertmagic builds a certmagic config around the DefaultACME
+// issuer, limited to maxIssuance concurrent obtain calls when positive. The
+// ACME issuer keeps a pointer to the config it serves, so this builds its own
+// config and cache instead of wrapping the issuers of certmagic.Default;
+// renewals reuse the same config. OCSP settings are copied from
+// certmagic.Default, which certmagic.New does not inherit.
+func newManagedCertmagic(maxIssuance int) *certmagic.Config {
+	certmagic.DefaultACME.Agreed = true
+	certmagic.DefaultACME.DisableHTTPChallenge = true
+	var magic *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return magic, nil
+		},
+	})
+	magic = certmagic.New(cache, certmagic.Config{OCSP: certmagic.Default.OCSP})
+	var issuer certmagic.Issuer = certmagic.NewACMEIssuer(magic, certmagic.DefaultACME)
+	if maxIssuance > 0 {
+		issuer = newIssuanceLimiter(issuer, maxIssuance)
+	}
+	magic.Issuers = []certmagic.Issuer{issuer}
+	return magic
+}
+
+// issuanceLimiter lets at most cap(slots) Issue calls reach the wrapped
+// issuer at once, so a burst of new domains does not trip CA rate limits.
+type issuanceLimiter struct {
+	certmagic.Issuer
+	slots chan struct{}
+}
+
+func newIssuanceLimiter(issuer certmagic.Issuer, max int) *issuanceLimiter {
+	return &issuanceLimiter{Issuer: issuer, slots: make(chan struct{}, max)}
+}
+
+func (l *issuanceLimiter) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-l.slots }()
+	return l.Issuer.Issue(ctx, csr)
+}
+
+// PreCheck, Revoke and GetRenewalInfo forward the optional interfaces
+// certmagic looks for on issuers.
+func (l *issuanceLimiter) PreCheck(ctx context.Context, names []string, interactive bool) error {
+	if checker, ok := l.Issuer.(certmagic.PreChecker); ok {
+		return checker.PreCheck(ctx, names, interactive)
+	}
+	return nil
+}
+
+func (l *issuanceLimiter) Revoke(ctx context.Context, cert certmagic.CertificateResource, reason int) error {
+	if revoker, ok := l.Issuer.(certmagic.Revoker); ok {
+		return revoker.Revoke(ctx, cert, reason)
+	}
+	return fmt.Errorf("issuer %s cannot revoke certificates", l.IssuerKey())
+}
+
+func (l *issuanceLimiter) GetRenewalInfo(ctx context.Context, cert certmagic.Certificate) (acme.RenewalInfo, error) {
+	if getter, ok := l.Issuer.(certmagic.RenewalInfoGetter); ok {
+		return getter.GetRenewalInfo(ctx, cert)
+	}
+	return acme.RenewalInfo{}, fmt.Errorf("issuer %s has no renewal info", l.IssuerKey())
+}
+
+// dns01Solver builds the DNS-01 solver for provider, or nil when no provider is configured.
+func dns01Solver(cfg certmagicConfig, provider certmagic.DNSProvider) *certmagic.DNS01Solver {
+	if provider == nil {
+		return nil
+	}
+	return &certmagic.DNS01Solver{
+		DNSManager: certmagic.DNSManager{
+			DNSProvider:        provider,
+			PropagationTimeout: cfg.DNSPropagationTimeout,
+			PropagationDelay:   cfg.DNSPropagationDelay,
+		},
+	}
+}
+
+// loadSNIAllowlist returns the server names accepted during the TLS handshake.
+// TLS_ALLOWED_SNI takes precedence; with TLS_REQUIRE_SNI the certmagic domains
+// are used, plus the on-demand suffixes' subdomains when CERTMAGIC_ON_DEMAND is
+// set. An empty list disables the check.
+func loadSNIAllowlist() []string {
+	if explicit := splitCommaList(os.Getenv("TLS_ALLOWED_SNI")); len(explicit) > 0 {
+		return explicit
+	}
+	if getEnvBool("TLS_REQUIRE_SNI", false) {
+		domains := splitCommaList(os.Getenv("CERTMAGIC_DOMAINS"))
+		if getEnvBool("CERTMAGIC_ON_DEMAND", false) {
+			suffixes, _ := loadOnDemandSuffixes()
+			return onDemandAllowlist(domains, suffixes)
+		}
+		return domains
+	}
+	return nil
+}
+
+// applySNIAllowlist rejects handshakes whose SNI is missing or not allowed.
+func applySNIAllowlist(cfg *tls.Config, allowed []string) {
+	if len(allowed) == 0 {
+		return
+	}
+	next := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if !sniAllowed(hello.ServerName, allowed) {
+			return nil, fmt.Errorf("tls: server name %q not allowed", hello.ServerName)
+		}
+		if next != nil {
+			return next(hello)
+		}
+		return nil, nil
+	}
+}
+
+func sniAllowed(serverName string, allowed []string) bool {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return false
+	}
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if entry == name {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(entry, "*."); ok {
+			label, found := strings.CutSuffix(name, "."+suffix)
+			if found && label != "" && !strings.Contains(label, ".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tlsMinVersion parses TLS_MIN_VERSION, "1.2" (the default) or "1.3".
+func tlsMinVersion() (uint16, error) {
+	switch raw := strings.TrimSpace(os.Getenv("TLS_MIN_VERSION")); raw {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", raw)
+	}
+}
+
+// tlsCipherSuites parses TLS_CIPHER_SUITES, a comma-separated list of Go
+// cipher suite names from tls.CipherSuites. Nil keeps Go's defaults. The
+// list only applies to TLS 1.2, since TLS 1.3 suites are not configurable.
+func tlsCipherSuites(minVersion uint16) ([]uint16, error) {
+	names := splitCommaList(os.Getenv("TLS_CIPHER_SUITES"))
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if minVersion >= tls.VersionTLS13 {
+		return nil, fmt.Errorf("TLS_CIPHER_SUITES only applies to TLS 1.2, but TLS_MIN_VERSION is 1.3, whose cipher suites are not configurable")
+	}
+	var ids []uint16
+	for _, name := range names {
+		id, ok := tls12CipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: %q is not a supported TLS 1.2 cipher suite", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func tls12CipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name && slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
 func splitCommaList(raw string) []string {
 	parts := strings.Split(raw, ",")
 	out := make([]string, 0, len(parts))
@@ -193,3 +1081,27 @@ func parseEnvPort(key string) (int, error) {
 	}
 	return port, nil
 }
+
+func parseEnvCount(key string) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", key, raw)
+	}
+	return n, nil
+}
+
+func parseEnvDuration(key string) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return 0, nil
+	}
+	d, err := parseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", key, raw)
+	}
+	return d, nil
+}
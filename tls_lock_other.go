@@ -0,0 +1,38 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleCertLockAge is how old dir/.tls.lock must be before it is treated as
+// left behind by a crashed process. Generating a pair takes well under this.
+const staleCertLockAge = 2 * time.Minute
+
+// lockCertDir takes an exclusive lock on dir/.tls.lock by creating it, since
+// flock is not available here, and waits while another process holds it. The
+// returned function releases it by removing the file.
+func lockCertDir(dir string) (func(), error) {
+	path := filepath.Join(dir, ".tls.lock")
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600) // #nosec G304 -- dir is the configured certificate directory
+		if err == nil {
+			_ = f.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleCertLockAge {
+			_ = os.Remove(path)
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockCertDir takes an exclusive lock on dir/.tls.lock, waiting for any
+// other process holding it. The returned function releases it; the lock is
+// also released if the process exits.
+func lockCertDir(dir string) (func(), error) {
+	f, err := os.OpenFile(filepath.Join(dir, ".tls.lock"), os.O_CREATE|os.O_RDWR, 0o600) // #nosec G304 -- dir is the configured certificate directory
+	if err != nil {
+		return nil, err
+	}
+	fd := int(f.Fd()) // #nosec G115 -- file descriptors fit in an int
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("lock %s: %w", f.Name(), err)
+	}
+	return func() {
+		_ = syscall.Flock(fd, syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
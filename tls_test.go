@@ -1,19 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/caddyserver/certmagic"
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/v3/acme"
 )
 
 func TestEnsureTLSCertCreatesFiles(t *testing.T) {
@@ -37,6 +53,380 @@ func TestEnsureTLSCertCreatesFiles(t *testing.T) {
 	}
 }
 
+func TestEnsureTLSCertSeparateCAAndLeafTTL(t *testing.T) {
+	t.Setenv("TLS_CA_TTL", "87600h")
+	t.Setenv("TLS_CERT_TTL", "2160h")
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+	keyPath := filepath.Join(dir, "registry.key")
+
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+
+	leaf, root := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if !root.IsCA {
+		t.Fatalf("expected root to be a CA")
+	}
+	if got := time.Until(leaf.NotAfter); got > 91*24*time.Hour || got < 89*24*time.Hour {
+		t.Fatalf("expected ~90 day leaf, got %s", got)
+	}
+	if root.NotAfter.Sub(leaf.NotAfter) < 9*365*24*time.Hour {
+		t.Fatalf("expected root NotAfter %s to be far later than leaf %s", root.NotAfter, leaf.NotAfter)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "registry"}); err != nil {
+		t.Fatalf("expected leaf to chain to root: %v", err)
+	}
+}
+
+func TestEnsureTLSCertReusesCA(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+	keyPath := filepath.Join(dir, "registry.key")
+
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	_, firstRoot := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+
+	if err := os.Remove(certPath); err != nil {
+		t.Fatalf("remove cert: %v", err)
+	}
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert again: %v", err)
+	}
+	leaf, secondRoot := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if !firstRoot.Equal(secondRoot) {
+		t.Fatalf("expected CA to be reused")
+	}
+	if err := leaf.CheckSignatureFrom(firstRoot); err != nil {
+		t.Fatalf("expected new leaf to be signed by existing CA: %v", err)
+	}
+}
+
+func TestEnsureTLSCertSignedByExternalCA(t *testing.T) {
+	pki := t.TempDir()
+	caCertPath := filepath.Join(pki, "issuing.crt")
+	caKeyPath := filepath.Join(pki, "issuing.key")
+	writeTestCA(t, caCertPath, caKeyPath)
+	t.Setenv("TLS_SIGNING_CA_CERT", caCertPath)
+	t.Setenv("TLS_SIGNING_CA_KEY", caKeyPath)
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+
+	if err := ensureTLSCert(certPath, filepath.Join(dir, "registry.key")); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	leaf, root := readTestChain(t, certPath, caCertPath)
+	if err := leaf.CheckSignatureFrom(root); err != nil {
+		t.Fatalf("expected leaf to be signed by the external CA: %v", err)
+	}
+	if len(root.SubjectKeyId) == 0 || !bytes.Equal(leaf.AuthorityKeyId, root.SubjectKeyId) {
+		t.Fatalf("expected AuthorityKeyId %x to match the CA's SubjectKeyId %x", leaf.AuthorityKeyId, root.SubjectKeyId)
+	}
+	if fileExists(filepath.Join(dir, "ca.crt")) {
+		t.Fatalf("expected no CA to be generated next to the certificate")
+	}
+}
+
+func TestLoadSigningCARejectsMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCA(t, filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"))
+	writeTestCA(t, filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"))
+	if _, _, err := loadSigningCA(filepath.Join(dir, "a.crt"), filepath.Join(dir, "b.key")); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expected key mismatch error, got %v", err)
+	}
+}
+
+func TestLoadSelfSignedConfigSigningCARequiresBoth(t *testing.T) {
+	t.Setenv("TLS_SIGNING_CA_CERT", "/pki/ca.crt")
+	if _, err := loadSelfSignedConfig(); err == nil {
+		t.Fatalf("expected error when TLS_SIGNING_CA_KEY is missing")
+	}
+}
+
+func TestLoadSelfSignedConfigInvalid(t *testing.T) {
+	t.Setenv("TLS_CERT_TTL", "forever")
+	if _, err := loadSelfSignedConfig(); err == nil {
+		t.Fatalf("expected error for invalid TLS_CERT_TTL")
+	}
+}
+
+func TestEnsureTLSCertValidityAndSkew(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "48h")
+	t.Setenv("TLS_SELF_SIGNED_NOT_BEFORE_SKEW", "6h")
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+
+	if err := ensureTLSCert(certPath, filepath.Join(dir, "registry.key")); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	leaf, root := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if got := time.Until(leaf.NotAfter); got > 49*time.Hour || got < 47*time.Hour {
+		t.Fatalf("expected ~48h leaf, got %s", got)
+	}
+	for _, cert := range []*x509.Certificate{leaf, root} {
+		if got := time.Since(cert.NotBefore); got > 7*time.Hour || got < 5*time.Hour {
+			t.Fatalf("expected NotBefore ~6h ago, got %s", got)
+		}
+	}
+}
+
+func TestLoadSelfSignedConfigRejectsNonPositiveValidity(t *testing.T) {
+	for _, key := range []string{"TLS_SELF_SIGNED_VALIDITY", "TLS_CERT_TTL"} {
+		for _, raw := range []string{"0", "-24h"} {
+			t.Setenv(key, raw)
+			if _, err := loadSelfSignedConfig(); err == nil {
+				t.Fatalf("expected error for %s=%s", key, raw)
+			}
+		}
+		t.Setenv(key, "")
+	}
+
+	t.Setenv("TLS_CERT_TTL", "8760h")
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "48h")
+	if _, err := loadSelfSignedConfig(); err == nil {
+		t.Fatalf("expected error for conflicting TLS_CERT_TTL and TLS_SELF_SIGNED_VALIDITY")
+	}
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "8760h")
+	if cfg, err := loadSelfSignedConfig(); err != nil || cfg.CertTTL != 8760*time.Hour {
+		t.Fatalf("expected matching values to be accepted, got %v %v", cfg.CertTTL, err)
+	}
+	t.Setenv("TLS_CERT_TTL", "")
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "")
+
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "")
+	t.Setenv("TLS_SELF_SIGNED_NOT_BEFORE_SKEW", "-1h")
+	if _, err := loadSelfSignedConfig(); err == nil {
+		t.Fatalf("expected error for negative skew")
+	}
+
+	t.Setenv("TLS_SELF_SIGNED_NOT_BEFORE_SKEW", "")
+	cfg, err := loadSelfSignedConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.CertTTL != defaultCertTTL || cfg.NotBeforeSkew != time.Hour {
+		t.Fatalf("expected 365 day validity and 1h skew, got %s and %s", cfg.CertTTL, cfg.NotBeforeSkew)
+	}
+}
+
+func TestEnsureTLSCertCustomNames(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_CN", "vault.internal")
+	t.Setenv("TLS_SELF_SIGNED_SANS", "vault.internal, registry.svc.cluster.local")
+	t.Setenv("TLS_SELF_SIGNED_IPS", "10.0.0.5, ::1")
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+
+	if err := ensureTLSCert(certPath, filepath.Join(dir, "registry.key")); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	leaf, _ := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if leaf.Subject.CommonName != "vault.internal" {
+		t.Fatalf("unexpected common name %q", leaf.Subject.CommonName)
+	}
+	if got := strings.Join(leaf.DNSNames, ","); got != "registry,localhost,vault.internal,registry.svc.cluster.local" {
+		t.Fatalf("unexpected DNS names %s", got)
+	}
+	if len(leaf.IPAddresses) != 2 || !leaf.IPAddresses[0].Equal(net.ParseIP("10.0.0.5")) || !leaf.IPAddresses[1].Equal(net.IPv6loopback) {
+		t.Fatalf("unexpected IP addresses %v", leaf.IPAddresses)
+	}
+	if err := leaf.VerifyHostname("10.0.0.5"); err != nil {
+		t.Fatalf("expected certificate to be valid for the IP: %v", err)
+	}
+}
+
+func TestLoadSelfSignedConfigRejectsInvalidIP(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_IPS", "10.0.0.5,not-an-ip")
+	if _, err := loadSelfSignedConfig(); err == nil || !strings.Contains(err.Error(), "not-an-ip") {
+		t.Fatalf("expected error naming the invalid IP, got %v", err)
+	}
+}
+
+func TestEnsureTLSCertRenewsExpiringLeaf(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "24h")
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+	keyPath := filepath.Join(dir, "registry.key")
+
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	first, root := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+
+	t.Setenv("TLS_SELF_SIGNED_RENEW_BEFORE", "1h")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	if same, _ := readTestChain(t, certPath, filepath.Join(dir, "ca.crt")); same.SerialNumber.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("expected leaf outside the renewal window to be kept")
+	}
+
+	t.Setenv("TLS_SELF_SIGNED_RENEW_BEFORE", "")
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	renewed, renewedRoot := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatalf("expected leaf expiring within 720h to be renewed")
+	}
+	if !renewedRoot.Equal(root) {
+		t.Fatalf("expected renewal to reuse the CA")
+	}
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("expected renewed key pair to match: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool { return e.Name() == ".tls.lock" })
+	if len(entries) != 4 {
+		t.Fatalf("expected no temporary files left behind, got %d entries", len(entries))
+	}
+}
+
+func TestEnsureTLSCertKeepsForeignCertificate(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_VALIDITY", "24h")
+	source := t.TempDir()
+	if err := ensureTLSCert(filepath.Join(source, "registry.crt"), filepath.Join(source, "registry.key")); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+
+	// A certificate the operator mounted has no ContainerVault CA next to it.
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+	keyPath := filepath.Join(dir, "registry.key")
+	for _, name := range []string{"registry.crt", "registry.key"} {
+		data, err := os.ReadFile(filepath.Join(source, name))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	before, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("read cert: %v", err)
+	}
+
+	if err := ensureTLSCert(certPath, keyPath); err != nil {
+		t.Fatalf("ensureTLSCert: %v", err)
+	}
+	after, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("read cert: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("expected a certificate without its CA to be left alone")
+	}
+}
+
+func TestEnsureTLSCertConcurrentInstances(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "registry.crt")
+	keyPath := filepath.Join(dir, "registry.key")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ensureTLSCert(certPath, keyPath)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("ensureTLSCert: %v", err)
+		}
+	}
+
+	if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		t.Fatalf("expected matching leaf key pair: %v", err)
+	}
+	if _, err := tls.LoadX509KeyPair(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatalf("expected matching CA key pair: %v", err)
+	}
+	leaf, root := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+	if err := leaf.CheckSignatureFrom(root); err != nil {
+		t.Fatalf("expected leaf to be signed by CA: %v", err)
+	}
+}
+
+func TestEnsureTLSCertKeyTypes(t *testing.T) {
+	cases := []struct {
+		keyType  string
+		pemType  string
+		checkKey func(crypto.PublicKey) bool
+	}{
+		{"ecdsa-p256", "EC PRIVATE KEY", func(pub crypto.PublicKey) bool {
+			key, ok := pub.(*ecdsa.PublicKey)
+			return ok && key.Curve == elliptic.P256()
+		}},
+		{"ecdsa-p384", "EC PRIVATE KEY", func(pub crypto.PublicKey) bool {
+			key, ok := pub.(*ecdsa.PublicKey)
+			return ok && key.Curve == elliptic.P384()
+		}},
+		{"ed25519", "PRIVATE KEY", func(pub crypto.PublicKey) bool {
+			_, ok := pub.(ed25519.PublicKey)
+			return ok
+		}},
+		{"rsa2048", "RSA PRIVATE KEY", func(pub crypto.PublicKey) bool {
+			key, ok := pub.(*rsa.PublicKey)
+			return ok && key.N.BitLen() == 2048
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.keyType, func(t *testing.T) {
+			t.Setenv("TLS_SELF_SIGNED_KEY_TYPE", tc.keyType)
+			dir := t.TempDir()
+			certPath := filepath.Join(dir, "registry.crt")
+			keyPath := filepath.Join(dir, "registry.key")
+
+			if err := ensureTLSCert(certPath, keyPath); err != nil {
+				t.Fatalf("ensureTLSCert: %v", err)
+			}
+			keyPEM, err := os.ReadFile(keyPath)
+			if err != nil {
+				t.Fatalf("read key: %v", err)
+			}
+			if block, _ := pem.Decode(keyPEM); block == nil || block.Type != tc.pemType {
+				t.Fatalf("expected %s PEM block", tc.pemType)
+			}
+			if _, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+				t.Fatalf("expected usable key pair: %v", err)
+			}
+			leaf, root := readTestChain(t, certPath, filepath.Join(dir, "ca.crt"))
+			if !tc.checkKey(leaf.PublicKey) {
+				t.Fatalf("unexpected leaf key %T", leaf.PublicKey)
+			}
+			if err := leaf.CheckSignatureFrom(root); err != nil {
+				t.Fatalf("expected leaf to be signed by CA: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadSelfSignedConfigKeyType(t *testing.T) {
+	t.Setenv("TLS_SELF_SIGNED_KEY_TYPE", "")
+	cfg, err := loadSelfSignedConfig()
+	if err != nil || cfg.KeyType != "rsa2048" {
+		t.Fatalf("expected rsa2048 default, got %q (%v)", cfg.KeyType, err)
+	}
+
+	t.Setenv("TLS_SELF_SIGNED_KEY_TYPE", "dsa1024")
+	if _, err := loadSelfSignedConfig(); err == nil || !strings.Contains(err.Error(), "dsa1024") {
+		t.Fatalf("expected error naming the unknown key type, got %v", err)
+	}
+}
+
 func TestLoadCertmagicConfigDisabled(t *testing.T) {
 	t.Setenv("CERTMAGIC_ENABLE", "")
 	t.Setenv("CERTMAGIC_DOMAINS", "")
@@ -88,6 +478,76 @@ func TestLoadCertmagicConfigParsing(t *testing.T) {
 	}
 }
 
+func TestCertmagicTLSConfigExternalAccountBinding(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_EAB_KEY_ID", "kid-1")
+	t.Setenv("CERTMAGIC_EAB_HMAC_KEY", "c2VjcmV0LWhtYWMta2V5==")
+
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	eab := certmagic.DefaultACME.ExternalAccount
+	if eab == nil || eab.KeyID != "kid-1" || eab.MACKey != "c2VjcmV0LWhtYWMta2V5" {
+		t.Fatalf("unexpected external account: %#v", eab)
+	}
+
+	t.Setenv("CERTMAGIC_EAB_HMAC_KEY", "not+base64url/")
+	if _, _, err := loadCertmagicConfig(); err == nil {
+		t.Fatalf("expected error for a malformed HMAC key")
+	}
+	for _, unset := range []string{"CERTMAGIC_EAB_KEY_ID", "CERTMAGIC_EAB_HMAC_KEY"} {
+		t.Setenv("CERTMAGIC_EAB_KEY_ID", "kid-1")
+		t.Setenv("CERTMAGIC_EAB_HMAC_KEY", "c2VjcmV0")
+		t.Setenv(unset, "")
+		if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "set together") {
+			t.Fatalf("expected error with only one EAB variable set, got %v", err)
+		}
+	}
+}
+
+func TestLoadCertmagicConfigWildcardDomains(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com,registry.example.com,*.registry.example.com")
+	certmagicDNSProvider = nil
+
+	if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "CERTMAGIC_DNS_PROVIDER") {
+		t.Fatalf("expected wildcard without DNS-01 to be refused, got %v", err)
+	}
+
+	t.Setenv("CERTMAGIC_DNS_PROVIDER", "cloudflare")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	var managed []string
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		managed = domains
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(managed, ",") != "example.com,registry.example.com,*.registry.example.com" {
+		t.Fatalf("expected domains to pass through unchanged, got %v", managed)
+	}
+
+	for _, domain := range []string{"*", "*.", "*example.com", "registry.*.example.com", "*.*.example.com"} {
+		t.Setenv("CERTMAGIC_DOMAINS", "example.com,"+domain)
+		if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "invalid wildcard") {
+			t.Fatalf("expected %q to be refused as an invalid wildcard, got %v", domain, err)
+		}
+	}
+}
+
 func TestCertmagicTLSConfigDisabled(t *testing.T) {
 	t.Setenv("CERTMAGIC_ENABLE", "")
 	t.Setenv("CERTMAGIC_DOMAINS", "")
@@ -181,6 +641,600 @@ func TestCertmagicTLSConfigAppliesCARootAndStorage(t *testing.T) {
 	}
 }
 
+func TestLoadCertmagicConfigDNSPropagation(t *testing.T) {
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_DNS_PROPAGATION_TIMEOUT", "10m")
+	t.Setenv("CERTMAGIC_DNS_PROPAGATION_DELAY", "45s")
+
+	cfg, _, err := loadCertmagicConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DNSPropagationTimeout != 10*time.Minute || cfg.DNSPropagationDelay != 45*time.Second {
+		t.Fatalf("unexpected propagation settings: %#v", cfg)
+	}
+
+	t.Setenv("CERTMAGIC_DNS_PROPAGATION_TIMEOUT", "soon")
+	if _, _, err := loadCertmagicConfig(); err == nil {
+		t.Fatalf("expected error for invalid propagation timeout")
+	}
+}
+
+func TestCertmagicTLSConfigAppliesDNSPropagation(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_DNS_PROPAGATION_TIMEOUT", "10m")
+	t.Setenv("CERTMAGIC_DNS_PROPAGATION_DELAY", "30s")
+
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	certmagicDNSProvider = fakeDNSProvider{}
+
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	solver, ok := certmagic.DefaultACME.DNS01Solver.(*certmagic.DNS01Solver)
+	if !ok {
+		t.Fatalf("expected DNS01 solver, got %T", certmagic.DefaultACME.DNS01Solver)
+	}
+	if solver.PropagationTimeout != 10*time.Minute || solver.PropagationDelay != 30*time.Second {
+		t.Fatalf("unexpected solver durations: timeout=%s delay=%s", solver.PropagationTimeout, solver.PropagationDelay)
+	}
+}
+
+func TestCertmagicTLSConfigUsesConfiguredDNSProvider(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "*.example.com,example.com")
+	t.Setenv("CERTMAGIC_DNS_PROVIDER", "Cloudflare")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	certmagicDNSProvider = nil
+
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := certmagicDNSProvider.(*cloudflareDNS); !ok {
+		t.Fatalf("expected cloudflare DNS provider, got %T", certmagicDNSProvider)
+	}
+	solver, ok := certmagic.DefaultACME.DNS01Solver.(*certmagic.DNS01Solver)
+	if !ok || solver.DNSProvider != certmagicDNSProvider {
+		t.Fatalf("expected DNS01 solver using the provider, got %#v", certmagic.DefaultACME.DNS01Solver)
+	}
+
+	t.Setenv("CERTMAGIC_DNS_PROVIDER", "bind")
+	if _, _, err := loadCertmagicConfig(); err == nil {
+		t.Fatalf("expected error for unsupported DNS provider")
+	}
+}
+
+func TestCertmagicTLSConfigUsesIssuanceLimit(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "a.example.com,b.example.com")
+	t.Setenv("CERTMAGIC_MAX_CONCURRENT_ISSUANCE", "1")
+
+	origTLS, origLimited := certmagicTLS, certmagicLimitedTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		t.Fatalf("expected the limited certmagic setup to be used")
+		return nil, nil
+	}
+	gotLimit := 0
+	certmagicLimitedTLS = func(domains []string, maxIssuance int) (*tls.Config, error) {
+		gotLimit = maxIssuance
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS, certmagicLimitedTLS = origTLS, origLimited
+	})
+
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotLimit != 1 {
+		t.Fatalf("expected issuance limit 1, got %d", gotLimit)
+	}
+}
+
+func TestCertmagicTLSConfigOCSPStapling(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+
+	for _, tc := range []struct {
+		env     string
+		disable bool
+	}{
+		{env: "", disable: false},
+		{env: "false", disable: true},
+		{env: "true", disable: false},
+	} {
+		if tc.env != "" {
+			t.Setenv("CERTMAGIC_OCSP_STAPLING", tc.env)
+		}
+		cfg, enabled, err := certmagicTLSConfig()
+		if err != nil || !enabled || cfg == nil {
+			t.Fatalf("CERTMAGIC_OCSP_STAPLING=%q: unexpected result enabled=%v err=%v", tc.env, enabled, err)
+		}
+		if certmagic.Default.OCSP.DisableStapling != tc.disable {
+			t.Fatalf("CERTMAGIC_OCSP_STAPLING=%q: expected DisableStapling=%v", tc.env, tc.disable)
+		}
+		magic := newManagedCertmagic(0)
+		if magic.OCSP.DisableStapling != tc.disable {
+			t.Fatalf("CERTMAGIC_OCSP_STAPLING=%q: managed config did not inherit the stapling setting", tc.env)
+		}
+		if magic.TLSConfig().GetCertificate == nil {
+			t.Fatalf("expected certmagic to serve certificates through GetCertificate")
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	for raw, want := range map[string]uint16{"": tls.VersionTLS12, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		t.Setenv("TLS_MIN_VERSION", raw)
+		got, err := tlsMinVersion()
+		if err != nil || got != want {
+			t.Fatalf("TLS_MIN_VERSION=%q: expected %x, got %x (%v)", raw, want, got, err)
+		}
+	}
+	for _, raw := range []string{"1.1", "1.0", "tls1.3"} {
+		t.Setenv("TLS_MIN_VERSION", raw)
+		if _, err := tlsMinVersion(); err == nil {
+			t.Fatalf("TLS_MIN_VERSION=%q: expected error", raw)
+		}
+	}
+}
+
+func TestTLSCipherSuites(t *testing.T) {
+	t.Setenv("TLS_CIPHER_SUITES", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	suites, err := tlsCipherSuites(tls.VersionTLS12)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if !slices.Equal(suites, want) {
+		t.Fatalf("expected %v, got %v", want, suites)
+	}
+
+	if _, err := tlsCipherSuites(tls.VersionTLS13); err == nil || !strings.Contains(err.Error(), "not configurable") {
+		t.Fatalf("expected TLS 1.3 conflict error, got %v", err)
+	}
+
+	for _, name := range []string{"TLS_BOGUS", "TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"} {
+		t.Setenv("TLS_CIPHER_SUITES", name)
+		if _, err := tlsCipherSuites(tls.VersionTLS12); err == nil {
+			t.Fatalf("expected error for %s", name)
+		}
+	}
+
+	t.Setenv("TLS_CIPHER_SUITES", "")
+	if suites, err := tlsCipherSuites(tls.VersionTLS13); err != nil || suites != nil {
+		t.Fatalf("expected defaults when unset, got %v (%v)", suites, err)
+	}
+}
+
+func TestCertmagicTLSConfigMinVersion(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("TLS_MIN_VERSION", "1.3")
+
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+
+	cfg, _, err := certmagicTLSConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3 minimum, got %x", cfg.MinVersion)
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.1")
+	if _, _, err := certmagicTLSConfig(); err == nil {
+		t.Fatalf("expected error for unsupported TLS_MIN_VERSION")
+	}
+}
+
+func TestLoadCertmagicConfigRejectsNegativeIssuanceLimit(t *testing.T) {
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_MAX_CONCURRENT_ISSUANCE", "-1")
+
+	if _, _, err := loadCertmagicConfig(); err == nil {
+		t.Fatalf("expected error for negative issuance limit")
+	}
+}
+
+func TestLoadCertmagicConfigSharedTLSALPNRejectsOtherPort(t *testing.T) {
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_TLS_ALPN_SHARED", "true")
+	t.Setenv("CERTMAGIC_TLS_ALPN_PORT", "9443")
+
+	if _, _, err := loadCertmagicConfig(); err == nil {
+		t.Fatalf("expected error for a TLS-ALPN port other than the main listener")
+	}
+
+	t.Setenv("CERTMAGIC_TLS_ALPN_PORT", "8443")
+	cfg, _, err := loadCertmagicConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.SharedTLSALPN {
+		t.Fatalf("expected shared TLS-ALPN")
+	}
+}
+
+func TestCertmagicOnDemandDecision(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "")
+	t.Setenv("CERTMAGIC_ON_DEMAND", "true")
+
+	if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "CERTMAGIC_ON_DEMAND_SUFFIXES") {
+		t.Fatalf("expected on-demand without suffixes to be refused, got %v", err)
+	}
+	for _, suffix := range []string{"*", "com", "*.*.example.com"} {
+		t.Setenv("CERTMAGIC_ON_DEMAND_SUFFIXES", suffix)
+		if _, _, err := loadCertmagicConfig(); err == nil {
+			t.Fatalf("expected suffix %q to be refused", suffix)
+		}
+	}
+
+	t.Setenv("CERTMAGIC_ON_DEMAND_SUFFIXES", "*.tenants.example.com, .Other.example.com")
+	cfg, enabled, err := loadCertmagicConfig()
+	if err != nil || !enabled {
+		t.Fatalf("expected on-demand to enable certmagic without domains, got %v", err)
+	}
+	if strings.Join(cfg.OnDemandSuffixes, ",") != "tenants.example.com,other.example.com" {
+		t.Fatalf("unexpected suffixes %v", cfg.OnDemandSuffixes)
+	}
+
+	t.Setenv("CERTMAGIC_DOMAINS", "registry.example.com")
+	var managed []string
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		managed = domains
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(managed, ",") != "registry.example.com" {
+		t.Fatalf("expected the listed domains to be managed, got %v", managed)
+	}
+	if certmagic.Default.OnDemand == nil || certmagic.Default.OnDemand.DecisionFunc == nil {
+		t.Fatalf("expected an on-demand decision func")
+	}
+	decide := certmagic.Default.OnDemand.DecisionFunc
+	for name, allowed := range map[string]bool{
+		"registry.example.com":      true,
+		"acme.tenants.example.com":  true,
+		"beta.other.example.com":    true,
+		"tenants.example.com":       false,
+		"a.b.tenants.example.com":   false,
+		"acme.tenants.example.com.": true,
+		"evil.example.net":          false,
+	} {
+		if err := decide(context.Background(), name); (err == nil) != allowed {
+			t.Fatalf("decision for %s: got %v, want allowed=%v", name, err, allowed)
+		}
+	}
+}
+
+func TestCertmagicOnDemandMaxDomains(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "registry.example.com")
+	t.Setenv("CERTMAGIC_ON_DEMAND", "true")
+	t.Setenv("CERTMAGIC_ON_DEMAND_SUFFIXES", "tenants.example.com")
+	t.Setenv("CERTMAGIC_MAX_DOMAINS", "-1")
+	if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "CERTMAGIC_MAX_DOMAINS") {
+		t.Fatalf("expected a negative cap to be refused, got %v", err)
+	}
+	t.Setenv("CERTMAGIC_MAX_DOMAINS", "2")
+	cfg, _, err := loadCertmagicConfig()
+	if err != nil || cfg.MaxDomains != 2 {
+		t.Fatalf("expected a cap of 2, got %d, %v", cfg.MaxDomains, err)
+	}
+
+	decide := onDemandDecision(cfg.Domains, cfg.OnDemandSuffixes, cfg.MaxDomains)
+	ctx := context.Background()
+	for _, name := range []string{"a.tenants.example.com", "B.tenants.example.com."} {
+		if err := decide(ctx, name); err != nil {
+			t.Fatalf("expected %s within the cap, got %v", name, err)
+		}
+	}
+	if err := decide(ctx, "c.tenants.example.com"); err == nil || !strings.Contains(err.Error(), "CERTMAGIC_MAX_DOMAINS") {
+		t.Fatalf("expected a third domain to be refused, got %v", err)
+	}
+	// Managed names are still served and renewed, and listed domains are
+	// not counted.
+	for _, name := range []string{"a.tenants.example.com", "b.tenants.example.com", "registry.example.com"} {
+		if err := decide(ctx, name); err != nil {
+			t.Fatalf("expected %s to keep working at the cap, got %v", name, err)
+		}
+	}
+	if err := decide(ctx, "evil.example.net"); err == nil || !strings.Contains(err.Error(), "not covered") {
+		t.Fatalf("expected names outside the allowlist to be refused as before, got %v", err)
+	}
+}
+
+func TestCertmagicTLSConfigUsesStorageBackend(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_STORAGE_BACKEND", "redis")
+	t.Setenv("CERTMAGIC_REDIS_ADDR", "redis:6379")
+	t.Setenv("CERTMAGIC_STORAGE", "/data/certmagic")
+
+	if _, _, err := loadCertmagicConfig(); err == nil || !strings.Contains(err.Error(), "CERTMAGIC_STORAGE") {
+		t.Fatalf("expected CERTMAGIC_STORAGE to be refused with a shared backend, got %v", err)
+	}
+
+	t.Setenv("CERTMAGIC_STORAGE", "")
+	origTLS := certmagicTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		return &tls.Config{MinVersion: tls.VersionTLS12}, nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS = origTLS
+	})
+	if _, _, err := certmagicTLSConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if storage, ok := certmagic.Default.Storage.(*redisStorage); !ok || storage.addr != "redis:6379" {
+		t.Fatalf("expected the redis storage to be installed, got %#v", certmagic.Default.Storage)
+	}
+}
+
+func TestSharedTLSALPNHandshakeOnMainListener(t *testing.T) {
+	restoreCertmagicDefaults(t)
+	storagePath := t.TempDir()
+	t.Setenv("CERTMAGIC_DOMAINS", "example.com")
+	t.Setenv("CERTMAGIC_TLS_ALPN_SHARED", "true")
+	t.Setenv("CERTMAGIC_STORAGE", storagePath)
+
+	// Store the challenge the way certmagic does for distributed solving, so
+	// GetCertificate can answer it without a solver listener of its own.
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+	}
+	chalJSON, err := json.Marshal(chal)
+	if err != nil {
+		t.Fatalf("marshal challenge: %v", err)
+	}
+	tokenPath := filepath.Join(storagePath, "acme", "counting", "challenge_tokens", "example.com.json")
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(tokenPath, chalJSON, 0o600); err != nil {
+		t.Fatalf("write challenge: %v", err)
+	}
+
+	origTLS, origShared := certmagicTLS, certmagicSharedTLS
+	certmagicTLS = func(domains []string) (*tls.Config, error) {
+		t.Fatalf("expected the shared certmagic setup to be used")
+		return nil, nil
+	}
+	certmagicSharedTLS = func(domains []string, maxIssuance int) (*tls.Config, error) {
+		magic := certmagic.New(certmagic.NewCache(certmagic.CacheOptions{
+			GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) { return nil, nil },
+		}), certmagic.Config{Storage: certmagic.Default.Storage})
+		magic.Issuers = []certmagic.Issuer{&countingIssuer{}}
+		return magic.TLSConfig(), nil
+	}
+	t.Cleanup(func() {
+		certmagicTLS, certmagicSharedTLS = origTLS, origShared
+	})
+
+	tlsCfg, _, err := certmagicTLSConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if certmagic.DefaultACME.AltTLSALPNPort != tlsListenPort {
+		t.Fatalf("expected TLS-ALPN on the main port, got %d", certmagic.DefaultACME.AltTLSALPNPort)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = tlsCfg
+	applySNIAllowlist(server.TLS, []string{"example.com"})
+	server.StartTLS()
+	defer server.Close()
+
+	// #nosec G402 -- the challenge certificate is self-signed by design
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatalf("acme-tls/1 handshake: %v", err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		t.Fatalf("expected acme-tls/1, got %q", state.NegotiatedProtocol)
+	}
+	acmeIdentifier := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+	leaf := state.PeerCertificates[0]
+	found := false
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(acmeIdentifier) {
+			found = true
+		}
+	}
+	if !found || len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.com" {
+		t.Fatalf("expected the TLS-ALPN challenge certificate, got %v", leaf.DNSNames)
+	}
+}
+
+// countingIssuer records the highest number of Issue calls in flight at once.
+type countingIssuer struct {
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	issued   int
+}
+
+func (c *countingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.peak {
+		c.peak = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.issued++
+	c.mu.Unlock()
+	return &certmagic.IssuedCertificate{}, nil
+}
+
+func (c *countingIssuer) IssuerKey() string { return "counting" }
+
+func TestIssuanceLimiterSerializesObtainCalls(t *testing.T) {
+	for _, tc := range []struct {
+		limit, wantPeak int
+	}{
+		{limit: 1, wantPeak: 1},
+		{limit: 2, wantPeak: 2},
+	} {
+		issuer := &countingIssuer{}
+		limiter := newIssuanceLimiter(issuer, tc.limit)
+		var wg sync.WaitGroup
+		for _, domain := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				csr := &x509.CertificateRequest{DNSNames: []string{domain}}
+				if _, err := limiter.Issue(context.Background(), csr); err != nil {
+					t.Errorf("issue %s: %v", domain, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if issuer.issued != 4 || issuer.peak != tc.wantPeak {
+			t.Fatalf("limit %d: expected 4 issued with peak %d, got %d with peak %d", tc.limit, tc.wantPeak, issuer.issued, issuer.peak)
+		}
+	}
+}
+
+func TestIssuanceLimiterHonorsContext(t *testing.T) {
+	limiter := newIssuanceLimiter(&countingIssuer{}, 1)
+	limiter.slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := limiter.Issue(ctx, &x509.CertificateRequest{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled while waiting for a slot, got %v", err)
+	}
+}
+
+func TestDNS01SolverWithoutProvider(t *testing.T) {
+	if solver := dns01Solver(certmagicConfig{DNSPropagationTimeout: time.Minute}, nil); solver != nil {
+		t.Fatalf("expected no solver without DNS provider")
+	}
+}
+
+type fakeDNSProvider struct{}
+
+func (fakeDNSProvider) AppendRecords(_ context.Context, _ string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, nil
+}
+
+func (fakeDNSProvider) DeleteRecords(_ context.Context, _ string, recs []libdns.Record) ([]libdns.Record, error) {
+	return recs, nil
+}
+
+func TestSNIAllowlistHandshake(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	applySNIAllowlist(server.TLS, []string{"registry.example.com", "*.teams.example.com"})
+	server.StartTLS()
+	defer server.Close()
+
+	addr := server.Listener.Addr().String()
+	handshake := func(serverName string) error {
+		// #nosec G402 -- test server uses a throwaway certificate
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if err := handshake("registry.example.com"); err != nil {
+		t.Fatalf("expected allowed SNI to succeed: %v", err)
+	}
+	if err := handshake("team1.teams.example.com"); err != nil {
+		t.Fatalf("expected wildcard SNI to succeed: %v", err)
+	}
+	if err := handshake("scanner.invalid"); err == nil {
+		t.Fatalf("expected disallowed SNI to be refused")
+	}
+}
+
+func TestLoadSNIAllowlist(t *testing.T) {
+	t.Setenv("TLS_ALLOWED_SNI", "")
+	t.Setenv("TLS_REQUIRE_SNI", "")
+	t.Setenv("CERTMAGIC_DOMAINS", "registry.example.com")
+	if got := loadSNIAllowlist(); len(got) != 0 {
+		t.Fatalf("expected SNI check disabled by default, got %v", got)
+	}
+
+	t.Setenv("TLS_REQUIRE_SNI", "true")
+	if got := loadSNIAllowlist(); len(got) != 1 || got[0] != "registry.example.com" {
+		t.Fatalf("expected certmagic domains, got %v", got)
+	}
+
+	t.Setenv("CERTMAGIC_ON_DEMAND", "true")
+	t.Setenv("CERTMAGIC_ON_DEMAND_SUFFIXES", "tenants.example.com")
+	if got := loadSNIAllowlist(); strings.Join(got, ",") != "registry.example.com,*.tenants.example.com" {
+		t.Fatalf("expected on-demand suffixes to be allowed, got %v", got)
+	}
+
+	t.Setenv("TLS_ALLOWED_SNI", "a.example.com, b.example.com")
+	if got := loadSNIAllowlist(); len(got) != 2 || got[1] != "b.example.com" {
+		t.Fatalf("expected explicit allowlist, got %v", got)
+	}
+}
+
+func TestSNIAllowedRejectsEmptyName(t *testing.T) {
+	if sniAllowed("", []string{"registry.example.com"}) {
+		t.Fatalf("expected empty SNI to be rejected")
+	}
+}
+
 func writeTestCA(t *testing.T, certPath, keyPath string) (*x509.Certificate, *rsa.PrivateKey) {
 	t.Helper()
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -266,21 +1320,62 @@ func generateLeafCert(t *testing.T, ca *x509.Certificate, caKey *rsa.PrivateKey,
 	return cert
 }
 
+func readTestChain(t *testing.T, certPath, caPath string) (*x509.Certificate, *x509.Certificate) {
+	t.Helper()
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("read cert: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("no certificate in %s", certPath)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse leaf: %v", err)
+	}
+	caPEM, err := os.ReadFile(caPath)
+	if err != nil {
+		t.Fatalf("read CA: %v", err)
+	}
+	block, _ = pem.Decode(caPEM)
+	if block == nil {
+		t.Fatalf("no certificate in %s", caPath)
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse root: %v", err)
+	}
+	return leaf, root
+}
+
 func restoreCertmagicDefaults(t *testing.T) {
 	t.Helper()
 	prevEmail := certmagic.DefaultACME.Email
 	prevCA := certmagic.DefaultACME.CA
+	prevEAB := certmagic.DefaultACME.ExternalAccount
 	prevAltHTTP := certmagic.DefaultACME.AltHTTPPort
 	prevAltTLS := certmagic.DefaultACME.AltTLSALPNPort
 	prevRoots := certmagic.DefaultACME.TrustedRoots
 	prevStorage := certmagic.Default.Storage
+	prevDNS01 := certmagic.DefaultACME.DNS01Solver
+	prevDNSProvider := certmagicDNSProvider
+	prevOCSP := certmagic.Default.OCSP
+	prevOnDemand := certmagic.Default.OnDemand
+	prevOnEvent := certmagic.Default.OnEvent
 
 	t.Cleanup(func() {
 		certmagic.DefaultACME.Email = prevEmail
 		certmagic.DefaultACME.CA = prevCA
+		certmagic.DefaultACME.ExternalAccount = prevEAB
 		certmagic.DefaultACME.AltHTTPPort = prevAltHTTP
 		certmagic.DefaultACME.AltTLSALPNPort = prevAltTLS
 		certmagic.DefaultACME.TrustedRoots = prevRoots
 		certmagic.Default.Storage = prevStorage
+		certmagic.DefaultACME.DNS01Solver = prevDNS01
+		certmagicDNSProvider = prevDNSProvider
+		certmagic.Default.OCSP = prevOCSP
+		certmagic.Default.OnDemand = prevOnDemand
+		certmagic.Default.OnEvent = prevOnEvent
 	})
 }
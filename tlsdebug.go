@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"strings"
+)
+
+// applyTLSDebugLog logs each ClientHello and, once a handshake completes,
+// the negotiated version, cipher suite, ALPN protocol and SNI, for
+// DEBUG_TLS. Hellos are logged first so clients whose handshake then fails
+// still leave a line with what they offered.
+func applyTLSDebugLog(cfg *tls.Config) {
+	nextConfig := cfg.GetConfigForClient
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		remote := ""
+		if hello.Conn != nil {
+			remote = hello.Conn.RemoteAddr().String()
+		}
+		versions := make([]string, 0, len(hello.SupportedVersions))
+		for _, v := range hello.SupportedVersions {
+			versions = append(versions, tls.VersionName(v))
+		}
+		log.Printf("DEBUG tls hello from %s sni=%q versions=%s alpn=%s", remote, hello.ServerName, strings.Join(versions, ","), strings.Join(hello.SupportedProtos, ","))
+		if nextConfig != nil {
+			return nextConfig(hello)
+		}
+		return nil, nil
+	}
+	nextVerify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		log.Printf("DEBUG tls handshake sni=%q version=%s cipher=%s alpn=%q resumed=%t", state.ServerName, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol, state.DidResume)
+		if nextVerify != nil {
+			return nextVerify(state)
+		}
+		return nil
+	}
+}
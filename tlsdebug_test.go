@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func startTLSDebugServer(t *testing.T, configure func(*tls.Config)) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{NextProtos: []string{"http/1.1"}, MinVersion: tls.VersionTLS12}
+	configure(server.TLS)
+	applyTLSDebugLog(server.TLS)
+	server.StartTLS()
+	return server
+}
+
+func TestTLSDebugLogsNegotiatedHandshake(t *testing.T) {
+	logs := captureLogs(t)
+	server := startTLSDebugServer(t, func(*tls.Config) {})
+
+	// #nosec G402 -- httptest's certificate is self-signed
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		ServerName:         "registry.example.com",
+		NextProtos:         []string{"http/1.1"},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: registry.example.com\r\nConnection: close\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	conn.Close()
+	// Close waits for the connection, so the handshake has been logged.
+	server.Close()
+
+	out := logs.String()
+	for _, want := range []string{
+		`DEBUG tls hello from 127.0.0.1:`,
+		`DEBUG tls handshake sni="registry.example.com" version=TLS 1.3 cipher=TLS_`,
+		`alpn="http/1.1"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in the log, got:\n%s", want, out)
+		}
+	}
+}
+
+func TestTLSDebugKeepsExistingCallbacks(t *testing.T) {
+	logs := captureLogs(t)
+	server := startTLSDebugServer(t, func(cfg *tls.Config) {
+		applySNIAllowlist(cfg, []string{"registry.example.com"})
+	})
+
+	// #nosec G402 -- httptest's certificate is self-signed
+	_, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{
+		ServerName:         "other.example.com",
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err == nil {
+		t.Fatalf("expected the SNI allowlist to still refuse the handshake")
+	}
+	server.Close()
+
+	out := logs.String()
+	if !strings.Contains(out, `DEBUG tls hello from`) || !strings.Contains(out, `sni="other.example.com"`) {
+		t.Fatalf("expected the refused hello to be logged, got:\n%s", out)
+	}
+	if strings.Contains(out, "DEBUG tls handshake ") {
+		t.Fatalf("expected no negotiated handshake, got:\n%s", out)
+	}
+}
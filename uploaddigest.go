@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadSessionTTL drops hashes of uploads that were opened but never
+// finalized or cancelled.
+const uploadSessionTTL = 24 * time.Hour
+
+func loadAllowedDigestAlgs() []string {
+	raw := splitCommaList(os.Getenv("ALLOWED_DIGEST_ALGS"))
+	var algs []string
+	for _, alg := range raw {
+		alg = strings.ToLower(alg)
+		if newDigestHash(alg) == nil {
+			log.Printf("ignoring ALLOWED_DIGEST_ALGS entry %q: unsupported algorithm", alg)
+			continue
+		}
+		algs = append(algs, alg)
+	}
+	if len(raw) > 0 && len(algs) == 0 {
+		log.Printf("ALLOWED_DIGEST_ALGS lists no supported algorithm, allowing sha256 only")
+		algs = []string{"sha256"}
+	}
+	return algs
+}
+
+func newDigestHash(alg string) hash.Hash {
+	switch alg {
+	case "sha256":
+		return sha256.New()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
+// uploadHashes follows the bytes of one blob upload through every allowed
+// algorithm, since the client only names its algorithm when it finalizes.
+type uploadHashes struct {
+	mu     sync.Mutex
+	hashes map[string]hash.Hash
+	size   int64
+	opened time.Time
+}
+
+func newUploadHashes(algs []string) *uploadHashes {
+	s := &uploadHashes{hashes: map[string]hash.Hash{}, opened: time.Now()}
+	for _, alg := range algs {
+		s.hashes[alg] = newDigestHash(alg)
+	}
+	return s
+}
+
+func (s *uploadHashes) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range s.hashes {
+		_, _ = h.Write(p)
+	}
+	s.size += int64(len(p))
+	return len(p), nil
+}
+
+func (s *uploadHashes) sum(alg string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return hex.EncodeToString(s.hashes[alg].Sum(nil))
+}
+
+func (s *uploadHashes) written() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// uploadDigestTracker holds the hashes of upload sessions opened through this
+// proxy, by upload UUID.
+type uploadDigestTracker struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadHashes
+}
+
+func newUploadDigestTracker() *uploadDigestTracker {
+	return &uploadDigestTracker{sessions: map[string]*uploadHashes{}}
+}
+
+func (t *uploadDigestTracker) open(uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, s := range t.sessions {
+		if time.Since(s.opened) > uploadSessionTTL {
+			delete(t.sessions, id)
+		}
+	}
+	t.sessions[uuid] = newUploadHashes(allowedDigestAlgs)
+}
+
+func (t *uploadDigestTracker) get(uuid string) *uploadHashes {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessions[uuid]
+}
+
+// take removes and returns the session, which a finalization ends whether
+// or not it succeeds.
+func (t *uploadDigestTracker) take(uuid string) *uploadHashes {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.sessions[uuid]
+	delete(t.sessions, uuid)
+	return s
+}
+
+func (t *uploadDigestTracker) drop(uuid string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, uuid)
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// uploadRouteUUID returns the session UUID of an upload path, or "" for the
+// POST that opens one.
+func uploadRouteUUID(route registryRoute) string {
+	return strings.Trim(strings.TrimPrefix(route.Reference, "uploads"), "/")
+}
+
+// enforceUploadDigest refuses uploads finalized with a digest algorithm
+// outside ALLOWED_DIGEST_ALGS and, when this proxy saw every byte of the
+// blob, checks the digest itself. Chunk bodies are hashed as they stream to
+// the registry; the finalizing body is spooled through the hashes and
+// refused with 400 DIGEST_INVALID before it is forwarded if the digest does
+// not match. Uploads whose bytes were not all seen here are left to the
+// registry's own check.
+func enforceUploadDigest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if len(allowedDigestAlgs) == 0 {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || !route.isUpload() {
+		return r, true
+	}
+	uuid := uploadRouteUUID(route)
+
+	if r.Method == http.MethodPatch {
+		if s := uploadDigests.get(uuid); s != nil && r.Body != nil {
+			r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, s), Closer: r.Body}
+		}
+		return r, true
+	}
+
+	raw := r.URL.Query().Get("digest")
+	if raw == "" || (r.Method != http.MethodPut && r.Method != http.MethodPost) {
+		return r, true
+	}
+	digest, err := (digestPolicy{}).normalizeDigest(raw)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return nil, false
+	}
+	alg, want, _ := strings.Cut(digest, ":")
+	if !slices.Contains(allowedDigestAlgs, alg) {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("digest algorithm %s is not allowed, use %s", alg, strings.Join(allowedDigestAlgs, " or ")))
+		return nil, false
+	}
+
+	// A POST with a digest is a monolithic upload: its body is the blob.
+	var s *uploadHashes
+	if r.Method == http.MethodPost {
+		s = newUploadHashes([]string{alg})
+	} else if s = uploadDigests.take(uuid); s == nil || !upstreamUploadAt(r, s.written()) {
+		return r, true
+	}
+
+	f, err := os.CreateTemp("", "cv-upload-")
+	if err != nil {
+		log.Printf("upload spool failed: %v", err)
+		writeRegistryError(w, http.StatusInternalServerError, "UNKNOWN", "unable to buffer upload")
+		return nil, false
+	}
+	// Unlink right away so the spool disappears with the last file handle.
+	_ = os.Remove(f.Name())
+	n, err := io.Copy(io.MultiWriter(f, s), r.Body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		writeRegistryError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "unable to read upload")
+		return nil, false
+	}
+	if got := s.sum(alg); got != want {
+		_ = f.Close()
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", fmt.Sprintf("uploaded content has digest %s:%s, not %s", alg, got, digest))
+		return nil, false
+	}
+	// The transport closes the body once it has been sent, releasing the spool.
+	r.Body = f
+	r.ContentLength = n
+	return r, true
+}
+
+// upstreamUploadAt asks the registry how much of the upload it holds and
+// reports whether that is the size this proxy hashed, so chunks sent through
+// another proxy never cause a false mismatch.
+func upstreamUploadAt(r *http.Request, size int64) bool {
+	query := r.URL.Query()
+	query.Del("digest")
+	statusURL := upstream.ResolveReference(&url.URL{Path: r.URL.Path, RawQuery: query.Encode()})
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, statusURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	client := &http.Client{Transport: proxyTransport, Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent && uploadRangeCovers(resp.Header.Get("Range"), size)
+}
+
+// uploadRangeCovers reports whether an upload's Range header, "0-<last
+// byte>", describes size bytes. The registry reports an empty upload as
+// "0-0", the same as a single byte.
+func uploadRangeCovers(header string, size int64) bool {
+	start, end, ok := strings.Cut(header, "-")
+	if !ok || start != "0" {
+		return false
+	}
+	last, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return false
+	}
+	return last+1 == size || (last == 0 && size == 0)
+}
+
+// trackUploadDigest starts hashing sessions the registry opens and forgets
+// them once a chunk lands somewhere other than where this proxy expected, or
+// the upload ends.
+func trackUploadDigest(resp *http.Response) error {
+	if len(allowedDigestAlgs) == 0 || resp.Request == nil {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || !route.isUpload() {
+		return nil
+	}
+	uuid := uploadRouteUUID(route)
+	switch resp.Request.Method {
+	case http.MethodPost:
+		if opened := openedUploadUUID(resp); resp.StatusCode == http.StatusAccepted && opened != "" {
+			uploadDigests.open(opened)
+		}
+	case http.MethodPatch:
+		s := uploadDigests.get(uuid)
+		if s != nil && (resp.StatusCode != http.StatusAccepted || !uploadRangeCovers(resp.Header.Get("Range"), s.written())) {
+			uploadDigests.drop(uuid)
+		}
+	case http.MethodPut, http.MethodDelete:
+		uploadDigests.drop(uuid)
+	}
+	return nil
+}
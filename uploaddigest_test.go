@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withAllowedDigestAlgs(t *testing.T, algs ...string) {
+	t.Helper()
+	prevAlgs, prevTracker := allowedDigestAlgs, uploadDigests
+	allowedDigestAlgs, uploadDigests = algs, newUploadDigestTracker()
+	t.Cleanup(func() { allowedDigestAlgs, uploadDigests = prevAlgs, prevTracker })
+}
+
+func TestUploadFinalizedWithSHA256(t *testing.T) {
+	withAllowedDigestAlgs(t, "sha256")
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	location := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+	if rec := serveProxyRequestBody(t, http.MethodPatch, location, strings.NewReader("hello ")); rec.Code != http.StatusAccepted {
+		t.Fatalf("expected chunk to be accepted, got %d", rec.Code)
+	}
+	digest := testDigest([]byte("hello world"))
+	rec := serveProxyRequestBody(t, http.MethodPut, location+"?digest="+digest, strings.NewReader("world"))
+	if rec.Code != http.StatusCreated || string(registry.blobs[digest]) != "hello world" {
+		t.Fatalf("expected the upload to complete, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The proxy hashed both chunks and refuses a wrong digest itself.
+	location = serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+	serveProxyRequestBody(t, http.MethodPatch, location, strings.NewReader("hello "))
+	rec = serveProxyRequestBody(t, http.MethodPut, location+"?digest="+digest, strings.NewReader("there"))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "DIGEST_INVALID") {
+		t.Fatalf("expected 400 DIGEST_INVALID, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, ok := registry.uploads[strings.TrimPrefix(location, "/v2/team1/app/blobs/uploads/")]; !ok {
+		t.Fatalf("expected the mismatched finalization not to reach the registry")
+	}
+}
+
+func TestUploadFinalizedWithDisallowedAlgorithm(t *testing.T) {
+	withAllowedDigestAlgs(t, "sha256")
+	registry := newFakeRegistry()
+	calls := withProxyUpstream(t, registry.roundTrip)
+
+	location := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+	sum := sha512.Sum512([]byte("hello world"))
+	before := *calls
+	rec := serveProxyRequestBody(t, http.MethodPut, location+"?digest=sha512:"+hex.EncodeToString(sum[:]), strings.NewReader("hello world"))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "sha512 is not allowed") {
+		t.Fatalf("expected 400 for a disallowed algorithm, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if *calls != before {
+		t.Fatalf("expected a disallowed algorithm not to reach the registry")
+	}
+
+	rec = serveProxyRequestBody(t, http.MethodPost, "/v2/team1/app/blobs/uploads/?digest=sha384:abc", strings.NewReader("hello world"))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unsupported algorithm, got %d", rec.Code)
+	}
+}
+
+func TestUploadDigestLeftToRegistryForUnseenChunks(t *testing.T) {
+	withAllowedDigestAlgs(t, "sha256", "sha512")
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+
+	location := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/").Header().Get("Location")
+	serveProxyRequestBody(t, http.MethodPatch, location, strings.NewReader("hello "))
+	// A chunk sent through another proxy.
+	session := strings.TrimPrefix(location, "/v2/team1/app/blobs/uploads/")
+	registry.uploads[session] = append(registry.uploads[session], "brave "...)
+
+	digest := testDigest([]byte("hello brave world"))
+	rec := serveProxyRequestBody(t, http.MethodPut, location+"?digest="+digest, strings.NewReader("world"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected the registry to accept the upload, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUploadRangeCovers(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		size   int64
+		want   bool
+	}{
+		{"0-9", 10, true},
+		{"0-9", 9, false},
+		{"0-0", 0, true},
+		{"0-0", 1, true},
+		{"5-9", 5, false},
+		{"", 0, false},
+	} {
+		if got := uploadRangeCovers(tc.header, tc.size); got != tc.want {
+			t.Fatalf("uploadRangeCovers(%q, %d) = %v, want %v", tc.header, tc.size, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type uploadLimitConfig struct {
+	// MaxPerNamespace caps open blob upload sessions per namespace. Zero
+	// disables the limit.
+	MaxPerNamespace int
+	// Idle is how long a session may go without a PATCH or PUT before its
+	// slot is released, for clients that abandon uploads.
+	Idle time.Duration
+}
+
+func loadUploadLimitConfig() uploadLimitConfig {
+	return uploadLimitConfig{
+		MaxPerNamespace: getEnvInt("MAX_UPLOADS_PER_NAMESPACE", 0),
+		Idle:            getEnvDuration("UPLOAD_SESSION_IDLE_TIMEOUT", 10*time.Minute),
+	}
+}
+
+type uploadSession struct {
+	namespace string
+	lastSeen  time.Time
+}
+
+// uploadSessionLimiter tracks open upload sessions by upload UUID. A POST
+// reserves a slot under a temporary key, which becomes the session UUID once
+// the registry answers 202, and is released otherwise.
+type uploadSessionLimiter struct {
+	cfg uploadLimitConfig
+	now func() time.Time
+
+	mu       sync.Mutex
+	sessions map[string]uploadSession
+	next     int
+}
+
+type uploadReservationContextKey struct{}
+
+func newUploadSessionLimiter(cfg uploadLimitConfig) *uploadSessionLimiter {
+	return &uploadSessionLimiter{cfg: cfg, now: time.Now, sessions: map[string]uploadSession{}}
+}
+
+func (l *uploadSessionLimiter) enabled() bool {
+	return l.cfg.MaxPerNamespace > 0
+}
+
+// reserve takes a slot for namespace, returning its key, or false when the
+// namespace already has MaxPerNamespace sessions open.
+func (l *uploadSessionLimiter) reserve(namespace string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	open := 0
+	for key, session := range l.sessions {
+		if l.cfg.Idle > 0 && now.Sub(session.lastSeen) >= l.cfg.Idle {
+			delete(l.sessions, key)
+			continue
+		}
+		if session.namespace == namespace {
+			open++
+		}
+	}
+	if open >= l.cfg.MaxPerNamespace {
+		return "", false
+	}
+	l.next++
+	key := "reservation-" + strconv.Itoa(l.next)
+	l.sessions[key] = uploadSession{namespace: namespace, lastSeen: now}
+	return key, true
+}
+
+// bind turns a reservation into the session the registry opened.
+func (l *uploadSessionLimiter) bind(key, uuid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	session, ok := l.sessions[key]
+	if !ok {
+		return
+	}
+	delete(l.sessions, key)
+	session.lastSeen = l.now()
+	l.sessions[uuid] = session
+}
+
+func (l *uploadSessionLimiter) touch(uuid string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if session, ok := l.sessions[uuid]; ok {
+		session.lastSeen = l.now()
+		l.sessions[uuid] = session
+	}
+}
+
+func (l *uploadSessionLimiter) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.sessions, key)
+}
+
+// enforceUploadLimit refuses to open an upload session in a namespace that
+// has MAX_UPLOADS_PER_NAMESPACE sessions open. Other namespaces are
+// unaffected.
+func enforceUploadLimit(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !uploadLimiter.enabled() || r.Method != http.MethodPost {
+		return r, true
+	}
+	route, ok := parseRegistryPath(r.URL.Path)
+	if !ok || !route.isUpload() {
+		return r, true
+	}
+	namespace, _, _ := strings.Cut(route.Repo, "/")
+	key, ok := uploadLimiter.reserve(namespace)
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		writeRegistryError(w, http.StatusTooManyRequests, "TOOMANYREQUESTS", "namespace "+namespace+" has too many uploads in progress")
+		return nil, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), uploadReservationContextKey{}, key)), true
+}
+
+// trackUploadSession follows upload sessions through the registry's answers:
+// a 202 to the opening POST binds the reservation to the upload UUID, PATCH
+// and PUT keep it alive, and completion, cancellation or an unknown upload
+// release it. Mounts and monolithic uploads answered with 201 never hold a
+// slot.
+func trackUploadSession(resp *http.Response) error {
+	if !uploadLimiter.enabled() || resp.Request == nil {
+		return nil
+	}
+	route, ok := parseRegistryPath(resp.Request.URL.Path)
+	if !ok || !route.isUpload() {
+		return nil
+	}
+	if key, ok := resp.Request.Context().Value(uploadReservationContextKey{}).(string); ok {
+		if uuid := openedUploadUUID(resp); resp.StatusCode == http.StatusAccepted && uuid != "" {
+			uploadLimiter.bind(key, uuid)
+		} else {
+			uploadLimiter.release(key)
+		}
+		return nil
+	}
+	uuid := uploadRouteUUID(route)
+	if uuid == "" {
+		return nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		uploadLimiter.touch(uuid)
+	case resp.StatusCode == http.StatusCreated, resp.StatusCode == http.StatusNoContent && resp.Request.Method == http.MethodDelete, resp.StatusCode == http.StatusNotFound:
+		uploadLimiter.release(uuid)
+	}
+	return nil
+}
+
+// openedUploadUUID reads the UUID of a new session from Docker-Upload-UUID,
+// falling back to the last segment of Location.
+func openedUploadUUID(resp *http.Response) string {
+	if uuid := resp.Header.Get("Docker-Upload-UUID"); uuid != "" {
+		return uuid
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return ""
+	}
+	_, uuid, ok := strings.Cut(location.Path, "/blobs/uploads/")
+	if !ok {
+		return ""
+	}
+	return strings.Trim(uuid, "/")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withUploadLimiter(t *testing.T, cfg uploadLimitConfig) *uploadSessionLimiter {
+	t.Helper()
+	prev := uploadLimiter
+	uploadLimiter = newUploadSessionLimiter(cfg)
+	t.Cleanup(func() {
+		uploadLimiter = prev
+	})
+	return uploadLimiter
+}
+
+func TestUploadLimitThrottlesNamespaceIndependently(t *testing.T) {
+	withUploadLimiter(t, uploadLimitConfig{MaxPerNamespace: 2, Idle: time.Minute})
+	registry := newFakeRegistry()
+	withProxyUpstream(t, registry.roundTrip)
+	ldapAuth = func(username, password string) (*User, []Access, error) {
+		return &User{Name: username}, []Access{{Namespace: "team1"}, {Namespace: "team2"}}, nil
+	}
+
+	var locations []string
+	for i := 0; i < 2; i++ {
+		rec := serveProxyRequest(t, http.MethodPost, "/v2/team1/app"+strconv.Itoa(i)+"/blobs/uploads/")
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("expected upload %d to start, got %d: %s", i, rec.Code, rec.Body.String())
+		}
+		locations = append(locations, rec.Header().Get("Location"))
+	}
+	rec := serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), "TOOMANYREQUESTS") {
+		t.Fatalf("expected third team1 upload to be throttled, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After on 429")
+	}
+
+	rec = serveProxyRequest(t, http.MethodPost, "/v2/team2/app/blobs/uploads/")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected team2 upload to proceed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Finishing one team1 upload frees its slot.
+	layer := []byte("layer")
+	rec = serveProxyRequestBody(t, http.MethodPut, locations[0]+"?digest="+testDigest(layer), strings.NewReader(string(layer)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected upload to complete, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = serveProxyRequest(t, http.MethodPost, "/v2/team1/app/blobs/uploads/")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected slot to be released after completion, got %d", rec.Code)
+	}
+}
+
+func TestUploadLimitReleasesIdleSessions(t *testing.T) {
+	limiter := withUploadLimiter(t, uploadLimitConfig{MaxPerNamespace: 1, Idle: time.Minute})
+	now := time.Unix(1_700_000_000, 0)
+	limiter.now = func() time.Time { return now }
+
+	key, ok := limiter.reserve("team1")
+	if !ok {
+		t.Fatalf("expected first reservation")
+	}
+	limiter.bind(key, "abandoned")
+	if _, ok := limiter.reserve("team1"); ok {
+		t.Fatalf("expected namespace to be full")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := limiter.reserve("team1"); !ok {
+		t.Fatalf("expected idle session to be released")
+	}
+}